@@ -1,46 +1,147 @@
-// The application struct is eventually meant hold the different services: Local, Bluetooth, Remote, ..
-// and manage their lifecycle. Ideally I would want to be able to start an stop a particular service at the press
-// of a button
+// The application struct holds the different services: Local, Bluetooth, Remote, .. and manages their
+// lifecycle. Each service can be started and stopped at the press of a button, the peers they discover
+// are merged into a single list and transfers go through the best service reaching the target.
 package shair
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
 	"sync"
+	"time"
 )
 
+// services reaching a peer, from the best to the worst: a direct connection beats a relayed one
+var pathPreference = []SvcType{Local, Bluetooth, Remote}
+
+// how long a service must run for its restarts in a row to be forgotten, a variable for the tests
+var healthyAfter = time.Minute
+
 // Application manages the lifecycle of all shairers and serves as the main api
 // for the UI. It handles service management, peer updates,
 // transfer requests, and the storage location for received files.
 type Application struct {
 	logger *slog.Logger
 
-	Shairer
+	services map[SvcType]*service
 
 	localDeviceName string // name by the device is discoverable by other peers
 	saveDir         string // destination directory for received files
 
+	restart RestartPolicy
+
+	history *History // records the transfers, none if nil
+
+	discoveryOnly bool // the services discover peers without announcing the device, see WithDiscoveryOnly
+
+	// set by Start, the services started later report on the same channels
+	mu   sync.Mutex
+	ctx  context.Context
+	puCh chan<- PeerUpdate
+	trCh chan<- TransferRequest
+	evCh chan<- ServiceEvent
+
+	// peers discovered by the services, by Device.Key then by service
+	pmu   sync.Mutex
+	peers map[string]map[SvcType]Device
+
 	// waits for all goroutines to finish
 	wg   sync.WaitGroup
 	stop context.CancelFunc
 }
 
-func NewApplication(logger *slog.Logger, localDeviceName string, saveDir string, sh Shairer) *Application {
+type service struct {
+	Shairer
 
-	return &Application{
+	cancel context.CancelFunc // stops the service, nil when it isn't running
+	done   chan struct{}      // closed once the service stopped
+}
+
+// AppOption configures optional behaviours of an Application.
+type AppOption func(*Application)
+
+// WithRestartPolicy restarts the services that fail according to p, they aren't restarted by default.
+func WithRestartPolicy(p RestartPolicy) AppOption {
+	return func(a *Application) {
+		a.restart = p
+	}
+}
+
+// WithDiscoveryOnly runs the discovery of the services without announcing the device: it finds peers
+// and sends them files, but isn't listed by them and receives nothing, eg for one-off commands.
+func WithDiscoveryOnly() AppOption {
+	return func(a *Application) {
+		a.discoveryOnly = true
+	}
+}
+
+// WithHistory records the transfers made through the application to h, see Application.History.
+func WithHistory(h *History) AppOption {
+	return func(a *Application) {
+		a.history = h
+	}
+}
+
+func NewApplication(logger *slog.Logger, localDeviceName string, saveDir string, services map[SvcType]Shairer, opts ...AppOption) *Application {
+	a := &Application{
 		logger: logger,
 
-		Shairer: sh,
+		services: make(map[SvcType]*service),
 
 		localDeviceName: localDeviceName,
 		saveDir:         saveDir,
 
+		peers: make(map[string]map[SvcType]Device),
+
 		wg: sync.WaitGroup{},
 	}
+
+	for svc, sh := range services {
+		a.services[svc] = &service{Shairer: sh}
+	}
+
+	for _, opt := range opts {
+		opt(a)
+	}
+
+	return a
+}
+
+// Services returns the types of the services held by the application.
+func (a *Application) Services() []SvcType {
+	svcs := make([]SvcType, 0, len(a.services))
+	for _, svc := range pathPreference {
+		if _, found := a.services[svc]; found {
+			svcs = append(svcs, svc)
+		}
+	}
+	return svcs
+}
+
+// Service returns the shairer of the service, eg to reach its specific features.
+func (a *Application) Service(svc SvcType) (Shairer, bool) {
+	s, found := a.services[svc]
+	if !found {
+		return nil, false
+	}
+	return s.Shairer, true
 }
 
-// Start initializes and runs a service, making the local device discoverable and enabling
-// the transfer mechanism. It performs the following actions:
+// Running tells whether the service is running.
+func (a *Application) Running(svc SvcType) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s, found := a.services[svc]
+	return found && s.cancel != nil
+}
+
+// Start initializes and runs all the services, making the local device discoverable and enabling
+// the transfer mechanism. For each service, it performs the following actions:
 // - Makes the local device discoverable by other peers searching for that specific service,
 // - Discovers peers registered to the same service, with updates sent to peerUpdateCh,
 // - Enables a 4-step file transfer process:
@@ -49,34 +150,439 @@ func NewApplication(logger *slog.Logger, localDeviceName string, saveDir string,
 //  3. If accepted, the sender proceeds to send the files,
 //  4. The files are saved to the specified saveDir.
 //
-// The service runs until the provided context is canceled.
-func (a *Application) Start(ctx context.Context, puCh chan<- PeerUpdate, trCh chan<- TransferRequest) {
+// The peers discovered by several services are merged, peerUpdateCh sees each of them once.
+// Start runs until the provided context is canceled or Stop is called, the services can be stopped
+// and started again in the meantime with StopService and StartService. The state of each service
+// is reported to evCh, see ServiceEvent. If discovery or announcement fails, the service is restarted
+// according to the restart policy, see WithRestartPolicy. Without one, the rest of the service keeps running.
+func (a *Application) Start(ctx context.Context, puCh chan<- PeerUpdate, trCh chan<- TransferRequest, evCh chan<- ServiceEvent) {
 	ctx, cancel := context.WithCancel(ctx)
-	a.stop = cancel
+
+	a.mu.Lock()
+	a.ctx, a.stop = ctx, cancel
+	a.puCh, a.trCh, a.evCh = puCh, trCh, evCh
+	a.mu.Unlock()
+
+	for _, svc := range a.Services() {
+		if err := a.StartService(svc); err != nil {
+			a.logger.Error("cannot start service", "svc", svc, "err", err)
+		}
+	}
+
+	<-ctx.Done()
+	a.wg.Wait()
+}
+
+func (a *Application) Stop() {
+	a.mu.Lock()
+	stop := a.stop
+	a.mu.Unlock()
+
+	if stop == nil {
+		return
+	}
+	stop()
+	a.wg.Wait()
+}
+
+// StartService starts a service held by the application, once the application is started.
+// Starting a running service does nothing.
+func (a *Application) StartService(svc SvcType) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s, found := a.services[svc]
+	if !found {
+		return NewError(UnexpectedError, fmt.Sprintf("no %s service", svc), nil)
+	}
+	if a.ctx == nil || a.ctx.Err() != nil {
+		return NewError(UnexpectedError, "the application isn't started", nil)
+	}
+	if s.cancel != nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(a.ctx)
+	s.cancel, s.done = cancel, make(chan struct{})
 
 	a.wg.Add(1)
 	go func() {
 		defer a.wg.Done()
-		a.Discover(ctx, puCh)
+		a.supervise(ctx, svc, s)
+
+		a.mu.Lock()
+		s.cancel = nil
+		close(s.done)
+		a.mu.Unlock()
 	}()
 
-	a.wg.Add(1)
+	return nil
+}
+
+// StopService stops a service and waits for it to be done, its peers are removed from the list.
+// Stopping a service that isn't running does nothing.
+func (a *Application) StopService(svc SvcType) error {
+	a.mu.Lock()
+	s, found := a.services[svc]
+	if !found {
+		a.mu.Unlock()
+		return NewError(UnexpectedError, fmt.Sprintf("no %s service", svc), nil)
+	}
+	cancel, done := s.cancel, s.done
+	a.mu.Unlock()
+
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+	<-done
+
+	return nil
+}
+
+// supervise runs a service until ctx is done, and restarts it on failure according to the restart policy.
+func (a *Application) supervise(ctx context.Context, svc SvcType, s *service) {
+	for restarts := 0; ; {
+		a.emit(ServiceEvent{Service: svc, State: ServiceStarting})
+
+		up, err := a.run(ctx, svc, s)
+		if ctx.Err() != nil || err == nil {
+			a.emit(ServiceEvent{Service: svc, State: ServiceStopped})
+			return
+		}
+
+		a.emit(ServiceEvent{Service: svc, State: ServiceStopped, Err: err})
+
+		if !up.IsZero() && time.Since(up) > healthyAfter {
+			restarts = 0
+		}
+		if a.restart.MaxRestarts >= 0 && restarts >= a.restart.MaxRestarts {
+			return
+		}
+		restarts++
+
+		a.logger.Info("restarting service", "svc", svc, "attempt", restarts)
+		t := time.NewTimer(a.restart.delay(restarts))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+	}
+}
+
+// run runs the discovery and announcement of a service until ctx is done or both are done, the
+// discovery only with WithDiscoveryOnly. It returns
+// when the service reported it was running, and its first failure. With restarts or StopOnFailure, the
+// first failure stops the whole service.
+func (a *Application) run(ctx context.Context, svc SvcType, s *service) (time.Time, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	mu := sync.Mutex{}
+	var up time.Time
+	var failure error
+
+	ctx = withHealthReporter(ctx, healthReporter{
+		running: func(port int, addrs []string) {
+			mu.Lock()
+			up = time.Now()
+			mu.Unlock()
+			a.emit(ServiceEvent{Service: svc, State: ServiceRunning, Port: port, Addrs: addrs})
+		},
+		degraded: func(err error) {
+			a.logger.Warn("service degraded", "svc", svc, "err", err)
+			a.emit(ServiceEvent{Service: svc, State: ServiceDegraded, Err: err})
+		},
+	})
+
+	report := func(err error) {
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		a.logger.Error("service failure", "svc", svc, "err", err)
+
+		mu.Lock()
+		if failure == nil {
+			failure = err
+		}
+		mu.Unlock()
+
+		if a.restart.MaxRestarts != 0 || a.restart.StopOnFailure {
+			cancel()
+			return
+		}
+		a.emit(ServiceEvent{Service: svc, State: ServiceDegraded, Err: err})
+	}
+
+	// the updates of the service are merged with the other services' before reaching the ui
+	peerCh := make(chan PeerUpdate)
+	discovered := make(chan struct{})
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+
 	go func() {
-		defer a.wg.Done()
-		a.Announce(ctx, a.localDeviceName, a.saveDir, trCh)
+		defer wg.Done()
+		defer close(discovered)
+		report(s.Discover(ctx, peerCh))
 	}()
 
-	a.wg.Wait()
+	if !a.discoveryOnly {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			report(s.Announce(ctx, a.localDeviceName, a.saveDir, a.requests(ctx, svc)))
+		}()
+	}
+
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case pu := <-peerCh:
+				a.forward(a.merge(svc, pu))
+			case <-discovered:
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+
+	// the peers of a stopped service are gone
+	a.pmu.Lock()
+	var gone []PeerUpdate
+	for _, seen := range a.peers {
+		if d, found := seen[svc]; found {
+			gone = append(gone, PeerUpdate{Peer: &d, Status: Removed})
+		}
+	}
+	a.pmu.Unlock()
+
+	for _, pu := range gone {
+		a.forward(a.merge(svc, pu))
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	return up, failure
 }
 
-func (a *Application) Stop() {
-	if a.stop == nil {
+func (a *Application) emit(ev ServiceEvent) {
+	if a.evCh == nil {
 		return
 	}
-	a.stop()
-	a.wg.Wait()
+
+	ev.Time = time.Now()
+	select {
+	case a.evCh <- ev:
+	case <-a.ctx.Done():
+	}
+}
+
+func (a *Application) forward(pus []PeerUpdate) {
+	for _, pu := range pus {
+		select {
+		case a.puCh <- pu:
+		case <-a.ctx.Done():
+			return
+		}
+	}
+}
+
+// best returns the best service reaching a peer seen by the services.
+func best(seen map[SvcType]Device) SvcType {
+	for _, svc := range pathPreference {
+		if _, found := seen[svc]; found {
+			return svc
+		}
+	}
+	return Bluetooth
 }
 
+// merge records an update of svc and returns the updates of the merged list: a peer is discovered when
+// the first service discovers it and removed when the last one loses it. In between, the ui sees the
+// peer as described by the best service reaching it.
+func (a *Application) merge(svc SvcType, pu PeerUpdate) []PeerUpdate {
+	if pu.Peer == nil || pu.Status == Self {
+		return []PeerUpdate{pu}
+	}
+
+	a.pmu.Lock()
+	defer a.pmu.Unlock()
+
+	key := pu.Peer.Key()
+	seen, found := a.peers[key]
+
+	if pu.Status == Removed {
+		if _, ok := seen[svc]; !ok {
+			return nil
+		}
+
+		wasBest := best(seen) == svc
+		delete(seen, svc)
+
+		if len(seen) == 0 {
+			delete(a.peers, key)
+			return []PeerUpdate{pu}
+		}
+		if wasBest {
+			d := seen[best(seen)]
+			return []PeerUpdate{{Peer: &d, Status: Updated}}
+		}
+		return nil
+	}
+
+	if !found {
+		seen = make(map[SvcType]Device)
+		a.peers[key] = seen
+	}
+	_, known := seen[svc]
+	prevBest := best(seen)
+	seen[svc] = *pu.Peer
+
+	d := *pu.Peer
+	switch {
+	case !found:
+		return []PeerUpdate{{Peer: &d, Status: Discovered}}
+	case best(seen) != svc:
+		return nil
+	case prevBest != svc || !known || pu.Status == Discovered:
+		return []PeerUpdate{{Peer: &d, Status: Updated}}
+	default:
+		return []PeerUpdate{{Peer: &d, Status: pu.Status}}
+	}
+}
+
+// route returns the running service to reach target through, along with target as that service knows it.
+// The service target was discovered on is preferred, then the best service reaching it.
+func (a *Application) route(target *Device) (Shairer, *Device, error) {
+	a.pmu.Lock()
+	seen := maps.Clone(a.peers[target.Key()])
+	a.pmu.Unlock()
+
+	candidates := []SvcType{target.DiscoveredOn}
+	for _, svc := range pathPreference {
+		if _, found := seen[svc]; found && svc != target.DiscoveredOn {
+			candidates = append(candidates, svc)
+		}
+	}
+
+	for _, svc := range candidates {
+		s, found := a.services[svc]
+		if !found || !a.Running(svc) {
+			continue
+		}
+
+		// peers unknown to the application, eg added by address, are sent to as given
+		if d, found := seen[svc]; found {
+			return s.Shairer, &d, nil
+		}
+		if svc == target.DiscoveredOn {
+			return s.Shairer, target, nil
+		}
+	}
+
+	return nil, nil, NewError(ServiceError, fmt.Sprintf("no running service reaches %s", target.Name), nil)
+}
+
+// SendFiles sends the files to target through the best running service reaching it. The transfer
+// is logged under the ID carried by ctx, a new one if it carries none.
 func (a *Application) SendFiles(ctx context.Context, target *Device, uploadProgressCh chan<- int, filepaths []string) error {
-	return a.Shairer.SendFiles(ctx, target, uploadProgressCh, filepaths...)
+	sh, peer, err := a.route(target)
+	if err != nil {
+		return err
+	}
+
+	ctx, id := EnsureTransferID(ctx)
+	a.logger.InfoContext(ctx, "sending files", "svc", peer.DiscoveredOn, "peer", peer.Name, "peerId", peer.ID, "files", len(filepaths))
+	err = a.sendFiles(ctx, sh, peer, id, uploadProgressCh, filepaths)
+	var deposited DepositedError
+	if errors.As(err, &deposited) {
+		a.logger.InfoContext(ctx, "files left in the mailbox", "peer", peer.Name, "mail", deposited.MailID)
+		return err
+	}
+	if err != nil {
+		a.logger.WarnContext(ctx, "send failed", "peer", peer.Name, "err", err)
+		return err
+	}
+	a.logger.InfoContext(ctx, "files sent", "peer", peer.Name)
+	return nil
+}
+
+// sendFiles sends the files to peer with sh, and records the transfer when the history is kept.
+func (a *Application) sendFiles(ctx context.Context, sh Shairer, peer *Device, id string, uploadProgressCh chan<- int, filepaths []string) error {
+	if a.history == nil {
+		return sh.SendFiles(ctx, peer, uploadProgressCh, filepaths...)
+	}
+
+	t := newTransfer(id, Sent, peer.DiscoveredOn, peer)
+	for _, p := range filepaths {
+		f := FileRecord{Name: filepath.Base(p)}
+		if fi, err := os.Stat(p); err == nil {
+			f.Size = uint64(fi.Size())
+		}
+		t.record.Files = append(t.record.Files, f)
+		t.paths = append(t.paths, p)
+	}
+
+	// the progress goes through us to be accounted for, the shairer closes progressCh on success only
+	progressCh := make(chan int)
+	failed := make(chan struct{})
+	forwarded := make(chan struct{})
+	go func() {
+		defer close(forwarded)
+		for {
+			select {
+			case n, ok := <-progressCh:
+				if !ok {
+					close(uploadProgressCh)
+					return
+				}
+				t.progress(n)
+				uploadProgressCh <- n
+			case <-failed:
+				return
+			}
+		}
+	}()
+
+	err := sh.SendFiles(ctx, peer, progressCh, filepaths...)
+	var deposited DepositedError
+	if errors.As(err, &deposited) {
+		// the files were sent to the mailbox, the receipt settles the transfer
+		<-forwarded
+		t.record.MailID = deposited.MailID
+		a.record(t, Deposited, nil)
+		return err
+	}
+	if err != nil {
+		close(failed)
+	}
+	<-forwarded
+
+	a.record(t, outcome(err), err)
+	return err
+}
+
+// AddPeer adds the peer listening on addr with the first service able to, see PeerAdder.
+func (a *Application) AddPeer(ctx context.Context, addr string) (Device, error) {
+	for _, svc := range a.Services() {
+		if adder, ok := a.services[svc].Shairer.(PeerAdder); ok {
+			return adder.AddPeer(ctx, addr)
+		}
+	}
+	return Device{}, NewError(UnexpectedError, "no service can add peers by address", nil)
+}
+
+// Pair pairs with the device using the same code with the first service able to, see Pairer.
+func (a *Application) Pair(ctx context.Context, code string) (Device, error) {
+	for _, svc := range a.Services() {
+		if pairer, ok := a.services[svc].Shairer.(Pairer); ok {
+			return pairer.Pair(ctx, code)
+		}
+	}
+	return Device{}, NewError(UnexpectedError, "no service can pair with devices, see -relay", nil)
 }
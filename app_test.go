@@ -0,0 +1,153 @@
+package shair
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"testing"
+)
+
+var discard = slog.New(slog.DiscardHandler)
+
+// fakeShairer counts the discoveries and announcements it runs, each until its context is done.
+type fakeShairer struct {
+	Shairer
+
+	discovering chan struct{} // receives once Discover runs
+	discovers   atomic.Int32
+	announces   atomic.Int32
+}
+
+func (f *fakeShairer) Discover(ctx context.Context, peerCh chan<- PeerUpdate) error {
+	f.discovers.Add(1)
+	f.discovering <- struct{}{}
+	<-ctx.Done()
+	return nil
+}
+
+func (f *fakeShairer) Announce(ctx context.Context, localDeviceName string, saveDir string, transferRequestCh chan<- TransferRequest) error {
+	f.announces.Add(1)
+	<-ctx.Done()
+	return nil
+}
+
+func TestApplicationDiscoveryOnly(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      []AppOption
+		announces int32
+	}{
+		{name: "discovery and announcement", announces: 1},
+		{name: "discovery only", opts: []AppOption{WithDiscoveryOnly()}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeShairer{discovering: make(chan struct{}, 1)}
+			a := NewApplication(discard, "me", t.TempDir(), map[SvcType]Shairer{Local: f}, tt.opts...)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				a.Start(ctx, make(chan PeerUpdate), make(chan TransferRequest), nil)
+			}()
+
+			<-f.discovering
+			cancel()
+			<-done
+
+			if f.discovers.Load() != 1 || f.announces.Load() != tt.announces {
+				t.Fatalf("got %d discoveries and %d announcements, want 1 and %d", f.discovers.Load(), f.announces.Load(), tt.announces)
+			}
+		})
+	}
+}
+
+func TestApplicationMerge(t *testing.T) {
+	peer := func(svc SvcType, name string) *Device {
+		return &Device{ID: "p", Name: name, DiscoveredOn: svc}
+	}
+	type want struct {
+		status PeerStatus
+		svc    SvcType
+		name   string
+	}
+
+	// the updates are applied in order, each to the list left by the previous ones
+	steps := []struct {
+		name string
+		svc  SvcType
+		pu   PeerUpdate
+		want []want
+	}{
+		{name: "discovered by the relay", svc: Remote, pu: PeerUpdate{Peer: peer(Remote, "r"), Status: Discovered}, want: []want{{Discovered, Remote, "r"}}},
+		{name: "updated by the relay", svc: Remote, pu: PeerUpdate{Peer: peer(Remote, "r2"), Status: Updated}, want: []want{{Updated, Remote, "r2"}}},
+		{name: "discovered on the local network", svc: Local, pu: PeerUpdate{Peer: peer(Local, "l"), Status: Discovered}, want: []want{{Updated, Local, "l"}}},
+		{name: "relay hidden by the local network", svc: Remote, pu: PeerUpdate{Peer: peer(Remote, "r3"), Status: Updated}},
+		{name: "local network updated", svc: Local, pu: PeerUpdate{Peer: peer(Local, "l2"), Status: Updated}, want: []want{{Updated, Local, "l2"}}},
+		{name: "lost on the local network", svc: Local, pu: PeerUpdate{Peer: peer(Local, "l2"), Status: Removed}, want: []want{{Updated, Remote, "r3"}}},
+		{name: "lost again on the local network", svc: Local, pu: PeerUpdate{Peer: peer(Local, "l2"), Status: Removed}},
+		{name: "lost by the relay", svc: Remote, pu: PeerUpdate{Peer: peer(Remote, "r3"), Status: Removed}, want: []want{{Removed, Remote, "r3"}}},
+		{name: "self", svc: Local, pu: PeerUpdate{Peer: peer(Local, "me"), Status: Self}, want: []want{{Self, Local, "me"}}},
+	}
+
+	a := NewApplication(discard, "me", t.TempDir(), nil)
+	for _, s := range steps {
+		got := a.merge(s.svc, s.pu)
+		if len(got) != len(s.want) {
+			t.Fatalf("%s: got %d updates, want %d", s.name, len(got), len(s.want))
+		}
+		for i, w := range s.want {
+			if pu := got[i]; pu.Status != w.status || pu.Peer.DiscoveredOn != w.svc || pu.Peer.Name != w.name {
+				t.Fatalf("%s: got %+v, want %+v", s.name, pu, w)
+			}
+		}
+	}
+}
+
+func TestApplicationRoute(t *testing.T) {
+	local, remote := &fakeShairer{}, &fakeShairer{}
+	known := &Device{ID: "p", Name: "p", DiscoveredOn: Remote}
+	added := &Device{ID: "q", Name: "q", DiscoveredOn: Remote}
+
+	tests := []struct {
+		name    string
+		running []SvcType
+		target  *Device
+		want    Shairer
+		wantOn  SvcType
+		wantErr bool
+	}{
+		{name: "discovered on", running: []SvcType{Local, Remote}, target: known, want: remote, wantOn: Remote},
+		{name: "best running", running: []SvcType{Local}, target: known, want: local, wantOn: Local},
+		{name: "unknown peer as given", running: []SvcType{Local, Remote}, target: added, want: remote, wantOn: Remote},
+		{name: "unknown peer not reached", running: []SvcType{Local}, target: added, wantErr: true},
+		{name: "nothing running", target: known, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewApplication(discard, "me", t.TempDir(), map[SvcType]Shairer{Local: local, Remote: remote})
+			a.merge(Remote, PeerUpdate{Peer: &Device{ID: "p", Name: "p", DiscoveredOn: Remote}, Status: Discovered})
+			a.merge(Local, PeerUpdate{Peer: &Device{ID: "p", Name: "p", DiscoveredOn: Local}, Status: Discovered})
+			for _, svc := range tt.running {
+				a.services[svc].cancel = func() {}
+			}
+
+			sh, peer, err := a.route(tt.target)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got a route through %v, want none", peer.DiscoveredOn)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sh != tt.want || peer.DiscoveredOn != tt.wantOn {
+				t.Fatalf("got the peer on %v, want it on %v", peer.DiscoveredOn, tt.wantOn)
+			}
+		})
+	}
+}
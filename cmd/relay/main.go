@@ -0,0 +1,56 @@
+// relay server introducing the devices that can't reach each other directly, see the remote package
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/masar3141/shair/remote"
+)
+
+func main() {
+	addr := flag.String("addr", fmt.Sprintf(":%d", remote.DefaultRelayPort), "`address` to listen on")
+	joinTimeout := flag.Duration("join-timeout", 10*time.Minute, "how long a device waits for its peer to join with the same code")
+	mailboxDir := flag.String("mailbox", "", "`directory` holding the files sent to offline devices, no mailbox if empty")
+	mailExpiry := flag.Duration("mail-expiry", 7*24*time.Hour, "how long the mailbox keeps the files of a device that doesn't come online")
+	maxMail := flag.Int64("max-mail-size", 1<<30, "size in `bytes` of the largest files accepted in the mailbox")
+	maxMailbox := flag.Int64("max-mailbox-size", 4<<30, "size in `bytes` of all the files waiting for a device")
+	maxStored := flag.Int64("max-stored-size", 32<<30, "size in `bytes` of all the files the mailbox holds")
+	mailRetry := flag.Duration("mail-retry", 5*time.Minute, "how long before files a device couldn't take yet are offered to it again")
+	flag.Parse()
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	opts := []remote.RelayOption{remote.WithJoinTimeout(*joinTimeout)}
+	if *mailboxDir != "" {
+		mailbox, err := remote.NewMailbox(
+			*mailboxDir,
+			remote.WithMailExpiry(*mailExpiry),
+			remote.WithMaxMailSize(*maxMail),
+			remote.WithMaxMailboxSize(*maxMailbox),
+			remote.WithMaxStoredSize(*maxStored),
+			remote.WithMailRetry(*mailRetry),
+		)
+		if err != nil {
+			logger.Error("cannot open the mailbox", "dir", *mailboxDir, "err", err)
+			os.Exit(1)
+		}
+		opts = append(opts, remote.WithMailbox(mailbox))
+	}
+
+	relay := remote.NewRelay(logger, opts...)
+
+	logger.Info("relay listening", "addr", *addr)
+	if err := relay.ListenAndServe(ctx, *addr); err != nil {
+		logger.Error("relay stopped", "err", err)
+		os.Exit(1)
+	}
+}
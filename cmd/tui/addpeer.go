@@ -0,0 +1,80 @@
+// screen to add a peer by address, when it can't be discovered
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/masar3141/shair"
+)
+
+// how long to wait for a peer added by address to tell who it is
+const addPeerTimeout = 15 * time.Second
+
+type addPeerModel struct {
+	textinput textinput.Model
+}
+
+func newAddPeerModel() *addPeerModel {
+	ti := textinput.New()
+	ti.Placeholder = "192.168.1.20:8085"
+	ti.Focus()
+
+	return &addPeerModel{textinput: ti}
+}
+
+type changePageAddPeerToListMsg struct {
+	addr string // empty when the user gave up
+}
+
+func changePageAddPeerToListCmd(addr string) tea.Cmd {
+	return func() tea.Msg {
+		return changePageAddPeerToListMsg{addr}
+	}
+}
+
+type peerAddedMsg struct {
+	peer *shair.Device
+}
+
+// addPeerCmd probes the peer at addr and lists it like a discovered peer.
+func addPeerCmd(adder shair.PeerAdder, addr string) tea.Cmd {
+	return func() tea.Msg {
+		ctx, cancel := context.WithTimeout(context.Background(), addPeerTimeout)
+		defer cancel()
+
+		dvc, err := adder.AddPeer(ctx, addr)
+		if err != nil {
+			return errMsg(err)
+		}
+
+		return peerAddedMsg{&dvc}
+	}
+}
+
+func (m *addPeerModel) Init() tea.Cmd {
+	return textinput.Blink
+}
+
+func (m *addPeerModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	if msg, ok := msg.(tea.KeyMsg); ok && msg.Type == tea.KeyEnter {
+		return m, changePageAddPeerToListCmd(strings.TrimSpace(m.textinput.Value()))
+	}
+
+	var cmd tea.Cmd
+	m.textinput, cmd = m.textinput.Update(msg)
+
+	return m, cmd
+}
+
+func (m *addPeerModel) View() string {
+	return fmt.Sprintf(
+		"Address of the peer (host:port)\n\n%s\n\n%s",
+		m.textinput.View(),
+		"(esc) back (enter) add",
+	) + "\n\n"
+}
@@ -0,0 +1,42 @@
+// this file holds the global bandwidth caps that can be adjusted at runtime from the list screen
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/dustin/go-humanize"
+	"github.com/masar3141/shair"
+)
+
+// caps the user can cycle through, in bytes per second. 0 means unlimited
+var bandwidthPresets = []int64{0, 512 * 1000, 1000 * 1000, 5 * 1000 * 1000, 10 * 1000 * 1000, 50 * 1000 * 1000}
+
+// the caps are nil when attached to a daemon, which applies its own
+type bandwidth struct {
+	upload   *shair.Limiter
+	download *shair.Limiter
+}
+
+// nextBandwidthPreset sets l to the preset following its current rate
+func nextBandwidthPreset(l *shair.Limiter) {
+	if l == nil {
+		return
+	}
+	idx := slices.Index(bandwidthPresets, l.Limit())
+	l.SetLimit(bandwidthPresets[(idx+1)%len(bandwidthPresets)])
+}
+
+func formatRate(rate int64) string {
+	if rate == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%s/s", humanize.Bytes(uint64(rate)))
+}
+
+func (b bandwidth) String() string {
+	if b.upload == nil || b.download == nil {
+		return "bandwidth set by the daemon"
+	}
+	return fmt.Sprintf("up: %s, down: %s", formatRate(b.upload.Limit()), formatRate(b.download.Limit()))
+}
@@ -0,0 +1,726 @@
+// this file provides the non-interactive subcommands, for scripts and CI:
+//
+//	shair peers [-json] [-wait 3s]
+//	shair send [-wait 10s] peer files...
+//	shair receive [-auto-accept] [-dir path]
+//	shair history [-json] [-peer name] [-direction sent|received] [-since 24h] [-limit 20]
+//	shair pair [-relay host:port] [code]
+//
+// They take the same settings as the tui, see config.go. Results go to stdout while the progress and
+// the errors go to stderr, and the exit code tells what went wrong, see exitCode. When a daemon runs,
+// see daemon.go, they go through it rather than starting services of their own.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/charmbracelet/x/term"
+	"github.com/dustin/go-humanize"
+
+	"github.com/masar3141/shair"
+	"github.com/masar3141/shair/control"
+)
+
+// exit codes of the subcommands
+const (
+	exitOK          = 0
+	exitFailure     = 1 // shair.UnexpectedError and the errors without a code
+	exitUsage       = 2 // invalid arguments or settings
+	exitNotFound    = 3 // the peer wasn't found in time
+	exitRejected    = 4 // shair.TransferRejected
+	exitDropped     = 5 // shair.ConnectionDroppedError
+	exitFile        = 6 // shair.StatFileError and shair.SendFileError
+	exitService     = 7 // shair.ServiceError
+	exitProtocol    = 8 // shair.InvalidHeaderError
+	exitInterrupted = 130
+)
+
+// exitCode returns the exit code telling err apart, after its shair.Error code.
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, shair.TransferRejected):
+		return exitRejected
+	case errors.Is(err, shair.ConnectionDroppedError):
+		return exitDropped
+	case errors.Is(err, shair.StatFileError), errors.Is(err, shair.SendFileError):
+		return exitFile
+	case errors.Is(err, shair.ServiceError):
+		return exitService
+	case errors.Is(err, shair.InvalidHeaderError):
+		return exitProtocol
+	case errors.Is(err, context.Canceled):
+		return exitInterrupted
+	}
+	return exitFailure
+}
+
+// how often the progress is printed
+const progressInterval = 100 * time.Millisecond
+
+// parseArgs parses the args of a subcommand along with the settings, it exits if they are invalid.
+func parseArgs(fs *flag.FlagSet, usage string, args []string) (*config, *slog.Logger) {
+	cfg := parseConfig(fs, usage, args)
+	logger, err := openLog(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitFailure)
+	}
+
+	return cfg, logger
+}
+
+// parseConfig is parseArgs for the subcommands opening their log themselves.
+func parseConfig(fs *flag.FlagSet, usage string, args []string) *config {
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s\n", usage)
+		fs.PrintDefaults()
+	}
+	cfg := newConfig(fs)
+	fs.Parse(args)
+
+	if err := cfg.load(fs); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitUsage)
+	}
+	return cfg
+}
+
+// backend runs the services of the subcommands, see newBackend.
+type backend interface {
+	Start(ctx context.Context, puCh chan<- shair.PeerUpdate, trCh chan<- shair.TransferRequest, evCh chan<- shair.ServiceEvent)
+	Stop()
+	Sender
+	shair.PeerAdder
+	shair.Pairer
+	Historian
+}
+
+// newBackend attaches to the daemon listening on the socket of cfg, see `shair daemon`. When none runs,
+// it returns an application of its own set up with opts, whose services stop on their first failure.
+func newBackend(logger *slog.Logger, cfg *config, opts ...shair.AppOption) (b backend, attached bool, err error) {
+	if c, ok := attach(logger, cfg); ok {
+		return c, true, nil
+	}
+
+	opts = append(opts, shair.WithRestartPolicy(shair.RestartPolicy{StopOnFailure: true}))
+	app, _, err := newApplication(logger, cfg, nil, opts...)
+	return app, false, err
+}
+
+// attach connects to the daemon listening on the socket of cfg, it fails if none runs.
+func attach(logger *slog.Logger, cfg *config) (*control.Client, bool) {
+	if cfg.Socket == "" {
+		return nil, false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	c, err := control.Dial(ctx, cfg.Socket)
+	if err != nil {
+		return nil, false
+	}
+	logger.Info("attached to the daemon", "socket", cfg.Socket)
+	return c, true
+}
+
+// start starts the services of app until ctx is done. The peer updates and transfer requests are sent
+// on puCh and trCh, when nil they are dropped: the requests relayed from a daemon are left for its other
+// clients to answer, and an application of our own receives none when it is discovery only. The
+// degradations of the services are printed, the returned channel receives the failure of the first
+// service to stop.
+func start(ctx context.Context, app backend, puCh chan shair.PeerUpdate, trCh chan shair.TransferRequest) <-chan error {
+	if puCh == nil {
+		puCh = make(chan shair.PeerUpdate)
+		go drain(puCh)
+	}
+	if trCh == nil {
+		trCh = make(chan shair.TransferRequest)
+		go drain(trCh)
+	}
+
+	evCh := make(chan shair.ServiceEvent)
+	failCh := make(chan error, 1)
+	go func() {
+		for ev := range evCh {
+			switch {
+			case ev.State == shair.ServiceDegraded:
+				fmt.Fprintf(os.Stderr, "%s service degraded: %s\n", ev.Service, ev.Err)
+			case ev.State == shair.ServiceStopped && ev.Err != nil:
+				select {
+				case failCh <- ev.Err:
+				default:
+				}
+			}
+		}
+	}()
+
+	go app.Start(ctx, puCh, trCh, evCh)
+
+	return failCh
+}
+
+func drain[T any](ch <-chan T) {
+	for range ch {
+	}
+}
+
+// runPeers implements `shair peers`, it returns the exit code.
+func runPeers(args []string) int {
+	const usage = "shair peers [-json] [-wait duration]"
+	fs := flag.NewFlagSet("peers", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the peers as JSON")
+	wait := fs.Duration("wait", 3*time.Second, "how long to look for peers")
+	cfg, logger := parseArgs(fs, usage, args)
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	wctx, cancel := context.WithTimeout(ctx, *wait)
+	defer cancel()
+
+	// only looking for peers, the device isn't announced
+	app, _, err := newBackend(logger, cfg, shair.WithDiscoveryOnly())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitCode(err)
+	}
+
+	var list []shair.Device
+	if c, ok := app.(*control.Client); ok {
+		// the daemon has been looking for peers all along
+		list, err = c.Peers(ctx)
+	} else {
+		list, err = collectPeers(ctx, wctx, logger, app)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return exitInterrupted
+		}
+		fmt.Fprintln(os.Stderr, err)
+		return exitCode(err)
+	}
+
+	if *asJSON {
+		err = printPeersJSON(os.Stdout, list)
+	} else {
+		err = printPeers(os.Stdout, list)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+// collectPeers returns the peers discovered by app until wctx is done, sorted by name.
+func collectPeers(ctx, wctx context.Context, logger *slog.Logger, app backend) ([]shair.Device, error) {
+	puCh := make(chan shair.PeerUpdate)
+	failCh := start(wctx, app, puCh, nil)
+	defer app.Stop()
+	addManualPeers(wctx, logger, app)
+
+	peers := make(map[string]shair.Device)
+	for wctx.Err() == nil {
+		select {
+		case pu := <-puCh:
+			switch pu.Status {
+			case shair.Self:
+			case shair.Removed:
+				delete(peers, pu.Peer.Key())
+			default:
+				peers[pu.Peer.Key()] = *pu.Peer
+			}
+		case err := <-failCh:
+			return nil, err
+		case <-wctx.Done():
+		}
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	return slices.SortedFunc(maps.Values(peers), func(a, b shair.Device) int { return strings.Compare(a.Name, b.Name) }), nil
+}
+
+// delay before asking again a manual peer that didn't answer, doubled on each attempt up to
+// manualPeerMaxRetry. Variables for the tests
+var (
+	manualPeerRetry    = 10 * time.Second
+	manualPeerMaxRetry = 5 * time.Minute
+)
+
+// addManualPeers adds the peers listed in the config directory, see shair.LoadManualPeers. The peers
+// that can't be reached, eg offline, are asked again from time to time until ctx is done.
+func addManualPeers(ctx context.Context, logger *slog.Logger, app shair.PeerAdder) {
+	addrs, err := shair.LoadManualPeers()
+	if err != nil {
+		logger.Warn("cannot load manual peers", "err", err)
+	}
+	for _, addr := range addrs {
+		go addManualPeer(ctx, logger, app, addr)
+	}
+}
+
+// addManualPeer adds the peer listening on addr, it retries until it succeeds or ctx is done.
+func addManualPeer(ctx context.Context, logger *slog.Logger, app shair.PeerAdder, addr string) {
+	for delay := manualPeerRetry; ; delay = min(2*delay, manualPeerMaxRetry) {
+		_, err := app.AddPeer(ctx, addr)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		logger.Warn("cannot add peer, retrying", "addr", addr, "in", delay, "err", err)
+
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+	}
+}
+
+// address returns the address the peer is reached on the local network, empty for the others.
+func address(p shair.Device) string {
+	if p.LocalInfo.IP == nil {
+		return ""
+	}
+	return net.JoinHostPort(p.LocalInfo.IP.String(), strconv.Itoa(p.LocalInfo.SvcPort))
+}
+
+func printPeers(w io.Writer, peers []shair.Device) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tID\tON\tADDRESS\tACCEPTING\tFINGERPRINT")
+	for _, p := range peers {
+		accepting := "no"
+		if p.Accepting {
+			accepting = "yes"
+		}
+		addr := address(p)
+		if addr == "" {
+			addr = "-"
+		}
+		fp := p.CertFingerprint
+		if fp == "" {
+			fp = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", p.Name, p.ID, p.DiscoveredOn, addr, accepting, fp)
+	}
+	return tw.Flush()
+}
+
+type peerJSON struct {
+	Name       string           `json:"name"`
+	ID         string           `json:"id,omitempty"`
+	On         string           `json:"on"`
+	Address    string           `json:"address,omitempty"`
+	Type       shair.DeviceType `json:"type,omitempty"`
+	OS         string           `json:"os,omitempty"`
+	Arch       string           `json:"arch,omitempty"`
+	AppVersion string           `json:"appVersion,omitempty"`
+	Accepting  bool             `json:"accepting"`
+	Key        string           `json:"fingerprint,omitempty"` // fingerprint of the device key, see remote.Fingerprint
+}
+
+func printPeersJSON(w io.Writer, peers []shair.Device) error {
+	out := make([]peerJSON, 0, len(peers))
+	for _, p := range peers {
+		out = append(out, peerJSON{
+			Name:       p.Name,
+			ID:         p.ID,
+			On:         p.DiscoveredOn.String(),
+			Address:    address(p),
+			Type:       p.Type,
+			OS:         p.OS,
+			Arch:       p.Arch,
+			AppVersion: p.AppVersion,
+			Accepting:  p.Accepting,
+			Key:        p.CertFingerprint,
+		})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// runSend implements `shair send`, it returns the exit code.
+func runSend(args []string) int {
+	const usage = "shair send [-wait duration] [-limit size] peer files...\n       shair send --code [-relay host:port] [-limit size] files..."
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	code := fs.Bool("code", false, "print a code phrase to give to the receiver, who receives the files with it")
+	wait := fs.Duration("wait", 10*time.Second, "how long to look for the peer")
+	var limit bytesValue
+	fs.Var(&limit, "limit", "`size` sent per second at most by this send, eg 1MB, on top of -upload, 0 for no limit of its own")
+	cfg, logger := parseArgs(fs, usage, args)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if limit > 0 {
+		ctx = shair.WithLimiter(ctx, shair.NewLimiter(int64(limit)))
+	}
+
+	if *code {
+		if fs.NArg() == 0 {
+			fs.Usage()
+			return exitUsage
+		}
+		return sendCode(ctx, logger, cfg, fs.Args())
+	}
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return exitUsage
+	}
+	name, paths := fs.Arg(0), fs.Args()[1:]
+
+	// the device isn't announced, it would have to decline the files sent to it meanwhile
+	app, attached, err := newBackend(logger, cfg, shair.WithDiscoveryOnly())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitCode(err)
+	}
+
+	puCh := make(chan shair.PeerUpdate)
+	failCh := start(ctx, app, puCh, nil)
+	defer app.Stop()
+	if !attached {
+		addManualPeers(ctx, logger, app)
+	}
+
+	target, err := findPeer(ctx, app, puCh, failCh, name, *wait)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return exitNotFound
+		}
+		return exitCode(err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Sending to %s...\n", target.Name)
+	return send(paths, func(progressCh chan<- int) error {
+		return app.SendFiles(ctx, target, progressCh, paths)
+	})
+}
+
+// findPeer waits up to wait for the peer named, or identified by, name to be discovered. An address such
+// as 192.168.1.20:8085 is asked for its identity instead, for the peers that can't be discovered.
+// The peer updates keep being drained once the peer is found.
+func findPeer(ctx context.Context, app shair.PeerAdder, puCh <-chan shair.PeerUpdate, failCh <-chan error, name string, wait time.Duration) (*shair.Device, error) {
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+
+	if _, port, err := net.SplitHostPort(name); err == nil {
+		if _, err := strconv.Atoi(port); err == nil {
+			go drain(puCh)
+			d, err := app.AddPeer(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+			return &d, nil
+		}
+	}
+
+	for {
+		select {
+		case pu := <-puCh:
+			if pu.Status != shair.Self && pu.Status != shair.Removed && (pu.Peer.Name == name || pu.Peer.ID == name) {
+				go drain(puCh)
+				return pu.Peer, nil
+			}
+		case err := <-failCh:
+			return nil, err
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return nil, fmt.Errorf("%s not found after %s: %w", name, wait, ctx.Err())
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// send sends paths with sendFiles and prints the progress, it returns the exit code.
+func send(paths []string, sendFiles func(progressCh chan<- int) error) int {
+	progressCh := make(chan int)
+	done := printProgress(progressCh, filesSize(paths))
+
+	if err := sendFiles(progressCh); err != nil {
+		var rejection shair.RejectedError
+		var deposited shair.DepositedError
+		switch {
+		case errors.As(err, &deposited):
+			// the outcome is recorded in the history once the receiver answers
+			fmt.Fprintln(os.Stderr, "\nThe receiver is offline, the files wait for it in the relay's mailbox.")
+			return exitOK
+		case errors.As(err, &rejection):
+			fmt.Fprintln(os.Stderr, "\nThe receiver didn't accept the files:", rejection.Error())
+		default:
+			fmt.Fprintln(os.Stderr, "\n"+err.Error())
+		}
+		return exitCode(err)
+	}
+
+	<-done
+	fmt.Fprintln(os.Stderr, "Files sent.")
+	return exitOK
+}
+
+// runReceive implements `shair receive`, it returns the exit code.
+func runReceive(args []string) int {
+	const usage = "shair receive [-auto-accept] [-dir path]\n       shair receive [-relay host:port] [-dir path] code"
+	fs := flag.NewFlagSet("receive", flag.ExitOnError)
+	all := fs.Bool("auto-accept", false, "accept the files of any peer without asking, see -auto-accept-peers to accept some of them")
+	cfg, logger := parseArgs(fs, usage, args)
+
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		return receiveCode(logger, cfg, fs.Arg(0))
+	default:
+		fs.Usage()
+		return exitUsage
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	app, attached, err := newBackend(logger, cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitCode(err)
+	}
+
+	trCh := make(chan shair.TransferRequest)
+	failCh := start(ctx, app, nil, trCh)
+	defer app.Stop()
+
+	interactive := term.IsTerminal(os.Stdin.Fd())
+	if attached {
+		fmt.Fprintf(os.Stderr, "Waiting for files received by the daemon on %s\n", cfg.Socket)
+	} else {
+		fmt.Fprintf(os.Stderr, "Waiting for files as %q, saved in %s\n", cfg.Name, cfg.SaveDir)
+	}
+
+	for {
+		select {
+		case err := <-failCh:
+			fmt.Fprintln(os.Stderr, err)
+			return exitCode(err)
+
+		case <-ctx.Done():
+			return exitInterrupted
+
+		case tr := <-trCh:
+			if *all || cfg.AutoAccept.matches(tr) {
+				describeRequest(tr)
+				return receive(tr)
+			}
+			if interactive && ask(tr, cfg.SaveDir) {
+				return receive(tr)
+			}
+			if !interactive {
+				fmt.Fprintf(os.Stderr, "Declined the files of %s, run with -auto-accept to accept them\n", tr.Sender.Name)
+			}
+			tr.AcceptCh <- false
+		}
+	}
+}
+
+// runHistory implements `shair history`, it returns the exit code.
+func runHistory(args []string) int {
+	const usage = "shair history [-json] [-peer name] [-direction sent|received] [-since duration] [-limit n]"
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the transfers as JSON")
+	peer := fs.String("peer", "", "only the transfers with the peer of this `name` or ID")
+	direction := fs.String("direction", "", "only the transfers in this `direction`: sent or received")
+	since := fs.Duration("since", 0, "only the transfers of the last `duration`, eg 24h")
+	limit := fs.Int("limit", 20, "most recent transfers printed at most, 0 for all of them")
+	cfg, _ := parseArgs(fs, usage, args)
+
+	if fs.NArg() != 0 || (*direction != "" && *direction != string(shair.Sent) && *direction != string(shair.Received)) {
+		fs.Usage()
+		return exitUsage
+	}
+	if cfg.HistoryFile == "" {
+		fmt.Fprintln(os.Stderr, "the history isn't kept, see -history-file")
+		return exitUsage
+	}
+
+	q := shair.HistoryQuery{Peer: *peer, Direction: shair.Direction(*direction), Limit: *limit}
+	if *since > 0 {
+		q.Since = time.Now().Add(-*since)
+	}
+
+	// the history is read directly, it is shared with the daemon and the tui
+	records, err := shair.NewHistory(cfg.HistoryFile).Query(q)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if records == nil {
+			records = []shair.TransferRecord{}
+		}
+		err = enc.Encode(records)
+	} else {
+		err = printHistory(records)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+func printHistory(records []shair.TransferRecord) error {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tDIRECTION\tPEER\tFILES\tSIZE\tDURATION\tRATE\tOUTCOME")
+	for _, r := range records {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			r.Time.Local().Format(time.DateTime), r.Direction, r.PeerName, describeFiles(r.Files),
+			humanize.Bytes(r.Size()), describeDuration(r), describeThroughput(r), describeOutcome(r))
+	}
+	return tw.Flush()
+}
+
+// describeFiles names the file of a transfer, or counts them.
+func describeFiles(files []shair.FileRecord) string {
+	if len(files) == 1 {
+		return files[0].Name
+	}
+	return fmt.Sprintf("%d files", len(files))
+}
+
+// describeDuration and describeThroughput leave out the transfers that didn't start.
+func describeDuration(r shair.TransferRecord) string {
+	if r.Duration == 0 {
+		return "-"
+	}
+	return r.Duration.Round(time.Millisecond).String()
+}
+
+func describeThroughput(r shair.TransferRecord) string {
+	if r.Throughput == 0 {
+		return "-"
+	}
+	return formatRate(int64(r.Throughput))
+}
+
+// describeOutcome tells how a transfer ended, with the reason it failed.
+func describeOutcome(r shair.TransferRecord) string {
+	if r.Error == "" {
+		return string(r.Outcome)
+	}
+	return fmt.Sprintf("%s: %s", r.Outcome, r.Error)
+}
+
+// describeRequest prints the files of tr, it returns their total size.
+func describeRequest(tr shair.TransferRequest) uint64 {
+	var total uint64
+	fmt.Fprintf(os.Stderr, "%s wants to send you:\n", tr.Sender.Name)
+	for _, fp := range tr.FilePreviews {
+		fmt.Fprintf(os.Stderr, "\t%s (%s)\n", fp.Name, humanize.Bytes(fp.Size))
+		total += fp.Size
+	}
+	return total
+}
+
+// ask asks the user whether to accept tr.
+func ask(tr shair.TransferRequest, dir string) bool {
+	total := describeRequest(tr)
+	fmt.Fprintf(os.Stderr, "Save %s in %s? [y/N] ", humanize.Bytes(total), dir)
+
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.EqualFold(strings.TrimSpace(line), "y")
+}
+
+// receive accepts tr and reports the outcome of the transfer, it returns the exit code.
+func receive(tr shair.TransferRequest) int {
+	var total uint64
+	for _, fp := range tr.FilePreviews {
+		total += fp.Size
+	}
+
+	tr.AcceptCh <- true
+	done := printProgress(tr.ProgressCh, total)
+
+	if err := <-tr.DoneCh; err != nil {
+		if errors.Is(err, shair.ConnectionDroppedError) {
+			fmt.Fprintln(os.Stderr, "\nThe sender left before the transfer was over.")
+		} else {
+			fmt.Fprintln(os.Stderr, "\n"+err.Error())
+		}
+		return exitCode(err)
+	}
+
+	<-done
+	fmt.Fprintln(os.Stderr, "Files received.")
+	return exitOK
+}
+
+// printProgress prints the bytes transferred out of total, if known, until ch is closed. ch must be
+// drained for the transfer to go on, the returned channel is closed once it is.
+func printProgress(ch <-chan int, total uint64) <-chan struct{} {
+	done := make(chan struct{})
+
+	show := func(n uint64) {
+		if total == 0 {
+			fmt.Fprintf(os.Stderr, "\r%s transferred", humanize.Bytes(n))
+			return
+		}
+		fmt.Fprintf(os.Stderr, "\r%s / %s (%d%%)", humanize.Bytes(n), humanize.Bytes(total), n*100/total)
+	}
+
+	go func() {
+		defer close(done)
+
+		var n uint64
+		var last time.Time
+		for p := range ch {
+			n += uint64(p)
+			if time.Since(last) >= progressInterval {
+				show(n)
+				last = time.Now()
+			}
+		}
+		show(n)
+		fmt.Fprintln(os.Stderr)
+	}()
+
+	return done
+}
+
+// filesSize returns the total size of the files at paths, the ones that can't be read are left out.
+func filesSize(paths []string) uint64 {
+	var total uint64
+	for _, p := range paths {
+		if fi, err := os.Stat(p); err == nil && fi.Mode().IsRegular() {
+			total += uint64(fi.Size())
+		}
+	}
+	return total
+}
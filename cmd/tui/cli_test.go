@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/masar3141/shair"
+	"github.com/masar3141/shair/control"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "success", want: exitOK},
+		{name: "rejected", err: shair.NewError(shair.TransferRejected, "rejected", shair.RejectedError{Reason: shair.ReasonBusy}), want: exitRejected},
+		{name: "dropped", err: shair.NewError(shair.ConnectionDroppedError, "dropped", nil), want: exitDropped},
+		{name: "unreadable file", err: shair.NewError(shair.StatFileError, "stat", nil), want: exitFile},
+		{name: "unsent file", err: shair.NewError(shair.SendFileError, "send", nil), want: exitFile},
+		{name: "service", err: shair.NewError(shair.ServiceError, "service", nil), want: exitService},
+		{name: "protocol", err: shair.NewError(shair.InvalidHeaderError, "header", nil), want: exitProtocol},
+		{name: "interrupted", err: shair.NewError(shair.UnexpectedError, "canceled", context.Canceled), want: exitInterrupted},
+		{name: "wrapped", err: fmt.Errorf("sending: %w", shair.NewError(shair.ServiceError, "service", nil)), want: exitService},
+		{name: "unexpected", err: shair.NewError(shair.UnexpectedError, "unexpected", nil), want: exitFailure},
+		{name: "without code", err: errors.New("no code"), want: exitFailure},
+		{name: "through the daemon", err: &control.Error{Code: "connectionDropped", Message: "dropped"}, want: exitDropped},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(tt.err); got != tt.want {
+				t.Fatalf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// offlineAdder fails to add a peer until it has been asked enough times.
+type offlineAdder struct {
+	offline int // number of attempts failing
+	asked   atomic.Int32
+	added   chan string
+}
+
+func (a *offlineAdder) AddPeer(ctx context.Context, addr string) (shair.Device, error) {
+	if int(a.asked.Add(1)) <= a.offline {
+		return shair.Device{}, shair.NewError(shair.ConnectionDroppedError, "offline", nil)
+	}
+	a.added <- addr
+	return shair.Device{Name: addr}, nil
+}
+
+func TestAddManualPeers(t *testing.T) {
+	retry, maxRetry := manualPeerRetry, manualPeerMaxRetry
+	defer func() { manualPeerRetry, manualPeerMaxRetry = retry, maxRetry }()
+	manualPeerRetry, manualPeerMaxRetry = time.Millisecond, 4*time.Millisecond
+
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "shair"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "shair", "peers"), []byte("192.168.1.20:8085\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the peer is offline when we start, it is added once it comes online
+	adder := &offlineAdder{offline: 5, added: make(chan string, 1)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addManualPeers(ctx, slog.New(slog.DiscardHandler), adder)
+
+	select {
+	case addr := <-adder.added:
+		if addr != "192.168.1.20:8085" || adder.asked.Load() != 6 {
+			t.Fatalf("added %s after %d attempts, want 192.168.1.20:8085 after 6", addr, adder.asked.Load())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the peer wasn't added after %d attempts", adder.asked.Load())
+	}
+}
+
+func TestFindPeer(t *testing.T) {
+	desktop := &shair.Device{ID: "id-desktop", Name: "desktop", DiscoveredOn: shair.Local}
+
+	tests := []struct {
+		name    string
+		target  string
+		updates []shair.PeerUpdate
+		offline int   // attempts of AddPeer failing
+		fail    error // failure of the services
+		want    string
+		code    int // exit code of `shair send` when the peer isn't found
+	}{
+		{name: "by name", target: "desktop", updates: []shair.PeerUpdate{{Peer: desktop}}, want: "desktop"},
+		{name: "by ID", target: "id-desktop", updates: []shair.PeerUpdate{{Peer: desktop, Status: shair.Updated}}, want: "desktop"},
+		{name: "by address", target: "192.168.1.20:8085", want: "192.168.1.20:8085"},
+		{name: "address offline", target: "192.168.1.20:8085", offline: 1, code: exitDropped},
+		{name: "self", target: "desktop", updates: []shair.PeerUpdate{{Peer: desktop, Status: shair.Self}}, code: exitNotFound},
+		{name: "removed", target: "desktop", updates: []shair.PeerUpdate{{Peer: desktop, Status: shair.Removed}}, code: exitNotFound},
+		{name: "not a port", target: "desktop:http", code: exitNotFound},
+		{name: "not found", target: "laptop", updates: []shair.PeerUpdate{{Peer: desktop}}, code: exitNotFound},
+		{name: "service failed", target: "desktop", fail: shair.NewError(shair.ServiceError, "failed", nil), code: exitService},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			puCh := make(chan shair.PeerUpdate, len(tt.updates)+1)
+			defer close(puCh)
+			for _, pu := range tt.updates {
+				puCh <- pu
+			}
+			failCh := make(chan error, 1)
+			if tt.fail != nil {
+				failCh <- tt.fail
+			}
+
+			adder := &offlineAdder{offline: tt.offline, added: make(chan string, 1)}
+			peer, err := findPeer(context.Background(), adder, puCh, failCh, tt.target, 50*time.Millisecond)
+			if tt.want != "" {
+				if err != nil || peer.Name != tt.want {
+					t.Fatalf("found %+v, %v, want %s", peer, err, tt.want)
+				}
+				// the updates sent afterwards don't block
+				puCh <- shair.PeerUpdate{Peer: desktop}
+				return
+			}
+
+			// see runSend
+			code := exitCode(err)
+			if errors.Is(err, context.DeadlineExceeded) {
+				code = exitNotFound
+			}
+			if err == nil || code != tt.code {
+				t.Fatalf("found %+v, %v, want exit code %d", peer, err, tt.code)
+			}
+		})
+	}
+}
+
+func TestPrintPeersJSON(t *testing.T) {
+	peers := []shair.Device{
+		{
+			ID: "id-desktop", Name: "desktop", DiscoveredOn: shair.Local, Accepting: true, Type: shair.Desktop, OS: "linux",
+			LocalInfo: shair.LocalInfo{IP: net.ParseIP("192.168.1.20"), SvcPort: 8085},
+		},
+		{ID: "id-phone", Name: "phone", DiscoveredOn: shair.Remote, CertFingerprint: "ab:cd"},
+	}
+
+	var buf bytes.Buffer
+	if err := printPeersJSON(&buf, peers); err != nil {
+		t.Fatal(err)
+	}
+	var got []map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("%v in %s", err, buf.String())
+	}
+
+	want := []map[string]any{
+		{"name": "desktop", "id": "id-desktop", "on": shair.Local.String(), "address": "192.168.1.20:8085", "type": string(shair.Desktop), "os": "linux", "accepting": true},
+		{"name": "phone", "id": "id-phone", "on": shair.Remote.String(), "accepting": false, "fingerprint": "ab:cd"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	// no peer is an empty list, not null
+	buf.Reset()
+	if err := printPeersJSON(&buf, nil); err != nil || bytes.TrimSpace(buf.Bytes())[0] != '[' {
+		t.Fatalf("got %s, %v, want an empty list", buf.String(), err)
+	}
+}
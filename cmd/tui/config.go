@@ -0,0 +1,580 @@
+// this file provides the settings of the tui. Each setting is read, from the highest precedence to the
+// lowest, from its command-line flag, its SHAIR_* environment variable, the config file and its default:
+//
+//	-port 0  >  SHAIR_PORT=0  >  port = 0 in config.toml  >  8085
+//
+// The config file is shair/config.toml in the user config directory, see `shair config`.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/masar3141/shair"
+	"github.com/masar3141/shair/control"
+	"github.com/masar3141/shair/local"
+)
+
+type config struct {
+	Name        string         // name the device is announced with
+	SaveDir     string         // directory the received files are saved in
+	Port        ports          // port, or range of ports, receiving the files
+	Interfaces  []string       // network interfaces used on the local network, all of them if empty
+	CIDRs       []netip.Prefix // networks the addresses used on the local network belong to, any if empty
+	Discovery   local.Discovery
+	Relay       string // relay reaching the paired devices outside the local network, none if empty
+	MaxRestarts int    // restarts in a row of a failing service before giving up, negative to never give up
+	AutoAccept  autoAccept
+	Receive     receivePolicy
+	Upload      uint64 // bandwidth caps in bytes per second, unlimited if 0
+	Download    uint64
+	Timeouts    local.Timeouts // deadlines of the transfer protocol, see local.Timeouts
+	Theme       string
+	LogFile     string // file the logs are appended to, none if empty
+	LogMaxSize  uint64 // size above which the log file is rotated, never rotated if 0
+	LogMaxFiles int    // rotated log files kept
+	Debug       bool   // log the debug records, those of dnssd included
+	Socket      string // control socket of the daemon, see `shair daemon`, none if empty
+	HistoryFile string // history of the transfers, not kept if empty
+
+	path     string // config file
+	settings []*setting
+}
+
+// autoAccept tells which transfer requests are accepted without asking.
+type autoAccept struct {
+	Peers      []string // names or IDs of the senders, "*" for any sender
+	MaxSize    uint64   // total size of the files above which the user is asked, no limit if 0
+	Unverified bool     // whether the senders that didn't prove their identity are matched, by name
+}
+
+// receivePolicy tells which transfer requests are rejected before reaching the user.
+type receivePolicy struct {
+	Quota       shair.Quota
+	TrustedPeer []string // names or IDs of the senders allowed to send files, anyone if empty
+	BlockedExts []string // extensions of the files refused, eg exe
+}
+
+// options returns the options of the local shairer applying the policy.
+func (r receivePolicy) options() []local.Option {
+	var opts []local.Option
+	if r.Quota != (shair.Quota{}) {
+		opts = append(opts, local.WithQuota(r.Quota))
+	}
+	if len(r.TrustedPeer) != 0 {
+		opts = append(opts, local.WithTrust(r.trusts))
+	}
+	if len(r.BlockedExts) != 0 {
+		opts = append(opts, local.WithBlockedExtensions(r.BlockedExts...))
+	}
+	return opts
+}
+
+// trusts tells whether sender may send files. The names of the local senders come from a reverse DNS
+// lookup of their address and aren't authenticated, the list only keeps the honest peers out.
+func (r receivePolicy) trusts(sender *shair.Device) bool {
+	return slices.ContainsFunc(r.TrustedPeer, func(p string) bool {
+		return p == sender.Name || (sender.ID != "" && p == sender.ID)
+	})
+}
+
+// matches tells whether tr is accepted without asking. Only the senders that proved their identity, the
+// pairs reached through the relay, are matched unless Unverified is set: the senders of the local network
+// are named after a reverse DNS lookup of their address, which anyone on the network can take.
+func (a autoAccept) matches(tr shair.TransferRequest) bool {
+	if !tr.Sender.Verified && !a.Unverified {
+		return false
+	}
+	if !slices.ContainsFunc(a.Peers, func(p string) bool { return p == "*" || p == tr.Sender.Name || p == tr.Sender.ID }) {
+		return false
+	}
+
+	var total uint64
+	for _, fp := range tr.FilePreviews {
+		total += fp.Size
+	}
+	return a.MaxSize == 0 || total <= a.MaxSize
+}
+
+// setting is a value of config with the names it goes by.
+type setting struct {
+	key    string // in the config file, "table.key" for the keys of a table
+	flag   string
+	usage  string
+	value  flag.Value
+	source string // where the value comes from, see config.load
+}
+
+// env returns the environment variable of the setting, eg SHAIR_BANDWIDTH_UPLOAD for bandwidth.upload.
+func (s *setting) env() string {
+	return "SHAIR_" + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(s.key))
+}
+
+// newConfig returns the default config, with its settings registered as flags.
+func newConfig(flags *flag.FlagSet) *config {
+	c := &config{
+		Port:        ports{8085, 8085},
+		Discovery:   local.DiscoveryMDNS | local.DiscoveryMulticast,
+		MaxRestarts: 5,
+		LogMaxSize:  10 << 20,
+		LogMaxFiles: 3,
+		Theme:       "dark",
+		Timeouts:    local.DefaultTimeouts(),
+		Socket:      control.SocketPath(),
+	}
+
+	c.Name, _ = os.Hostname()
+	c.SaveDir, _ = os.UserHomeDir()
+	if dir, err := os.UserConfigDir(); err == nil {
+		c.path = filepath.Join(dir, "shair", "config.toml")
+		c.LogFile = filepath.Join(dir, "shair", "shair.log")
+	}
+	c.HistoryFile, _ = shair.HistoryPath()
+
+	// the keys of tables come last, see write
+	c.settings = []*setting{
+		{key: "name", flag: "name", usage: "`name` the device is announced with", value: (*stringValue)(&c.Name)},
+		{key: "save_dir", flag: "dir", usage: "`directory` the received files are saved in", value: (*pathValue)(&c.SaveDir)},
+		{key: "port", flag: "port", usage: "`port` receiving the files, 0 for any free port, or a range such as 8085-8095 to use the first free one", value: &c.Port},
+		{key: "interfaces", flag: "interfaces", usage: "comma separated network `interfaces` used on the local network, all of them if empty", value: (*listValue)(&c.Interfaces)},
+		{key: "cidrs", flag: "cidrs", usage: "comma separated `networks` the addresses used on the local network belong to, eg 192.168.1.0/24, any if empty", value: (*prefixesValue)(&c.CIDRs)},
+		{key: "discovery", flag: "discovery", usage: "comma separated `mechanisms` used to discover peers: mdns, multicast", value: (*discoveryValue)(&c.Discovery)},
+		{key: "relay", flag: "relay", usage: "`host:port` of the relay reaching the paired devices outside the local network, none if empty", value: (*stringValue)(&c.Relay)},
+		{key: "max_restarts", flag: "max-restarts", usage: "restarts in a row of a failing service before giving up, -1 to never give up", value: (*intValue)(&c.MaxRestarts)},
+		{key: "theme", flag: "theme", usage: "color `theme` of the interface: " + themeNames(), value: (*themeValue)(&c.Theme)},
+		{key: "log_file", flag: "log-file", usage: "`file` the logs are appended to, none if empty", value: (*pathValue)(&c.LogFile)},
+		{key: "log_max_size", flag: "log-max-size", usage: "`size` above which the log file is rotated, eg 10MB, 0 to never rotate it", value: (*bytesValue)(&c.LogMaxSize)},
+		{key: "log_max_files", flag: "log-max-files", usage: "`number` of rotated log files kept", value: (*intValue)(&c.LogMaxFiles)},
+		{key: "debug", flag: "debug", usage: "log the debug records, those of the mdns library included", value: (*boolValue)(&c.Debug)},
+		{key: "history_file", flag: "history-file", usage: "`file` the history of the transfers is kept in, none if empty", value: (*pathValue)(&c.HistoryFile)},
+		{key: "socket", flag: "socket", usage: "control `socket` of the daemon, which the interface and the subcommands attach to when it runs, none if empty", value: (*pathValue)(&c.Socket)},
+		{key: "auto_accept.peers", flag: "auto-accept-peers", usage: "comma separated names or IDs of the `peers` whose files are accepted without asking, * for any peer", value: (*listValue)(&c.AutoAccept.Peers)},
+		{key: "auto_accept.unverified", flag: "auto-accept-unverified", usage: "accept without asking the files of the listed peers that didn't prove their identity, such as those of the local network matched by name only", value: (*boolValue)(&c.AutoAccept.Unverified)},
+		{key: "auto_accept.max_size", flag: "auto-accept-max-size", usage: "`size` above which the files of the auto-accepted peers are not accepted without asking, 0 for no limit", value: (*bytesValue)(&c.AutoAccept.MaxSize)},
+		{key: "bandwidth.upload", flag: "upload", usage: "`size` uploaded per second at most, eg 5MB, 0 for unlimited", value: (*bytesValue)(&c.Upload)},
+		{key: "bandwidth.download", flag: "download", usage: "`size` downloaded per second at most, eg 5MB, 0 for unlimited", value: (*bytesValue)(&c.Download)},
+		{key: "receive.trusted_peers", flag: "trusted-peers", usage: "comma separated names or IDs of the only `peers` allowed to send files, anyone if empty", value: (*listValue)(&c.Receive.TrustedPeer)},
+		{key: "receive.blocked_extensions", flag: "blocked-extensions", usage: "comma separated `extensions` of the files refused, eg exe,bat", value: (*listValue)(&c.Receive.BlockedExts)},
+		{key: "receive.max_transfer_size", flag: "max-transfer-size", usage: "`size` of a transfer above which it is refused, 0 for no limit", value: (*bytesValue)(&c.Receive.Quota.MaxTransferSize)},
+		{key: "receive.max_files", flag: "max-files", usage: "`number` of files of a transfer above which it is refused, 0 for no limit", value: (*intValue)(&c.Receive.Quota.MaxFiles)},
+		{key: "receive.max_daily_per_peer", flag: "max-daily-per-peer", usage: "`size` received from a peer per day above which its transfers are refused, 0 for no limit", value: (*bytesValue)(&c.Receive.Quota.MaxDailyPerPeer)},
+		{key: "timeouts.handshake", flag: "handshake-timeout", usage: "`duration` allowed to connect and exchange the header, 0 for no limit", value: (*durationValue)(&c.Timeouts.Handshake)},
+		{key: "timeouts.accept", flag: "accept-timeout", usage: "`duration` a transfer request waits for an answer, 0 for no limit", value: (*durationValue)(&c.Timeouts.Accept)},
+		{key: "timeouts.idle", flag: "idle-timeout", usage: "`duration` a transfer may stall before it is dropped, 0 for no limit", value: (*durationValue)(&c.Timeouts.Idle)},
+		{key: "timeouts.total", flag: "total-timeout", usage: "`duration` a whole transfer may take, 0 for no limit", value: (*durationValue)(&c.Timeouts.Total)},
+		{key: "timeouts.keepalive", flag: "keepalive", usage: "`duration` a connection stays silent before TCP keepalive probes check the peer is still there, 0 to disable them", value: (*keepAliveValue)(&c.Timeouts.KeepAlive)},
+		{key: "timeouts.keepalive_interval", flag: "keepalive-interval", usage: "`duration` between two TCP keepalive probes", value: (*durationValue)(&c.Timeouts.KeepAlive.Interval)},
+		{key: "timeouts.keepalive_count", flag: "keepalive-count", usage: "`number` of unanswered TCP keepalive probes after which the peer is considered gone", value: (*intValue)(&c.Timeouts.KeepAlive.Count)},
+	}
+
+	for _, s := range c.settings {
+		s.source = "default"
+		flags.Var(s.value, s.flag, s.usage)
+	}
+	flags.Var((*stringValue)(&c.path), "config", "config `file`, also set with SHAIR_CONFIG")
+
+	return c
+}
+
+// load completes the settings that weren't given on the command line, already parsed, with the
+// environment and the config file. A missing config file is only an error when it was asked for.
+func (c *config) load(flags *flag.FlagSet) error {
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	for _, s := range c.settings {
+		if given[s.flag] {
+			s.source = "flag -" + s.flag
+		}
+	}
+
+	explicit := given["config"]
+	if p, ok := os.LookupEnv("SHAIR_CONFIG"); ok && !explicit {
+		c.path, explicit = p, true
+	}
+	if err := c.loadFile(given); err != nil && (explicit || !errors.Is(err, fs.ErrNotExist)) {
+		return err
+	}
+
+	for _, s := range c.settings {
+		if given[s.flag] {
+			continue
+		}
+		v, ok := os.LookupEnv(s.env())
+		if !ok {
+			continue
+		}
+		if err := s.value.Set(v); err != nil {
+			return fmt.Errorf("%s: %w", s.env(), err)
+		}
+		s.source = "env " + s.env()
+	}
+
+	return nil
+}
+
+func (c *config) loadFile(given map[string]bool) error {
+	if c.path == "" {
+		return fs.ErrNotExist
+	}
+
+	f, err := os.Open(c.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	values, err := parseTOML(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", c.path, err)
+	}
+
+	for key, v := range values {
+		i := slices.IndexFunc(c.settings, func(s *setting) bool { return s.key == key })
+		if i < 0 {
+			return fmt.Errorf("%s: unknown setting %s", c.path, key)
+		}
+		s := c.settings[i]
+		if given[s.flag] {
+			continue
+		}
+
+		_, isPrefixes := s.value.(*prefixesValue)
+		switch lv, isList := s.value.(*listValue); {
+		case v.isArray && isList:
+			*lv = v.array
+		case v.isArray && isPrefixes:
+			err = s.value.Set(strings.Join(v.array, ","))
+		case v.isArray:
+			err = errors.New("takes a single value")
+		default:
+			err = s.value.Set(v.scalar)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s: %w", c.path, key, err)
+		}
+		s.source = c.path
+	}
+
+	return nil
+}
+
+// isSet tells whether the setting of key was given rather than left to its default.
+func (c *config) isSet(key string) bool {
+	i := slices.IndexFunc(c.settings, func(s *setting) bool { return s.key == key })
+	return i >= 0 && c.settings[i].source != "default"
+}
+
+// write prints the settings in the format of the config file, with where each of them comes from.
+func (c *config) write(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	table := ""
+	for _, s := range c.settings {
+		key := s.key
+		if t, k, ok := strings.Cut(s.key, "."); ok {
+			if t != table {
+				fmt.Fprintf(tw, "\n[%s]\n", t)
+				table = t
+			}
+			key = k
+		}
+
+		var v string
+		switch sv := s.value.(type) {
+		case *listValue:
+			quoted := make([]string, len(*sv))
+			for i, e := range *sv {
+				quoted[i] = strconv.Quote(e)
+			}
+			v = "[" + strings.Join(quoted, ", ") + "]"
+		case *intValue, *boolValue:
+			v = sv.String()
+		default:
+			v = strconv.Quote(s.value.String())
+		}
+
+		fmt.Fprintf(tw, "%s = %s\t# %s\n", key, v, s.source)
+	}
+
+	return tw.Flush()
+}
+
+// runConfig implements `shair config`, it prints the effective settings and returns the exit code.
+func runConfig(args []string) int {
+	flags := flag.NewFlagSet("config", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: shair config [flags]\n\nPrints the settings in effect with the given flags, environment and config file.")
+		flags.PrintDefaults()
+	}
+	cfg := newConfig(flags)
+	flags.Parse(args)
+
+	if err := cfg.load(flags); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	fmt.Printf("# config file: %s\n", cfg.path)
+	if err := cfg.write(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// ports is a port, or the range of ports from first to last.
+type ports struct{ first, last int }
+
+func (p *ports) String() string {
+	if p.first == p.last {
+		return strconv.Itoa(p.first)
+	}
+	return fmt.Sprintf("%d-%d", p.first, p.last)
+}
+
+func (p *ports) Set(s string) error {
+	first, last, err := parsePorts(s)
+	if err != nil {
+		return err
+	}
+	p.first, p.last = first, last
+	return nil
+}
+
+// parsePorts parses a port, eg "8085", or a range of ports, eg "8085-8095".
+func parsePorts(s string) (int, int, error) {
+	first, last, isRange := strings.Cut(s, "-")
+	if !isRange {
+		last = first
+	}
+
+	f, err := strconv.ParseUint(first, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %q", first)
+	}
+	l, err := strconv.ParseUint(last, 10, 16)
+	if err != nil || l < f {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+
+	return int(f), int(l), nil
+}
+
+type stringValue string
+
+func (v *stringValue) String() string { return string(*v) }
+
+func (v *stringValue) Set(s string) error {
+	*v = stringValue(s)
+	return nil
+}
+
+// pathValue is a path, a leading ~ stands for the home directory.
+type pathValue string
+
+func (v *pathValue) String() string { return string(*v) }
+
+func (v *pathValue) Set(s string) error {
+	if s == "~" || strings.HasPrefix(s, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		s = filepath.Join(home, s[1:])
+	}
+	*v = pathValue(s)
+	return nil
+}
+
+type intValue int
+
+func (v *intValue) String() string { return strconv.Itoa(int(*v)) }
+
+func (v *intValue) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("invalid number %q", s)
+	}
+	*v = intValue(n)
+	return nil
+}
+
+type boolValue bool
+
+func (v *boolValue) String() string { return strconv.FormatBool(bool(*v)) }
+
+func (v *boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return fmt.Errorf("invalid boolean %q", s)
+	}
+	*v = boolValue(b)
+	return nil
+}
+
+// IsBoolFlag lets the flag be given without a value, as -debug.
+func (v *boolValue) IsBoolFlag() bool { return true }
+
+// listValue is a comma separated list, setting it replaces the whole list.
+type listValue []string
+
+func (v *listValue) String() string { return strings.Join(*v, ",") }
+
+func (v *listValue) Set(s string) error {
+	l := listValue{}
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			l = append(l, e)
+		}
+	}
+	*v = l
+	return nil
+}
+
+// prefixesValue is a comma separated list of networks such as 192.168.1.0/24.
+type prefixesValue []netip.Prefix
+
+func (v *prefixesValue) String() string {
+	s := make([]string, len(*v))
+	for i, p := range *v {
+		s[i] = p.String()
+	}
+	return strings.Join(s, ",")
+}
+
+func (v *prefixesValue) Set(s string) error {
+	l := prefixesValue{}
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e == "" {
+			continue
+		}
+		p, err := netip.ParsePrefix(e)
+		if err != nil {
+			return fmt.Errorf("invalid network %q", e)
+		}
+		l = append(l, p.Masked())
+	}
+	*v = l
+	return nil
+}
+
+// bytesValue is a size such as 5MB or 1GiB, a bare number is a count of bytes.
+type bytesValue uint64
+
+// byteUnits are the units a size is printed with, the largest dividing it exactly is used
+var byteUnits = []struct {
+	name string
+	size uint64
+}{
+	{"GiB", humanize.GiByte}, {"GB", humanize.GByte},
+	{"MiB", humanize.MiByte}, {"MB", humanize.MByte},
+	{"KiB", humanize.KiByte}, {"kB", humanize.KByte},
+}
+
+func (v *bytesValue) String() string {
+	n := uint64(*v)
+	for _, u := range byteUnits {
+		if n != 0 && n%u.size == 0 {
+			return fmt.Sprintf("%d%s", n/u.size, u.name)
+		}
+	}
+	return strconv.FormatUint(n, 10)
+}
+
+func (v *bytesValue) Set(s string) error {
+	n, err := humanize.ParseBytes(s)
+	if err != nil {
+		return fmt.Errorf("invalid size %q", s)
+	}
+	*v = bytesValue(n)
+	return nil
+}
+
+// durationValue is a duration such as 30s or 2m, 0 disables the deadline.
+type durationValue time.Duration
+
+func (v *durationValue) String() string { return time.Duration(*v).String() }
+
+func (v *durationValue) Set(s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	*v = durationValue(d)
+	return nil
+}
+
+// keepAliveValue is the idle duration of the TCP keepalive probes, 0 disables them.
+type keepAliveValue net.KeepAliveConfig
+
+func (v *keepAliveValue) String() string {
+	if !v.Enable {
+		return "0s"
+	}
+	return v.Idle.String()
+}
+
+func (v *keepAliveValue) Set(s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	v.Enable, v.Idle = d > 0, d
+	return nil
+}
+
+type discoveryValue local.Discovery
+
+func (v *discoveryValue) String() string {
+	var names []string
+	if local.Discovery(*v)&local.DiscoveryMDNS != 0 {
+		names = append(names, "mdns")
+	}
+	if local.Discovery(*v)&local.DiscoveryMulticast != 0 {
+		names = append(names, "multicast")
+	}
+	return strings.Join(names, ",")
+}
+
+func (v *discoveryValue) Set(s string) error {
+	var d local.Discovery
+	for _, name := range strings.Split(s, ",") {
+		switch strings.TrimSpace(name) {
+		case "mdns":
+			d |= local.DiscoveryMDNS
+		case "multicast":
+			d |= local.DiscoveryMulticast
+		default:
+			return fmt.Errorf("unknown discovery mechanism %q", name)
+		}
+	}
+	*v = discoveryValue(d)
+	return nil
+}
+
+type themeValue string
+
+func (v *themeValue) String() string { return string(*v) }
+
+func (v *themeValue) Set(s string) error {
+	if _, ok := themes[s]; !ok {
+		return fmt.Errorf("unknown theme %q, pick one of %s", s, themeNames())
+	}
+	*v = themeValue(s)
+	return nil
+}
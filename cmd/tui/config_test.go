@@ -0,0 +1,181 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/masar3141/shair"
+)
+
+func TestAutoAcceptMatches(t *testing.T) {
+	local := &shair.Device{Name: "desktop", DiscoveredOn: shair.Local}
+	pair := &shair.Device{Name: "desktop", ID: "id-desktop", DiscoveredOn: shair.Remote, Verified: true}
+	request := func(sender *shair.Device, sizes ...uint64) shair.TransferRequest {
+		tr := shair.TransferRequest{Sender: sender}
+		for _, s := range sizes {
+			tr.FilePreviews = append(tr.FilePreviews, shair.FilePreview{Size: s})
+		}
+		return tr
+	}
+
+	tests := []struct {
+		name string
+		auto autoAccept
+		tr   shair.TransferRequest
+		want bool
+	}{
+		{name: "nobody listed", tr: request(pair, 1)},
+		{name: "pair by name", auto: autoAccept{Peers: []string{"desktop"}}, tr: request(pair, 1), want: true},
+		{name: "pair by ID", auto: autoAccept{Peers: []string{"id-desktop"}}, tr: request(pair, 1), want: true},
+		{name: "anyone", auto: autoAccept{Peers: []string{"*"}}, tr: request(pair, 1), want: true},
+		{name: "another peer", auto: autoAccept{Peers: []string{"laptop"}}, tr: request(pair, 1)},
+		{name: "local sender by name", auto: autoAccept{Peers: []string{"desktop"}}, tr: request(local, 1)},
+		{name: "local sender anyone", auto: autoAccept{Peers: []string{"*"}}, tr: request(local, 1)},
+		{name: "local sender by name unverified", auto: autoAccept{Peers: []string{"desktop"}, Unverified: true}, tr: request(local, 1), want: true},
+		{name: "small enough", auto: autoAccept{Peers: []string{"*"}, MaxSize: 10}, tr: request(pair, 4, 6), want: true},
+		{name: "too big", auto: autoAccept{Peers: []string{"*"}, MaxSize: 10}, tr: request(pair, 4, 7)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.auto.matches(tt.tr); got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string // content of the config file, none if empty
+		env     map[string]string
+		args    []string
+		want    func(c *config) bool
+		wantErr string
+	}{
+		{
+			name: "defaults without a file",
+			want: func(c *config) bool {
+				return c.MaxRestarts == 5 && c.AutoAccept.Peers == nil && !c.isSet("max_restarts")
+			},
+		},
+		{
+			name: "file",
+			file: "max_restarts = 2\n[auto_accept]\npeers = [\"a\", \"b\"]\nmax_size = \"1KB\"\n",
+			want: func(c *config) bool {
+				return c.MaxRestarts == 2 && strings.Join(c.AutoAccept.Peers, ",") == "a,b" && c.AutoAccept.MaxSize == 1000 && c.isSet("auto_accept.peers")
+			},
+		},
+		{
+			name: "env over file",
+			file: "max_restarts = 2\n",
+			env:  map[string]string{"SHAIR_MAX_RESTARTS": "3", "SHAIR_AUTO_ACCEPT_PEERS": "c,d"},
+			want: func(c *config) bool { return c.MaxRestarts == 3 && strings.Join(c.AutoAccept.Peers, ",") == "c,d" },
+		},
+		{
+			name: "flag over env",
+			file: "max_restarts = 2\n",
+			env:  map[string]string{"SHAIR_MAX_RESTARTS": "3"},
+			args: []string{"-max-restarts", "4"},
+			want: func(c *config) bool { return c.MaxRestarts == 4 },
+		},
+		{
+			name: "keepalive disabled",
+			file: "[timeouts]\nkeepalive = \"0\"\nkeepalive_count = 5\n",
+			want: func(c *config) bool {
+				return !c.Timeouts.KeepAlive.Enable && c.Timeouts.KeepAlive.Count == 5
+			},
+		},
+		{
+			name: "keepalive tuned",
+			args: []string{"-keepalive", "1m", "-keepalive-interval", "10s"},
+			want: func(c *config) bool {
+				ka := c.Timeouts.KeepAlive
+				return ka.Enable && ka.Idle == time.Minute && ka.Interval == 10*time.Second && ka.Count == 3
+			},
+		},
+		{
+			name: "networks",
+			file: "cidrs = [\"192.168.1.7/24\", \"fd00::/8\"]\n",
+			want: func(c *config) bool {
+				return len(c.CIDRs) == 2 && c.CIDRs[0].String() == "192.168.1.0/24" && c.CIDRs[1].String() == "fd00::/8"
+			},
+		},
+		{
+			name:    "invalid network",
+			env:     map[string]string{"SHAIR_CIDRS": "192.168.1.0"},
+			wantErr: "invalid network",
+		},
+		{
+			name:    "unknown setting",
+			file:    "[auto_accept]\nmax = 1\n",
+			wantErr: "unknown setting auto_accept.max",
+		},
+		{
+			name:    "array of a single value",
+			file:    "max_restarts = [1]\n",
+			wantErr: "max_restarts: takes a single value",
+		},
+		{
+			name:    "invalid value",
+			file:    "max_restarts = \"lots\"\n",
+			wantErr: "max_restarts: invalid number",
+		},
+		{
+			name:    "invalid env",
+			env:     map[string]string{"SHAIR_MAX_RESTARTS": "x"},
+			wantErr: "SHAIR_MAX_RESTARTS",
+		},
+		{
+			name:    "missing file asked for",
+			env:     map[string]string{"SHAIR_CONFIG": filepath.Join(os.TempDir(), "shair-missing", "config.toml")},
+			wantErr: "no such file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the config file and the other settings are looked up in the user config directory
+			t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+			t.Setenv("HOME", t.TempDir())
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			flags := flag.NewFlagSet("test", flag.ContinueOnError)
+			flags.SetOutput(io.Discard)
+			c := newConfig(flags)
+			if err := flags.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if tt.file != "" {
+				if err := os.MkdirAll(filepath.Dir(c.path), 0o700); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(c.path, []byte(tt.file), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := c.load(flags)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.want(c) {
+				t.Fatalf("got %+v", c)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+// this file provides `shair daemon`, which receives files without the tui. It serves the control api on
+// the socket setting, through which the tui and the subcommands attach to it, see the control package.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/masar3141/shair"
+	"github.com/masar3141/shair/control"
+)
+
+// runDaemon implements `shair daemon`, it returns the exit code.
+func runDaemon(args []string) int {
+	const usage = "shair daemon [-socket path] [-dir path] [-auto-accept-peers peers]"
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	cfg := parseConfig(fs, usage, args)
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	if cfg.Socket == "" {
+		fmt.Fprintln(os.Stderr, "the daemon needs a control socket, see -socket")
+		return exitUsage
+	}
+	// unless a log file is set, the logs go to stderr for the service manager to collect
+	var logger *slog.Logger
+	if cfg.isSet("log_file") {
+		var err error
+		if logger, err = openLog(cfg); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailure
+		}
+	} else {
+		logger = newLogger(os.Stderr, cfg.Debug)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	ln, err := control.Listen(cfg.Socket)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitService
+	}
+	defer os.Remove(cfg.Socket)
+
+	app, _, err := newApplication(logger, cfg, nil, shair.WithRestartPolicy(shair.RestartPolicy{MaxRestarts: cfg.MaxRestarts, Backoff: time.Second, MaxBackoff: time.Minute}))
+	if err != nil {
+		ln.Close()
+		fmt.Fprintln(os.Stderr, err)
+		return exitCode(err)
+	}
+
+	srv := control.NewServer(logger, app, control.WithAutoAccept(cfg.AutoAccept.matches))
+	addManualPeers(ctx, logger, app)
+
+	logger.Info("daemon started", "socket", cfg.Socket, "name", cfg.Name, "dir", cfg.SaveDir)
+	if err := srv.Serve(ctx, ln); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailure
+	}
+	logger.Info("daemon stopped")
+	return exitOK
+}
@@ -18,3 +18,9 @@ func listenAndForwardTransferRequest(p *tea.Program, trCh <-chan shair.TransferR
 		p.Send(transferRequestMsg(tr))
 	}
 }
+
+func listenAndForwardServiceEvent(p *tea.Program, evCh <-chan shair.ServiceEvent) {
+	for ev := range evCh {
+		p.Send(serviceEventMsg(ev))
+	}
+}
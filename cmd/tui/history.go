@@ -0,0 +1,136 @@
+// screen listing the past transfers, most recent first
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/dustin/go-humanize"
+	"github.com/masar3141/shair"
+)
+
+const (
+	historyColumnFmt = "%-3s %-19s %-9s %-20s %-24s %-10s %-10s %-12s %s\n"
+
+	historyLimit = 200 // transfers loaded at most
+	historyRows  = 15  // transfers shown at once
+)
+
+// Historian is implemented by the backends keeping the history of the transfers.
+type Historian interface {
+	History(q shair.HistoryQuery) ([]shair.TransferRecord, error)
+}
+
+type historyModel struct {
+	historian Historian
+
+	records []shair.TransferRecord
+	err     error
+	cursor  int
+	offset  int // first record shown
+}
+
+func newHistoryModel(h Historian) *historyModel {
+	return &historyModel{historian: h}
+}
+
+type changePageListToHistoryMsg struct{}
+
+func changePageListToHistoryCmd() tea.Msg {
+	return changePageListToHistoryMsg{}
+}
+
+type historyLoadedMsg struct {
+	records []shair.TransferRecord
+	err     error
+}
+
+func (m *historyModel) loadCmd() tea.Msg {
+	records, err := m.historian.History(shair.HistoryQuery{Limit: historyLimit})
+	return historyLoadedMsg{records, err}
+}
+
+func (m *historyModel) Init() tea.Cmd {
+	return m.loadCmd
+}
+
+func (m *historyModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case historyLoadedMsg:
+		m.records, m.err = msg.records, msg.err
+		m.cursor, m.offset = 0, 0
+
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "k", "ctrl-p", "up":
+			if m.cursor > 0 {
+				m.cursor--
+			}
+
+		case "j", "ctrl-n", "down":
+			if m.cursor < len(m.records)-1 {
+				m.cursor++
+			}
+
+		case "r":
+			return m, m.loadCmd
+		}
+
+		// keep the cursor in view
+		m.offset = min(m.offset, m.cursor)
+		m.offset = max(m.offset, m.cursor-historyRows+1)
+	}
+
+	return m, nil
+}
+
+func (m *historyModel) View() string {
+	s := styles.title.Render("Transfers") + "\n\n"
+
+	switch {
+	case m.err != nil:
+		s += m.err.Error() + "\n"
+
+	case len(m.records) == 0:
+		s += "No transfer yet\n"
+
+	default:
+		s += fmt.Sprintf(historyColumnFmt, " ", "Time", "Direction", "Peer", "Files", "Size", "Rate", "Duration", "Outcome")
+		for idx := m.offset; idx < min(len(m.records), m.offset+historyRows); idx++ {
+			r := m.records[idx]
+			selected := " "
+			if idx == m.cursor {
+				selected = ">"
+			}
+			row := fmt.Sprintf(
+				historyColumnFmt,
+				selected, r.Time.Local().Format(time.DateTime), r.Direction, r.PeerName, describeFiles(r.Files),
+				humanize.Bytes(r.Size()), describeThroughput(r), describeDuration(r), r.Outcome,
+			)
+			if idx == m.cursor {
+				row = styles.selected.Render(strings.TrimSuffix(row, "\n")) + "\n"
+			}
+			s += row
+		}
+		s += "\n" + m.details(m.records[m.cursor])
+	}
+
+	return s + "\n(esc) Back, (k) Up, (j) Down, (r) Reload"
+}
+
+// details describes the files of the transfer under the cursor, and why it failed.
+func (m *historyModel) details(r shair.TransferRecord) string {
+	s := ""
+	if r.PeerID != "" {
+		s += fmt.Sprintf("%s (%s) on %s\n", r.PeerName, r.PeerID, r.Service)
+	}
+	for _, f := range r.Files {
+		s += fmt.Sprintf("  %s (%s) %s\n", f.Name, humanize.Bytes(f.Size), f.SHA256)
+	}
+	if r.Error != "" {
+		s += styles.notice.Render(r.Error) + "\n"
+	}
+	return s
+}
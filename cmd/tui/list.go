@@ -5,19 +5,24 @@ import (
 	"fmt"
 	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
+	"github.com/dustin/go-humanize"
 	"github.com/masar3141/shair"
+	"github.com/masar3141/shair/remote"
 )
 
 const (
-	columnFmt = "%-3s %-20s %-10s %-15s %-5s\n"
+	columnFmt = "%-3s %-20s %-10s %-8s %-14s %-8s %-10s %-14s %-15s %-5s\n"
 )
 
 type transferRequest struct {
 	// set by update when transferRequest received
 	acceptCh           chan<- bool
 	downloadProgressCh <-chan int
+	doneCh             <-chan error
 	filePreviews       []shair.FilePreview
 	requester          *shair.Device
 }
@@ -33,17 +38,28 @@ type listModel struct {
 	// discovered peers
 	peers []*shair.Device
 
+	// name the local device is announced with, may differ from the requested one after a name conflict
+	selfName string
+
 	transferRequest transferRequest
+
+	// global bandwidth caps, adjustable with (u) and (d)
+	bandwidth bandwidth
+
+	// requests accepted without asking
+	autoAccept autoAccept
 }
 
-func newListModel() *listModel {
-	f := "\n(esc) Quit, (enter) Send, (k) Up, (j) Down"
+func newListModel(bw bandwidth, auto autoAccept) *listModel {
+	f := "\n(esc) Quit, (enter) Send, (k) Up, (j) Down, (a) Add peer, (p) Pair, (h) History, (u) Upload cap, (d) Download cap"
 
 	return &listModel{
-		columns:    fmt.Sprintf(columnFmt, " ", "Device", "On", "IP", "Port"),
+		columns:    fmt.Sprintf(columnFmt, " ", "Device", "On", "Type", "Platform", "Version", "Accepting", "Status", "IP", "Port"),
 		footer:     f,
 		baseFooter: f,
 		peers:      make([]*shair.Device, 0),
+		bandwidth:  bw,
+		autoAccept: auto,
 	}
 }
 
@@ -57,15 +73,22 @@ func changePageListToInputCmd(dest *shair.Device) tea.Cmd {
 	}
 }
 
+type changePageListToAddPeerMsg struct{}
+
+func changePageListToAddPeerCmd() tea.Msg {
+	return changePageListToAddPeerMsg{}
+}
+
 type changePageListToReceivingMsg struct {
 	filePreviews       []shair.FilePreview
 	downloadProgressCh <-chan int
+	doneCh             <-chan error
 	sender             *shair.Device
 }
 
-func changePageListToReceivingCmd(fp []shair.FilePreview, downloadProgressCh <-chan int, sender *shair.Device) tea.Cmd {
+func changePageListToReceivingCmd(fp []shair.FilePreview, downloadProgressCh <-chan int, doneCh <-chan error, sender *shair.Device) tea.Cmd {
 	return func() tea.Msg {
-		return changePageListToReceivingMsg{fp, downloadProgressCh, sender}
+		return changePageListToReceivingMsg{fp, downloadProgressCh, doneCh, sender}
 	}
 }
 
@@ -89,20 +112,30 @@ func (m *listModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				m.cursor++
 			}
 
+		case "a":
+			return m, changePageListToAddPeerCmd
+
+		case "p":
+			return m, changePageListToPairCmd
+
+		case "h":
+			return m, changePageListToHistoryCmd
+
+		case "u":
+			nextBandwidthPreset(m.bandwidth.upload)
+
+		case "d":
+			nextBandwidthPreset(m.bandwidth.download)
+
 		case "enter":
+			if len(m.peers) == 0 {
+				break
+			}
 			return m, changePageListToInputCmd(m.peers[m.cursor])
 
 		case "y":
 			if m.transferRequest.acceptCh != nil { // if transfer requested
-				m.transferRequest.acceptCh <- true
-				close(m.transferRequest.acceptCh)
-				m.transferRequest.acceptCh = nil
-				m.additionalMsgFooter = ""
-				return m, changePageListToReceivingCmd(
-					m.transferRequest.filePreviews,
-					m.transferRequest.downloadProgressCh,
-					m.transferRequest.requester,
-				)
+				return m, m.acceptTransfer()
 			}
 
 		case "n":
@@ -115,24 +148,79 @@ func (m *listModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		}
 
 	case peerUpdateMsg:
-		if msg.Status == shair.Discovered {
-			m.peers = append(m.peers, msg.Peer)
+		if msg.Status == shair.Self {
+			m.selfName = msg.Peer.Name
+
+		} else if msg.Status == shair.Removed {
+			m.peers = slices.DeleteFunc(m.peers, func(p *shair.Device) bool { return p.Key() == msg.Peer.Key() })
+			m.cursor = max(0, min(m.cursor, len(m.peers)-1))
 
 		} else {
-			m.peers = slices.DeleteFunc(m.peers, func(p *shair.Device) bool { return p == msg.Peer })
+			m.upsertPeer(msg.Peer)
 		}
 		return m, cmd
 
+	case peerAddedMsg:
+		m.upsertPeer(msg.peer)
+		m.additionalMsgFooter = fmt.Sprintf(" --- added %s", msg.peer.Name)
+
 	case transferRequestMsg:
 		m.transferRequest.acceptCh = msg.AcceptCh
 		m.transferRequest.downloadProgressCh = msg.ProgressCh
+		m.transferRequest.doneCh = msg.DoneCh
+		m.transferRequest.requester = msg.Sender
 		m.transferRequest.filePreviews = msg.FilePreviews
-		m.additionalMsgFooter = fmt.Sprintf(" (y/n) %s wants to transfer %d files", msg.Sender.Name, len(m.transferRequest.filePreviews))
+		if m.autoAccept.matches(shair.TransferRequest(msg)) {
+			return m, m.acceptTransfer()
+		}
+
+		total := uint64(0)
+		for _, fp := range msg.FilePreviews {
+			total += fp.Size
+		}
+		free := "unknown"
+		if msg.FreeSpace != 0 {
+			free = humanize.Bytes(msg.FreeSpace)
+		}
+		m.additionalMsgFooter = fmt.Sprintf(
+			" (y/n) %s wants to transfer %d files (%s, %s free)",
+			msg.Sender.Name, len(m.transferRequest.filePreviews), humanize.Bytes(total), free,
+		)
+
+	case changePageAddPeerToListMsg:
+		m.additionalMsgFooter = fmt.Sprintf(" --- looking for %s", msg.addr)
+
+	case peerPairedMsg:
+		m.additionalMsgFooter = fmt.Sprintf(" --- paired with %s", msg.peer.Name)
+
+	case changePagePairToListMsg:
+		m.additionalMsgFooter = fmt.Sprintf(" --- waiting for the device pairing with %s", msg.code)
+
+	case serviceEventMsg:
+		if msg.Err != nil {
+			m.additionalMsgFooter = fmt.Sprintf(" --- %s service %s: %s ", msg.Service, msg.State, msg.Err.Error())
+		}
+
+	case receiptMsg:
+		name := msg.To
+		if i := slices.IndexFunc(m.peers, func(p *shair.Device) bool { return p.ID == msg.To }); i >= 0 {
+			name = m.peers[i].Name
+		}
+		m.additionalMsgFooter = fmt.Sprintf(" --- %s", describeReceipt(name, remote.Receipt(msg)))
 
 	case errMsg:
-		if errors.Is(msg, shair.TransferRejected) {
-			// if dest rejects transfer, go back to list page and inform the user
-			m.additionalMsgFooter = fmt.Sprintf(" --- %s didn't accept the files", m.peers[m.cursor].Name)
+		var rejection shair.RejectedError
+		var deposited shair.DepositedError
+		if errors.As(msg, &deposited) {
+			// the receipt tells later what became of the files
+			m.additionalMsgFooter = " --- the receiver is offline, the files wait for it in the mailbox"
+		} else if errors.As(msg, &rejection) {
+			// if dest rejects transfer, go back to list page and inform the user of the reason
+			name := "the receiver"
+			if m.cursor < len(m.peers) {
+				name = m.peers[m.cursor].Name
+			}
+			m.additionalMsgFooter = fmt.Sprintf(" --- %s didn't accept the files: %s", name, rejection.Error())
 		} else {
 			// TODO: probably a good thing to send a generic error message to the ui
 			m.additionalMsgFooter = fmt.Sprintf(" --- %s ", msg.Error())
@@ -142,7 +230,9 @@ func (m *listModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.additionalMsgFooter = " --- transfer done"
 
 	case receivingDoneMsg:
-		if msg.expected != msg.received {
+		if msg.err != nil {
+			m.additionalMsgFooter = fmt.Sprintf(" --- %s ", msg.err.Error())
+		} else if msg.expected != msg.received {
 			m.additionalMsgFooter = " --- transfer incomplete"
 		} else {
 			m.additionalMsgFooter = " --- files received"
@@ -152,9 +242,37 @@ func (m *listModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	return m, cmd
 }
 
+// acceptTransfer accepts the pending transfer request and moves to the receiving page.
+func (m *listModel) acceptTransfer() tea.Cmd {
+	m.transferRequest.acceptCh <- true
+	close(m.transferRequest.acceptCh)
+	m.transferRequest.acceptCh = nil
+	m.additionalMsgFooter = ""
+	return changePageListToReceivingCmd(
+		m.transferRequest.filePreviews,
+		m.transferRequest.downloadProgressCh,
+		m.transferRequest.doneCh,
+		m.transferRequest.requester,
+	)
+}
+
+// upsertPeer lists the peer, or replaces the listed copy of it.
+func (m *listModel) upsertPeer(peer *shair.Device) {
+	if i := slices.IndexFunc(m.peers, func(p *shair.Device) bool { return p.Key() == peer.Key() }); i >= 0 {
+		// updates carry a fresh copy of the peer, replace ours in place to keep the cursor on it
+		m.peers[i] = peer
+		return
+	}
+	m.peers = append(m.peers, peer)
+}
+
 func (m *listModel) View() string {
 	//TODO: better string concatenation
-	s := m.columns
+	s := ""
+	if m.selfName != "" {
+		s += styles.title.Render(fmt.Sprintf("Visible as %q", m.selfName)) + "\n\n"
+	}
+	s += m.columns
 
 	var selected string
 	for idx, p := range m.peers {
@@ -163,10 +281,39 @@ func (m *listModel) View() string {
 		} else {
 			selected = " "
 		}
-		s += fmt.Sprintf(columnFmt, selected, p.Name, p.DiscoveredOn.String(), p.LocalInfo.IP, strconv.Itoa(p.LocalInfo.SvcPort))
+		platform := ""
+		if p.OS != "" {
+			platform = p.OS + "/" + p.Arch
+		}
+		accepting := "no"
+		if p.Accepting {
+			accepting = "yes"
+		}
+		row := fmt.Sprintf(
+			columnFmt,
+			selected, p.Name, p.DiscoveredOn.String(), p.Type, platform, p.AppVersion, accepting, reachability(p),
+			p.LocalInfo.IP, strconv.Itoa(p.LocalInfo.SvcPort),
+		)
+		if idx == m.cursor {
+			row = styles.selected.Render(strings.TrimSuffix(row, "\n")) + "\n"
+		}
+		s += row
 	}
 
-	s += m.footer + m.additionalMsgFooter
+	s += "\n" + m.bandwidth.String()
+	s += m.footer + styles.notice.Render(m.additionalMsgFooter)
 
 	return s
 }
+
+// reachability describes the liveness of the peer, with its round trip time when it answers.
+func reachability(p *shair.Device) string {
+	switch p.Reachability {
+	case shair.ReachabilityUnknown:
+		return "-"
+	case shair.Reachable:
+		return "ok " + p.RTT.Round(100*time.Microsecond).String()
+	default:
+		return p.Reachability.String()
+	}
+}
@@ -0,0 +1,136 @@
+// this file provides the log file, rotated once it grows over the log_max_size setting: shair.log is
+// renamed shair.log.1, shair.log.1 becomes shair.log.2 and so on, the oldest beyond log_max_files is removed
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/brutella/dnssd/log"
+	"github.com/masar3141/shair"
+)
+
+// logFile is a log file rotated by size.
+type logFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  uint64 // size above which the file is rotated, never rotated if 0
+	maxFiles int    // rotated files kept
+	f        *os.File
+	size     uint64
+}
+
+func openLogFile(path string, maxSize uint64, maxFiles int) (*logFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	l := &logFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *logFile) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size = f, uint64(fi.Size())
+	return nil
+}
+
+// Write appends p, a whole record, rotating the file first if p would take it over its maximum size.
+// Other processes, eg the daemon and a subcommand, may append to the same file and rotate it: before
+// rotating, a file they rotated already is reopened instead, and the size of the file is read again.
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxSize > 0 && l.size+uint64(len(p)) > l.maxSize {
+		if err := l.reopen(); err != nil {
+			return 0, err
+		}
+		if l.size > 0 && l.size+uint64(len(p)) > l.maxSize {
+			if err := l.rotate(); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	n, err := l.f.Write(p)
+	l.size += uint64(n)
+	return n, err
+}
+
+// reopen opens the file at the path again if it isn't the one we write to, ie another process rotated
+// it, and reads the size of the file.
+func (l *logFile) reopen() error {
+	fi, err := os.Stat(l.path)
+	if err == nil {
+		if cur, err := l.f.Stat(); err == nil && os.SameFile(fi, cur) {
+			l.size = uint64(fi.Size())
+			return nil
+		}
+	}
+
+	l.f.Close()
+	return l.open()
+}
+
+// rotate shifts the rotated files, dropping the oldest, and starts a new file.
+func (l *logFile) rotate() error {
+	l.f.Close()
+
+	_ = os.Remove(fmt.Sprintf("%s.%d", l.path, l.maxFiles))
+	for i := l.maxFiles - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	if l.maxFiles > 0 {
+		_ = os.Rename(l.path, l.path+".1")
+	} else {
+		_ = os.Remove(l.path)
+	}
+
+	return l.open()
+}
+
+// openLog returns the logger writing to the log file of cfg, or discarding the logs if there is none.
+// Each record is a JSON object, those of a transfer carry its ID. In debug mode, the debug records
+// are kept and the logs of the dnssd package, which are otherwise disabled, go along with ours.
+func openLog(cfg *config) (*slog.Logger, error) {
+	var w io.Writer = io.Discard
+	if cfg.LogFile != "" {
+		f, err := openLogFile(cfg.LogFile, cfg.LogMaxSize, cfg.LogMaxFiles)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open the log file: %w", err)
+		}
+		w = f
+	}
+	return newLogger(w, cfg.Debug), nil
+}
+
+// newLogger returns the logger writing to w, see openLog.
+func newLogger(w io.Writer, debug bool) *slog.Logger {
+	level := slog.LevelInfo
+	if debug {
+		level = slog.LevelDebug
+	}
+	h := shair.NewLogHandler(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level}))
+
+	if debug {
+		dnssd := h.WithAttrs([]slog.Attr{slog.String("component", "dnssd")})
+		log.Debug.Logger = slog.NewLogLogger(dnssd, slog.LevelDebug)
+		log.Info.Logger = slog.NewLogLogger(dnssd, slog.LevelInfo)
+	}
+	return slog.New(h)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readLogs returns the content of the log file and of its rotated files, "" for those missing.
+func readLogs(t *testing.T, path string, n int) []string {
+	t.Helper()
+
+	var logs []string
+	for i := range n + 1 {
+		p := path
+		if i > 0 {
+			p = path + "." + string(rune('0'+i))
+		}
+		b, err := os.ReadFile(p)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		logs = append(logs, string(b))
+	}
+	return logs
+}
+
+func write(t *testing.T, l *logFile, record string) {
+	t.Helper()
+
+	if _, err := l.Write([]byte(record)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLogFileRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shair.log")
+	l, err := openLogFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.f.Close()
+
+	for _, r := range []string{"aaaa\n", "bbbb\n", "cccc\n", "dddd\n", "eeee\n", "ffffffffffff\n", "gggg\n"} {
+		write(t, l, r)
+	}
+
+	// records are kept whole, even those over the maximum size, and the oldest file is dropped
+	want := []string{"gggg\n", "ffffffffffff\n", "eeee\n", ""}
+	got := readLogs(t, path, 3)
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestLogFileRotatedByAnotherProcess(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shair.log")
+
+	a, err := openLogFile(path, 20, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.f.Close()
+	write(t, a, "a1: 12345678901234\n")
+
+	// b shares the file, and rotates it
+	b, err := openLogFile(path, 20, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.f.Close()
+	write(t, b, "b1\n")
+
+	// a writes to the file rotated by b rather than rotating it again
+	write(t, a, "a2\n")
+
+	want := []string{"b1\na2\n", "a1: 12345678901234\n", "", ""}
+	got := readLogs(t, path, 3)
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+}
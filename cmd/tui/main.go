@@ -2,53 +2,113 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
-	"io"
 	"log/slog"
 	"os"
+	"strings"
+	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
 
 	"github.com/masar3141/shair"
 	"github.com/masar3141/shair/local"
+	"github.com/masar3141/shair/remote"
 
 	"github.com/brutella/dnssd/log"
 )
 
+// the dnssd logs are enabled in debug mode only, see newLogger
 func init() {
 	log.Info.Disable()
 	log.Debug.Disable()
 }
 
+// peersFlag collects the repeated -peer flags.
+type peersFlag []string
+
+func (p *peersFlag) String() string { return strings.Join(*p, ",") }
+
+func (p *peersFlag) Set(addr string) error {
+	*p = append(*p, addr)
+	return nil
+}
+
 func main() {
-	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "peers":
+			os.Exit(runPeers(os.Args[2:]))
+		case "send":
+			os.Exit(runSend(os.Args[2:]))
+		case "receive":
+			os.Exit(runReceive(os.Args[2:]))
+		case "config":
+			os.Exit(runConfig(os.Args[2:]))
+		case "history":
+			os.Exit(runHistory(os.Args[2:]))
+		case "daemon":
+			os.Exit(runDaemon(os.Args[2:]))
+		case "pair":
+			os.Exit(runPair(os.Args[2:]))
+		}
+	}
 
-	hostname, err := os.Hostname()
-	if err != nil {
-		panic(err)
+	var peers peersFlag
+	flag.Var(&peers, "peer", "add the peer listening on `host:port`, for networks where discovery doesn't work. Can be repeated")
+	cfg := newConfig(flag.CommandLine)
+	flag.Parse()
+
+	if err := cfg.load(flag.CommandLine); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
+	styles = themes[cfg.Theme]
 
-	dirname, err := os.UserHomeDir()
+	logger, err := openLog(cfg)
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 
-	app := shair.NewApplication(
-		logger,
-		hostname,
-		dirname, // TODO: either need a flag or a config file
-		local.NewLocalShairer(logger, 8085),
+	// the tui attaches to the daemon when one runs, whose bandwidth caps can't be changed from here
+	var (
+		app  backend
+		bw   bandwidth
+		pgrm *tea.Program
 	)
+	if c, ok := attach(logger, cfg); ok {
+		app = c
+	} else {
+		// the receipts come once the program runs the application
+		notify := func(rc remote.Receipt) { pgrm.Send(receiptMsg(rc)) }
+		a, b, err := newApplication(logger, cfg, notify, shair.WithRestartPolicy(shair.RestartPolicy{MaxRestarts: cfg.MaxRestarts, Backoff: time.Second, MaxBackoff: time.Minute}))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		app, bw = a, b
+
+		// peers listed in the config directory are added in the background until they answer, the
+		// daemon adds them itself
+		addManualPeers(context.Background(), logger, a)
+	}
 
-	pgrm := tea.NewProgram(newRootModel(app, app))
+	pgrm = tea.NewProgram(newRootModel(app, app, app, app, app, bw, cfg.AutoAccept))
 
 	peerUpdateCh := make(chan shair.PeerUpdate)
 	transferRequestCh := make(chan shair.TransferRequest)
+	serviceEventCh := make(chan shair.ServiceEvent)
 
-	go app.Start(context.Background(), peerUpdateCh, transferRequestCh)
+	go app.Start(context.Background(), peerUpdateCh, transferRequestCh, serviceEventCh)
 
 	go listenAndForwardPeerUpdate(pgrm, peerUpdateCh)
 	go listenAndForwardTransferRequest(pgrm, transferRequestCh)
+	go listenAndForwardServiceEvent(pgrm, serviceEventCh)
+
+	for _, addr := range peers {
+		go func() { pgrm.Send(addPeerCmd(app, addr)()) }()
+	}
 
 	_, err = pgrm.Run()
 	if err != nil {
@@ -56,3 +116,71 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// newApplication returns the application running the services set up by cfg, along with the bandwidth
+// caps applied to them. The receipts of the files left for offline pairs settle their transfers in the
+// history, and are passed to onReceipt when not nil.
+func newApplication(logger *slog.Logger, cfg *config, onReceipt func(remote.Receipt), opts ...shair.AppOption) (*shair.Application, bandwidth, error) {
+	// the ID is shared by the instances of a user, peers would see several instances on one host as a
+	// single device: each needs its own config directory, see the README
+	deviceID, err := shair.LoadDeviceID()
+	if err != nil {
+		// peers will see a new identity on every restart
+		logger.Warn("cannot load device id", "err", err)
+		deviceID = shair.NewDeviceID()
+	}
+
+	bw := bandwidth{
+		upload:   shair.NewLimiter(int64(cfg.Upload)),
+		download: shair.NewLimiter(int64(cfg.Download)),
+	}
+
+	localOpts := []local.Option{
+		local.WithPortRange(cfg.Port.first, cfg.Port.last),
+		local.WithSendLimiter(bw.upload),
+		local.WithReceiveLimiter(bw.download),
+		local.WithDeviceID(deviceID),
+		local.WithDiscovery(cfg.Discovery),
+		local.WithInterfaces(cfg.Interfaces...),
+		local.WithCIDRs(cfg.CIDRs...),
+		local.WithTimeouts(cfg.Timeouts),
+	}
+	if key, err := remote.LoadKey(); err != nil {
+		logger.Warn("cannot load the device key", "err", err)
+	} else {
+		localOpts = append(localOpts, local.WithCertFingerprint(remote.Fingerprint(key.PublicKey().Bytes())))
+	}
+	localShairer := local.NewLocalShairer(logger, cfg.Port.first, append(localOpts, cfg.Receive.options()...)...)
+	services := map[shair.SvcType]shair.Shairer{shair.Local: localShairer}
+
+	// receipts are only received once the application runs
+	var app *shair.Application
+	if cfg.Relay != "" {
+		rs, err := newRemoteShairer(logger, cfg.Relay, deviceID, localShairer, func(rc remote.Receipt) {
+			if cfg.HistoryFile != "" {
+				if _, err := app.Settle(rc.MailID, rc.Outcome(), rc.Reason); err != nil {
+					logger.Warn("cannot record the receipt", "mail", rc.MailID, "err", err)
+				}
+			}
+			if onReceipt != nil {
+				onReceipt(rc)
+			}
+		})
+		if err != nil {
+			return nil, bw, fmt.Errorf("cannot reach paired devices: %w", err)
+		}
+		services[shair.Remote] = rs
+	}
+
+	opts = append(opts, shair.WithHistory(openHistory(cfg)))
+	app = shair.NewApplication(logger, cfg.Name, cfg.SaveDir, services, opts...)
+	return app, bw, nil
+}
+
+// openHistory returns the history of the transfers set by cfg, nil if it isn't kept.
+func openHistory(cfg *config) *shair.History {
+	if cfg.HistoryFile == "" {
+		return nil
+	}
+	return shair.NewHistory(cfg.HistoryFile)
+}
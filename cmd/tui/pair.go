@@ -0,0 +1,169 @@
+// this file provides the pairing with a device reached through the relay, from the command line:
+//
+//	shair pair [-relay host:port] [code]
+//
+// and from the screen opened with (p) in the tui. Paired devices are listed and accept each other's files.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+
+	"github.com/masar3141/shair"
+	"github.com/masar3141/shair/local"
+	"github.com/masar3141/shair/remote"
+)
+
+// how long to wait for the other device to pair, as long as the relay waits for it
+const pairTimeout = 10 * time.Minute
+
+// runPair implements `shair pair`, it returns the exit code. Without a code, it prints a new one for
+// the other device.
+func runPair(args []string) int {
+	const usage = "shair pair [-relay host:port] [code]"
+	fs := flag.NewFlagSet("pair", flag.ExitOnError)
+	cfg, logger := parseArgs(fs, usage, args)
+
+	code := remote.NewCode()
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		code = fs.Arg(0)
+		if !remote.ValidPairCode(code) {
+			fmt.Fprintf(os.Stderr, "%q is not a valid pairing code, it looks like K7MQ-2PXA\n", code)
+			return exitUsage
+		}
+	default:
+		fs.Usage()
+		return exitUsage
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, pairTimeout)
+	defer cancel()
+
+	pairer, err := newPairer(logger, cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitCode(err)
+	}
+
+	if fs.NArg() == 0 {
+		fmt.Printf("On the other device, run:\n\n\tshair pair %s\n\nWaiting for the other device...\n", code)
+	}
+
+	peer, err := pairer.Pair(ctx, code)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return exitInterrupted
+		}
+		fmt.Fprintln(os.Stderr, err)
+		return exitCode(err)
+	}
+
+	fmt.Printf("Paired with %s (%s)\n", peer.Name, peer.ID)
+	return exitOK
+}
+
+// newPairer returns the daemon when one runs, so that it reaches the new pair right away, or pairs
+// on the relay of cfg otherwise. Either way, the pair is saved in the config directory.
+func newPairer(logger *slog.Logger, cfg *config) (shair.Pairer, error) {
+	if c, ok := attach(logger, cfg); ok {
+		return c, nil
+	}
+
+	// our pairs know us by our ID, a throwaway one would be useless
+	deviceID, err := shair.LoadDeviceID()
+	if err != nil {
+		return nil, fmt.Errorf("cannot load the device id: %w", err)
+	}
+	return newRemoteShairer(logger, relayAddr(cfg), deviceID, local.NewLocalShairer(logger, 0), nil)
+}
+
+// screen to pair with a device through the relay
+type pairModel struct {
+	textinput textinput.Model
+	code      string // new code, used when none is typed
+}
+
+func newPairModel() *pairModel {
+	code := remote.NewCode()
+
+	ti := textinput.New()
+	ti.Placeholder = code
+	ti.Focus()
+
+	return &pairModel{textinput: ti, code: code}
+}
+
+type changePageListToPairMsg struct{}
+
+func changePageListToPairCmd() tea.Msg {
+	return changePageListToPairMsg{}
+}
+
+type changePagePairToListMsg struct {
+	code string
+}
+
+type peerPairedMsg struct {
+	peer *shair.Device
+}
+
+// pairCmd waits for the device pairing with the same code.
+func pairCmd(pairer shair.Pairer, code string) tea.Cmd {
+	return func() tea.Msg {
+		ctx, cancel := context.WithTimeout(context.Background(), pairTimeout)
+		defer cancel()
+
+		dvc, err := pairer.Pair(ctx, code)
+		if err != nil {
+			return errMsg(err)
+		}
+
+		return peerPairedMsg{&dvc}
+	}
+}
+
+func (m *pairModel) Init() tea.Cmd {
+	return textinput.Blink
+}
+
+func (m *pairModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	if msg, ok := msg.(tea.KeyMsg); ok && msg.Type == tea.KeyEnter {
+		code := strings.TrimSpace(m.textinput.Value())
+		if code == "" {
+			code = m.code
+		}
+		if !remote.ValidPairCode(code) {
+			m.textinput.SetValue("")
+			m.textinput.Placeholder = m.code
+			return m, nil
+		}
+		return m, func() tea.Msg { return changePagePairToListMsg{code} }
+	}
+
+	var cmd tea.Cmd
+	m.textinput, cmd = m.textinput.Update(msg)
+
+	return m, cmd
+}
+
+func (m *pairModel) View() string {
+	return fmt.Sprintf(
+		"Pairing code, the same on both devices. Type the one of the other device, or enter this one on it\n\n%s\n\n%s",
+		m.textinput.View(),
+		"(esc) back (enter) pair",
+	) + "\n\n"
+}
@@ -17,14 +17,16 @@ type receivingModel struct {
 	sender       *shair.Device
 	filePreviews []shair.FilePreview
 	progressCh   <-chan int
+	doneCh       <-chan error // outcome of the transfer, filled before progressCh is closed
 	received     int
 }
 
-func newReceivingModel(sender *shair.Device, fp []shair.FilePreview, progressCh <-chan int) *receivingModel {
+func newReceivingModel(sender *shair.Device, fp []shair.FilePreview, progressCh <-chan int, doneCh <-chan error) *receivingModel {
 	return &receivingModel{
 		sender:       sender,
 		filePreviews: fp,
 		progressCh:   progressCh,
+		doneCh:       doneCh,
 	}
 }
 
@@ -33,6 +35,7 @@ type downloadProgressMsg struct{ p int }
 type receivingDoneMsg struct {
 	received int
 	expected int // set in root. TODO: investigate a less confusing pattern
+	err      error
 }
 
 func (m receivingModel) listenDownloadProgressCmd() tea.Msg {
@@ -40,6 +43,7 @@ func (m receivingModel) listenDownloadProgressCmd() tea.Msg {
 	if !ok {
 		return receivingDoneMsg{
 			received: m.received,
+			err:      <-m.doneCh,
 		}
 	}
 
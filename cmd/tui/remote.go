@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/masar3141/shair/local"
+	"github.com/masar3141/shair/remote"
+)
+
+// newRemoteShairer reaches the paired devices through the relay, with the key and pairs saved in the
+// config directory. Transfers run through the local shairer so that its caps and policies apply, and
+// the receipts of the files left for offline pairs are passed to onReceipt, when not nil.
+func newRemoteShairer(logger *slog.Logger, relayAddr string, deviceID string, transfer *local.LocalShairer, onReceipt func(remote.Receipt)) (*remote.RemoteShairer, error) {
+	key, err := remote.LoadKey()
+	if err != nil {
+		return nil, err
+	}
+
+	pairs, err := remote.LoadPairs()
+	if err != nil {
+		return nil, err
+	}
+
+	var rs *remote.RemoteShairer
+	opts := []remote.Option{
+		remote.WithKey(key),
+		remote.WithDeviceID(deviceID),
+		remote.WithPairs(pairs...),
+		remote.WithPairHandler(func(remote.Pair) {
+			if err := remote.SavePairs(rs.Pairs()); err != nil {
+				logger.Warn("cannot save pairs", "err", err)
+			}
+		}),
+		remote.WithTransferer(transfer),
+		remote.WithMailFallback(),
+	}
+	if onReceipt != nil {
+		opts = append(opts, remote.WithReceiptHandler(onReceipt))
+	}
+	rs = remote.NewRemoteShairer(logger, relayAddr, opts...)
+
+	return rs, nil
+}
+
+// receiptMsg tells the ui what became of files left for an offline pair.
+type receiptMsg remote.Receipt
+
+// describeReceipt tells what became of the files left for name.
+func describeReceipt(name string, rc remote.Receipt) string {
+	switch rc.Status {
+	case remote.Delivered:
+		return fmt.Sprintf("%s received the files left in the mailbox", name)
+	case remote.Rejected:
+		return fmt.Sprintf("%s didn't accept the files left in the mailbox: %s", name, rc.Reason)
+	}
+	return fmt.Sprintf("%s didn't collect the files left in the mailbox in time", name)
+}
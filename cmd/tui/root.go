@@ -26,6 +26,9 @@ const (
 	fileInput
 	receiving
 	sending
+	addPeer
+	pair
+	history
 	quit
 )
 
@@ -34,23 +37,32 @@ type Sender interface {
 }
 
 type rootModel struct {
-	sender Sender
+	sender    Sender
+	adder     shair.PeerAdder
+	pairer    shair.Pairer
+	historian Historian
 
 	state  state
 	models map[state]tea.Model
 
 	dest *shair.Device // device selected in list model
 
+	status statusBar // state of the services, shown below every page
+
 	//  store that holds shared state
 	store store
 }
 
-func newRootModel(sender Sender, quitter Quitter) *rootModel {
+func newRootModel(sender Sender, quitter Quitter, adder shair.PeerAdder, pairer shair.Pairer, historian Historian, bw bandwidth, auto autoAccept) *rootModel {
 	return &rootModel{
-		sender: sender,
-		state:  list,
-		models: map[state]tea.Model{list: newListModel(), fileInput: newFileInputModel(), quit: newQuitModel(quitter)},
-		dest:   &shair.Device{},
+		sender:    sender,
+		adder:     adder,
+		pairer:    pairer,
+		historian: historian,
+		state:     list,
+		models:    map[state]tea.Model{list: newListModel(bw, auto), fileInput: newFileInputModel(), quit: newQuitModel(quitter)},
+		dest:      &shair.Device{},
+		status:    newStatusBar(),
 	}
 }
 
@@ -61,6 +73,7 @@ func newRootModel(sender Sender, quitter Quitter) *rootModel {
 // and re-invoked after each model Update.
 type peerUpdateMsg shair.PeerUpdate
 type transferRequestMsg shair.TransferRequest
+type serviceEventMsg shair.ServiceEvent
 
 type sendingDoneMsg struct{}
 type errMsg error
@@ -87,6 +100,10 @@ func (m *rootModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		switch msg.String() {
 		// TODO: understand why ctrl-c doesn't work and make it work
 		case "esc":
+			if m.state == addPeer || m.state == pair || m.state == history {
+				m.state = list
+				return m, nil
+			}
 			m.state = quit
 		}
 
@@ -94,10 +111,55 @@ func (m *rootModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.models[list], cmd = m.models[list].Update(msg)
 		return m, cmd
 
+	case peerAddedMsg:
+		m.models[list], cmd = m.models[list].Update(msg)
+		return m, cmd
+
+	case peerPairedMsg:
+		m.models[list], cmd = m.models[list].Update(msg)
+		return m, cmd
+
 	case transferRequestMsg:
 		m.models[list], cmd = m.models[list].Update(msg)
 		return m, cmd
 
+	case receiptMsg:
+		m.models[list], cmd = m.models[list].Update(msg)
+		return m, cmd
+
+	case serviceEventMsg:
+		m.status.update(shair.ServiceEvent(msg))
+		m.models[list], cmd = m.models[list].Update(msg)
+		return m, cmd
+
+	case changePageListToAddPeerMsg:
+		m.models[addPeer] = newAddPeerModel()
+		m.state = addPeer
+		return m, m.models[addPeer].Init()
+
+	case changePageListToPairMsg:
+		m.models[pair] = newPairModel()
+		m.state = pair
+		return m, m.models[pair].Init()
+
+	case changePageListToHistoryMsg:
+		m.models[history] = newHistoryModel(m.historian)
+		m.state = history
+		return m, m.models[history].Init()
+
+	case changePageAddPeerToListMsg:
+		m.state = list
+		if msg.addr != "" {
+			m.models[list], cmd = m.models[list].Update(msg)
+			return m, tea.Batch(cmd, addPeerCmd(m.adder, msg.addr))
+		}
+		return m, nil
+
+	case changePagePairToListMsg:
+		m.state = list
+		m.models[list], cmd = m.models[list].Update(msg)
+		return m, tea.Batch(cmd, pairCmd(m.pairer, msg.code))
+
 	case changePageListToInputMsg:
 		m.store.destForSend = msg.dest
 		m.state = fileInput
@@ -108,7 +170,7 @@ func (m *rootModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			rqTotSize += int(fp.Size)
 		}
 		m.store.transferRequestTotSize = rqTotSize
-		m.models[receiving] = newReceivingModel(msg.sender, msg.filePreviews, msg.downloadProgressCh)
+		m.models[receiving] = newReceivingModel(msg.sender, msg.filePreviews, msg.downloadProgressCh, msg.doneCh)
 		m.state = receiving
 
 	case changePageInputToSendingMsg:
@@ -143,5 +205,5 @@ func (m *rootModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 }
 
 func (m *rootModel) View() string {
-	return m.models[m.state].View()
+	return m.models[m.state].View() + "\n" + styles.status.Render(m.status.String())
 }
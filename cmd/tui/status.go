@@ -0,0 +1,70 @@
+// this file provides the status bar telling how each service is doing, built on the service events
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/masar3141/shair"
+)
+
+// addresses shown for a running service, the others are elided
+const maxStatusAddrs = 2
+
+type statusBar struct {
+	last map[shair.SvcType]shair.ServiceEvent
+}
+
+func newStatusBar() statusBar {
+	return statusBar{last: make(map[shair.SvcType]shair.ServiceEvent)}
+}
+
+func (b statusBar) update(ev shair.ServiceEvent) {
+	// a degradation is reported once, keep showing it until the service restarts
+	if prev, ok := b.last[ev.Service]; ok && prev.State == shair.ServiceDegraded && ev.State == shair.ServiceRunning {
+		return
+	}
+	b.last[ev.Service] = ev
+}
+
+func (b statusBar) String() string {
+	svcs := make([]shair.SvcType, 0, len(b.last))
+	for svc := range b.last {
+		svcs = append(svcs, svc)
+	}
+	slices.Sort(svcs)
+
+	parts := make([]string, 0, len(svcs))
+	for _, svc := range svcs {
+		parts = append(parts, fmt.Sprintf("%s: %s", svc, describe(b.last[svc])))
+	}
+
+	return strings.Join(parts, " | ")
+}
+
+func describe(ev shair.ServiceEvent) string {
+	switch ev.State {
+	case shair.ServiceRunning:
+		s := ev.State.String()
+		if ev.Port != 0 {
+			s += fmt.Sprintf(" on :%d", ev.Port)
+		}
+		if len(ev.Addrs) > 0 {
+			addrs := ev.Addrs[:min(len(ev.Addrs), maxStatusAddrs)]
+			s += " (" + strings.Join(addrs, ", ")
+			if len(ev.Addrs) > maxStatusAddrs {
+				s += ", …"
+			}
+			s += ")"
+		}
+		return s
+
+	case shair.ServiceDegraded, shair.ServiceStopped:
+		if ev.Err != nil {
+			return fmt.Sprintf("%s (%s)", ev.State, ev.Err)
+		}
+	}
+
+	return ev.State.String()
+}
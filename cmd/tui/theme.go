@@ -0,0 +1,44 @@
+// this file provides the color themes of the tui, picked with the theme setting
+package main
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+type theme struct {
+	title    lipgloss.Style // headings
+	selected lipgloss.Style // peer under the cursor
+	notice   lipgloss.Style // messages at the end of the footer
+	status   lipgloss.Style // status bar of the services
+}
+
+var themes = map[string]theme{
+	"dark": {
+		title:    lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("12")),
+		selected: lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("14")),
+		notice:   lipgloss.NewStyle().Foreground(lipgloss.Color("11")),
+		status:   lipgloss.NewStyle().Foreground(lipgloss.Color("8")),
+	},
+	"light": {
+		title:    lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("4")),
+		selected: lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("6")),
+		notice:   lipgloss.NewStyle().Foreground(lipgloss.Color("3")),
+		status:   lipgloss.NewStyle().Foreground(lipgloss.Color("8")),
+	},
+	"plain": {},
+}
+
+// styles is the theme in use, set from the config before the program starts
+var styles = themes["dark"]
+
+func themeNames() string {
+	names := make([]string, 0, len(themes))
+	for name := range themes {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return strings.Join(names, ", ")
+}
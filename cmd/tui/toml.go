@@ -0,0 +1,76 @@
+// this file reads the config file with a TOML parser and flattens it into the settings it holds: values
+// that are strings, integers, booleans or arrays of those. Anything else is reported as an error.
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/BurntSushi/toml"
+)
+
+// tomlValue is a value of the config file: the text of a scalar, or the elements of an array.
+type tomlValue struct {
+	scalar  string
+	array   []string
+	isArray bool
+}
+
+// parseTOML returns the values of r keyed by their dotted path, eg "bandwidth.upload".
+func parseTOML(r io.Reader) (map[string]tomlValue, error) {
+	var doc map[string]any
+	if _, err := toml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]tomlValue)
+	return values, flattenTOML(values, "", doc)
+}
+
+// flattenTOML adds the values of table to values, their keys prefixed with the path of the table.
+func flattenTOML(values map[string]tomlValue, path string, table map[string]any) error {
+	for key, v := range table {
+		key = path + key
+
+		switch v := v.(type) {
+		case map[string]any:
+			if err := flattenTOML(values, key+".", v); err != nil {
+				return err
+			}
+
+		case []any:
+			tv := tomlValue{isArray: true, array: make([]string, 0, len(v))}
+			for _, elem := range v {
+				s, err := tomlScalar(elem)
+				if err != nil {
+					return fmt.Errorf("%s: %w", key, err)
+				}
+				tv.array = append(tv.array, s)
+			}
+			values[key] = tv
+
+		default:
+			s, err := tomlScalar(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			values[key] = tomlValue{scalar: s}
+		}
+	}
+
+	return nil
+}
+
+// tomlScalar returns the text of a string, integer or boolean.
+func tomlScalar(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", v)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    map[string]tomlValue
+		wantErr string
+	}{
+		{
+			name: "scalars",
+			in:   "# settings\nname = \"desk\\ttop\\u00e9\" # comment\nport = 0x10\nmax = 1_000\ndebug = true\ndir = '/tmp/a\\b'\n",
+			want: map[string]tomlValue{
+				"name":  {scalar: "desk\ttopé"},
+				"port":  {scalar: "16"},
+				"max":   {scalar: "1000"},
+				"debug": {scalar: "true"},
+				"dir":   {scalar: `/tmp/a\b`},
+			},
+		},
+		{
+			name: "tables",
+			in:   "name = \"a\"\n[bandwidth]\nupload = \"5MB\"\n[ receive ]\nmax_files = 3\ntimeouts.handshake = \"5s\"\n",
+			want: map[string]tomlValue{
+				"name":                       {scalar: "a"},
+				"bandwidth.upload":           {scalar: "5MB"},
+				"receive.max_files":          {scalar: "3"},
+				"receive.timeouts.handshake": {scalar: "5s"},
+			},
+		},
+		{
+			name: "arrays",
+			in:   "empty = []\npeers = [\"a\", 'b',]\nexts = [\n  \"exe\", # windows\n  \"bat\"\n]\nnext = 1\n",
+			want: map[string]tomlValue{
+				"empty": {isArray: true, array: []string{}},
+				"peers": {isArray: true, array: []string{"a", "b"}},
+				"exts":  {isArray: true, array: []string{"exe", "bat"}},
+				"next":  {scalar: "1"},
+			},
+		},
+		{name: "leading zero", in: "max = 010\n", wantErr: "line 1"},
+		{name: "escape of go only", in: "name = \"a\\ab\"\n", wantErr: "line 1"},
+		{name: "float", in: "max = 1.5\n", wantErr: "max: unsupported value 1.5"},
+		{name: "array of floats", in: "exts = [1.5]\n", wantErr: "exts: unsupported value 1.5"},
+		{name: "bare string", in: "name = desktop\n", wantErr: "line 1"},
+		{name: "missing value", in: "name =\n", wantErr: "line 1"},
+		{name: "trailing text", in: "port = 1 2\n", wantErr: "line 1"},
+		{name: "unterminated string", in: "name = \"a\n", wantErr: "line 1"},
+		{name: "unterminated array", in: "peers = [\"a\",\n\"b\"\n", wantErr: "expected a comma"},
+		{name: "no key", in: "\n= 1\n", wantErr: "line 2"},
+		{name: "invalid key", in: "a b = 1\n", wantErr: "line 1"},
+		{name: "invalid table", in: "[bandwidth\n", wantErr: "to end table name"},
+		{name: "defined twice", in: "[a]\nb = 1\n[a]\nb = 2\n", wantErr: "line 3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTOML(strings.NewReader(tt.in))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
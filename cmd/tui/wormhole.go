@@ -0,0 +1,80 @@
+// this file provides the code phrase transfers, for devices that don't see each other on the network:
+//
+//	shair send --code [-relay host:port] files...
+//	shair receive [-relay host:port] [-dir path] code
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+
+	"github.com/masar3141/shair"
+	"github.com/masar3141/shair/local"
+	"github.com/masar3141/shair/remote"
+)
+
+var defaultRelay = net.JoinHostPort("localhost", strconv.Itoa(remote.DefaultRelayPort))
+
+// relayAddr returns the relay set in cfg, or the default one.
+func relayAddr(cfg *config) string {
+	if cfg.Relay != "" {
+		return cfg.Relay
+	}
+	return defaultRelay
+}
+
+// sendCode implements `shair send --code`, it returns the exit code. ctx is canceled on interrupt.
+func sendCode(ctx context.Context, logger *slog.Logger, cfg *config, paths []string) int {
+	w := remote.NewWormhole(logger, relayAddr(cfg))
+	c, err := w.Allocate(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitCode(err)
+	}
+
+	fmt.Printf("On the other device, run:\n\n\tshair receive %s\n\nWaiting for the receiver...\n", c)
+
+	return send(paths, func(progressCh chan<- int) error {
+		return w.SendFiles(ctx, w.Peer(), progressCh, paths...)
+	})
+}
+
+// receiveCode implements `shair receive <code>`, it returns the exit code.
+func receiveCode(logger *slog.Logger, cfg *config, code string) int {
+	if !remote.ValidCode(code) {
+		fmt.Fprintf(os.Stderr, "%q is not a valid code, it looks like 7-guitar-orbit\n", code)
+		return exitUsage
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// the receive policies apply to the transfers by code too
+	transfer := local.NewLocalShairer(logger, 0, append(cfg.Receive.options(), local.WithTimeouts(cfg.Timeouts))...)
+	w := remote.NewWormhole(logger, relayAddr(cfg), remote.WithCode(code), remote.WithWormholeTransferer(transfer))
+	app := shair.NewApplication(logger, cfg.Name, cfg.SaveDir, map[shair.SvcType]shair.Shairer{shair.Remote: w}, shair.WithHistory(openHistory(cfg)))
+
+	// the only peer is the sender, known from the code
+	trCh := make(chan shair.TransferRequest)
+	failCh := start(ctx, app, nil, trCh)
+	defer app.Stop()
+
+	select {
+	case err := <-failCh:
+		fmt.Fprintln(os.Stderr, err)
+		return exitCode(err)
+	case tr := <-trCh:
+		if !ask(tr, cfg.SaveDir) {
+			tr.AcceptCh <- false
+			return exitRejected
+		}
+		return receive(tr)
+	case <-ctx.Done():
+		return exitInterrupted
+	}
+}
@@ -0,0 +1,387 @@
+// this file provides the client side of the control api. A Client stands in for the Application run by
+// the daemon: it sends files through it, and relays its peers, requests and services as if they were local.
+package control
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/masar3141/shair"
+)
+
+// Client talks to a daemon over its control socket.
+type Client struct {
+	http *http.Client
+
+	mu       sync.Mutex
+	stop     context.CancelFunc
+	services []shair.SvcType // services the daemon reported
+}
+
+// Dial connects to the daemon listening on the unix socket at path, it fails if no daemon answers.
+func Dial(ctx context.Context, path string) (*Client, error) {
+	c := &Client{
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", path)
+				},
+			},
+		},
+	}
+
+	if _, err := c.Peers(ctx); err != nil {
+		c.http.CloseIdleConnections()
+		return nil, err
+	}
+	return c, nil
+}
+
+// do sends a request with body encoded as JSON, and decodes the response in out when not nil.
+// The caller closes the body of the returned response when out is nil.
+func (c *Client) do(ctx context.Context, method, path string, body, out any) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, "http://shair"+path, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
+		e := &Error{}
+		if err := json.NewDecoder(resp.Body).Decode(e); err != nil {
+			return nil, fmt.Errorf("daemon answered %s", resp.Status)
+		}
+		return nil, e
+	}
+
+	if out == nil {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	return resp, json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Peers returns the peers discovered by the daemon.
+func (c *Client) Peers(ctx context.Context) ([]shair.Device, error) {
+	var peers []shair.Device
+	_, err := c.do(ctx, http.MethodGet, "/peers", nil, &peers)
+	return peers, err
+}
+
+// Requests returns the transfer requests waiting for an answer.
+func (c *Client) Requests(ctx context.Context) ([]Request, error) {
+	var reqs []Request
+	_, err := c.do(ctx, http.MethodGet, "/requests", nil, &reqs)
+	return reqs, err
+}
+
+// Answer accepts or rejects the request id. It fails with an error matching errors.Is(err, ErrNotFound)
+// if the request expired or was answered by another client.
+func (c *Client) Answer(ctx context.Context, id string, accept bool) error {
+	action := "reject"
+	if accept {
+		action = "accept"
+	}
+
+	resp, err := c.do(ctx, http.MethodPost, "/requests/"+id+"/"+action, nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// History returns the transfers recorded by the daemon, see shair.Application.History.
+func (c *Client) History(q shair.HistoryQuery) ([]shair.TransferRecord, error) {
+	params := url.Values{}
+	if q.Peer != "" {
+		params.Set("peer", q.Peer)
+	}
+	if q.Direction != "" {
+		params.Set("direction", string(q.Direction))
+	}
+	if !q.Since.IsZero() {
+		params.Set("since", q.Since.Format(time.RFC3339))
+	}
+	if q.Limit > 0 {
+		params.Set("limit", strconv.Itoa(q.Limit))
+	}
+
+	var records []shair.TransferRecord
+	_, err := c.do(context.Background(), http.MethodGet, "/history?"+params.Encode(), nil, &records)
+	return records, err
+}
+
+// AddPeer asks the daemon to add the peer listening on addr, see shair.PeerAdder.
+func (c *Client) AddPeer(ctx context.Context, addr string) (shair.Device, error) {
+	var peer shair.Device
+	_, err := c.do(ctx, http.MethodPost, "/peers", map[string]string{"addr": addr}, &peer)
+	return peer, err
+}
+
+// Pair has the daemon pair with the device using the same code, see shair.Pairer.
+func (c *Client) Pair(ctx context.Context, code string) (shair.Device, error) {
+	var peer shair.Device
+	_, err := c.do(ctx, http.MethodPost, "/pair", map[string]string{"code": code}, &peer)
+	return peer, err
+}
+
+// SendFiles has the daemon send the files to target, see shair.Application.SendFiles. The paths are
+// resolved here, as the daemon may run from another directory. Canceling ctx cancels the send. The rate of
+// the limiter attached to ctx with shair.WithLimiter caps the send, later changes of it don't.
+func (c *Client) SendFiles(ctx context.Context, target *shair.Device, progressCh chan<- int, filepaths []string) error {
+	paths := make([]string, 0, len(filepaths))
+	for _, p := range filepaths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return shair.NewError(shair.StatFileError, "cannot resolve "+p, err)
+		}
+		paths = append(paths, abs)
+	}
+
+	body := struct {
+		Peer  *shair.Device `json:"peer"`
+		Files []string      `json:"files"`
+		Limit int64         `json:"limit,omitempty"`
+	}{target, paths, shair.LimiterFromContext(ctx).Limit()}
+
+	resp, err := c.do(ctx, http.MethodPost, "/send", body, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev Event
+		if err := dec.Decode(&ev); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return shair.NewError(shair.ConnectionDroppedError, "lost the connection to the daemon", err)
+		}
+
+		switch ev.Type {
+		case EventProgress:
+			progressCh <- ev.Bytes
+		case EventDone:
+			if ev.Error != nil {
+				return ev.Error
+			}
+			close(progressCh)
+			return nil
+		}
+	}
+}
+
+// Start relays the events of the daemon until ctx is done or Stop is called, see shair.Application.Start.
+// The requests accepted by the daemon's own rules aren't relayed. Losing the connection to the daemon
+// is reported as the failure of its services.
+func (c *Client) Start(ctx context.Context, puCh chan<- shair.PeerUpdate, trCh chan<- shair.TransferRequest, evCh chan<- shair.ServiceEvent) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	c.mu.Lock()
+	c.stop = cancel
+	c.mu.Unlock()
+
+	err := c.relay(ctx, puCh, trCh, evCh)
+	if ctx.Err() != nil {
+		return
+	}
+
+	// the daemon went away, along with its services
+	err = shair.NewError(shair.ServiceError, "lost the connection to the daemon", err)
+	c.mu.Lock()
+	services := slices.Clone(c.services)
+	c.mu.Unlock()
+	for _, svc := range services {
+		select {
+		case evCh <- shair.ServiceEvent{Service: svc, State: shair.ServiceStopped, Err: err}:
+		case <-ctx.Done():
+			return
+		}
+	}
+	<-ctx.Done()
+}
+
+// Stop detaches from the daemon, which keeps running.
+func (c *Client) Stop() {
+	c.mu.Lock()
+	stop := c.stop
+	c.mu.Unlock()
+
+	if stop != nil {
+		stop()
+	}
+}
+
+// relay forwards the events of the daemon until the stream ends.
+func (c *Client) relay(ctx context.Context, puCh chan<- shair.PeerUpdate, trCh chan<- shair.TransferRequest, evCh chan<- shair.ServiceEvent) error {
+	resp, err := c.do(ctx, http.MethodGet, "/events", nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	requests := make(map[string]chan<- Event) // relayed requests, receiving their progress and outcome
+	defer func() {
+		for _, ch := range requests {
+			close(ch)
+		}
+	}()
+
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		var ev Event
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil {
+			return err
+		}
+
+		switch ev.Type {
+		case EventPeer:
+			err = send(ctx, puCh, shair.PeerUpdate{Peer: ev.Peer, Status: ev.Status})
+
+		case EventRequest:
+			ch := make(chan Event)
+			requests[ev.ID] = ch
+			err = send(ctx, trCh, c.newRequest(ctx, ev.Request, ch))
+
+		case EventProgress, EventDone:
+			ch, found := requests[ev.ID]
+			if !found {
+				continue
+			}
+			if err := send(ctx, ch, ev); err != nil {
+				return err
+			}
+			if ev.Type == EventDone {
+				delete(requests, ev.ID)
+				close(ch)
+			}
+
+		case EventService:
+			status := ev.Service
+			c.mu.Lock()
+			if !slices.Contains(c.services, status.Service) {
+				c.services = append(c.services, status.Service)
+			}
+			c.mu.Unlock()
+			err = send(ctx, evCh, status.event())
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return io.ErrUnexpectedEOF
+}
+
+// newRequest returns the transfer request standing for req. Its answer is sent to the daemon, and the
+// events received on eventCh are turned into its progress and outcome.
+func (c *Client) newRequest(ctx context.Context, req *Request, eventCh <-chan Event) shair.TransferRequest {
+	acceptCh := make(chan bool, 1)
+	progressCh := make(chan int)
+	doneCh := make(chan error, 1)
+
+	go func() {
+		select {
+		case accept := <-acceptCh:
+			// the request may have been answered by another client, the outcome tells what became of it
+			_ = c.Answer(ctx, req.ID, accept)
+		case <-ctx.Done():
+		}
+	}()
+
+	go func() {
+		defer close(progressCh)
+
+		// progress is added up while the receiver is busy, so that relaying events never waits on it
+		var (
+			n   int
+			out chan<- int
+			err error
+		)
+		for eventCh != nil || n > 0 {
+			if n > 0 {
+				out = progressCh
+			} else {
+				out = nil
+			}
+
+			select {
+			case ev, ok := <-eventCh:
+				switch {
+				case !ok:
+					eventCh = nil
+					err = shair.NewError(shair.ConnectionDroppedError, "lost the connection to the daemon", nil)
+				case ev.Type == EventProgress:
+					n += ev.Bytes
+				case ev.Type == EventDone:
+					eventCh = nil
+					if ev.Error != nil {
+						err = ev.Error
+					}
+				}
+			case out <- n:
+				n = 0
+			case <-ctx.Done():
+				doneCh <- ctx.Err()
+				return
+			}
+		}
+		doneCh <- err
+	}()
+
+	return shair.TransferRequest{
+		ID:           req.Transfer,
+		Sender:       &req.Sender,
+		FilePreviews: req.Files,
+		FreeSpace:    req.FreeSpace,
+		AcceptCh:     acceptCh,
+		ProgressCh:   progressCh,
+		DoneCh:       doneCh,
+	}
+}
+
+func send[T any](ctx context.Context, ch chan<- T, v T) error {
+	select {
+	case ch <- v:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,171 @@
+// this file provides the types of the control api, served by a daemon running an Application over a
+// unix socket, see Server, and used by the ui and the subcommands to attach to the daemon, see Client.
+//
+// The api speaks JSON over HTTP:
+//
+//	GET  /peers                  the discovered peers, as shair.Device
+//	POST /peers                  adds the peer listening on {"addr": "host:port"}
+//	POST /pair                   pairs with the device using the same {"code": "K7MQ-2PXA"}, see remote.NewCode
+//	GET  /requests               the transfer requests waiting for an answer
+//	POST /requests/{id}/accept   accepts a request
+//	POST /requests/{id}/reject   rejects a request
+//	POST /send                   sends {"peer": device, "files": [...], "limit": bytes per second}, streams progress and done events
+//	GET  /events                 streams the events, starting with the current peers, requests and services
+//	GET  /history                the past transfers, filtered by ?peer=&direction=&since=RFC3339&limit=
+//
+// Streams are made of one JSON Event per line. Failures are reported with an Error.
+package control
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/masar3141/shair"
+)
+
+// SocketPath returns the default path of the control socket: in the runtime directory if there is
+// one, in the user config directory otherwise.
+func SocketPath() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "shair.sock")
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		return filepath.Join(dir, "shair", "shair.sock")
+	}
+	return filepath.Join(os.TempDir(), "shair.sock")
+}
+
+// Request is a transfer request received by the daemon.
+type Request struct {
+	ID        string              `json:"id"`
+	Transfer  string              `json:"transfer,omitempty"` // the transfer ID found in the logs and the history
+	Sender    shair.Device        `json:"sender"`
+	Files     []shair.FilePreview `json:"files"`
+	FreeSpace uint64              `json:"freeSpace,omitempty"` // bytes available in the save directory, 0 if unknown
+}
+
+type EventType string
+
+const (
+	EventPeer     EventType = "peer"     // Peer changed, see Status
+	EventRequest  EventType = "request"  // Request waits for an answer
+	EventAccepted EventType = "accepted" // Request was accepted, by a client or by the daemon's rules
+	EventProgress EventType = "progress" // Bytes more were transferred for the request or the send of ID
+	EventDone     EventType = "done"     // the request or the send of ID is over, Error is set on failure
+	EventService  EventType = "service"  // Service changed state
+)
+
+type Event struct {
+	Type EventType `json:"type"`
+	ID   string    `json:"id,omitempty"` // request the event is about, empty for sends
+
+	Peer    *shair.Device    `json:"peer,omitempty"`
+	Status  shair.PeerStatus `json:"status,omitempty"`
+	Request *Request         `json:"request,omitempty"`
+	Bytes   int              `json:"bytes,omitempty"`
+	Service *ServiceStatus   `json:"service,omitempty"`
+	Error   *Error           `json:"error,omitempty"`
+}
+
+// ServiceStatus is a shair.ServiceEvent as sent by the api.
+type ServiceStatus struct {
+	Service shair.SvcType      `json:"service"`
+	State   shair.ServiceState `json:"state"`
+	Port    int                `json:"port,omitempty"`
+	Addrs   []string           `json:"addrs,omitempty"`
+	Error   *Error             `json:"error,omitempty"`
+	Time    time.Time          `json:"time"`
+}
+
+func newServiceStatus(ev shair.ServiceEvent) ServiceStatus {
+	return ServiceStatus{Service: ev.Service, State: ev.State, Port: ev.Port, Addrs: ev.Addrs, Error: newError(ev.Err), Time: ev.Time}
+}
+
+func (s ServiceStatus) event() shair.ServiceEvent {
+	ev := shair.ServiceEvent{Service: s.Service, State: s.State, Port: s.Port, Addrs: s.Addrs, Time: s.Time}
+	if s.Error != nil {
+		ev.Err = s.Error
+	}
+	return ev
+}
+
+// codes of the errors crossing the api, the first one matching an error is sent
+var codes = []struct {
+	name string
+	err  error
+}{
+	{"statFile", shair.StatFileError},
+	{"sendFile", shair.SendFileError},
+	{"connectionDropped", shair.ConnectionDroppedError},
+	{"transferRejected", shair.TransferRejected},
+	{"unexpected", shair.UnexpectedError},
+	{"service", shair.ServiceError},
+	{"invalidHeader", shair.InvalidHeaderError},
+	{"canceled", context.Canceled},
+	{"notFound", ErrNotFound},
+}
+
+// ErrNotFound is returned for the requests that aren't waiting for an answer anymore.
+var ErrNotFound = errors.New("not found")
+
+// Error is an error sent by the api. It keeps the code of the shair errors, the reason of the
+// rejected transfers and the mail of the deposited ones, so that errors.Is and errors.As tell them
+// apart as if the error was local.
+type Error struct {
+	Code      string     `json:"code,omitempty"`
+	Message   string     `json:"message"`
+	Rejection *rejection `json:"rejection,omitempty"`
+	Mail      string     `json:"mail,omitempty"` // see shair.DepositedError
+}
+
+type rejection struct {
+	Reason  shair.RejectReason `json:"reason"`
+	Message string             `json:"message,omitempty"`
+}
+
+func newError(err error) *Error {
+	if err == nil {
+		return nil
+	}
+
+	e := &Error{Message: err.Error()}
+	for _, c := range codes {
+		if errors.Is(err, c.err) {
+			e.Code = c.name
+			break
+		}
+	}
+
+	var r shair.RejectedError
+	if errors.As(err, &r) {
+		e.Rejection = &rejection{Reason: r.Reason, Message: r.Message}
+	}
+	var d shair.DepositedError
+	if errors.As(err, &d) {
+		e.Mail = d.MailID
+	}
+	return e
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() []error {
+	var errs []error
+	for _, c := range codes {
+		if c.name == e.Code {
+			errs = append(errs, c.err)
+		}
+	}
+	if e.Rejection != nil {
+		errs = append(errs, shair.RejectedError{Reason: e.Rejection.Reason, Message: e.Rejection.Message})
+	}
+	if e.Mail != "" {
+		errs = append(errs, shair.DepositedError{MailID: e.Mail})
+	}
+	return errs
+}
@@ -0,0 +1,250 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/masar3141/shair"
+)
+
+var discard = slog.New(slog.DiscardHandler)
+
+func TestErrorRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		is     error
+		reason shair.RejectReason
+		mail   string
+	}{
+		{name: "code", err: shair.NewError(shair.ConnectionDroppedError, "gone", nil), is: shair.ConnectionDroppedError},
+		{name: "canceled", err: context.Canceled, is: context.Canceled},
+		{name: "rejection", err: shair.NewError(shair.TransferRejected, "transfer rejected", shair.RejectedError{Reason: shair.ReasonBusy, Message: "later"}), is: shair.TransferRejected, reason: shair.ReasonBusy},
+		{name: "deposit", err: shair.DepositedError{MailID: "m1"}, mail: "m1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := json.Marshal(newError(tt.err))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var e *Error
+			if err := json.Unmarshal(b, &e); err != nil {
+				t.Fatal(err)
+			}
+
+			if e.Error() != tt.err.Error() {
+				t.Fatalf("got %q, want %q", e.Error(), tt.err.Error())
+			}
+			if tt.is != nil && !errors.Is(e, tt.is) {
+				t.Fatalf("got %+v, want it to be %v", e, tt.is)
+			}
+			var r shair.RejectedError
+			if errors.As(e, &r) != (tt.is == shair.TransferRejected) || r.Reason != tt.reason {
+				t.Fatalf("got the rejection %+v of %+v", r, e)
+			}
+			var d shair.DepositedError
+			if errors.As(e, &d) != (tt.mail != "") || d.MailID != tt.mail {
+				t.Fatalf("got the deposit %+v of %+v", d, e)
+			}
+		})
+	}
+}
+
+// fakeShairer discovers peer, relays the requests of the test and deposits the files it sends.
+type fakeShairer struct {
+	peer     shair.Device
+	requests chan shair.TransferRequest
+	limit    atomic.Int64 // rate of the limiter of the last send
+}
+
+func (f *fakeShairer) Discover(ctx context.Context, peerCh chan<- shair.PeerUpdate) error {
+	peer := f.peer
+	peerCh <- shair.PeerUpdate{Peer: &peer, Status: shair.Discovered}
+	<-ctx.Done()
+	return nil
+}
+
+func (f *fakeShairer) Announce(ctx context.Context, localDeviceName string, saveDir string, transferRequestCh chan<- shair.TransferRequest) error {
+	for {
+		select {
+		case tr := <-f.requests:
+			transferRequestCh <- tr
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (f *fakeShairer) SendFiles(ctx context.Context, target *shair.Device, progressCh chan<- int, filepaths ...string) error {
+	f.limit.Store(shair.LimiterFromContext(ctx).Limit())
+	progressCh <- 5
+	close(progressCh)
+	return shair.DepositedError{MailID: "m1"}
+}
+
+// request is a transfer request as made by a sender, along with the channels the sender plays on.
+type request struct {
+	shair.TransferRequest
+	acceptCh   chan bool
+	progressCh chan int
+	doneCh     chan error
+}
+
+func newRequest(id string, sender shair.Device) request {
+	r := request{acceptCh: make(chan bool, 1), progressCh: make(chan int), doneCh: make(chan error, 1)}
+	r.TransferRequest = shair.TransferRequest{
+		ID:           id,
+		Sender:       &sender,
+		FilePreviews: []shair.FilePreview{{Name: id + ".txt", Size: 5}},
+		AcceptCh:     r.acceptCh,
+		ProgressCh:   r.progressCh,
+		DoneCh:       r.doneCh,
+	}
+	return r
+}
+
+// complete sends the files of an accepted request.
+func (r request) complete(t *testing.T) {
+	t.Helper()
+
+	select {
+	case accept := <-r.acceptCh:
+		if !accept {
+			t.Fatalf("request %s rejected", r.ID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("request %s not answered", r.ID)
+	}
+	r.progressCh <- 5
+	r.doneCh <- nil
+	close(r.progressCh)
+}
+
+func TestServer(t *testing.T) {
+	dir := t.TempDir()
+	peer := shair.Device{ID: "p", Name: "p", DiscoveredOn: shair.Local}
+	f := &fakeShairer{peer: peer, requests: make(chan shair.TransferRequest)}
+	app := shair.NewApplication(discard, "me", dir, map[shair.SvcType]shair.Shairer{shair.Local: f},
+		shair.WithHistory(shair.NewHistory(filepath.Join(dir, "history.jsonl"))))
+	srv := NewServer(discard, app, WithAutoAccept(func(tr shair.TransferRequest) bool { return tr.Sender.Verified }))
+
+	sock := filepath.Join(dir, "shair.sock")
+	ln, err := Listen(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- srv.Serve(ctx, ln) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	if _, err := Listen(sock); err == nil {
+		t.Fatal("listened on the socket of a running daemon")
+	}
+
+	c, err := Dial(ctx, sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	puCh := make(chan shair.PeerUpdate)
+	trCh := make(chan shair.TransferRequest)
+	evCh := make(chan shair.ServiceEvent, 16)
+	go c.Start(ctx, puCh, trCh, evCh)
+	defer c.Stop()
+
+	select {
+	case pu := <-puCh:
+		if pu.Status != shair.Discovered || pu.Peer.ID != peer.ID {
+			t.Fatalf("got %+v, want %s discovered", pu, peer.ID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer not relayed")
+	}
+
+	// the request of an unverified sender waits for a client to answer it
+	asked := newRequest("t1", peer)
+	f.requests <- asked.TransferRequest
+	relayed := <-trCh
+	if relayed.ID != "t1" || relayed.Sender.Name != peer.Name {
+		t.Fatalf("got %+v, want the request t1 of %s", relayed, peer.Name)
+	}
+	reqs, err := c.Requests(ctx)
+	if err != nil || len(reqs) != 1 {
+		t.Fatalf("got %+v, %v, want the request t1 waiting", reqs, err)
+	}
+
+	relayed.AcceptCh <- true
+	asked.complete(t)
+	var got int
+	for n := range relayed.ProgressCh {
+		got += n
+	}
+	if err := <-relayed.DoneCh; err != nil || got != 5 {
+		t.Fatalf("got %d bytes and %v, want 5 bytes received", got, err)
+	}
+
+	if err := c.Answer(ctx, reqs[0].ID, false); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got %v, want the request answered already", err)
+	}
+
+	// the request of a verified sender is accepted by the daemon
+	verified := peer
+	verified.Verified = true
+	auto := newRequest("t2", verified)
+	f.requests <- auto.TransferRequest
+	auto.complete(t)
+
+	p := filepath.Join(dir, "hello.txt")
+	if err := os.WriteFile(p, []byte("hello"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	progressCh := make(chan int)
+	go func() {
+		for range progressCh {
+		}
+	}()
+	err = c.SendFiles(shair.WithLimiter(ctx, shair.NewLimiter(1000)), &peer, progressCh, []string{p})
+	var d shair.DepositedError
+	if !errors.As(err, &d) || d.MailID != "m1" {
+		t.Fatalf("got %v, want the files deposited as m1", err)
+	}
+	if f.limit.Load() != 1000 {
+		t.Fatalf("sent at %d bytes per second at most, want 1000", f.limit.Load())
+	}
+
+	// the outcome of a received transfer is recorded once the daemon is done with it
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		records, err := c.History(shair.HistoryQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %+v, want the 3 transfers recorded", records)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	records, err := c.History(shair.HistoryQuery{Direction: shair.Sent})
+	if err != nil || len(records) != 1 || records[0].Outcome != shair.Deposited {
+		t.Fatalf("got %+v, %v, want the deposited transfer", records, err)
+	}
+}
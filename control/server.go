@@ -0,0 +1,487 @@
+// this file provides the server side of the control api: it runs an Application, keeps track of its
+// peers, requests and services, and lets clients answer the requests and send files.
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/masar3141/shair"
+)
+
+// events a client may lag behind before being disconnected, so that a stuck client never blocks the daemon
+const subscriberBuffer = 1024
+
+// Server serves the control api of an Application.
+type Server struct {
+	logger *slog.Logger
+	app    *shair.Application
+
+	autoAccept func(shair.TransferRequest) bool // accepts requests without asking the clients
+
+	mu       sync.Mutex
+	self     *shair.Device // local device as announced, see shair.Self
+	peers    map[string]shair.Device
+	services map[shair.SvcType]ServiceStatus
+	requests map[string]*pending // requests waiting for an answer
+	subs     map[chan Event]struct{}
+	lastID   int
+}
+
+type pending struct {
+	Request
+	acceptCh chan<- bool
+}
+
+// ServerOption configures optional behaviours of a Server.
+type ServerOption func(*Server)
+
+// WithAutoAccept accepts the transfer requests matching fn without waiting for a client to answer them.
+// The names of the senders aren't authenticated unless shair.Device.Verified is set.
+func WithAutoAccept(fn func(shair.TransferRequest) bool) ServerOption {
+	return func(s *Server) {
+		s.autoAccept = fn
+	}
+}
+
+func NewServer(logger *slog.Logger, app *shair.Application, opts ...ServerOption) *Server {
+	s := &Server{
+		logger:   logger,
+		app:      app,
+		peers:    make(map[string]shair.Device),
+		services: make(map[shair.SvcType]ServiceStatus),
+		requests: make(map[string]*pending),
+		subs:     make(map[chan Event]struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// Listen listens on the unix socket at path, reachable by the current user only. The socket left
+// behind by a daemon that didn't stop cleanly is replaced, but not the one of a running daemon.
+func Listen(path string) (net.Listener, error) {
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("a daemon already listens on %s", path)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// Serve runs the application and serves the api on ln until ctx is done.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	puCh := make(chan shair.PeerUpdate)
+	trCh := make(chan shair.TransferRequest)
+	evCh := make(chan shair.ServiceEvent)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.app.Start(ctx, puCh, trCh, evCh)
+	}()
+
+	go func() {
+		for {
+			select {
+			case pu := <-puCh:
+				s.updatePeer(pu)
+			case tr := <-trCh:
+				s.handleRequest(ctx, tr)
+			case ev := <-evCh:
+				status := newServiceStatus(ev)
+				s.mu.Lock()
+				s.services[ev.Service] = status
+				s.mu.Unlock()
+				s.broadcast(Event{Type: EventService, Service: &status})
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	srv := &http.Server{
+		Handler:     s.handler(),
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	err := srv.Serve(ln)
+	cancel()
+	<-done
+
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /peers", s.listPeers)
+	mux.HandleFunc("POST /peers", s.addPeer)
+	mux.HandleFunc("POST /pair", s.pair)
+	mux.HandleFunc("GET /requests", s.listRequests)
+	mux.HandleFunc("POST /requests/{id}/accept", func(w http.ResponseWriter, r *http.Request) { s.answer(w, r, true) })
+	mux.HandleFunc("POST /requests/{id}/reject", func(w http.ResponseWriter, r *http.Request) { s.answer(w, r, false) })
+	mux.HandleFunc("POST /send", s.send)
+	mux.HandleFunc("GET /events", s.events)
+	mux.HandleFunc("GET /history", s.history)
+	return mux
+}
+
+func (s *Server) updatePeer(pu shair.PeerUpdate) {
+	if pu.Peer == nil {
+		return
+	}
+
+	s.mu.Lock()
+	switch pu.Status {
+	case shair.Self:
+		self := *pu.Peer
+		s.self = &self
+	case shair.Removed:
+		delete(s.peers, pu.Peer.Key())
+	default:
+		s.peers[pu.Peer.Key()] = *pu.Peer
+	}
+	s.mu.Unlock()
+
+	peer := *pu.Peer
+	s.broadcast(Event{Type: EventPeer, Peer: &peer, Status: pu.Status})
+}
+
+// handleRequest accepts tr if it matches the auto accept rules, or holds it until a client answers it.
+// The progress and outcome of the transfer are reported to the clients.
+func (s *Server) handleRequest(ctx context.Context, tr shair.TransferRequest) {
+	s.mu.Lock()
+	s.lastID++
+	req := Request{ID: strconv.Itoa(s.lastID), Transfer: tr.ID, Sender: *tr.Sender, Files: tr.FilePreviews, FreeSpace: tr.FreeSpace}
+	auto := s.autoAccept != nil && s.autoAccept(tr)
+	if !auto {
+		s.requests[req.ID] = &pending{Request: req, acceptCh: tr.AcceptCh}
+	}
+	s.mu.Unlock()
+
+	if auto {
+		s.logger.InfoContext(shair.WithTransferID(ctx, tr.ID), "transfer request accepted automatically", "id", req.ID, "sender", req.Sender.Name, "senderId", req.Sender.ID, "verified", req.Sender.Verified)
+		tr.AcceptCh <- true
+		s.broadcast(Event{Type: EventAccepted, ID: req.ID, Request: &req})
+	} else {
+		s.broadcast(Event{Type: EventRequest, ID: req.ID, Request: &req})
+	}
+
+	go func() {
+		// the progress channel is closed once the request is over, answered or not
+		for n := range tr.ProgressCh {
+			s.broadcast(Event{Type: EventProgress, ID: req.ID, Bytes: n})
+		}
+
+		var err error
+		select {
+		case err = <-tr.DoneCh:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+
+		s.mu.Lock()
+		delete(s.requests, req.ID)
+		s.mu.Unlock()
+
+		// the failure was logged by the shairer
+		s.broadcast(Event{Type: EventDone, ID: req.ID, Error: newError(err)})
+	}()
+}
+
+// subscribe returns the channel receiving the events, along with the events describing the current state.
+func (s *Server) subscribe() (chan Event, []Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var snapshot []Event
+	for _, svc := range slices.Sorted(maps.Keys(s.services)) {
+		status := s.services[svc]
+		snapshot = append(snapshot, Event{Type: EventService, Service: &status})
+	}
+	if s.self != nil {
+		self := *s.self
+		snapshot = append(snapshot, Event{Type: EventPeer, Peer: &self, Status: shair.Self})
+	}
+	for _, p := range s.peers {
+		snapshot = append(snapshot, Event{Type: EventPeer, Peer: &p, Status: shair.Discovered})
+	}
+	for _, p := range s.requests {
+		snapshot = append(snapshot, Event{Type: EventRequest, ID: p.ID, Request: &p.Request})
+	}
+
+	ch := make(chan Event, subscriberBuffer)
+	s.subs[ch] = struct{}{}
+	return ch, snapshot
+}
+
+func (s *Server) unsubscribe(ch chan Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.subs[ch]; found {
+		delete(s.subs, ch)
+		close(ch)
+	}
+}
+
+// broadcast sends ev to the clients, the ones lagging too far behind are disconnected.
+func (s *Server) broadcast(ev Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for ch := range s.subs {
+		select {
+		case ch <- ev:
+		default:
+			s.logger.Warn("disconnecting a client lagging behind")
+			delete(s.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func (s *Server) listPeers(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	peers := slices.SortedFunc(maps.Values(s.peers), func(a, b shair.Device) int { return strings.Compare(a.Name, b.Name) })
+	s.mu.Unlock()
+
+	if peers == nil {
+		peers = []shair.Device{}
+	}
+	writeJSON(w, http.StatusOK, peers)
+}
+
+func (s *Server) addPeer(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Addr string `json:"addr"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	peer, err := s.app.AddPeer(r.Context(), body.Addr)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, peer)
+}
+
+func (s *Server) pair(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	peer, err := s.app.Pair(r.Context(), body.Code)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, peer)
+}
+
+func (s *Server) listRequests(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	reqs := make([]Request, 0, len(s.requests))
+	for _, p := range s.requests {
+		reqs = append(reqs, p.Request)
+	}
+	s.mu.Unlock()
+
+	slices.SortFunc(reqs, func(a, b Request) int { return cmpID(a.ID, b.ID) })
+	writeJSON(w, http.StatusOK, reqs)
+}
+
+func (s *Server) answer(w http.ResponseWriter, r *http.Request, accept bool) {
+	id := r.PathValue("id")
+
+	// a request is answered once, by the first client to do so
+	s.mu.Lock()
+	p, found := s.requests[id]
+	delete(s.requests, id)
+	s.mu.Unlock()
+
+	if !found {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no request %s waiting for an answer: %w", id, ErrNotFound))
+		return
+	}
+
+	p.acceptCh <- accept
+	if accept {
+		s.broadcast(Event{Type: EventAccepted, ID: id, Request: &p.Request})
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// send sends the files and streams the progress, the send is canceled when the client goes away.
+// Its bandwidth is capped by the limit of the body, if any, on top of the global one.
+func (s *Server) send(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Peer  shair.Device `json:"peer"`
+		Files []string     `json:"files"`
+		Limit int64        `json:"limit"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx := r.Context()
+	if body.Limit > 0 {
+		ctx = shair.WithLimiter(ctx, shair.NewLimiter(body.Limit))
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+
+	progressCh := make(chan int)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.app.SendFiles(ctx, &body.Peer, progressCh, body.Files)
+	}()
+
+	for {
+		select {
+		case n, ok := <-progressCh:
+			if !ok {
+				// closed once all the files are sent
+				progressCh = nil
+				continue
+			}
+			_ = enc.Encode(Event{Type: EventProgress, Bytes: n})
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case err := <-errCh:
+			// the failure was logged by the application
+			_ = enc.Encode(Event{Type: EventDone, Error: newError(err)})
+			return
+		}
+	}
+}
+
+func (s *Server) events(w http.ResponseWriter, r *http.Request) {
+	ch, snapshot := s.subscribe()
+	defer s.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+
+	for _, ev := range snapshot {
+		if enc.Encode(ev) != nil {
+			return
+		}
+	}
+
+	for {
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		select {
+		case ev, ok := <-ch:
+			if !ok || enc.Encode(ev) != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *Server) history(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q := shair.HistoryQuery{Peer: params.Get("peer"), Direction: shair.Direction(params.Get("direction"))}
+
+	var err error
+	if v := params.Get("since"); v != "" {
+		if q.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	records, err := s.app.History(q)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if records == nil {
+		records = []shair.TransferRecord{}
+	}
+	writeJSON(w, http.StatusOK, records)
+}
+
+// cmpID orders the request IDs, which are increasing numbers.
+func cmpID(a, b string) int {
+	if len(a) != len(b) {
+		return len(a) - len(b)
+	}
+	return strings.Compare(a, b)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, newError(err))
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package shair
+
+import "errors"
+
+// FreeSpace is not supported on this platform, transfers are accepted without checking the free space.
+func FreeSpace(dir string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
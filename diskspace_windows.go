@@ -0,0 +1,20 @@
+//go:build windows
+
+package shair
+
+import "golang.org/x/sys/windows"
+
+// FreeSpace returns the number of bytes available to the current user on the volume holding dir.
+func FreeSpace(dir string) (uint64, error) {
+	p, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var free uint64
+	if err := windows.GetDiskFreeSpaceEx(p, &free, nil, nil); err != nil {
+		return 0, err
+	}
+
+	return free, nil
+}
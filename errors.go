@@ -3,6 +3,7 @@ package shair
 import (
 	"errors"
 	"fmt"
+	"time"
 )
 
 var (
@@ -11,6 +12,8 @@ var (
 	ConnectionDroppedError = errors.New("Tcp connexion dropped")
 	TransferRejected       = errors.New("Target rejected the file transfer")
 	UnexpectedError        = errors.New("Something unexpected happened")
+	ServiceError           = errors.New("Service failed")
+	InvalidHeaderError     = errors.New("Received an invalid header")
 )
 
 type Error struct {
@@ -27,6 +30,16 @@ func (e Error) Unwrap() error {
 	return e.Code
 }
 
+// Is lets errors.Is match the underlying error too, eg context.Canceled, while Unwrap matches the code.
+func (e Error) Is(target error) bool {
+	return e.UnderlyingErr != nil && errors.Is(e.UnderlyingErr, target)
+}
+
+// As lets errors.As reach the underlying error, eg a TimeoutError.
+func (e Error) As(target any) bool {
+	return e.UnderlyingErr != nil && errors.As(e.UnderlyingErr, target)
+}
+
 func NewError(code error, msg string, err error) error {
 	return Error{
 		Code:          code,
@@ -34,3 +47,52 @@ func NewError(code error, msg string, err error) error {
 		UnderlyingErr: err,
 	}
 }
+
+// RejectedError is the underlying error of a TransferRejected error. It carries the reason
+// sent by the receiver and an optional human readable message.
+type RejectedError struct {
+	Reason  RejectReason
+	Message string
+}
+
+func (e RejectedError) Error() string {
+	if e.Message == "" {
+		return e.Reason.String()
+	}
+	return fmt.Sprintf("%s: %s", e.Reason, e.Message)
+}
+
+// Phase identifies a step of the transfer protocol.
+type Phase string
+
+const (
+	PhaseHandshake Phase = "handshake" // sending and reading the header
+	PhaseAccept    Phase = "accept"    // waiting for the receiver's decision
+	PhaseTransfer  Phase = "transfer"  // streaming the files
+)
+
+// TimeoutError is the underlying error of a ConnectionDroppedError raised when one of the
+// protocol deadlines expires. It tells in which phase the connection was dropped.
+type TimeoutError struct {
+	Phase    Phase
+	Deadline string        // name of the deadline that expired: handshake, accept, idle or total
+	After    time.Duration // value of the expired deadline
+}
+
+func (e TimeoutError) Error() string {
+	return fmt.Sprintf("%s deadline of %s expired during %s phase", e.Deadline, e.After, e.Phase)
+}
+
+func (e TimeoutError) Timeout() bool {
+	return true
+}
+
+// DepositedError is returned by SendFiles when the target was offline and the files were left for it,
+// eg in the mailbox of a relay. They aren't transferred yet: the outcome comes later, see Application.Settle.
+type DepositedError struct {
+	MailID string // refers to the files left, until the receipt tells what became of them
+}
+
+func (e DepositedError) Error() string {
+	return "the target is offline, the files wait for it in the mailbox"
+}
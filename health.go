@@ -0,0 +1,94 @@
+// this file provides the events telling the ui how the services are doing. Services report their health
+// through the context the Application runs them with, see ReportRunning and ReportDegraded.
+package shair
+
+import (
+	"context"
+	"time"
+)
+
+type ServiceState int
+
+const (
+	ServiceStarting ServiceState = iota // the service was started but isn't serving yet
+	ServiceRunning                      // the service is up, see ServiceEvent.Port and ServiceEvent.Addrs
+	ServiceDegraded                     // part of the service failed, the rest keeps running
+	ServiceStopped                      // the service is stopped, on failure or on purpose
+)
+
+func (s ServiceState) String() string {
+	switch s {
+	case ServiceStarting:
+		return "starting"
+	case ServiceRunning:
+		return "running"
+	case ServiceDegraded:
+		return "degraded"
+	case ServiceStopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+// ServiceEvent reports a change of state of a service run by the Application.
+type ServiceEvent struct {
+	Service SvcType
+	State   ServiceState
+	Port    int      // Running: port the service listens on, 0 if it doesn't listen
+	Addrs   []string // Running: addresses the service is reachable on
+	Err     error    // Degraded: the failure. Stopped: the failure that stopped it, nil if stopped on purpose
+	Time    time.Time
+}
+
+// RestartPolicy tells the Application whether to restart a service that failed.
+type RestartPolicy struct {
+	MaxRestarts int           // restarts in a row before giving up, negative to never give up
+	Backoff     time.Duration // delay before the first restart, doubled for each restart in a row
+	MaxBackoff  time.Duration // cap of the delay, none if 0
+
+	// StopOnFailure stops the whole service when part of it fails, even when it isn't restarted,
+	// rather than leaving the rest of it running degraded. It is implied by restarts.
+	StopOnFailure bool
+}
+
+// NoRestart leaves the failing services stopped, or degraded if only part of them failed.
+var NoRestart = RestartPolicy{}
+
+// delay returns how long to wait before the nth restart in a row, starting at 1.
+func (p RestartPolicy) delay(n int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < n; i++ {
+		d *= 2
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			return p.MaxBackoff
+		}
+	}
+	return d
+}
+
+type healthCtxKey struct{}
+
+type healthReporter struct {
+	running  func(port int, addrs []string)
+	degraded func(err error)
+}
+
+func withHealthReporter(ctx context.Context, r healthReporter) context.Context {
+	return context.WithValue(ctx, healthCtxKey{}, r)
+}
+
+// ReportRunning tells the Application running the service behind ctx that it is up, listening on port
+// and reachable on addrs. It does nothing when the service isn't run by an Application.
+func ReportRunning(ctx context.Context, port int, addrs []string) {
+	if r, ok := ctx.Value(healthCtxKey{}).(healthReporter); ok {
+		r.running(port, addrs)
+	}
+}
+
+// ReportDegraded tells the Application running the service behind ctx that part of it failed while the
+// rest keeps running, eg the mDNS responder while the TCP listener still receives files.
+func ReportDegraded(ctx context.Context, err error) {
+	if r, ok := ctx.Value(healthCtxKey{}).(healthReporter); ok {
+		r.degraded(err)
+	}
+}
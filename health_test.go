@@ -0,0 +1,159 @@
+package shair
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRestartPolicyDelay(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy RestartPolicy
+		n      int
+		want   time.Duration
+	}{
+		{name: "first restart", policy: RestartPolicy{Backoff: time.Second}, n: 1, want: time.Second},
+		{name: "doubled", policy: RestartPolicy{Backoff: time.Second}, n: 4, want: 8 * time.Second},
+		{name: "uncapped", policy: RestartPolicy{Backoff: time.Second}, n: 11, want: 1024 * time.Second},
+		{name: "under the cap", policy: RestartPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second}, n: 3, want: 4 * time.Second},
+		{name: "capped", policy: RestartPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second}, n: 4, want: 5 * time.Second},
+		{name: "capped for good", policy: RestartPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second}, n: 100, want: 5 * time.Second},
+		{name: "no backoff", policy: RestartPolicy{}, n: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.delay(tt.n); got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// failingShairer reports running, then its discovery fails after a while. Its announcement runs until
+// its context is done.
+type failingShairer struct {
+	Shairer
+
+	after time.Duration
+	runs  atomic.Int32
+}
+
+func (f *failingShairer) Discover(ctx context.Context, peerCh chan<- PeerUpdate) error {
+	f.runs.Add(1)
+	ReportRunning(ctx, 0, nil)
+
+	select {
+	case <-time.After(f.after):
+		return errors.New("discovery failed")
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+func (f *failingShairer) Announce(ctx context.Context, localDeviceName string, saveDir string, transferRequestCh chan<- TransferRequest) error {
+	<-ctx.Done()
+	return nil
+}
+
+// states describes the events, a failure is marked with a !.
+func states(evs []ServiceEvent) string {
+	s := make([]string, len(evs))
+	for i, ev := range evs {
+		s[i] = ev.State.String()
+		if ev.Err != nil {
+			s[i] += "!"
+		}
+	}
+	return strings.Join(s, " ")
+}
+
+func TestApplicationSupervise(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy RestartPolicy
+		runs   int32
+		want   string // events until the service is stopped
+	}{
+		{name: "no restart", policy: NoRestart, runs: 1, want: "starting running degraded! stopped"},
+		{name: "stop on failure", policy: RestartPolicy{StopOnFailure: true}, runs: 1, want: "starting running stopped!"},
+		{
+			name:   "restarts",
+			policy: RestartPolicy{MaxRestarts: 2, Backoff: time.Millisecond},
+			runs:   3,
+			want:   "starting running stopped! starting running stopped! starting running stopped!",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &failingShairer{after: 10 * time.Millisecond}
+			a := NewApplication(discard, "me", t.TempDir(), map[SvcType]Shairer{Local: f}, WithRestartPolicy(tt.policy))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			evCh := make(chan ServiceEvent, 32)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				a.Start(ctx, make(chan PeerUpdate), make(chan TransferRequest), evCh)
+			}()
+
+			// the service settles once no event comes for a while
+			var evs []ServiceEvent
+			settle := func() {
+				for {
+					select {
+					case ev := <-evCh:
+						evs = append(evs, ev)
+					case <-time.After(200 * time.Millisecond):
+						return
+					}
+				}
+			}
+			settle()
+			if err := a.StopService(Local); err != nil {
+				t.Fatal(err)
+			}
+			settle()
+			cancel()
+			<-done
+
+			if got := states(evs); got != tt.want || f.runs.Load() != tt.runs {
+				t.Fatalf("got %q in %d runs, want %q in %d", got, f.runs.Load(), tt.want, tt.runs)
+			}
+		})
+	}
+}
+
+func TestApplicationSuperviseHealthy(t *testing.T) {
+	healthy := healthyAfter
+	defer func() { healthyAfter = healthy }()
+	healthyAfter = 10 * time.Millisecond
+
+	// the service runs long enough to be healthy before each failure, its restarts are forgotten
+	f := &failingShairer{after: 30 * time.Millisecond}
+	a := NewApplication(discard, "me", t.TempDir(), map[SvcType]Shairer{Local: f}, WithRestartPolicy(RestartPolicy{MaxRestarts: 1, Backoff: time.Millisecond}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.Start(ctx, make(chan PeerUpdate), make(chan TransferRequest), nil)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for f.runs.Load() < 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d runs, want the service restarted more than once", f.runs.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
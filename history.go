@@ -0,0 +1,392 @@
+// this file provides the history of the transfers, kept in an append-only file of one JSON record per
+// line so that several processes, eg the daemon and a subcommand, can record to the same history.
+package shair
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+type Direction string
+
+const (
+	Sent     Direction = "sent"
+	Received Direction = "received"
+)
+
+type Outcome string
+
+const (
+	Completed Outcome = "completed" // all the files were transferred
+	Declined  Outcome = "declined"  // the user, or the receiver, didn't accept the files
+	Expired   Outcome = "expired"   // the request wasn't answered in time
+	Canceled  Outcome = "canceled"  // the transfer was canceled on this side
+	Failed    Outcome = "failed"    // the transfer started but didn't complete
+	Deposited Outcome = "deposited" // the target was offline, the files wait for it, see Application.Settle
+)
+
+// TransferRecord describes a transfer once it is over.
+type TransferRecord struct {
+	ID         string        `json:"id,omitempty"` // the transfer ID found in the logs
+	Time       time.Time     `json:"time"`         // when the transfer was requested
+	Direction  Direction     `json:"direction"`
+	Service    SvcType       `json:"service"`
+	PeerID     string        `json:"peerId,omitempty"`
+	PeerName   string        `json:"peerName"`
+	Files      []FileRecord  `json:"files"`
+	Bytes      uint64        `json:"bytes"`      // bytes actually transferred
+	Duration   time.Duration `json:"duration"`   // from the first byte to the last, 0 if none was transferred
+	Throughput float64       `json:"throughput"` // in bytes per second, 0 if nothing was transferred
+	Outcome    Outcome       `json:"outcome"`
+	Error      string        `json:"error,omitempty"`  // why the transfer didn't complete
+	MailID     string        `json:"mailId,omitempty"` // the files left for an offline target, see DepositedError
+}
+
+type FileRecord struct {
+	Name   string `json:"name"`
+	Size   uint64 `json:"size"`
+	SHA256 string `json:"sha256,omitempty"` // hex digest, only for the files of the completed transfers
+}
+
+// Size returns the total size of the files.
+func (r TransferRecord) Size() uint64 {
+	var total uint64
+	for _, f := range r.Files {
+		total += f.Size
+	}
+	return total
+}
+
+// HistoryQuery selects records of a History. Its zero value selects all of them.
+type HistoryQuery struct {
+	Peer      string    // name or ID of the peer, any if empty
+	Direction Direction // any if empty
+	Since     time.Time // records before it are left out, none if zero
+	Limit     int       // most recent records returned at most, no limit if 0
+}
+
+func (q HistoryQuery) matches(r TransferRecord) bool {
+	return (q.Peer == "" || q.Peer == r.PeerName || q.Peer == r.PeerID) &&
+		(q.Direction == "" || q.Direction == r.Direction) &&
+		!r.Time.Before(q.Since)
+}
+
+// History is the history of the transfers, stored in a JSONL file.
+type History struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewHistory(path string) *History {
+	return &History{path: path}
+}
+
+// HistoryPath returns the default path of the history, in the user config directory.
+func HistoryPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "shair", "history.jsonl"), nil
+}
+
+// Append records r at the end of the history, creating the file if needed.
+func (h *History) Append(r TransferRecord) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(h.path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+
+	// a single write keeps the records of concurrent writers whole
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Query returns the records selected by q, the most recent first. A record supersedes the earlier ones
+// with the same ID, see Application.Settle. A missing history holds no record, and the lines that can't
+// be decoded, eg cut by a crash, are skipped.
+func (h *History) Query(q HistoryQuery) ([]TransferRecord, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	f, err := os.Open(h.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var all []TransferRecord
+	byID := make(map[string]int) // index of the records in all
+	rd := bufio.NewReader(f)
+	for {
+		line, err := rd.ReadBytes('\n')
+		var r TransferRecord
+		if len(line) != 0 && json.Unmarshal(line, &r) == nil {
+			// a settled transfer keeps its place, it was requested at the same time
+			if i, found := byID[r.ID]; found && r.ID != "" {
+				all[i] = r
+			} else {
+				byID[r.ID] = len(all)
+				all = append(all, r)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var records []TransferRecord
+	for _, r := range all {
+		if q.matches(r) {
+			records = append(records, r)
+		}
+	}
+
+	slices.Reverse(records)
+	if q.Limit > 0 && len(records) > q.Limit {
+		records = records[:q.Limit]
+	}
+	return records, nil
+}
+
+// transfer keeps track of a transfer until it is over and recorded.
+type transfer struct {
+	record TransferRecord
+	paths  []string // files hashed once the transfer completes
+
+	first, last time.Time // first and last bytes transferred
+}
+
+func newTransfer(id string, dir Direction, svc SvcType, peer *Device) *transfer {
+	return &transfer{record: TransferRecord{
+		ID:        id,
+		Time:      time.Now(),
+		Direction: dir,
+		Service:   svc,
+		PeerID:    peer.ID,
+		PeerName:  peer.Name,
+	}}
+}
+
+// progress accounts for n more bytes transferred.
+func (t *transfer) progress(n int) {
+	t.last = time.Now()
+	if t.first.IsZero() {
+		t.first = t.last
+	}
+	t.record.Bytes += uint64(n)
+}
+
+// end completes the record with the outcome of the transfer, err being nil on success.
+func (t *transfer) end(outcome Outcome, err error) TransferRecord {
+	r := t.record
+	r.Duration = t.last.Sub(t.first)
+	if r.Duration > 0 {
+		r.Throughput = float64(r.Bytes) / r.Duration.Seconds()
+	}
+
+	r.Outcome = outcome
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	if outcome == Completed {
+		for i, p := range t.paths {
+			sum, err := hashFile(p)
+			if err == nil {
+				r.Files[i].SHA256 = sum
+			}
+		}
+	}
+	return r
+}
+
+// outcome classifies the error a transfer ended with.
+func outcome(err error) Outcome {
+	var rejection RejectedError
+	var timeout TimeoutError
+	var deposited DepositedError
+	switch {
+	case err == nil:
+		return Completed
+	case errors.As(err, &deposited):
+		return Deposited
+	case errors.As(err, &rejection):
+		if rejection.Reason == ReasonTimeout {
+			return Expired
+		}
+		return Declined
+	case errors.As(err, &timeout) && timeout.Phase == PhaseAccept:
+		return Expired
+	case errors.Is(err, context.Canceled):
+		return Canceled
+	}
+	return Failed
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// History returns the records of the transfers selected by q, the most recent first.
+func (a *Application) History(q HistoryQuery) ([]TransferRecord, error) {
+	if a.history == nil {
+		return nil, NewError(UnexpectedError, "the history isn't kept", nil)
+	}
+	return a.history.Query(q)
+}
+
+// record ends t and appends it to the history. The files are hashed in the background, Stop waits
+// for the record to be written.
+func (a *Application) record(t *transfer, outcome Outcome, err error) {
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		if err := a.history.Append(t.end(outcome, err)); err != nil {
+			a.logger.Warn("cannot record the transfer", "transfer", t.record.ID, "err", err)
+		}
+	}()
+}
+
+// Settle records what became of the files left for an offline target, told by the receipt of the mail:
+// the deposited transfer is recorded again with its outcome and reason, if any. It returns the settled record.
+func (a *Application) Settle(mailID string, outcome Outcome, reason string) (TransferRecord, error) {
+	if a.history == nil {
+		return TransferRecord{}, NewError(UnexpectedError, "the history isn't kept", nil)
+	}
+
+	records, err := a.history.Query(HistoryQuery{Direction: Sent})
+	if err != nil {
+		return TransferRecord{}, err
+	}
+	i := slices.IndexFunc(records, func(r TransferRecord) bool { return r.MailID == mailID && r.Outcome == Deposited })
+	if i < 0 {
+		return TransferRecord{}, NewError(UnexpectedError, fmt.Sprintf("no transfer waits for the receipt of mail %s", mailID), nil)
+	}
+
+	r := records[i]
+	r.Outcome, r.Error = outcome, reason
+	return r, a.history.Append(r)
+}
+
+// requests returns the channel the transfer requests of svc are sent on. When the history is kept,
+// the requests are relayed to the ui through watch, to record them.
+func (a *Application) requests(ctx context.Context, svc SvcType) chan<- TransferRequest {
+	if a.history == nil {
+		return a.trCh
+	}
+
+	reqCh := make(chan TransferRequest)
+	go func() {
+		for {
+			select {
+			case tr := <-reqCh:
+				select {
+				case a.trCh <- a.watch(svc, tr):
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return reqCh
+}
+
+// watch returns a copy of tr whose answer, progress and outcome go through us to be recorded.
+func (a *Application) watch(svc SvcType, tr TransferRequest) TransferRequest {
+	t := newTransfer(tr.ID, Received, svc, tr.Sender)
+	for _, fp := range tr.FilePreviews {
+		t.record.Files = append(t.record.Files, FileRecord{Name: fp.Name, Size: fp.Size})
+		t.paths = append(t.paths, filepath.Join(a.saveDir, fp.Name))
+	}
+
+	acceptCh := make(chan bool, 1)
+	progressCh := make(chan int)
+	doneCh := make(chan error, 1)
+
+	go func() {
+		// the progress channel is closed once the request is over, answered or not
+		answer, in, accepted := acceptCh, tr.ProgressCh, false
+		for in != nil {
+			select {
+			case accept := <-answer:
+				tr.AcceptCh <- accept
+				answer, accepted = nil, accept
+			case n, ok := <-in:
+				if !ok {
+					in = nil
+					continue
+				}
+				t.progress(n)
+				progressCh <- n
+			}
+		}
+
+		err := <-tr.DoneCh
+		doneCh <- err
+		close(progressCh)
+
+		switch {
+		case err != nil:
+			a.record(t, outcome(err), err)
+		case accepted:
+			a.record(t, Completed, nil)
+		default:
+			a.record(t, Declined, nil)
+		}
+	}()
+
+	return TransferRequest{
+		ID:           tr.ID,
+		Sender:       tr.Sender,
+		FilePreviews: tr.FilePreviews,
+		FreeSpace:    tr.FreeSpace,
+		AcceptCh:     acceptCh,
+		ProgressCh:   progressCh,
+		DoneCh:       doneCh,
+	}
+}
@@ -0,0 +1,157 @@
+package shair
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// depositor leaves the files in a mailbox, as the remote shairer does for an offline target.
+type depositor struct {
+	Shairer
+}
+
+func (depositor) SendFiles(ctx context.Context, target *Device, progressCh chan<- int, filepaths ...string) error {
+	progressCh <- 5
+	close(progressCh)
+	return DepositedError{MailID: "m1"}
+}
+
+func TestApplicationSettle(t *testing.T) {
+	dir := t.TempDir()
+	h := NewHistory(filepath.Join(dir, "history.jsonl"))
+	a := NewApplication(discard, "me", dir, nil, WithHistory(h))
+
+	p := filepath.Join(dir, "hello.txt")
+	if err := os.WriteFile(p, []byte("hello"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	progressCh := make(chan int)
+	go func() {
+		for range progressCh {
+		}
+	}()
+	peer := &Device{ID: "b", Name: "b", DiscoveredOn: Remote}
+	err := a.sendFiles(context.Background(), depositor{}, peer, "t1", progressCh, []string{p})
+	if !errors.As(err, &DepositedError{}) {
+		t.Fatalf("got %v, want the files deposited", err)
+	}
+	a.wg.Wait()
+
+	records, err := h.Query(HistoryQuery{})
+	if err != nil || len(records) != 1 {
+		t.Fatalf("got %v, %v, want the deposited transfer", records, err)
+	}
+	if r := records[0]; r.Outcome != Deposited || r.MailID != "m1" || r.Error != "" || r.Bytes != 5 {
+		t.Fatalf("got %+v, want mail m1 deposited", r)
+	}
+
+	if _, err := a.Settle("m2", Completed, ""); err == nil {
+		t.Fatal("settled a mail never deposited")
+	}
+
+	settled, err := a.Settle("m1", Declined, "not now")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settled.ID != "t1" || settled.Outcome != Declined || settled.Error != "not now" {
+		t.Fatalf("got %+v, want t1 declined", settled)
+	}
+
+	// the settled record replaces the deposited one
+	records, err = h.Query(HistoryQuery{})
+	if err != nil || len(records) != 1 || records[0].Outcome != Declined || records[0].Error != "not now" {
+		t.Fatalf("got %+v, %v, want the settled record only", records, err)
+	}
+
+	if _, err := a.Settle("m1", Completed, ""); err == nil {
+		t.Fatal("settled a transfer twice")
+	}
+}
+
+func TestHistoryQuery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	h := NewHistory(path)
+
+	if records, err := h.Query(HistoryQuery{}); err != nil || records != nil {
+		t.Fatalf("got %v, %v, want a missing history empty", records, err)
+	}
+
+	t0 := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	at := func(i int) time.Time { return t0.Add(time.Duration(i) * time.Hour) }
+	appendLine := func(line string) {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, r := range []TransferRecord{
+		{ID: "t1", Time: at(0), Direction: Sent, PeerID: "pa", PeerName: "a", Outcome: Completed},
+		{ID: "t2", Time: at(1), Direction: Received, PeerID: "pb", PeerName: "b", Outcome: Declined},
+		// records without an ID, eg written by older versions, are all kept
+		{Time: at(2), Direction: Received, PeerName: "c1", Outcome: Completed},
+		{Time: at(3), Direction: Received, PeerName: "c2", Outcome: Completed},
+		{ID: "t3", Time: at(4), Direction: Sent, PeerID: "pa", PeerName: "a", Outcome: Deposited, MailID: "m1"},
+	} {
+		if err := h.Append(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	appendLine("not json\n")
+	if err := h.Append(TransferRecord{ID: "t3", Time: at(4), Direction: Sent, PeerID: "pa", PeerName: "a", Outcome: Completed, MailID: "m1"}); err != nil {
+		t.Fatal(err)
+	}
+	// cut by a crash
+	appendLine(`{"id":"t4","time":`)
+
+	tests := []struct {
+		name string
+		q    HistoryQuery
+		want []string // IDs of the records, or the peer names of those without one
+	}{
+		{name: "all", want: []string{"t3", "c2", "c1", "t2", "t1"}},
+		{name: "peer by name", q: HistoryQuery{Peer: "a"}, want: []string{"t3", "t1"}},
+		{name: "peer by ID", q: HistoryQuery{Peer: "pb"}, want: []string{"t2"}},
+		{name: "unknown peer", q: HistoryQuery{Peer: "z"}},
+		{name: "direction", q: HistoryQuery{Direction: Received}, want: []string{"c2", "c1", "t2"}},
+		{name: "since", q: HistoryQuery{Since: at(1)}, want: []string{"t3", "c2", "c1", "t2"}},
+		{name: "limit", q: HistoryQuery{Limit: 2}, want: []string{"t3", "c2"}},
+		{name: "filtered then limited", q: HistoryQuery{Direction: Sent, Limit: 1}, want: []string{"t3"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := h.Query(tt.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, r := range records {
+				if r.ID != "" {
+					got = append(got, r.ID)
+				} else {
+					got = append(got, r.PeerName)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// the settled record replaces the deposited one
+	records, err := h.Query(HistoryQuery{Peer: "a", Limit: 1})
+	if err != nil || len(records) != 1 || records[0].Outcome != Completed {
+		t.Fatalf("got %+v, %v, want t3 completed", records, err)
+	}
+}
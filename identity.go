@@ -0,0 +1,92 @@
+// this file provides what a device needs to describe itself to its peers
+package shair
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// ProtocolVersion is the version of the transfer protocol implemented by this build.
+const ProtocolVersion = 1
+
+// Version of the application, set at build time with
+// -ldflags "-X github.com/masar3141/shair.Version=v1.2.3"
+var Version = "dev"
+
+// optional protocol features a device can advertise
+const (
+	CapRejectReasons = "reject-reasons" // rejections carry a reason and a message
+	CapQuota         = "quota"          // the receiver enforces quotas
+	CapPing          = "ping"           // the peer answers reachability probes
+)
+
+// Capabilities lists the optional features implemented by this build.
+var Capabilities = []string{CapRejectReasons, CapQuota, CapPing}
+
+type DeviceType string
+
+const (
+	Desktop DeviceType = "desktop"
+	Laptop  DeviceType = "laptop"
+	Server  DeviceType = "server"
+)
+
+// DetectDeviceType makes a best effort guess of the kind of machine we run on:
+// a machine with a battery is a laptop, a linux machine without a display is a server.
+func DetectDeviceType() DeviceType {
+	if runtime.GOOS != "linux" {
+		return Desktop
+	}
+
+	if bats, _ := filepath.Glob("/sys/class/power_supply/BAT*"); len(bats) > 0 {
+		return Laptop
+	}
+
+	if os.Getenv("DISPLAY") == "" && os.Getenv("WAYLAND_DISPLAY") == "" {
+		return Server
+	}
+
+	return Desktop
+}
+
+// NewDeviceID returns a random device identifier.
+func NewDeviceID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// LoadDeviceID returns the identifier of this device, stored in the user config directory.
+// It is generated on first use so that peers see the same identifier across restarts.
+func LoadDeviceID() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	p := filepath.Join(dir, "shair", "device-id")
+
+	b, err := os.ReadFile(p)
+	if err == nil && len(strings.TrimSpace(string(b))) != 0 {
+		return strings.TrimSpace(string(b)), nil
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+
+	id := NewDeviceID()
+	if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(p, []byte(id+"\n"), 0o600); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
@@ -0,0 +1,125 @@
+package local
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/masar3141/shair"
+)
+
+// delay between two connection attempts when racing the addresses of a peer, as recommended by RFC 8305
+const raceDelay = 250 * time.Millisecond
+
+// ipAddrs converts the IPs advertised on iface. Link-local IPv6 addresses are only reachable
+// through the interface they were found on, they get it as zone.
+func ipAddrs(ips []net.IP, iface string) []net.IPAddr {
+	addrs := make([]net.IPAddr, 0, len(ips))
+	for _, ip := range ips {
+		addr := net.IPAddr{IP: ip}
+		if ip.To4() == nil && ip.IsLinkLocalUnicast() {
+			addr.Zone = iface
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// dialOrder returns every address of the peer in the order they should be raced:
+// the preferred address first, then alternating between IPv6 and IPv4 addresses.
+func dialOrder(peer shair.Device) []net.IPAddr {
+	if len(peer.Addrs) == 0 && peer.IP != nil {
+		return []net.IPAddr{{IP: peer.IP}}
+	}
+
+	var preferred []net.IPAddr
+	var v6, v4 []net.IPAddr
+	for _, a := range peer.Addrs {
+		switch {
+		case peer.IP != nil && a.IP.Equal(peer.IP) && len(preferred) == 0:
+			preferred = append(preferred, a)
+		case a.IP.To4() == nil:
+			v6 = append(v6, a)
+		default:
+			v4 = append(v4, a)
+		}
+	}
+
+	order := preferred
+	for i := 0; i < max(len(v6), len(v4)); i++ {
+		if i < len(v6) {
+			order = append(order, v6[i])
+		}
+		if i < len(v4) {
+			order = append(order, v4[i])
+		}
+	}
+
+	return order
+}
+
+type dialResult struct {
+	conn net.Conn
+	addr net.IPAddr
+	err  error
+}
+
+// dialRace connects to the first reachable address, happy eyeballs style: a new attempt starts
+// every raceDelay, or as soon as the previous one failed, and the first established connection wins.
+// It returns the winning connection and address, or the errors of every attempt.
+func dialRace(ctx context.Context, dialer *net.Dialer, addrs []net.IPAddr, port int) (net.Conn, net.IPAddr, error) {
+	if len(addrs) == 0 {
+		return nil, net.IPAddr{}, errors.New("peer has no known address")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, len(addrs))
+	attempt := func(a net.IPAddr) {
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(a.String(), strconv.Itoa(port)))
+		results <- dialResult{conn, a, err}
+	}
+
+	next, pending := 0, 0
+	errs := make([]error, 0, len(addrs))
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			if next < len(addrs) {
+				go attempt(addrs[next])
+				next++
+				pending++
+				timer.Reset(raceDelay)
+			}
+
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// close the connections that were established after the winner
+				cancel()
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, r.addr, nil
+			}
+
+			errs = append(errs, r.err)
+			if next < len(addrs) {
+				// don't wait for the delay, the previous attempt already failed
+				timer.Reset(0)
+			} else if pending == 0 {
+				return nil, net.IPAddr{}, errors.Join(errs...)
+			}
+		}
+	}
+}
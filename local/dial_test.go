@@ -0,0 +1,177 @@
+package local
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/masar3141/shair"
+)
+
+func addrs(ips ...string) []net.IPAddr {
+	a := make([]net.IPAddr, 0, len(ips))
+	for _, ip := range ips {
+		ip, zone, _ := strings.Cut(ip, "%")
+		a = append(a, net.IPAddr{IP: net.ParseIP(ip), Zone: zone})
+	}
+	return a
+}
+
+func TestIPAddrs(t *testing.T) {
+	ips := []net.IP{net.ParseIP("192.168.1.2"), net.ParseIP("2001:db8::1"), net.ParseIP("fe80::1")}
+
+	got := ipAddrs(ips, "eth0")
+	want := addrs("192.168.1.2", "2001:db8::1", "fe80::1%eth0")
+	if !slices.EqualFunc(got, want, func(a, b net.IPAddr) bool { return a.String() == b.String() }) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestDialOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		peer shair.Device
+		want []net.IPAddr
+	}{
+		{name: "no address"},
+		{name: "single IP", peer: shair.Device{LocalInfo: shair.LocalInfo{IP: net.ParseIP("10.0.0.1")}}, want: addrs("10.0.0.1")},
+		{
+			name: "v6 and v4 alternate",
+			peer: shair.Device{LocalInfo: shair.LocalInfo{Addrs: addrs("10.0.0.1", "10.0.0.2", "10.0.0.3", "2001:db8::1", "fe80::1%eth0")}},
+			want: addrs("2001:db8::1", "10.0.0.1", "fe80::1%eth0", "10.0.0.2", "10.0.0.3"),
+		},
+		{
+			name: "preferred first",
+			peer: shair.Device{LocalInfo: shair.LocalInfo{IP: net.ParseIP("10.0.0.2"), Addrs: addrs("2001:db8::1", "10.0.0.1", "10.0.0.2")}},
+			want: addrs("10.0.0.2", "2001:db8::1", "10.0.0.1"),
+		},
+		{
+			name: "preferred not advertised",
+			peer: shair.Device{LocalInfo: shair.LocalInfo{IP: net.ParseIP("10.0.0.9"), Addrs: addrs("10.0.0.1")}},
+			want: addrs("10.0.0.1"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := dialOrder(tt.peer)
+			if !slices.EqualFunc(got, tt.want, func(a, b net.IPAddr) bool { return a.String() == b.String() }) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// acceptAll accepts the transfers sent to a listener on localhost until the test ends, it returns its port.
+func acceptAll(t *testing.T) int {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = conn.Write([]byte{replyAccepted})
+				_, _ = io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestDialRace(t *testing.T) {
+	port := acceptAll(t)
+
+	// 192.0.2.1 never answers, 127.0.0.2 refuses the connection
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		ControlContext: func(ctx context.Context, network, address string, c syscall.RawConn) error {
+			if strings.HasPrefix(address, "192.0.2.1:") {
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			return nil
+		},
+	}
+
+	tests := []struct {
+		name   string
+		addrs  []net.IPAddr
+		winner string // none if the race is lost
+		within time.Duration
+	}{
+		{name: "unreachable first", addrs: addrs("192.0.2.1", "127.0.0.1"), winner: "127.0.0.1", within: raceDelay + time.Second},
+		{name: "refused first", addrs: addrs("127.0.0.2", "127.0.0.1"), winner: "127.0.0.1", within: raceDelay},
+		{name: "all refused", addrs: addrs("127.0.0.2", "127.0.0.3"), within: raceDelay},
+		{name: "no address"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			conn, winner, err := dialRace(context.Background(), dialer, tt.addrs, port)
+			elapsed := time.Since(start)
+
+			if tt.winner == "" {
+				if err == nil {
+					conn.Close()
+					t.Fatalf("connected to %v, want the race lost", winner)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+			if winner.String() != tt.winner {
+				t.Fatalf("got %v, want %s", winner, tt.winner)
+			}
+			if tt.within > 0 && elapsed > tt.within {
+				t.Fatalf("took %v, want at most %v", elapsed, tt.within)
+			}
+		})
+	}
+}
+
+func TestSendFilesRemembersWinner(t *testing.T) {
+	port := acceptAll(t)
+	l := NewLocalShairer(slog.New(slog.DiscardHandler), 0)
+
+	// the first address advertised is preferred until a connection wins over it
+	l.registry.Upsert("test", shair.Device{ID: "p", Name: "p", LocalInfo: shair.LocalInfo{Addrs: addrs("127.0.0.2", "127.0.0.1"), SvcPort: port}})
+
+	f := filepath.Join(t.TempDir(), "hello.txt")
+	if err := os.WriteFile(f, []byte("hello"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	progressCh := make(chan int)
+	go func() {
+		for range progressCh {
+		}
+	}()
+	if err := l.SendFiles(context.Background(), &shair.Device{ID: "p", Name: "p"}, progressCh, f); err != nil {
+		t.Fatal(err)
+	}
+
+	peer, _ := l.registry.Get("p")
+	if order := dialOrder(peer); !order[0].IP.Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("got %v, want the winner tried first", order)
+	}
+}
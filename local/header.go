@@ -3,7 +3,11 @@ package local
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
 	"os"
+	"strings"
 )
 
 // header represents the metadata sent before a file transfer.
@@ -15,8 +19,24 @@ type header struct {
 	fileSize    []int64  // Size of each file in bytes.
 }
 
+// limits enforced on every header, whether it is built locally or received from a peer
+const (
+	maxNumFiles  = 4096
+	maxTotalSize = 1 << 40 // 1 TiB
+)
+
+var (
+	errHeaderTooShort = errors.New("header is truncated")
+	errHeaderTooLarge = errors.New("header doesn't fit in 65535 bytes")
+)
+
 // newHeader creates a Header from a list of file information.
-func newHeader(finfos ...os.FileInfo) *header {
+// It fails if the files can't be described by a valid header, see header.validate.
+func newHeader(finfos ...os.FileInfo) (*header, error) {
+	if len(finfos) > maxNumFiles {
+		return nil, fmt.Errorf("too many files: %d, at most %d can be sent at once", len(finfos), maxNumFiles)
+	}
+
 	h := &header{
 		numFiles:    uint16(len(finfos)),
 		nameLengths: make([]uint8, len(finfos)),
@@ -26,12 +46,51 @@ func newHeader(finfos ...os.FileInfo) *header {
 
 	for i, f := range finfos {
 		name := f.Name()
+		if len(name) > math.MaxUint8 {
+			return nil, fmt.Errorf("file name %q is longer than %d bytes", name, math.MaxUint8)
+		}
+
 		h.names[i] = name
 		h.nameLengths[i] = uint8(len(name))
 		h.fileSize[i] = int64(f.Size())
 	}
 
-	return h
+	if err := h.validate(); err != nil {
+		return nil, err
+	}
+
+	if len(h.encode()) > math.MaxUint16 {
+		return nil, errHeaderTooLarge
+	}
+
+	return h, nil
+}
+
+// validate checks the header against the limits and makes sure every name is a plain file name,
+// so that a peer can't write outside of the save directory.
+func (h *header) validate() error {
+	if h.numFiles > maxNumFiles {
+		return fmt.Errorf("too many files: %d, at most %d are accepted", h.numFiles, maxNumFiles)
+	}
+
+	total := int64(0)
+	for i := 0; i < int(h.numFiles); i++ {
+		name := h.names[i]
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`+"\x00") {
+			return fmt.Errorf("invalid file name %q", name)
+		}
+
+		if h.fileSize[i] < 0 {
+			return fmt.Errorf("invalid size %d for file %q", h.fileSize[i], name)
+		}
+
+		total += h.fileSize[i]
+		if total > maxTotalSize || total < 0 {
+			return fmt.Errorf("transfer is larger than %d bytes", int64(maxTotalSize))
+		}
+	}
+
+	return nil
 }
 
 // encode serializes the header into a byte slice.
@@ -66,15 +125,32 @@ func (h *header) encode() []byte {
 }
 
 // decodeHeader parses a byte slice into a Header.
-func decodeHeader(p []byte) *header {
+// Every read is bounds checked: a truncated or malformed header returns an error, never panics.
+func decodeHeader(p []byte) (*header, error) {
+	if len(p) < 4 {
+		return nil, errHeaderTooShort
+	}
+
 	offset := 0
 
 	hdrSize := binary.BigEndian.Uint16(p[offset:])
 	offset += 2
 
+	if int(hdrSize) != len(p) {
+		return nil, fmt.Errorf("header announces %d bytes but %d were received", hdrSize, len(p))
+	}
+
 	numFiles := binary.BigEndian.Uint16(p[offset:])
 	offset += 2
 
+	if numFiles > maxNumFiles {
+		return nil, fmt.Errorf("too many files: %d, at most %d are accepted", numFiles, maxNumFiles)
+	}
+
+	if len(p)-offset < int(numFiles) {
+		return nil, errHeaderTooShort
+	}
+
 	h := &header{
 		headerSize:  hdrSize,
 		numFiles:    numFiles,
@@ -90,15 +166,31 @@ func decodeHeader(p []byte) *header {
 
 	for i := 0; i < int(numFiles); i++ {
 		nameSize := int(h.nameLengths[i])
+		if len(p)-offset < nameSize {
+			return nil, errHeaderTooShort
+		}
+
 		h.names[i] = string(p[offset : offset+nameSize])
 		offset += nameSize
 	}
 
 	for i := 0; i < int(numFiles); i++ {
 		fileLen, n := binary.Varint(p[offset:])
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid size for file %q", h.names[i])
+		}
+
 		h.fileSize[i] = int64(fileLen)
 		offset += n
 	}
 
-	return h
+	if offset != len(p) {
+		return nil, fmt.Errorf("%d unexpected trailing bytes in header", len(p)-offset)
+	}
+
+	if err := h.validate(); err != nil {
+		return nil, err
+	}
+
+	return h, nil
 }
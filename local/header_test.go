@@ -0,0 +1,77 @@
+package local
+
+import (
+	"slices"
+	"testing"
+)
+
+// newTestHeader builds a header from raw names and sizes, bypassing os.FileInfo.
+func newTestHeader(names []string, sizes []int64) *header {
+	h := &header{
+		numFiles:    uint16(len(names)),
+		nameLengths: make([]uint8, len(names)),
+		names:       names,
+		fileSize:    sizes,
+	}
+	for i, n := range names {
+		h.nameLengths[i] = uint8(len(n))
+	}
+	return h
+}
+
+func FuzzHeaderRoundTrip(f *testing.F) {
+	f.Add("a.txt", int64(0), "photo.jpg", int64(1<<20))
+	f.Add("é", int64(42), "b", int64(maxTotalSize/2))
+	f.Add("x", int64(-1), "y", int64(1))
+
+	f.Fuzz(func(t *testing.T, n1 string, s1 int64, n2 string, s2 int64) {
+		if len(n1) > 255 || len(n2) > 255 {
+			t.Skip()
+		}
+
+		h := newTestHeader([]string{n1, n2}, []int64{s1, s2})
+		if h.validate() != nil {
+			t.Skip()
+		}
+
+		p := h.encode()
+		got, err := decodeHeader(p)
+		if err != nil {
+			t.Fatalf("decoding an encoded valid header failed: %v", err)
+		}
+
+		if got.headerSize != h.headerSize || got.numFiles != h.numFiles ||
+			!slices.Equal(got.names, h.names) || !slices.Equal(got.fileSize, h.fileSize) {
+			t.Fatalf("round trip mismatch: encoded %+v, decoded %+v", h, got)
+		}
+	})
+}
+
+func FuzzDecodeHeader(f *testing.F) {
+	f.Add(newTestHeader([]string{"a.txt", "b.bin"}, []int64{12, 1 << 30}).encode())
+	f.Add([]byte{0, 4, 0, 0})
+	f.Add([]byte{0, 6, 0, 1, 5})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, p []byte) {
+		h, err := decodeHeader(p)
+		if err != nil {
+			return
+		}
+
+		if err := h.validate(); err != nil {
+			t.Fatalf("decoded header is invalid: %v", err)
+		}
+
+		// varints have several encodings for the same value, compare the re-encoded form
+		// by decoding it again rather than byte for byte
+		again, err := decodeHeader(h.encode())
+		if err != nil {
+			t.Fatalf("re-encoding a decoded header failed: %v", err)
+		}
+
+		if !slices.Equal(again.names, h.names) || !slices.Equal(again.fileSize, h.fileSize) {
+			t.Fatalf("re-encoded header differs: %+v, %+v", h, again)
+		}
+	})
+}
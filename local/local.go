@@ -5,116 +5,353 @@ package local
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
 	"os"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/brutella/dnssd"
 	"github.com/masar3141/shair"
 )
 
-type tcpInfo struct {
-	ip   net.IP
-	port int
-}
-
 // LocalShairer implements shair.Shairer
 type LocalShairer struct {
 	logger *slog.Logger
 
-	port int // port on which the tcp server will be listening
+	port     int // port on which the tcp server will be listening, 0 for any free port
+	lastPort int // with lastPort, the server listens on the first free port from port to lastPort
 
-	// serviceToDevice maps service names (shair.Device.Name) to discovered devices.
-	// Usage:
-	// - Add when a peer is discovered via mDNS.
-	// - Retrieve device on peer removal to delete to send along peerCh
-	// - Remove when peer is lost
-	serviceToDevice map[string]*shair.Device
-	smu             sync.Mutex // protects the map
+	boundPort atomic.Int32 // port the tcp server actually listens on, announced to the peers
 
-	// deviceToTCP maps devices to their TCP connection details.
+	// registry holds the discovered peers, it can be shared with other discovery mechanisms
+	registry *shair.PeerRegistry
+
+	// mdnsPeers maps mDNS service instance names to the peers announcing them.
 	// Usage:
-	// - Store when a peer is discovered.
-	// - Retrieve tcp info with device from ui when want to send file
-	// - Remove using serviceToDevice when the peer is lost.
-	deviceToTCP map[*shair.Device]tcpInfo
-	dmu         sync.Mutex // protects the map
+	// - Add or merge the addresses of an interface when a peer is discovered via mDNS.
+	// - Remove the addresses of an interface when the peer is lost on it, and remove
+	//   the peer from the registry once it is lost on all interfaces.
+	mdnsPeers map[string]*mdnsPeer
+	smu       sync.Mutex // protects the map
+
+	sendLimiter *shair.Limiter // global cap applied to every outgoing transfer
+	recvLimiter *shair.Limiter // global cap applied to every incoming transfer
+
+	timeouts Timeouts // deadlines applied to each phase of the protocol
+
+	quota       *shair.QuotaTracker      // limits checked before a transfer request reaches the ui, nil means no limit
+	trust       func(*shair.Device) bool // tells whether a sender may send us files, nil trusts everyone
+	blockedExts []string                 // lower cased extensions, with the leading dot, of files we refuse
+	busy        atomic.Bool              // set while a transfer request is being handled
+
+	// identity advertised in the TXT record of the mDNS service
+	instanceID      string // random identifier of this LocalShairer, used to recognize our own announcement
+	deviceID        string
+	deviceType      shair.DeviceType
+	certFingerprint string
+
+	// current mDNS announcement, used to update the TXT record while announcing
+	amu       sync.Mutex
+	responder dnssd.Responder
+	handle    dnssd.ServiceHandle
+
+	name          string // name we asked to be announced with
+	announcedName string // name we are known by on the network, after dnssd resolved conflicts
+
+	netFilter netFilter // interfaces and networks used to announce, discover and receive
+
+	discovery  Discovery     // mechanisms used to discover peers and to be discovered
+	mcAnnounce chan struct{} // signals the multicast announcer to announce right away, see announceNow
+
+	probeInterval time.Duration // how often the discovered peers are pinged, 0 disables the probes
+}
+
+// Option configures optional behaviours of a LocalShairer.
+type Option func(*LocalShairer)
+
+// WithSendLimiter caps the bandwidth of all outgoing transfers.
+// The limiter can be adjusted at runtime with shair.Limiter.SetLimit.
+func WithSendLimiter(l *shair.Limiter) Option {
+	return func(ls *LocalShairer) {
+		ls.sendLimiter = l
+	}
+}
+
+// WithReceiveLimiter caps the bandwidth of all incoming transfers.
+// The limiter can be adjusted at runtime with shair.Limiter.SetLimit.
+func WithReceiveLimiter(l *shair.Limiter) Option {
+	return func(ls *LocalShairer) {
+		ls.recvLimiter = l
+	}
+}
+
+// WithQuota rejects incoming transfers exceeding q before they reach the user.
+func WithQuota(q shair.Quota) Option {
+	return func(ls *LocalShairer) {
+		ls.quota = shair.NewQuotaTracker(q)
+	}
+}
+
+// WithTrust rejects transfers from senders for which trust returns false.
+func WithTrust(trust func(sender *shair.Device) bool) Option {
+	return func(ls *LocalShairer) {
+		ls.trust = trust
+	}
+}
+
+// WithBlockedExtensions rejects transfers containing files with one of the given extensions, eg ".exe".
+func WithBlockedExtensions(exts ...string) Option {
+	return func(ls *LocalShairer) {
+		for _, ext := range exts {
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			ls.blockedExts = append(ls.blockedExts, strings.ToLower(ext))
+		}
+	}
+}
+
+// WithPortRange makes the tcp server listen on the first free port from first to last, instead of the
+// port given to NewLocalShairer. The port actually bound is announced to the peers.
+func WithPortRange(first, last int) Option {
+	return func(ls *LocalShairer) {
+		ls.port, ls.lastPort = first, last
+	}
 }
 
-func NewLocalShairer(logger *slog.Logger, port int) *LocalShairer {
-	return &LocalShairer{
+// WithDeviceID sets the identifier advertised to peers. Without it, a random identifier
+// is generated for each LocalShairer, see shair.LoadDeviceID for a persistent one.
+func WithDeviceID(id string) Option {
+	return func(ls *LocalShairer) {
+		ls.deviceID = id
+	}
+}
+
+// WithDeviceType overrides the device type detected with shair.DetectDeviceType.
+func WithDeviceType(t shair.DeviceType) Option {
+	return func(ls *LocalShairer) {
+		ls.deviceType = t
+	}
+}
+
+// WithCertFingerprint advertises the fingerprint of the device key to peers, see remote.Fingerprint.
+// Peers show it to tell devices apart, it isn't proven: anyone may advertise it.
+func WithCertFingerprint(fp string) Option {
+	return func(ls *LocalShairer) {
+		ls.certFingerprint = fp
+	}
+}
+
+// WithRegistry makes the LocalShairer record the peers it discovers in r instead of its own registry.
+func WithRegistry(r *shair.PeerRegistry) Option {
+	return func(ls *LocalShairer) {
+		ls.registry = r
+	}
+}
+
+func NewLocalShairer(logger *slog.Logger, port int, opts ...Option) *LocalShairer {
+	l := &LocalShairer{
 		logger: logger,
 		port:   port,
 
-		serviceToDevice: make(map[string]*shair.Device),
-		smu:             sync.Mutex{},
+		registry: shair.NewPeerRegistry(),
+
+		mdnsPeers: make(map[string]*mdnsPeer),
+		smu:       sync.Mutex{},
 
-		deviceToTCP: make(map[*shair.Device]tcpInfo),
-		dmu:         sync.Mutex{},
+		timeouts: DefaultTimeouts(),
+
+		discovery:  DiscoveryMDNS | DiscoveryMulticast,
+		mcAnnounce: make(chan struct{}, 1),
+
+		probeInterval: defaultProbeInterval,
+
+		instanceID: shair.NewDeviceID(),
+		deviceID:   shair.NewDeviceID(),
+		deviceType: shair.DetectDeviceType(),
 	}
+
+	for _, opt := range opts {
+		opt(l)
+	}
+
+	return l
+}
+
+// Port returns the port the tcp server listens on, 0 until it does.
+func (l *LocalShairer) Port() int {
+	return int(l.boundPort.Load())
 }
 
-// Discover continuously listens for mDNS service announcements from other nodes on the local network.
-// It filters services matching "_shair._tcp" and sends notifications through a channel
-// indicating whether a service was added or removed.
-// This function runs indefinitely until the provided context is canceled.
-func (l *LocalShairer) Discover(ctx context.Context, peerCh chan<- shair.PeerUpdate) {
-	l.discover(ctx, peerCh)
+// Registry returns the registry holding the peers discovered by the LocalShairer.
+func (l *LocalShairer) Registry() *shair.PeerRegistry {
+	return l.registry
+}
+
+// Discover continuously listens for mDNS service announcements and multicast announcements, depending
+// on the selected discovery, from other nodes on the local network. It sends notifications through a channel
+// indicating whether a peer was added, updated or removed, a peer found by both means is only listed once.
+// Discovered peers are also probed in the background, changes of their reachability are sent as well.
+// This function runs indefinitely until the provided context is canceled or one of the listeners fails.
+func (l *LocalShairer) Discover(ctx context.Context, peerCh chan<- shair.PeerUpdate) error {
+	fns := []func(context.Context) error{
+		l.probe,
+		func(ctx context.Context) error {
+			l.registry.Forward(ctx, peerCh)
+			return nil
+		},
+	}
+	if l.discovery&DiscoveryMDNS != 0 {
+		fns = append(fns, degradeOnFailure(func(ctx context.Context) error { return l.discover(ctx, peerCh) }))
+	}
+	if l.discovery&DiscoveryMulticast != 0 {
+		fns = append(fns, degradeOnFailure(l.discoverMulticast))
+	}
+
+	return runAll(ctx, fns...)
 }
 
+// Announce broadcasts the local device over mDNS and multicast, depending on the selected discovery,
+// and runs the tcp server receiving the files. If the server fails, the others are stopped and the error
+// is returned. The failure of a broadcast is reported with shair.ReportDegraded and the rest keeps running.
 func (l *LocalShairer) Announce(
 	ctx context.Context,
 	localDeviceName string,
 	saveDir string,
 	transferRequestCh chan<- shair.TransferRequest,
-) {
-	wg := sync.WaitGroup{}
+) error {
+	l.amu.Lock()
+	l.name = localDeviceName
+	l.amu.Unlock()
+
+	// the port is known once bound, before being announced
+	ln, err := l.bind(ctx)
+	if err != nil {
+		return err
+	}
+
+	fns := []func(context.Context) error{
+		func(ctx context.Context) error { return l.listen(ctx, ln, saveDir, transferRequestCh) },
+	}
+	if l.discovery&DiscoveryMDNS != 0 {
+		fns = append(fns, degradeOnFailure(func(ctx context.Context) error { return l.broadcastAndWatch(ctx, localDeviceName) }))
+	}
+	if l.discovery&DiscoveryMulticast != 0 {
+		fns = append(fns, degradeOnFailure(l.announceMulticast))
+	}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		l.broadcast(ctx, localDeviceName)
-	}()
+	return runAll(ctx, fns...)
+}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		l.listen(ctx, saveDir, transferRequestCh)
-	}()
+// runAll runs every fn concurrently until ctx is done. If one of them returns, the others
+// are stopped, and the errors of all of them are returned.
+func runAll(ctx context.Context, fns ...func(context.Context) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	wg := sync.WaitGroup{}
+	errs := make([]error, len(fns))
+
+	for i, fn := range fns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = fn(ctx)
+			cancel()
+		}()
+	}
 
 	wg.Wait()
-}
 
-func (l *LocalShairer) SendFiles(ctx context.Context, target *shair.Device, updloadProgressCh chan<- int, filepaths ...string) error {
-	// try to open and stat the files and store them in arrays
-	numFiles := len(filepaths)
-	files := make([]*os.File, numFiles)
-	fileInfos := make([]os.FileInfo, numFiles)
+	return errors.Join(errs...)
+}
 
-	for idx, fp := range filepaths {
-		file, err := os.Open(fp)
-		if err != nil {
-			return shair.NewError(shair.StatFileError, fmt.Sprintf("cannot open file %s", file.Name()), err)
+// degradeOnFailure turns the failure of fn, one of several discovery mechanisms, into a degradation of
+// the service rather than its end: the other mechanisms keep running.
+func degradeOnFailure(fn func(context.Context) error) func(context.Context) error {
+	return func(ctx context.Context) error {
+		if err := fn(ctx); err != nil && ctx.Err() == nil {
+			shair.ReportDegraded(ctx, err)
+			<-ctx.Done()
 		}
+		return nil
+	}
+}
 
-		info, err := file.Stat()
-		if err != nil {
-			return shair.NewError(shair.StatFileError, fmt.Sprintf("cannot stat file %s", file.Name()), err)
+// reachableAddrs returns the addresses the server can be reached on, sorted.
+func (l *LocalShairer) reachableAddrs() []string {
+	ifaces, err := l.netFilter.resolve()
+	if err != nil {
+		return nil
+	}
+
+	var addrs []string
+	for _, ips := range ifaces {
+		for _, ip := range ips {
+			if !ip.IsLoopback() {
+				addrs = append(addrs, ip.String())
+			}
 		}
+	}
+	slices.Sort(addrs)
 
-		files[idx] = file
-		fileInfos[idx] = info
+	return addrs
+}
+
+// SendFiles sends the files to target. The bandwidth is capped by the global send limiter
+// and, if any, by the limiter attached to ctx with shair.WithLimiter.
+func (l *LocalShairer) SendFiles(ctx context.Context, target *shair.Device, updloadProgressCh chan<- int, filepaths ...string) error {
+	files, hdr, err := openFiles(filepaths)
+	defer closeFiles(files)
+	if err != nil {
+		return err
+	}
+
+	// connect to the server, racing all its addresses. A target the registry doesn't know about,
+	// eg built by the caller from an address, is dialed as is
+	peer, found := l.registry.Get(target.Key())
+	if !found {
+		peer = *target
+	}
+	if len(dialOrder(peer)) == 0 || peer.SvcPort == 0 {
+		return shair.NewError(shair.UnexpectedError, fmt.Sprintf("unknown address for device %s", target.Name), nil)
+	}
+
+	dialer := net.Dialer{Timeout: l.timeouts.Handshake, KeepAlive: l.timeouts.keepAlive(), KeepAliveConfig: l.timeouts.KeepAlive}
+	conn, winner, err := dialRace(ctx, &dialer, dialOrder(peer), peer.SvcPort)
+	if err != nil {
+		return l.timeouts.wrapErr(ctx, shair.PhaseHandshake, "handshake", shair.UnexpectedError, fmt.Sprintf("cannot dial with %s", target.Name), err)
 	}
+	defer conn.Close()
 
-	// connect to the server
-	targetTcpInfo := l.deviceToTCP[target]
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", targetTcpInfo.ip, targetTcpInfo.port))
+	// remember the winner so that the next transfer tries it first
+	l.registry.SetPreferredIP(peer.Key(), winner.IP)
+	l.logger.DebugContext(ctx, "connected to the receiver", "peer", peer.Name, "addr", conn.RemoteAddr().String())
+
+	return l.sendFilesOn(ctx, conn, hdr, files, updloadProgressCh)
+}
+
+// SendFilesOn sends the files over conn, a connection to the receiver established by another Shairer,
+// eg relayed and authenticated. The bandwidth is capped as for SendFiles.
+func (l *LocalShairer) SendFilesOn(ctx context.Context, conn net.Conn, updloadProgressCh chan<- int, filepaths ...string) error {
+	files, hdr, err := openFiles(filepaths)
+	defer closeFiles(files)
 	if err != nil {
-		return shair.NewError(shair.UnexpectedError, fmt.Sprintf("cannot dial with server %s:%d", targetTcpInfo.ip, targetTcpInfo.port), err)
+		return err
 	}
 
-	s := newSender(ctx, conn, files)
+	return l.sendFilesOn(ctx, conn, hdr, files, updloadProgressCh)
+}
+
+// sendFilesOn runs the transfer protocol over conn: header, acceptation, then the files.
+func (l *LocalShairer) sendFilesOn(ctx context.Context, conn net.Conn, hdr *header, files []*os.File, updloadProgressCh chan<- int) error {
+	s := newSender(ctx, conn, files, l.sendLimiter, shair.LimiterFromContext(ctx))
 	// TODO: Check the connection state in a separate goroutine and report to ErrCh if the destination has closed the connection.
 	// See: https://github.com/golang/go/issues/15735#issuecomment-266574151 for feasability
 	//
@@ -123,30 +360,87 @@ func (l *LocalShairer) SendFiles(ctx context.Context, target *shair.Device, updl
 	//   the TCP stack may still deliver buffered data to the receiver due to OS-level socket buffering.
 	// -> we should drop the accept mechanism receiver's side as soon as the sender quits
 
-	// prepare the header and send it immediately
-	hdr := newHeader(fileInfos...)
+	// send the header immediately
+	_ = conn.SetDeadline(deadline(l.timeouts.Handshake))
 	w, err := s.writeHeaderToConn(hdr)
 	if err != nil && w != int(hdr.headerSize) {
 		// TODO: better error handling, maybe switch on the error or create another shair.WriteHeader error
-		return shair.NewError(shair.UnexpectedError, "failed to write header on conn", err)
+		return l.timeouts.wrapErr(ctx, shair.PhaseHandshake, "handshake", shair.UnexpectedError, "failed to write header on conn", err)
 	}
+	l.logger.DebugContext(ctx, "header sent, waiting for the receiver to accept", "files", len(files))
+
+	// read confirmation bit sent by dest on conn. The receiver applies its own accept deadline,
+	// leave it the time of a handshake to tell us it gave up before giving up ourselves
+	acceptTimeout := time.Duration(0)
+	if l.timeouts.Accept > 0 {
+		acceptTimeout = l.timeouts.Accept + l.timeouts.Handshake
+	}
+	_ = conn.SetDeadline(deadline(acceptTimeout))
 
-	// rend confirmation bit sent by dest on conn
 	buf := make([]byte, 1)
 	n, err := conn.Read(buf)
 	if err != nil || n != 1 {
-		return shair.NewError(shair.UnexpectedError, "failed to read confirmation bit", err)
+		return l.timeouts.wrapErr(ctx, shair.PhaseAccept, "accept", shair.UnexpectedError, "failed to read confirmation bit", err)
 	}
 
-	// 0 means rejected
-	if buf[0] == 0 {
-		return shair.NewError(shair.TransferRejected, "cannot send file", err)
+	// anything but an acceptation is a rejection, followed by its reason
+	if buf[0] != replyAccepted {
+		rejection, err := readRejection(conn)
+		if err != nil {
+			return l.timeouts.wrapErr(ctx, shair.PhaseAccept, "accept", shair.UnexpectedError, "failed to read rejection", err)
+		}
+		l.logger.InfoContext(ctx, "transfer rejected by the receiver", "reason", rejection.Reason.String(), "msg", rejection.Message)
+		return shair.NewError(shair.TransferRejected, "cannot send file", rejection)
 	}
+	l.logger.DebugContext(ctx, "transfer accepted by the receiver")
+
+	// from now on, the connection expires when idle for too long or when the whole transfer takes too long
+	_ = conn.SetDeadline(time.Time{})
+	ctx, cancel := l.timeouts.withTotal(ctx, conn)
+	defer cancel()
+	s.setDataConn(ctx, newIdleConn(ctx, conn, l.timeouts.Idle))
 
 	err = s.sendFiles(updloadProgressCh)
 	if err != nil {
-		return shair.NewError(shair.SendFileError, "cannot send file", err)
+		return l.timeouts.wrapErr(ctx, shair.PhaseTransfer, "idle", shair.SendFileError, "cannot send file", err)
 	}
 
 	return nil
 }
+
+// openFiles opens and stats the files and describes them in a header. The opened files are returned
+// even on failure, to be closed with closeFiles.
+func openFiles(filepaths []string) ([]*os.File, *header, error) {
+	files := make([]*os.File, len(filepaths))
+	fileInfos := make([]os.FileInfo, len(filepaths))
+
+	for idx, fp := range filepaths {
+		file, err := os.Open(fp)
+		if err != nil {
+			return files, nil, shair.NewError(shair.StatFileError, fmt.Sprintf("cannot open file %s", fp), err)
+		}
+		files[idx] = file
+
+		info, err := file.Stat()
+		if err != nil {
+			return files, nil, shair.NewError(shair.StatFileError, fmt.Sprintf("cannot stat file %s", fp), err)
+		}
+
+		fileInfos[idx] = info
+	}
+
+	hdr, err := newHeader(fileInfos...)
+	if err != nil {
+		return files, nil, shair.NewError(shair.InvalidHeaderError, "cannot describe the files to send", err)
+	}
+
+	return files, hdr, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package local
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/masar3141/shair"
+)
+
+// name of the peers added by address in the peer registry
+const manualSource = "manual"
+
+// AddPeer adds the peer listening on addr, a "host:port" pair, for networks where mDNS doesn't work.
+// The peer is asked for its identity over the protocol, then recorded in the registry like a discovered one.
+func (l *LocalShairer) AddPeer(ctx context.Context, addr string) (shair.Device, error) {
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return shair.Device{}, shair.NewError(shair.UnexpectedError, fmt.Sprintf("invalid peer address %s", addr), err)
+	}
+
+	port, err := strconv.Atoi(p)
+	if err != nil || port <= 0 || port > 65535 {
+		return shair.Device{}, shair.NewError(shair.UnexpectedError, fmt.Sprintf("invalid port in peer address %s", addr), err)
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return shair.Device{}, shair.NewError(shair.UnexpectedError, fmt.Sprintf("cannot resolve %s", host), err)
+	}
+
+	dvc, err := l.identify(ctx, addrs, port)
+	if err != nil {
+		return shair.Device{}, l.timeouts.wrapErr(ctx, shair.PhaseHandshake, "handshake", shair.UnexpectedError, fmt.Sprintf("cannot identify the peer at %s", addr), err)
+	}
+
+	if dvc.ID == l.deviceID {
+		return shair.Device{}, shair.NewError(shair.UnexpectedError, fmt.Sprintf("%s is this device", addr), nil)
+	}
+
+	if dvc.Name == "" {
+		dvc.Name = host
+	}
+
+	l.logger.Info("peer added", "source", manualSource, "addr", addr, "peer", dvc.Name, "id", dvc.ID)
+	l.registry.Upsert(manualSource, dvc)
+
+	// the registry merges the peer with what other sources know about it
+	if merged, found := l.registry.Get(dvc.Key()); found {
+		return merged, nil
+	}
+	return dvc, nil
+}
+
+// identify asks the peer listening on port at one of addrs who it is.
+func (l *LocalShairer) identify(ctx context.Context, addrs []net.IPAddr, port int) (shair.Device, error) {
+	dialer := net.Dialer{Timeout: l.timeouts.Handshake, KeepAlive: l.timeouts.keepAlive(), KeepAliveConfig: l.timeouts.KeepAlive}
+	conn, winner, err := dialRace(ctx, &dialer, dialOrder(shair.Device{LocalInfo: shair.LocalInfo{Addrs: addrs}}), port)
+	if err != nil {
+		return shair.Device{}, err
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(deadline(l.timeouts.Handshake))
+	if err := writeMessage(conn, msgIdentify); err != nil {
+		return shair.Device{}, err
+	}
+
+	txt, err := readIdentity(conn)
+	if err != nil {
+		return shair.Device{}, err
+	}
+
+	dvc := shair.Device{
+		Name:         txt[txtName],
+		DiscoveredOn: shair.Local,
+		LocalInfo: shair.LocalInfo{
+			IP:      winner.IP,
+			Addrs:   addrs,
+			SvcPort: port,
+		},
+	}
+	parseTXT(txt, &dvc)
+
+	return dvc, nil
+}
@@ -0,0 +1,103 @@
+package local
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"maps"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/masar3141/shair"
+)
+
+func TestIdentityRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		txt  map[string]string
+		want map[string]string
+	}{
+		{name: "empty", txt: map[string]string{}, want: map[string]string{}},
+		{name: "entries", txt: map[string]string{"n": "laptop", "id": "abc", "empty": ""}, want: map[string]string{"n": "laptop", "id": "abc", "empty": ""}},
+		{name: "value with =", txt: map[string]string{"k": "a=b"}, want: map[string]string{"k": "a=b"}},
+		{name: "entry too long dropped", txt: map[string]string{"k": strings.Repeat("x", 254), "n": "laptop"}, want: map[string]string{"n": "laptop"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readIdentity(bytes.NewReader(encodeIdentity(tt.txt)))
+			if err != nil || !maps.Equal(got, tt.want) {
+				t.Fatalf("got %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// serve runs the tcp server of l on a free port until the test ends.
+func serve(t *testing.T, l *LocalShairer) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ln, err := l.bind(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = l.listen(ctx, ln, t.TempDir(), make(chan shair.TransferRequest))
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func TestAddPeer(t *testing.T) {
+	peer := NewLocalShairer(slog.New(slog.DiscardHandler), 0, WithDeviceID("id-peer"))
+	peer.name = "peer"
+	serve(t, peer)
+	l := NewLocalShairer(slog.New(slog.DiscardHandler), 0, WithDeviceID("id-self"))
+	self := NewLocalShairer(slog.New(slog.DiscardHandler), 0, WithDeviceID("id-self"))
+	serve(t, self)
+
+	// a port nobody listens on
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := free.Addr().String()
+	free.Close()
+
+	tests := []struct {
+		name string
+		addr string
+		ok   bool
+	}{
+		{name: "peer", addr: net.JoinHostPort("127.0.0.1", strconv.Itoa(peer.Port())), ok: true},
+		{name: "by host name", addr: net.JoinHostPort("localhost", strconv.Itoa(peer.Port())), ok: true},
+		{name: "this device", addr: net.JoinHostPort("127.0.0.1", strconv.Itoa(self.Port()))},
+		{name: "nobody listening", addr: closed},
+		{name: "no port", addr: "127.0.0.1"},
+		{name: "invalid port", addr: "127.0.0.1:99999"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dvc, err := l.AddPeer(context.Background(), tt.addr)
+			if (err == nil) != tt.ok {
+				t.Fatalf("got %v, want ok %v", err, tt.ok)
+			}
+			if !tt.ok {
+				return
+			}
+
+			got, found := l.registry.Get("id-peer")
+			if dvc.ID != "id-peer" || dvc.Name != "peer" || !found || got.SvcPort != peer.Port() || got.IP == nil {
+				t.Fatalf("added %+v, registry has %+v, want the peer on port %d", dvc, got, peer.Port())
+			}
+		})
+	}
+}
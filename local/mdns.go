@@ -3,7 +3,9 @@ package local
 import (
 	"context"
 	"fmt"
-	"os"
+	"maps"
+	"net"
+	"slices"
 
 	"github.com/brutella/dnssd"
 	"github.com/masar3141/shair"
@@ -11,104 +13,243 @@ import (
 
 const MDNSSERVICE = "_shair._tcp"
 
-//	broadcasts an mDNS service record for the local Device, allowing other peers
-//
+// name of the mDNS discovery in the peer registry
+const mdnsSource = "mdns"
+
+// mdnsPeer is a peer found by the mDNS browser, possibly on several interfaces.
+type mdnsPeer struct {
+	device shair.Device            // device as last advertised, without addresses
+	ifaces map[string][]net.IPAddr // addresses per interface name
+}
+
+// addrs returns the addresses of the peer on every interface.
+func (p *mdnsPeer) addrs() []net.IPAddr {
+	var addrs []net.IPAddr
+	for _, iface := range slices.Sorted(maps.Keys(p.ifaces)) {
+		addrs = append(addrs, p.ifaces[iface]...)
+	}
+	return addrs
+}
+
+// broadcast broadcasts an mDNS service record for the local Device, allowing other peers
 // to discover the service and obtain the TCP server information to send data to.
 // It advertises the service with the "_shair._tcp" service type on the specified port and the name of the host.
-// This function runs until the context is cancelled by the caller, continuously broadcasting the service.
-func (l *LocalShairer) broadcast(ctx context.Context, name string) {
+// This function runs until the context is cancelled by the caller, continuously broadcasting the service,
+// or until the responder fails, in which case a shair.ServiceError is returned.
+func (l *LocalShairer) broadcast(ctx context.Context, name string) error {
 
-	svCfg := dnssd.Config{
-		Name:   name,
-		Type:   MDNSSERVICE,
-		Domain: "local",
-		Port:   l.port,
+	svCfg := l.mdnsService(name)
+
+	if !l.netFilter.empty() {
+		ifaces, err := l.netFilter.resolve()
+		if err != nil {
+			return shair.NewError(shair.ServiceError, "couldn't list the network interfaces", err)
+		}
+
+		// nothing to announce on until the network changes
+		if len(ifaces) == 0 {
+			<-ctx.Done()
+			return nil
+		}
+
+		for iface, ips := range ifaces {
+			svCfg.Ifaces = append(svCfg.Ifaces, iface)
+			svCfg.IPs = append(svCfg.IPs, ips...)
+		}
 	}
 
 	sv, err := dnssd.NewService(svCfg)
 	if err != nil {
-		panic(fmt.Errorf("Mdns.Announce: Couldn't create the service: %w", err))
+		return shair.NewError(shair.ServiceError, "couldn't create the mdns service", err)
 	}
 
 	rp, err := dnssd.NewResponder()
 	if err != nil {
-		panic(fmt.Errorf("broadcast err responder: %w", err))
+		return shair.NewError(shair.ServiceError, "couldn't create the mdns responder", err)
 	}
 
 	hdl, err := rp.Add(sv)
-	_ = hdl
 	if err != nil {
-		return
+		return shair.NewError(shair.ServiceError, "couldn't add the service to the mdns responder", err)
 	}
 
+	l.amu.Lock()
+	l.responder, l.handle = rp, hdl
+	l.amu.Unlock()
+
 	go func() {
 		<-ctx.Done()
 		rp.Remove(hdl)
+
+		l.amu.Lock()
+		if l.handle == hdl {
+			l.responder, l.handle = nil, nil
+		}
+		l.amu.Unlock()
 	}()
 
 	err = rp.Respond(ctx)
-	if err != nil {
+	if err != nil && ctx.Err() == nil {
+		return shair.NewError(shair.ServiceError, "mdns responder stopped", err)
+	}
+
+	return nil
+}
+
+// mdnsService returns the service announced under name on every interface, advertising the port
+// the tcp server is bound to.
+func (l *LocalShairer) mdnsService(name string) dnssd.Config {
+	return dnssd.Config{
+		Name:   name,
+		Type:   MDNSSERVICE,
+		Domain: "local",
+		Port:   l.Port(),
+		Text:   l.txtRecord(!l.busy.Load()),
+	}
+}
+
+// broadcastAndWatch broadcasts the service and starts over every time the network interfaces
+// change, eg when switching Wi-Fi or plugging an ethernet cable, so that peers learn our new addresses.
+func (l *LocalShairer) broadcastAndWatch(ctx context.Context, name string) error {
+	for {
+		bctx, cancel := context.WithCancel(ctx)
+
+		changed := make(chan bool, 1)
+		go func() {
+			changed <- l.netFilter.waitChange(bctx)
+			cancel()
+		}()
+
+		err := l.broadcast(bctx, name)
+		cancel()
+
+		if !<-changed {
+			// the broadcast stopped on its own or ctx is done
+			return err
+		}
+		l.logger.Info("network changed, announcing again")
+	}
+}
+
+// setAccepting re-announces the TXT record with the new accepting state. dnssd browsers only read the
+// TXT record when a service is first found: the peers learn the new state from our multicast announcement,
+// sent right away, or from their next probe, see probe.
+func (l *LocalShairer) setAccepting(accepting bool) {
+	l.announceNow()
+
+	l.amu.Lock()
+	defer l.amu.Unlock()
+
+	if l.handle == nil {
 		return
 	}
+
+	l.handle.UpdateText(l.txtRecord(accepting), l.responder)
+}
+
+// isSelf tells whether e is our own announcement. It may be found without its TXT record, it is then
+// told by our name and port: dnssd makes sure no one else on the network uses the name.
+func (l *LocalShairer) isSelf(e dnssd.BrowseEntry) bool {
+	if id, found := e.Text[txtInstanceID]; found {
+		return id == l.instanceID
+	}
+
+	l.amu.Lock()
+	defer l.amu.Unlock()
+	return (e.Name == l.name || e.Name == l.announcedName) && e.Port == l.Port()
 }
 
 // Discover continuously listens for mDNS service announcements from other nodes on the local network.
 // It filters services matching "_shair._tcp" and sends notifications through a channel
 // indicating whether a service was added or removed.
-// This function runs indefinitely until the provided context is canceled.
+// This function runs indefinitely until the provided context is canceled or the browser fails.
 func (l *LocalShairer) discover(
 	ctx context.Context,
 	peerCh chan<- shair.PeerUpdate,
-) {
+) error {
 	addFn := func(e dnssd.BrowseEntry) {
-		// TODO: figure out why it self discovers itself. for now, use that check to prevent self discovery
-		hostname, _ := os.Hostname()
-		if e.Name == hostname {
+		if !l.netFilter.allowsIface(e.IfaceName) {
+			return
+		}
+		e.IPs = l.netFilter.filterIPs(e.IPs)
+
+		// the browser also finds our own announcement. It tells us the name we ended up with:
+		// if another peer already uses the name we asked for, dnssd probing renames us, eg "laptop (2)"
+		if l.isSelf(e) {
+			l.amu.Lock()
+			renamed := l.announcedName != e.Name
+			l.announcedName = e.Name
+			l.amu.Unlock()
+
+			if renamed {
+				l.logger.Info("announced", "name", e.Name)
+				self := &shair.Device{Name: e.Name, DiscoveredOn: shair.Local}
+				parseTXT(e.Text, self)
+				peerCh <- shair.PeerUpdate{Peer: self, Status: shair.Self}
+			}
 			return
 		}
 
-		dvc := &shair.Device{
+		if len(e.IPs) == 0 {
+			return
+		}
+
+		// dnssd reports a peer once per network interface it was found on, merge the addresses
+		// of an already known peer
+		l.smu.Lock()
+		p, found := l.mdnsPeers[e.Name]
+		if !found {
+			p = &mdnsPeer{ifaces: make(map[string][]net.IPAddr)}
+			l.mdnsPeers[e.Name] = p
+		}
+		p.ifaces[e.IfaceName] = ipAddrs(e.IPs, e.IfaceName)
+		p.device = shair.Device{
 			Name:         e.Name,
 			DiscoveredOn: shair.Local,
 			LocalInfo: shair.LocalInfo{
-				IP:      e.IPs[0],
+				Addrs:   p.addrs(),
 				SvcPort: e.Port,
 			},
 		}
-		peerCh <- shair.PeerUpdate{Peer: dvc, Status: shair.Discovered}
-
-		// store the device in the service to device map
-		l.smu.Lock()
-		defer l.smu.Unlock()
-		l.serviceToDevice[e.Name] = dvc
+		parseTXT(e.Text, &p.device)
+		dvc := p.device
+		l.smu.Unlock()
 
-		// store the tcp info in the device to tcp map
-		l.dmu.Lock()
-		defer l.dmu.Unlock()
-		l.deviceToTCP[dvc] = tcpInfo{e.IPs[0], e.Port}
+		l.logger.Debug("peer found", "source", mdnsSource, "peer", dvc.Name, "id", dvc.ID, "iface", e.IfaceName, "port", dvc.SvcPort)
+		l.registry.Upsert(mdnsSource, dvc)
 	}
 
 	rmvFn := func(e dnssd.BrowseEntry) {
-		// get the device associated with the service
-		dvcToRmv, found := l.serviceToDevice[e.Name]
+		l.smu.Lock()
+		p, found := l.mdnsPeers[e.Name]
 		if !found {
-			// shouldn't reach there
+			// our own announcement, or a peer without address
+			l.smu.Unlock()
 			return
 		}
 
-		// send update through channel
-		peerCh <- shair.PeerUpdate{Peer: dvcToRmv, Status: shair.Removed}
-
-		// delete entries in the maps
-		l.smu.Lock()
-		defer l.smu.Unlock()
-		delete(l.serviceToDevice, e.Name)
+		// the peer is gone from one interface, it is only removed once gone from all of them
+		delete(p.ifaces, e.IfaceName)
+		p.device.Addrs = p.addrs()
+		dvc := p.device
+		if len(p.ifaces) == 0 {
+			delete(l.mdnsPeers, e.Name)
+		}
+		l.smu.Unlock()
 
-		l.dmu.Lock()
-		defer l.dmu.Unlock()
-		delete(l.deviceToTCP, dvcToRmv)
+		if len(dvc.Addrs) == 0 {
+			l.logger.Debug("peer lost", "source", mdnsSource, "peer", dvc.Name, "id", dvc.ID)
+			l.registry.Remove(mdnsSource, dvc.Key())
+		} else {
+			l.registry.Upsert(mdnsSource, dvc)
+		}
 	}
 
 	svc := fmt.Sprintf("%s.local.", MDNSSERVICE)
-	dnssd.LookupType(ctx, svc, addFn, rmvFn)
+	err := dnssd.LookupType(ctx, svc, addFn, rmvFn)
+	if err != nil && ctx.Err() == nil {
+		return shair.NewError(shair.ServiceError, "mdns browser stopped", err)
+	}
+
+	return nil
 }
@@ -0,0 +1,79 @@
+package local
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+)
+
+// the first two bytes sent on a connection tell the receiver what the peer wants. A transfer starts
+// with its header, whose size is at least minHeaderSize: the smaller values announce the other messages.
+const (
+	msgIdentify uint16 = 1 // the peer asks who we are, we answer with encodeIdentity
+	msgPing     uint16 = 2 // the peer checks we are alive, we answer with msgPing
+
+	minHeaderSize = 4
+)
+
+// readMessage reads the first two bytes of a connection: a message kind or the size of a header.
+func readMessage(r io.Reader) (uint16, error) {
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, fmt.Errorf("failed to read message: %w", err)
+	}
+	return binary.BigEndian.Uint16(buf), nil
+}
+
+func writeMessage(w io.Writer, kind uint16) error {
+	_, err := w.Write(binary.BigEndian.AppendUint16(nil, kind))
+	return err
+}
+
+// encodeIdentity encodes the TXT record of a device the way DNS does: the length of the record
+// on 2 bytes, then each "key=value" entry prefixed by its length on 1 byte. Entries that don't fit
+// in 255 bytes are dropped.
+func encodeIdentity(txt map[string]string) []byte {
+	p := make([]byte, 2)
+	for _, k := range slices.Sorted(maps.Keys(txt)) {
+		entry := k + "=" + txt[k]
+		if len(entry) > math.MaxUint8 || len(p)+1+len(entry) > math.MaxUint16 {
+			continue
+		}
+		p = append(p, uint8(len(entry)))
+		p = append(p, entry...)
+	}
+	binary.BigEndian.PutUint16(p, uint16(len(p)-2))
+
+	return p
+}
+
+// readIdentity reads a TXT record encoded by encodeIdentity.
+func readIdentity(r io.Reader) (map[string]string, error) {
+	size := make([]byte, 2)
+	if _, err := io.ReadFull(r, size); err != nil {
+		return nil, fmt.Errorf("failed to read identity size: %w", err)
+	}
+
+	p := make([]byte, binary.BigEndian.Uint16(size))
+	if _, err := io.ReadFull(r, p); err != nil {
+		return nil, fmt.Errorf("failed to read identity: %w", err)
+	}
+
+	txt := make(map[string]string)
+	for len(p) > 0 {
+		n := int(p[0])
+		if 1+n > len(p) {
+			return nil, errors.New("identity is truncated")
+		}
+		k, v, _ := strings.Cut(string(p[1:1+n]), "=")
+		txt[k] = v
+		p = p[1+n:]
+	}
+
+	return txt, nil
+}
@@ -0,0 +1,257 @@
+package local
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/masar3141/shair"
+	"golang.org/x/net/ipv4"
+)
+
+// Discovery selects the mechanisms used to discover peers and to be discovered by them.
+type Discovery uint8
+
+const (
+	DiscoveryMDNS      Discovery = 1 << iota // mDNS service announcements, see MDNSSERVICE
+	DiscoveryMulticast                       // announcements sent to a UDP multicast group, for networks where mDNS is unreliable
+)
+
+// WithDiscovery selects the discovery mechanisms, both mDNS and multicast are used by default.
+func WithDiscovery(d Discovery) Option {
+	return func(ls *LocalShairer) {
+		ls.discovery = d
+	}
+}
+
+// multicast announcements are sent to an administratively scoped group, so they don't leave the site
+var multicastGroup = &net.UDPAddr{IP: net.IPv4(239, 255, 83, 72), Port: 8086}
+
+const (
+	multicastInterval = 30 * time.Second      // how often we announce ourselves
+	multicastTTL      = 3 * multicastInterval // peers not heard of for that long are removed
+
+	// name of the multicast discovery in the peer registry
+	multicastSource = "multicast"
+)
+
+// a multicast packet is the magic followed by its kind and the TXT record of the device, see encodeIdentity
+var multicastMagic = []byte("shair")
+
+const (
+	mcHello   byte = 1 // sent when we start announcing, peers answer with mcAlive so that we learn them right away
+	mcAlive   byte = 2 // sent periodically and in answer to mcHello
+	mcGoodbye byte = 3 // sent when we stop announcing
+)
+
+// txt key carrying the port of the tcp server in multicast packets, mDNS carries it in the service record
+const txtPort = "port"
+
+func (l *LocalShairer) multicastPacket(kind byte) []byte {
+	txt := l.identity()
+	txt[txtPort] = strconv.Itoa(l.Port())
+
+	p := append(slices.Clone(multicastMagic), kind)
+	return append(p, encodeIdentity(txt)...)
+}
+
+func parseMulticastPacket(p []byte) (byte, map[string]string, error) {
+	if !bytes.HasPrefix(p, multicastMagic) || len(p) < len(multicastMagic)+1 {
+		return 0, nil, errors.New("not a shair packet")
+	}
+	kind := p[len(multicastMagic)]
+
+	txt, err := readIdentity(bytes.NewReader(p[len(multicastMagic)+1:]))
+	return kind, txt, err
+}
+
+// multicastIfaces returns the allowed interfaces able to send and receive IPv4 multicast.
+func (l *LocalShairer) multicastIfaces() []net.Interface {
+	allowed, err := l.netFilter.resolve()
+	if err != nil {
+		return nil
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	return slices.DeleteFunc(ifaces, func(iface net.Interface) bool {
+		hasV4 := slices.ContainsFunc(allowed[iface.Name], func(ip net.IP) bool { return ip.To4() != nil })
+		return iface.Flags&net.FlagMulticast == 0 || !hasV4
+	})
+}
+
+// announceMulticast sends our announcement to the multicast group on every allowed interface: once
+// when starting, then every multicastInterval, when a new peer says hello or when our state changes. A goodbye is sent when ctx is done.
+func (l *LocalShairer) announceMulticast(ctx context.Context) error {
+	c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return shair.NewError(shair.ServiceError, "couldn't open the multicast announcement socket", err)
+	}
+	defer c.Close()
+
+	pc := ipv4.NewPacketConn(c)
+	_ = pc.SetMulticastLoopback(true) // let peers running on this host hear us
+	_ = pc.SetMulticastTTL(1)
+
+	send := func(kind byte) {
+		p := l.multicastPacket(kind)
+		for _, iface := range l.multicastIfaces() {
+			if err := pc.SetMulticastInterface(&iface); err != nil {
+				continue
+			}
+			if _, err := pc.WriteTo(p, nil, multicastGroup); err != nil {
+				l.logger.Debug("cannot send multicast announcement", "iface", iface.Name, "err", err)
+			}
+		}
+	}
+
+	send(mcHello)
+
+	t := time.NewTicker(multicastInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			send(mcGoodbye)
+			return nil
+		case <-t.C:
+			send(mcAlive)
+		case <-l.mcAnnounce:
+			send(mcAlive)
+		}
+	}
+}
+
+// discoverMulticast listens to the announcements sent to the multicast group and records the peers
+// in the registry, where they are merged with the ones found by mDNS thanks to their device ID.
+func (l *LocalShairer) discoverMulticast(ctx context.Context) error {
+	c, err := net.ListenUDP("udp4", multicastGroup)
+	if err != nil {
+		return shair.NewError(shair.ServiceError, "couldn't listen to the multicast group", err)
+	}
+
+	pc := ipv4.NewPacketConn(c)
+	_ = pc.SetControlMessage(ipv4.FlagInterface, true)
+
+	// interfaces come and go with the network, join the group on the new ones from time to time.
+	// Joining an interface twice fails, which is fine
+	join := func() {
+		for _, iface := range l.multicastIfaces() {
+			_ = pc.JoinGroup(&iface, multicastGroup)
+		}
+	}
+	join()
+
+	seen := make(map[string]time.Time) // last time each peer was heard of, by key
+	mu := sync.Mutex{}
+
+	go func() {
+		t := time.NewTicker(netWatchInterval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				_ = c.Close()
+				return
+			case <-t.C:
+				join()
+
+				// forget the peers that went away without saying goodbye
+				mu.Lock()
+				for key, last := range seen {
+					if time.Since(last) > multicastTTL {
+						l.logger.Debug("peer expired", "source", multicastSource, "key", key)
+						delete(seen, key)
+						l.registry.Remove(multicastSource, key)
+					}
+				}
+				mu.Unlock()
+			}
+		}
+	}()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, cm, src, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return shair.NewError(shair.ServiceError, "multicast listener stopped", err)
+		}
+
+		udpSrc, ok := src.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		// control messages are not implemented on windows, the interface filter can't be applied there
+		if cm != nil && len(l.netFilter.ifaces) != 0 {
+			iface, err := net.InterfaceByIndex(cm.IfIndex)
+			if err != nil || !l.netFilter.allowsIface(iface.Name) {
+				continue
+			}
+		}
+
+		mu.Lock()
+		hello := l.onMulticastPacket(buf[:n], udpSrc.IP, seen)
+		mu.Unlock()
+
+		// a new peer wants to know who is around
+		if hello {
+			l.announceNow()
+		}
+	}
+}
+
+// onMulticastPacket records in the registry the peer announcing itself with the packet p, received
+// from src, and when it was heard of in seen. Our own packets, malformed ones and those from addresses
+// that aren't allowed are ignored. It returns whether the peer said hello.
+func (l *LocalShairer) onMulticastPacket(p []byte, src net.IP, seen map[string]time.Time) bool {
+	kind, txt, err := parseMulticastPacket(p)
+	if err != nil || txt[txtInstanceID] == l.instanceID || !l.netFilter.allowsIP(src) {
+		return false
+	}
+
+	dvc := shair.Device{Name: txt[txtName], DiscoveredOn: shair.Local}
+	parseTXT(txt, &dvc)
+	dvc.SvcPort, _ = strconv.Atoi(txt[txtPort])
+	dvc.Addrs = []net.IPAddr{{IP: src}}
+	if dvc.SvcPort == 0 {
+		return false
+	}
+
+	_, known := seen[dvc.Key()]
+	if kind == mcGoodbye {
+		l.logger.Debug("peer left", "source", multicastSource, "peer", dvc.Name, "id", dvc.ID)
+		delete(seen, dvc.Key())
+		l.registry.Remove(multicastSource, dvc.Key())
+		return false
+	}
+
+	if !known {
+		l.logger.Debug("peer found", "source", multicastSource, "peer", dvc.Name, "id", dvc.ID, "addr", src.String(), "port", dvc.SvcPort)
+	}
+	seen[dvc.Key()] = time.Now()
+	l.registry.Upsert(multicastSource, dvc)
+
+	return kind == mcHello
+}
+
+// announceNow has the multicast announcer send our announcement without waiting for the next one.
+func (l *LocalShairer) announceNow() {
+	select {
+	case l.mcAnnounce <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,127 @@
+package local
+
+import (
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/masar3141/shair"
+)
+
+// newAnnouncer returns a LocalShairer announcing itself as name, with the device id, on port.
+func newAnnouncer(name string, id string, port int, opts ...Option) *LocalShairer {
+	l := NewLocalShairer(slog.New(slog.DiscardHandler), port, append([]Option{WithDeviceID(id)}, opts...)...)
+	l.name = name
+	l.boundPort.Store(int32(port))
+	return l
+}
+
+func TestMulticastPacketRoundTrip(t *testing.T) {
+	l := newAnnouncer("laptop", "id-laptop", 8085)
+
+	for _, kind := range []byte{mcHello, mcAlive, mcGoodbye} {
+		got, txt, err := parseMulticastPacket(l.multicastPacket(kind))
+		if err != nil || got != kind || txt[txtName] != "laptop" || txt[txtID] != "id-laptop" || txt[txtPort] != "8085" || txt[txtInstanceID] != l.instanceID {
+			t.Fatalf("got kind %d, %v, %v, want the packet of kind %d", got, txt, err, kind)
+		}
+	}
+}
+
+func TestParseMulticastPacketMalformed(t *testing.T) {
+	valid := newAnnouncer("laptop", "id-laptop", 8085).multicastPacket(mcAlive)
+
+	tests := []struct {
+		name string
+		p    []byte
+	}{
+		{name: "empty"},
+		{name: "another magic", p: append([]byte("shaun"), valid[len(multicastMagic):]...)},
+		{name: "magic only", p: multicastMagic},
+		{name: "no identity", p: valid[:len(multicastMagic)+1]},
+		{name: "truncated size", p: valid[:len(multicastMagic)+2]},
+		{name: "truncated identity", p: valid[:len(valid)-1]},
+		{name: "truncated entry", p: append(slices.Clone(valid[:len(multicastMagic)+1]), 0, 3, 5, 'a', 'b')},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if kind, txt, err := parseMulticastPacket(tt.p); err == nil {
+				t.Fatalf("got kind %d, %v, want an error", kind, txt)
+			}
+		})
+	}
+}
+
+func TestOnMulticastPacket(t *testing.T) {
+	peer := newAnnouncer("laptop", "id-laptop", 8085)
+	src := net.ParseIP("192.168.1.20")
+
+	tests := []struct {
+		name  string
+		opts  []Option
+		p     func(l *LocalShairer) []byte // packet received by l
+		src   net.IP
+		hello bool
+		found bool
+	}{
+		{name: "hello", p: func(*LocalShairer) []byte { return peer.multicastPacket(mcHello) }, src: src, hello: true, found: true},
+		{name: "alive", p: func(*LocalShairer) []byte { return peer.multicastPacket(mcAlive) }, src: src, found: true},
+		{name: "our own", p: func(l *LocalShairer) []byte { return l.multicastPacket(mcHello) }, src: src},
+		{name: "not listening", p: func(*LocalShairer) []byte { return newAnnouncer("laptop", "id-laptop", 0).multicastPacket(mcHello) }, src: src},
+		{name: "malformed", p: func(*LocalShairer) []byte { return []byte("shair") }, src: src},
+		{
+			name: "address not allowed", opts: []Option{WithCIDRs(netip.MustParsePrefix("10.0.0.0/8"))},
+			p: func(*LocalShairer) []byte { return peer.multicastPacket(mcHello) }, src: src,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newAnnouncer("desktop", "id-desktop", 8086, tt.opts...)
+			seen := make(map[string]time.Time)
+
+			if hello := l.onMulticastPacket(tt.p(l), tt.src, seen); hello != tt.hello {
+				t.Fatalf("got hello %v, want %v", hello, tt.hello)
+			}
+			got, found := l.registry.Get("id-laptop")
+			if found != tt.found || len(seen) != len(l.registry.Snapshot()) {
+				t.Fatalf("got %+v found %v, seen %v, want found %v", got, found, seen, tt.found)
+			}
+			if found && (got.Name != "laptop" || got.SvcPort != 8085 || !slices.ContainsFunc(got.Addrs, func(a net.IPAddr) bool { return a.IP.Equal(src) })) {
+				t.Fatalf("got %+v, want laptop on %v:8085", got, src)
+			}
+
+			// the peer is gone once it says goodbye
+			l.onMulticastPacket(peer.multicastPacket(mcGoodbye), tt.src, seen)
+			if _, found := l.registry.Get("id-laptop"); found || len(seen) != 0 {
+				t.Fatalf("got the peer still there after its goodbye, seen %v", seen)
+			}
+		})
+	}
+}
+
+func TestOnMulticastPacketMergesMDNS(t *testing.T) {
+	l := newAnnouncer("desktop", "id-desktop", 8086)
+	peer := newAnnouncer("laptop", "id-laptop", 8085)
+
+	// the same device found by mDNS on its v6 address, and by multicast on its v4 one
+	mdns := shair.Device{ID: "id-laptop", Name: "laptop", DiscoveredOn: shair.Local, LocalInfo: shair.LocalInfo{Addrs: addrs("fd00::20"), SvcPort: 8085}}
+	l.registry.Upsert(mdnsSource, mdns)
+	seen := make(map[string]time.Time)
+	l.onMulticastPacket(peer.multicastPacket(mcAlive), net.ParseIP("192.168.1.20"), seen)
+
+	peers := l.registry.Snapshot()
+	if len(peers) != 1 || len(peers[0].Addrs) != 2 {
+		t.Fatalf("got %+v, want laptop once with both its addresses", peers)
+	}
+
+	// it stays as long as mDNS still sees it
+	l.onMulticastPacket(peer.multicastPacket(mcGoodbye), net.ParseIP("192.168.1.20"), seen)
+	peers = l.registry.Snapshot()
+	if len(peers) != 1 || len(peers[0].Addrs) != 1 || peers[0].Addrs[0].String() != "fd00::20" {
+		t.Fatalf("got %+v, want laptop left with its mDNS address", peers)
+	}
+}
@@ -0,0 +1,170 @@
+package local
+
+import (
+	"context"
+	"maps"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+)
+
+// how often the network interfaces are checked for changes while announcing, a variable for the tests
+var netWatchInterval = 5 * time.Second
+
+// netFilter restricts the network interfaces and addresses used to announce, discover and
+// receive. An empty list allows everything.
+type netFilter struct {
+	ifaces []string       // names of the allowed interfaces
+	cidrs  []netip.Prefix // networks the allowed addresses belong to
+}
+
+// WithInterfaces restricts the LocalShairer to the network interfaces with the given names, eg "wlan0".
+func WithInterfaces(names ...string) Option {
+	return func(ls *LocalShairer) {
+		ls.netFilter.ifaces = append(ls.netFilter.ifaces, names...)
+	}
+}
+
+// WithCIDRs restricts the LocalShairer to addresses belonging to one of the given networks,
+// eg 192.168.1.0/24. Interfaces without such an address are not used at all.
+func WithCIDRs(prefixes ...netip.Prefix) Option {
+	return func(ls *LocalShairer) {
+		ls.netFilter.cidrs = append(ls.netFilter.cidrs, prefixes...)
+	}
+}
+
+func (f netFilter) empty() bool {
+	return len(f.ifaces) == 0 && len(f.cidrs) == 0
+}
+
+func (f netFilter) allowsIface(name string) bool {
+	return len(f.ifaces) == 0 || slices.Contains(f.ifaces, name)
+}
+
+func (f netFilter) allowsIP(ip net.IP) bool {
+	if len(f.cidrs) == 0 {
+		return true
+	}
+
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+
+	return slices.ContainsFunc(f.cidrs, func(p netip.Prefix) bool { return p.Contains(addr.Unmap()) })
+}
+
+// filterIPs returns the allowed IPs among ips.
+func (f netFilter) filterIPs(ips []net.IP) []net.IP {
+	return slices.DeleteFunc(slices.Clone(ips), func(ip net.IP) bool { return !f.allowsIP(ip) })
+}
+
+// upAddrs returns the addresses of the network interfaces that are up, by interface name.
+// Tests replace it to change the network.
+var upAddrs = func() (map[string][]net.IP, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string][]net.IP)
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok {
+				res[iface.Name] = append(res[iface.Name], ipnet.IP)
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// resolve returns the allowed interfaces that are up with at least one allowed address, along with
+// those addresses. Interfaces are resolved every time since they come and go with the network.
+func (f netFilter) resolve() (map[string][]net.IP, error) {
+	up, err := upAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string][]net.IP)
+	for name, ips := range up {
+		if !f.allowsIface(name) {
+			continue
+		}
+		if ips = f.filterIPs(ips); len(ips) != 0 {
+			res[name] = ips
+		}
+	}
+
+	return res, nil
+}
+
+// allowsLocal tells whether a connection received on the local address ip may be handled.
+func (f netFilter) allowsLocal(ip net.IP) bool {
+	if f.empty() {
+		return true
+	}
+
+	ifaces, err := f.resolve()
+	if err != nil {
+		return false
+	}
+
+	for _, ips := range ifaces {
+		if slices.ContainsFunc(ips, ip.Equal) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// signature describes the allowed interfaces and their addresses, it changes with the network.
+func (f netFilter) signature() string {
+	ifaces, err := f.resolve()
+	if err != nil {
+		return ""
+	}
+
+	var b strings.Builder
+	for _, name := range slices.Sorted(maps.Keys(ifaces)) {
+		b.WriteString(name)
+		for _, ip := range ifaces[name] {
+			b.WriteString(" " + ip.String())
+		}
+		b.WriteString("\n")
+	}
+
+	return b.String()
+}
+
+// waitChange blocks until the signature of the network changes, in which case it returns true,
+// or until ctx is done.
+func (f netFilter) waitChange(ctx context.Context) bool {
+	t := time.NewTicker(netWatchInterval)
+	defer t.Stop()
+
+	last := f.signature()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-t.C:
+			if f.signature() != last {
+				return true
+			}
+		}
+	}
+}
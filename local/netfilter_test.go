@@ -0,0 +1,88 @@
+package local
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNetFilter(t *testing.T) {
+	ips := []net.IP{net.ParseIP("192.168.1.2"), net.ParseIP("10.0.0.2"), net.ParseIP("::ffff:192.168.1.3"), net.ParseIP("fd00::2")}
+
+	tests := []struct {
+		name    string
+		filter  netFilter
+		iface   string
+		allowed bool
+		ips     []string
+	}{
+		{name: "no filter", iface: "eth0", allowed: true, ips: []string{"192.168.1.2", "10.0.0.2", "192.168.1.3", "fd00::2"}},
+		{name: "interface listed", filter: netFilter{ifaces: []string{"eth0"}}, iface: "eth0", allowed: true, ips: []string{"192.168.1.2", "10.0.0.2", "192.168.1.3", "fd00::2"}},
+		{name: "interface not listed", filter: netFilter{ifaces: []string{"eth0"}}, iface: "wlan0", ips: []string{"192.168.1.2", "10.0.0.2", "192.168.1.3", "fd00::2"}},
+		{name: "v4 network", filter: netFilter{cidrs: []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24")}}, iface: "eth0", allowed: true, ips: []string{"192.168.1.2", "192.168.1.3"}},
+		{name: "v6 network", filter: netFilter{cidrs: []netip.Prefix{netip.MustParsePrefix("fd00::/8")}}, iface: "eth0", allowed: true, ips: []string{"fd00::2"}},
+		{name: "no network matching", filter: netFilter{cidrs: []netip.Prefix{netip.MustParsePrefix("172.16.0.0/12")}}, iface: "eth0", allowed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.allowsIface(tt.iface); got != tt.allowed {
+				t.Fatalf("got %s allowed %v, want %v", tt.iface, got, tt.allowed)
+			}
+
+			got := tt.filter.filterIPs(ips)
+			if !slices.EqualFunc(got, tt.ips, func(ip net.IP, s string) bool { return ip.Equal(net.ParseIP(s)) }) {
+				t.Fatalf("got %v, want %v", got, tt.ips)
+			}
+		})
+	}
+}
+
+func TestNetFilterWaitChange(t *testing.T) {
+	interval, up := netWatchInterval, upAddrs
+	defer func() { netWatchInterval, upAddrs = interval, up }()
+	netWatchInterval = 10 * time.Millisecond
+
+	// network is the network the next checks see
+	network := make(chan map[string][]net.IP, 1)
+	current := map[string][]net.IP{"eth0": {net.ParseIP("192.168.1.2")}, "docker0": {net.ParseIP("172.17.0.1")}}
+	upAddrs = func() (map[string][]net.IP, error) {
+		select {
+		case current = <-network:
+		default:
+		}
+		return current, nil
+	}
+	f := netFilter{ifaces: []string{"eth0"}}
+
+	tests := []struct {
+		name    string
+		network map[string][]net.IP
+		changed bool
+	}{
+		{name: "same network", network: current},
+		{name: "change on an interface not used", network: map[string][]net.IP{"eth0": {net.ParseIP("192.168.1.2")}}},
+		{name: "new address", network: map[string][]net.IP{"eth0": {net.ParseIP("192.168.1.2"), net.ParseIP("fd00::2")}}, changed: true},
+		{name: "interface down", network: map[string][]net.IP{}, changed: true},
+		{name: "interface up", network: map[string][]net.IP{"eth0": {net.ParseIP("192.168.1.9")}}, changed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+
+			// the network changes once the announce took the signature of the current one
+			go func() {
+				time.Sleep(5 * netWatchInterval)
+				network <- tt.network
+			}()
+			if got := f.waitChange(ctx); got != tt.changed {
+				t.Fatalf("got changed %v, want %v", got, tt.changed)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package local
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/masar3141/shair"
+)
+
+const (
+	defaultProbeInterval = 10 * time.Second
+	pingTimeout          = 3 * time.Second
+
+	// a peer missing that many probes in a row is unreachable, a single miss only makes it stale
+	unreachableAfter = 3
+)
+
+// WithProbeInterval sets how often the discovered peers are pinged to measure their reachability,
+// 0 disables the probes.
+func WithProbeInterval(d time.Duration) Option {
+	return func(ls *LocalShairer) {
+		ls.probeInterval = d
+	}
+}
+
+// probe pings every peer of the registry reachable over the local network every probeInterval
+// and records whether it answered, how fast, and whether it accepts transfers, in the registry.
+func (l *LocalShairer) probe(ctx context.Context) error {
+	if l.probeInterval <= 0 {
+		<-ctx.Done()
+		return nil
+	}
+
+	misses := make(map[string]int) // number of probes missed in a row, by peer key
+	mu := sync.Mutex{}
+
+	t := time.NewTicker(l.probeInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+
+		peers := slices.DeleteFunc(l.registry.Snapshot(), func(p shair.Device) bool {
+			// peers not advertising the ping capability would take our ping for a broken header
+			return p.DiscoveredOn != shair.Local || p.SvcPort == 0 || !slices.Contains(p.Capabilities, shair.CapPing)
+		})
+
+		wg := sync.WaitGroup{}
+		for _, p := range peers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				rtt, accepting, err := l.ping(ctx, p)
+				if ctx.Err() != nil {
+					return
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+
+				if err == nil {
+					misses[p.Key()] = 0
+					l.registry.SetReachability(p.Key(), shair.Reachable, rtt)
+					l.registry.SetAccepting(p.Key(), accepting)
+					return
+				}
+
+				misses[p.Key()]++
+				reach := shair.Stale
+				if misses[p.Key()] >= unreachableAfter {
+					reach = shair.Unreachable
+				}
+				l.logger.Debug("peer missed a probe", "peer", p.Name, "misses", misses[p.Key()], "err", err)
+				l.registry.SetReachability(p.Key(), reach, 0)
+			}()
+		}
+		wg.Wait()
+
+		// forget the peers that left the registry
+		mu.Lock()
+		for key := range misses {
+			if !slices.ContainsFunc(peers, func(p shair.Device) bool { return p.Key() == key }) {
+				delete(misses, key)
+			}
+		}
+		mu.Unlock()
+	}
+}
+
+// ping connects to the peer and measures the round trip time of a msgIdentify, connection excluded.
+// Its answer tells whether the peer currently accepts transfers, which mDNS browsers only learn once.
+func (l *LocalShairer) ping(ctx context.Context, peer shair.Device) (time.Duration, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+
+	dialer := net.Dialer{Timeout: pingTimeout}
+	conn, _, err := dialRace(ctx, &dialer, dialOrder(peer), peer.SvcPort)
+	if err != nil {
+		return 0, false, err
+	}
+	defer conn.Close()
+
+	dl, _ := ctx.Deadline()
+	_ = conn.SetDeadline(dl)
+
+	start := time.Now()
+	if err := writeMessage(conn, msgIdentify); err != nil {
+		return 0, false, err
+	}
+
+	txt, err := readIdentity(conn)
+	if err != nil {
+		return 0, false, err
+	}
+	if txt[txtID] != peer.ID {
+		return 0, false, fmt.Errorf("another device, %q, answered the ping", txt[txtName])
+	}
+
+	return time.Since(start), txt[txtAccepting] == "1", nil
+}
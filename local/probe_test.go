@@ -0,0 +1,128 @@
+package local
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/masar3141/shair"
+)
+
+func TestProbe(t *testing.T) {
+	receiver := NewLocalShairer(slog.New(slog.DiscardHandler), 0, WithDeviceID("id-receiver"))
+	rctx, stopReceiver := context.WithCancel(context.Background())
+	defer stopReceiver()
+	ln, err := receiver.bind(rctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listening := make(chan struct{})
+	go func() {
+		defer close(listening)
+		_ = receiver.listen(rctx, ln, t.TempDir(), make(chan shair.TransferRequest))
+	}()
+
+	dvc := shair.Device{Name: "receiver", DiscoveredOn: shair.Local, LocalInfo: shair.LocalInfo{Addrs: addrs("127.0.0.1"), SvcPort: receiver.Port()}}
+	parseTXT(receiver.txtRecord(true), &dvc)
+
+	prober := NewLocalShairer(slog.New(slog.DiscardHandler), 0, WithProbeInterval(20*time.Millisecond))
+	prober.registry.Upsert(mdnsSource, dvc)
+	updates, unsubscribe := prober.registry.Subscribe()
+	defer unsubscribe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	probing := make(chan struct{})
+	go func() {
+		defer close(probing)
+		_ = prober.probe(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-probing
+	}()
+
+	// waitReach waits for the receiver to be probed as reach
+	waitReach := func(reach shair.Reachability) shair.Device {
+		t.Helper()
+
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case pu := <-updates:
+				if pu.Status == shair.ReachabilityChanged && pu.Peer.Reachability == reach {
+					return *pu.Peer
+				}
+			case <-timeout:
+				t.Fatalf("the receiver never became %v", reach)
+			}
+		}
+	}
+
+	if got := waitReach(shair.Reachable); !got.Accepting || got.RTT <= 0 {
+		t.Fatalf("got %+v, want the receiver accepting with its round trip time", got)
+	}
+
+	// the receiver stops answering, it misses a probe then several
+	stopReceiver()
+	<-listening
+	waitReach(shair.Stale)
+	waitReach(shair.Unreachable)
+}
+
+func TestPingReply(t *testing.T) {
+	l := NewLocalShairer(slog.New(slog.DiscardHandler), 0, WithDeviceID("id"))
+
+	tests := []struct {
+		name string
+		msg  uint16
+		read func(conn net.Conn) error // reads the answer
+	}{
+		{
+			name: "ping",
+			msg:  msgPing,
+			read: func(conn net.Conn) error {
+				msg, err := readMessage(conn)
+				if err == nil && msg != msgPing {
+					t.Errorf("got the message %d, want a ping", msg)
+				}
+				return err
+			},
+		},
+		{
+			name: "identify",
+			msg:  msgIdentify,
+			read: func(conn net.Conn) error {
+				txt, err := readIdentity(conn)
+				if err == nil && txt[txtID] != "id" {
+					t.Errorf("got the identity %v, want id", txt)
+				}
+				return err
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, peer := net.Pipe()
+			defer peer.Close()
+
+			done := make(chan error, 1)
+			go func() {
+				done <- l.ServeConn(context.Background(), t.TempDir(), conn, &shair.Device{Name: "peer"}, make(chan shair.TransferRequest))
+			}()
+
+			_ = peer.SetDeadline(time.Now().Add(5 * time.Second))
+			if err := writeMessage(peer, tt.msg); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.read(peer); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-done; err != nil {
+				t.Fatalf("answering failed: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package local
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/masar3141/shair"
+)
+
+// the receiver answers a header with a single byte: replyAccepted, or replyRejected followed by
+// the reason code, the length of the message on 2 bytes and the message itself.
+const (
+	replyRejected byte = 0
+	replyAccepted byte = 1
+)
+
+func encodeRejection(r shair.RejectedError) []byte {
+	msg := r.Message
+	if len(msg) > math.MaxUint16 {
+		msg = msg[:math.MaxUint16]
+	}
+
+	p := make([]byte, 4, 4+len(msg))
+	p[0] = replyRejected
+	p[1] = byte(r.Reason)
+	binary.BigEndian.PutUint16(p[2:], uint16(len(msg)))
+
+	return append(p, msg...)
+}
+
+// readRejection reads what follows a replyRejected byte.
+func readRejection(r io.Reader) (shair.RejectedError, error) {
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return shair.RejectedError{}, fmt.Errorf("failed to read rejection reason: %w", err)
+	}
+
+	msg := make([]byte, binary.BigEndian.Uint16(buf[1:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return shair.RejectedError{}, fmt.Errorf("failed to read rejection message: %w", err)
+	}
+
+	return shair.RejectedError{Reason: shair.RejectReason(buf[0]), Message: string(msg)}, nil
+}
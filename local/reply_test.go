@@ -0,0 +1,61 @@
+package local
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/masar3141/shair"
+)
+
+func TestRejectionRoundTrip(t *testing.T) {
+	var tests []shair.RejectedError
+	for reason := shair.ReasonDeclined; reason <= shair.ReasonTimeout; reason++ {
+		tests = append(tests, shair.RejectedError{Reason: reason, Message: reason.String()})
+	}
+	tests = append(tests, shair.RejectedError{Reason: shair.ReasonDeclined}, shair.RejectedError{Reason: shair.ReasonBusy, Message: "déjà occupé"})
+
+	for _, want := range tests {
+		t.Run(want.Reason.String(), func(t *testing.T) {
+			sender, receiver := net.Pipe()
+			defer sender.Close()
+			defer receiver.Close()
+
+			go func() {
+				_, _ = receiver.Write(encodeRejection(want))
+			}()
+
+			reply := make([]byte, 1)
+			if _, err := io.ReadFull(sender, reply); err != nil || reply[0] != replyRejected {
+				t.Fatalf("got reply %v, %v, want a rejection", reply, err)
+			}
+			got, err := readRejection(sender)
+			if err != nil || got != want {
+				t.Fatalf("got %+v, %v, want %+v", got, err, want)
+			}
+		})
+	}
+}
+
+func TestRejectionLongMessage(t *testing.T) {
+	p := encodeRejection(shair.RejectedError{Reason: shair.ReasonDeclined, Message: strings.Repeat("x", math.MaxUint16+10)})
+
+	got, err := readRejection(bytes.NewReader(p[1:]))
+	if err != nil || len(got.Message) != math.MaxUint16 {
+		t.Fatalf("got a message of %d bytes, %v, want it cut to %d", len(got.Message), err, math.MaxUint16)
+	}
+}
+
+func TestRejectionTruncated(t *testing.T) {
+	p := encodeRejection(shair.RejectedError{Reason: shair.ReasonQuotaExceeded, Message: "too many files"})
+
+	// the reply without its first byte, cut anywhere
+	for n := range len(p) - 1 {
+		if got, err := readRejection(bytes.NewReader(p[1 : 1+n])); err == nil {
+			t.Fatalf("read %+v from the first %d bytes", got, n)
+		}
+	}
+}
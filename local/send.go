@@ -12,17 +12,28 @@ import (
 )
 
 type sender struct {
-	ctxConn contextConn
-	files   []*os.File
+	ctx      context.Context
+	ctxConn  contextConn
+	files    []*os.File
+	limiters []*shair.Limiter // every limiter is waited on before writing file data
 }
 
-func newSender(ctx context.Context, conn net.Conn, f []*os.File) sender {
+func newSender(ctx context.Context, conn net.Conn, f []*os.File, limiters ...*shair.Limiter) sender {
 	return sender{
-		ctxConn: newContextWriter(ctx, conn),
-		files:   f,
+		ctx:      ctx,
+		ctxConn:  newContextWriter(ctx, conn),
+		files:    f,
+		limiters: limiters,
 	}
 }
 
+// setDataConn swaps the connection used to stream the files, eg to apply idle deadlines once the
+// handshake is over. ctx replaces the sender's context.
+func (s *sender) setDataConn(ctx context.Context, conn net.Conn) {
+	s.ctx = ctx
+	s.ctxConn = newContextWriter(ctx, conn)
+}
+
 func (s sender) writeHeaderToConn(hdr *header) (int, error) {
 	bhdr := hdr.encode()
 
@@ -63,7 +74,8 @@ func (s sender) sendFiles(uploadProgressCh chan<- int) error {
 func (s sender) sendFile(fileNumber int, uploadProgressCh chan<- int) (int64, error) {
 	file := s.files[fileNumber]
 
-	multiWriter := io.MultiWriter(s.ctxConn, shair.NewProgressWriter(uploadProgressCh))
+	lw := shair.NewLimitedWriter(s.ctx, s.ctxConn, s.limiters...)
+	multiWriter := io.MultiWriter(lw, shair.NewProgressWriter(uploadProgressCh))
 
 	n, err := io.Copy(multiWriter, s.files[fileNumber])
 
@@ -9,22 +9,45 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"encoding/binary"
 
 	"github.com/masar3141/shair"
 )
 
+// bind listens on the port of the tcp server, or on the first free port of its range.
+func (s *LocalShairer) bind(ctx context.Context) (net.Listener, error) {
+	lnc := net.ListenConfig{KeepAlive: s.timeouts.keepAlive(), KeepAliveConfig: s.timeouts.KeepAlive}
+
+	last := max(s.port, s.lastPort)
+	var err error
+	for port := s.port; port <= last; port++ {
+		var ln net.Listener
+		ln, err = lnc.Listen(ctx, "tcp", fmt.Sprintf(":%d", port))
+		if err == nil {
+			s.boundPort.Store(int32(ln.Addr().(*net.TCPAddr).Port))
+			return ln, nil
+		}
+	}
+
+	if last != s.port {
+		return nil, shair.NewError(shair.ServiceError, fmt.Sprintf("unable to start server on any port from %d to %d", s.port, last), err)
+	}
+	return nil, shair.NewError(shair.ServiceError, fmt.Sprintf("unable to start server on port %d", s.port), err)
+}
+
+// listen serves the transfer requests received on ln until ctx is done.
 func (s *LocalShairer) listen(
 	ctx context.Context,
+	ln net.Listener,
 	saveDir string,
 	transferRequestCh chan<- shair.TransferRequest,
-) {
-	var lnc net.ListenConfig
-	ln, err := lnc.Listen(ctx, "tcp", fmt.Sprintf(":%d", s.port))
-	if err != nil {
-		panic(fmt.Errorf("unable to start server: %w", err))
-	}
+) error {
+	shair.ReportRunning(ctx, s.Port(), s.reachableAddrs())
 
 	// Close the listener when context is cancelled
 	go func() {
@@ -32,108 +55,273 @@ func (s *LocalShairer) listen(
 		_ = ln.Close()
 	}()
 
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
 			select {
 			case <-ctx.Done():
-				return // listener closed due to ctx cancellation
+				return nil // listener closed due to ctx cancellation
 			default:
 				continue
 			}
 		}
 
-		//TODO: error handling
-		_ = s.handleRequest(ctx, saveDir, conn, transferRequestCh)
+		// only handle connections received on the allowed interfaces
+		if local, ok := conn.LocalAddr().(*net.TCPAddr); ok && !s.netFilter.allowsLocal(local.IP) {
+			conn.Close()
+			continue
+		}
+
+		// handle requests concurrently so that a busy receiver can still tell other senders it is busy
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := shair.WithTransferID(ctx, shair.NewTransferID())
+			err := s.handleRequest(ctx, saveDir, conn, nil, transferRequestCh)
+			if err != nil {
+				s.logger.ErrorContext(ctx, "transfer request failed", "remote", conn.RemoteAddr().String(), "err", err)
+			}
+		}()
 	}
 }
 
-func (s *LocalShairer) handleRequest(
+// ServeConn handles a transfer request received from sender on conn, a connection established by
+// another Shairer, eg relayed and authenticated. The receiver's policies apply as for local requests.
+func (s *LocalShairer) ServeConn(
 	ctx context.Context,
 	saveDir string,
 	conn net.Conn,
+	sender *shair.Device,
 	transferRequestCh chan<- shair.TransferRequest,
 ) error {
+	return s.handleRequest(ctx, saveDir, conn, sender, transferRequestCh)
+}
+
+// handleRequest handles a request received on conn. The sender is identified by a reverse lookup
+// of the remote address when nil. A transfer is logged under the ID carried by ctx, a new one if none.
+func (s *LocalShairer) handleRequest(
+	ctx context.Context,
+	saveDir string,
+	conn net.Conn,
+	sender *shair.Device,
+	transferRequestCh chan<- shair.TransferRequest,
+) (err error) {
 	defer conn.Close()
+	ctx, id := shair.EnsureTransferID(ctx)
 
-	// read the header to send transferRequest to ui
-	hdr := s.readHeader(conn)
+	// read what the peer wants, either our identity or a transfer starting with its header
+	_ = conn.SetReadDeadline(deadline(s.timeouts.Handshake))
+	msg, err := readMessage(conn)
+	if err != nil {
+		return s.timeouts.wrapErr(ctx, shair.PhaseHandshake, "handshake", shair.InvalidHeaderError, "failed to read message", err)
+	}
 
-	// get the sender's hostname with a dns lookup
-	// TODO: remove and let client send its name within the header
-	remoteAddr := conn.RemoteAddr() // ← this is the client's address
-	remoteIP, _, err := net.SplitHostPort(remoteAddr.String())
-	names, err := net.LookupAddr(remoteIP)
+	switch msg {
+	case msgIdentify:
+		_ = conn.SetWriteDeadline(deadline(s.timeouts.Handshake))
+		_, err := conn.Write(encodeIdentity(s.identity()))
+		return err
+
+	case msgPing:
+		_ = conn.SetWriteDeadline(deadline(s.timeouts.Handshake))
+		return writeMessage(conn, msgPing)
+	}
+
+	// read the header to send transferRequest to ui
+	hdr, err := s.readHeader(conn, msg)
 	if err != nil {
-		// in my local setup virtual machines are not register in the router's dns table
-		// if the lookup fails, we set the name to unknown.
-		names = append(names, "unknown")
+		return s.timeouts.wrapErr(ctx, shair.PhaseHandshake, "handshake", shair.InvalidHeaderError, "failed to read header", err)
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	// quotas are tracked by the address of the sender, or its key when it is already identified
+	var peer string
+	if sender == nil {
+		// get the sender's hostname with a dns lookup
+		// TODO: remove and let client send its name within the header
+		remoteAddr := conn.RemoteAddr() // ← this is the client's address
+		remoteIP, _, _ := net.SplitHostPort(remoteAddr.String())
+		names, err := net.LookupAddr(remoteIP)
+		if err != nil {
+			// in my local setup virtual machines are not register in the router's dns table
+			// if the lookup fails, we set the name to unknown.
+			names = append(names, "unknown")
+		}
+
+		sender = &shair.Device{Name: names[0], DiscoveredOn: shair.Local}
+		peer = remoteIP
+	} else {
+		peer = sender.Key()
 	}
 
 	// send preview of requested file transfer to ui
 	fp := make([]shair.FilePreview, hdr.numFiles)
+	total := uint64(0)
 	for i := 0; i < int(hdr.numFiles); i++ {
 		fp[i] = shair.FilePreview{
 			Name: hdr.names[i],
 			Size: uint64(hdr.fileSize[i]),
 		}
+		total += fp[i].Size
+	}
+	s.logger.InfoContext(ctx, "transfer requested", "remote", conn.RemoteAddr().String(), "sender", sender.Name, "files", len(fp), "size", total)
+
+	// reject right away the requests we know we can't fulfill, without bothering the user
+	_ = conn.SetWriteDeadline(deadline(s.timeouts.Handshake))
+
+	if !s.busy.CompareAndSwap(false, true) {
+		s.reject(ctx, conn, shair.RejectedError{Reason: shair.ReasonBusy, Message: "another transfer is in progress"})
+		return nil
+	}
+	s.setAccepting(false)
+	defer func() {
+		s.busy.Store(false)
+		s.setAccepting(true)
+	}()
+
+	free, rejection := s.checkRequest(ctx, sender, peer, fp, saveDir)
+	if rejection != nil {
+		s.reject(ctx, conn, *rejection)
+		return nil
 	}
 
 	downloadProgressCh := make(chan int)
 	defer close(downloadProgressCh)
 
-	acceptCh := make(chan bool)
+	acceptCh := make(chan bool, 1)
+
+	// report the outcome to the ui before closing the progress channel
+	doneCh := make(chan error, 1)
+	defer func() { doneCh <- err }()
 
 	// notify ui transferRequest
-	sender := &shair.Device{Name: names[0], DiscoveredOn: shair.Local}
-	transferRequestCh <- shair.TransferRequest{
+	select {
+	case <-ctx.Done():
+		return nil
+	case transferRequestCh <- shair.TransferRequest{
+		ID:           id,
 		Sender:       sender,
 		FilePreviews: fp,
+		FreeSpace:    free,
 		AcceptCh:     acceptCh,
 		ProgressCh:   downloadProgressCh,
+		DoneCh:       doneCh,
+	}:
+	}
+
+	var acceptTimeout <-chan time.Time
+	if s.timeouts.Accept > 0 {
+		t := time.NewTimer(s.timeouts.Accept)
+		defer t.Stop()
+		acceptTimeout = t.C
 	}
 
-	// wait for user accepts or context cancelled
+	// wait for user accepts, the accept deadline or context cancelled
 	select {
 	case <-ctx.Done():
 		return nil
+	case <-acceptTimeout:
+		// tell the sender we gave up waiting
+		_ = conn.SetWriteDeadline(deadline(s.timeouts.Handshake))
+		s.reject(ctx, conn, shair.RejectedError{Reason: shair.ReasonTimeout, Message: "no answer to the request"})
+		return shair.NewError(
+			shair.ConnectionDroppedError,
+			"transfer request expired",
+			shair.TimeoutError{Phase: shair.PhaseAccept, Deadline: "accept", After: s.timeouts.Accept},
+		)
 	case accepts := <-acceptCh:
+		_ = conn.SetWriteDeadline(deadline(s.timeouts.Handshake))
 		if !accepts {
-			// send to sender reject bit
-			conn.Write([]byte{0})
-			// TODO: return custom err?
+			s.reject(ctx, conn, shair.RejectedError{Reason: shair.ReasonDeclined})
 			return nil
 		}
 	}
+	s.logger.InfoContext(ctx, "transfer accepted", "sender", sender.Name)
 
 	// send to sender confirmation bit
-	conn.Write([]byte{1})
+	conn.Write([]byte{replyAccepted})
+
+	// from now on, the connection expires when idle for too long or when the whole transfer takes too long
+	_ = conn.SetDeadline(time.Time{})
+	ctx, cancel := s.timeouts.withTotal(ctx, conn)
+	defer cancel()
+	dataConn := newIdleConn(ctx, conn, s.timeouts.Idle)
 
 	// save the files
 	for i := 0; i < int(hdr.numFiles); i++ {
 		size := hdr.fileSize[i]
-		read, err := s.readAndSaveFile(conn, hdr.names[i], size, saveDir, downloadProgressCh)
+		read, err := s.readAndSaveFile(ctx, dataConn, hdr.names[i], size, saveDir, downloadProgressCh)
+		s.quota.Record(peer, uint64(read))
 
 		if err != nil {
-			return fmt.Errorf("encode: can't read the file %s error: %w\n", hdr.names[i], err)
+			return s.timeouts.wrapErr(ctx, shair.PhaseTransfer, "idle", shair.UnexpectedError, fmt.Sprintf("can't read the file %s", hdr.names[i]), err)
 		}
 
 		if read != size {
-			return fmt.Errorf("encode: didn't read enough bytes for file %s", hdr.names[i])
+			return shair.NewError(shair.ConnectionDroppedError, fmt.Sprintf("didn't read enough bytes for file %s", hdr.names[i]), io.ErrUnexpectedEOF)
 		}
 	}
 
+	s.logger.InfoContext(ctx, "files received", "sender", sender.Name, "dir", saveDir, "size", total)
 	return nil
 }
 
-func (s *LocalShairer) readAndSaveFile(conn net.Conn, name string, size int64, saveDir string, downloadProgressCh chan<- int) (int64, error) {
+// checkRequest applies the receiver's policies to a request before it reaches the user.
+// It returns the free space in saveDir, 0 if unknown, and the rejection to send if the request can't be accepted.
+func (s *LocalShairer) checkRequest(ctx context.Context, sender *shair.Device, peer string, fp []shair.FilePreview, saveDir string) (uint64, *shair.RejectedError) {
+	if s.trust != nil && !s.trust(sender) {
+		return 0, &shair.RejectedError{Reason: shair.ReasonUntrusted}
+	}
+
+	total := uint64(0)
+	for _, f := range fp {
+		total += f.Size
+
+		ext := strings.ToLower(filepath.Ext(f.Name))
+		if slices.Contains(s.blockedExts, ext) {
+			return 0, &shair.RejectedError{Reason: shair.ReasonFileTypeBlocked, Message: fmt.Sprintf("%s files are not accepted", ext)}
+		}
+	}
+
+	if err := s.quota.Check(peer, fp); err != nil {
+		return 0, &shair.RejectedError{Reason: shair.ReasonQuotaExceeded, Message: err.Error()}
+	}
+
+	free, err := shair.FreeSpace(saveDir)
+	if err != nil {
+		s.logger.WarnContext(ctx, "cannot determine free space", "dir", saveDir, "err", err)
+		return 0, nil
+	}
+
+	if total > free {
+		msg := fmt.Sprintf("%d bytes requested, %d available", total, free)
+		return free, &shair.RejectedError{Reason: shair.ReasonInsufficientSpace, Message: msg}
+	}
+
+	return free, nil
+}
+
+// reject tells the sender the transfer won't happen and why.
+func (s *LocalShairer) reject(ctx context.Context, conn net.Conn, r shair.RejectedError) {
+	s.logger.InfoContext(ctx, "transfer rejected", "remote", conn.RemoteAddr().String(), "reason", r.Reason.String(), "msg", r.Message)
+
+	if _, err := conn.Write(encodeRejection(r)); err != nil {
+		s.logger.WarnContext(ctx, "cannot send rejection", "reason", r.Reason.String(), "err", err)
+	}
+}
+
+func (s *LocalShairer) readAndSaveFile(ctx context.Context, conn net.Conn, name string, size int64, saveDir string, downloadProgressCh chan<- int) (int64, error) {
 	//	create the empty file that will hold the received file
 	file, err := os.Create(filepath.Join(saveDir, name))
 	if err != nil {
 		return 0, err
 	}
 
-	trdr := io.TeeReader(conn, shair.NewProgressWriter(downloadProgressCh))
+	lr := shair.NewLimitedReader(ctx, conn, s.recvLimiter)
+	trdr := io.TeeReader(lr, shair.NewProgressWriter(downloadProgressCh))
 
 	n, err := io.CopyN(file, trdr, size)
 	if err != nil && !errors.Is(err, io.EOF) {
@@ -143,29 +331,17 @@ func (s *LocalShairer) readAndSaveFile(conn net.Conn, name string, size int64, s
 	return n, nil
 }
 
-func (s *LocalShairer) readHeader(conn net.Conn) *header {
-	offset := 0
-
-	hdrSizeBytes := make([]byte, 2)
-	_, err := conn.Read(hdrSizeBytes)
-	if err != nil {
-		panic(fmt.Errorf("err read: %w", err))
+// readHeader reads the rest of a header of hdrSize bytes, its first two bytes were read by readMessage.
+func (s *LocalShairer) readHeader(conn net.Conn, hdrSize uint16) (*header, error) {
+	if hdrSize < minHeaderSize {
+		return nil, fmt.Errorf("header size %d is too small", hdrSize)
 	}
 
-	offset += 2
-
-	hdrSize := binary.BigEndian.Uint16(hdrSizeBytes)
+	hdr := bytes.NewBuffer(make([]byte, 0, hdrSize))
+	hdr.Write(binary.BigEndian.AppendUint16(nil, hdrSize))
 
-	hdr := bytes.NewBuffer(make([]byte, 0))
-	hdr.Write(hdrSizeBytes)
-
-	read := int64(0)
-	for read < int64(hdrSize)-int64(offset) {
-		n, err := io.CopyN(hdr, conn, int64(hdrSize)-int64(offset))
-		if err != nil {
-
-		}
-		read += n
+	if _, err := io.CopyN(hdr, conn, int64(hdrSize)-2); err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
 	}
 
 	return decodeHeader(hdr.Bytes())
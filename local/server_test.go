@@ -0,0 +1,141 @@
+package local
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/masar3141/shair"
+)
+
+func TestCheckRequest(t *testing.T) {
+	trusted := func(d *shair.Device) bool { return d.Name == "friend" }
+
+	tests := []struct {
+		name   string
+		opts   []Option
+		sender string
+		files  []shair.FilePreview
+		reject bool
+		want   shair.RejectReason
+	}{
+		{name: "no policy", sender: "stranger", files: []shair.FilePreview{{Name: "a.exe", Size: 1}}},
+		{name: "trusted", opts: []Option{WithTrust(trusted)}, sender: "friend", files: []shair.FilePreview{{Name: "a.txt"}}},
+		{name: "untrusted", opts: []Option{WithTrust(trusted)}, sender: "stranger", files: []shair.FilePreview{{Name: "a.txt"}}, reject: true, want: shair.ReasonUntrusted},
+		{name: "allowed extension", opts: []Option{WithBlockedExtensions("exe")}, files: []shair.FilePreview{{Name: "a.txt"}}},
+		{name: "blocked extension", opts: []Option{WithBlockedExtensions("exe")}, files: []shair.FilePreview{{Name: "a.txt"}, {Name: "b.EXE"}}, reject: true, want: shair.ReasonFileTypeBlocked},
+		{name: "blocked extension with its dot", opts: []Option{WithBlockedExtensions(".sh")}, files: []shair.FilePreview{{Name: "run.sh"}}, reject: true, want: shair.ReasonFileTypeBlocked},
+		{name: "within quota", opts: []Option{WithQuota(shair.Quota{MaxFiles: 1})}, files: []shair.FilePreview{{Name: "a"}}},
+		{name: "over quota", opts: []Option{WithQuota(shair.Quota{MaxFiles: 1})}, files: []shair.FilePreview{{Name: "a"}, {Name: "b"}}, reject: true, want: shair.ReasonQuotaExceeded},
+		{name: "not enough space", files: []shair.FilePreview{{Name: "a", Size: 1 << 62}}, reject: true, want: shair.ReasonInsufficientSpace},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLocalShairer(slog.New(slog.DiscardHandler), 0, tt.opts...)
+			sender := &shair.Device{Name: tt.sender}
+
+			_, rej := l.checkRequest(context.Background(), sender, tt.sender, tt.files, t.TempDir())
+			switch {
+			case !tt.reject && rej != nil:
+				t.Fatalf("got rejected: %v, want accepted", rej)
+			case tt.reject && (rej == nil || rej.Reason != tt.want):
+				t.Fatalf("got %v, want rejected with %v", rej, tt.want)
+			}
+		})
+	}
+}
+
+func TestBind(t *testing.T) {
+	// a port already taken
+	taken, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	port := taken.Addr().(*net.TCPAddr).Port
+
+	tests := []struct {
+		name   string
+		port   int
+		opts   []Option
+		ok     bool
+		within func(port int) bool // the ports we may end up on
+	}{
+		{name: "any port", ok: true, within: func(p int) bool { return p != 0 }},
+		{name: "range with first port taken", opts: []Option{WithPortRange(port, port+20)}, ok: true, within: func(p int) bool { return p > port && p <= port+20 }},
+		{name: "port taken", port: port},
+		{name: "range taken", opts: []Option{WithPortRange(port, port)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLocalShairer(slog.New(slog.DiscardHandler), tt.port, append([]Option{WithDeviceID("id-laptop")}, tt.opts...)...)
+			l.name = "laptop"
+
+			ln, err := l.bind(context.Background())
+			if (err == nil) != tt.ok {
+				t.Fatalf("got %v, want ok %v", err, tt.ok)
+			}
+			if !tt.ok {
+				if l.Port() != 0 {
+					t.Fatalf("got port %d, want none", l.Port())
+				}
+				return
+			}
+			defer ln.Close()
+
+			bound := ln.Addr().(*net.TCPAddr).Port
+			if !tt.within(bound) || l.Port() != bound {
+				t.Fatalf("bound %d, reported %d", bound, l.Port())
+			}
+
+			// the peers learn the port bound, not the one asked for
+			if svc := l.mdnsService("laptop"); svc.Port != bound {
+				t.Fatalf("mdns announces port %d, want %d", svc.Port, bound)
+			}
+			if _, txt, err := parseMulticastPacket(l.multicastPacket(mcAlive)); err != nil || txt[txtPort] != strconv.Itoa(bound) {
+				t.Fatalf("multicast announces %v, %v, want port %d", txt, err, bound)
+			}
+		})
+	}
+}
+
+func TestServeConnGarbage(t *testing.T) {
+	l := NewLocalShairer(slog.New(slog.DiscardHandler), 0)
+	valid := newTestHeader([]string{"a.txt"}, []int64{5}).encode()
+
+	tests := []struct {
+		name string
+		sent []byte // before the sender hangs up
+	}{
+		{name: "nothing"},
+		{name: "short message", sent: []byte{0}},
+		{name: "header too small", sent: []byte{0, 3}},
+		{name: "short header", sent: valid[:len(valid)-2]},
+		{name: "header size only", sent: []byte{0xff, 0xff}},
+		{name: "garbage header", sent: []byte{0, 8, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{name: "name longer than the header", sent: binary.BigEndian.AppendUint16([]byte{0, 7, 0, 1, 200}, 0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, peer := net.Pipe()
+
+			go func() {
+				_, _ = peer.Write(tt.sent)
+				peer.Close()
+			}()
+
+			err := l.ServeConn(context.Background(), t.TempDir(), conn, &shair.Device{Name: "peer"}, make(chan shair.TransferRequest))
+			var serr shair.Error
+			if !errors.As(err, &serr) || !errors.Is(err, shair.InvalidHeaderError) {
+				t.Fatalf("got %v, want an invalid header error", err)
+			}
+		})
+	}
+}
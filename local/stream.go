@@ -0,0 +1,74 @@
+// this file provides transfers over a stream rather than a connection, for a receiver that reads the
+// transfer later than it was written, eg from a mailbox holding it until the receiver comes online.
+package local
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"time"
+
+	"github.com/masar3141/shair"
+)
+
+// streamConn runs the transfer protocol over a stream: reads come from r, writes go to w.
+type streamConn struct {
+	r io.Reader
+	w io.Writer
+}
+
+type streamAddr struct{}
+
+func (streamAddr) Network() string { return "stream" }
+func (streamAddr) String() string  { return "stream" }
+
+func (c streamConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c streamConn) Write(p []byte) (int, error) { return c.w.Write(p) }
+
+func (streamConn) Close() error                     { return nil }
+func (streamConn) LocalAddr() net.Addr              { return streamAddr{} }
+func (streamConn) RemoteAddr() net.Addr             { return streamAddr{} }
+func (streamConn) SetDeadline(time.Time) error      { return nil }
+func (streamConn) SetReadDeadline(time.Time) error  { return nil }
+func (streamConn) SetWriteDeadline(time.Time) error { return nil }
+
+// WriteTransfer writes to w the transfer of the files as SendFilesOn would send it, without waiting
+// for the receiver to accept it. The receiver reads it with ReadTransfer.
+func (l *LocalShairer) WriteTransfer(ctx context.Context, w io.Writer, updloadProgressCh chan<- int, filepaths ...string) error {
+	files, hdr, err := openFiles(filepaths)
+	defer closeFiles(files)
+	if err != nil {
+		return err
+	}
+
+	// the receiver's answer is given later, proceed as if it accepted
+	conn := streamConn{r: bytes.NewReader([]byte{replyAccepted}), w: w}
+
+	return l.sendFilesOn(ctx, conn, hdr, files, updloadProgressCh)
+}
+
+// ReadTransfer handles a transfer written by WriteTransfer from sender, it is offered to the user with a
+// transfer request as any other. It returns nil once the files are saved, a shair.TransferRejected error
+// if the request was rejected and a shair.ConnectionDroppedError if it wasn't answered.
+func (l *LocalShairer) ReadTransfer(ctx context.Context, saveDir string, r io.Reader, sender *shair.Device, transferRequestCh chan<- shair.TransferRequest) error {
+	answer := bytes.Buffer{}
+	err := l.handleRequest(ctx, saveDir, streamConn{r: r, w: &answer}, sender, transferRequestCh)
+
+	if answer.Len() == 0 {
+		if err == nil {
+			err = ctx.Err()
+		}
+		return shair.NewError(shair.ConnectionDroppedError, "the transfer request wasn't answered", err)
+	}
+
+	if reply, _ := answer.ReadByte(); reply != replyAccepted {
+		rejection, rerr := readRejection(&answer)
+		if rerr != nil {
+			return shair.NewError(shair.UnexpectedError, "failed to read rejection", rerr)
+		}
+		return shair.NewError(shair.TransferRejected, "transfer rejected", rejection)
+	}
+
+	return err
+}
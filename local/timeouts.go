@@ -0,0 +1,149 @@
+package local
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/masar3141/shair"
+)
+
+// Timeouts holds the deadlines applied to each phase of the transfer protocol.
+// A zero duration disables the corresponding deadline.
+type Timeouts struct {
+	Handshake time.Duration // dialing, writing and reading the header
+	Accept    time.Duration // waiting for the receiver to accept or reject the transfer
+	Idle      time.Duration // maximum time without any data flowing during the transfer
+	Total     time.Duration // whole transfer, from the first to the last byte
+
+	KeepAlive net.KeepAliveConfig // TCP keepalive probes used to detect vanished peers
+}
+
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		Handshake: 10 * time.Second,
+		Accept:    2 * time.Minute,
+		Idle:      30 * time.Second,
+		Total:     0,
+
+		KeepAlive: net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     15 * time.Second,
+			Interval: 5 * time.Second,
+			Count:    3,
+		},
+	}
+}
+
+// WithTimeouts overrides the default protocol deadlines.
+func WithTimeouts(t Timeouts) Option {
+	return func(ls *LocalShairer) {
+		ls.timeouts = t
+	}
+}
+
+// keepAlive returns the keepalive period of a net.Dialer or net.ListenConfig using t.KeepAlive,
+// negative to turn the probes off when they are disabled rather than falling back to those of the system.
+func (t Timeouts) keepAlive() time.Duration {
+	if t.KeepAlive.Enable {
+		return 0
+	}
+	return -1
+}
+
+// deadline returns the time at which a deadline of d expires, or the zero time when d is disabled.
+func deadline(d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
+
+// withTotal derives a context that expires after the total transfer deadline, and makes sure
+// any blocked read or write on conn returns as soon as that context is done.
+func (t Timeouts) withTotal(ctx context.Context, conn net.Conn) (context.Context, context.CancelFunc) {
+	var cancel context.CancelFunc
+	if t.Total > 0 {
+		ctx, cancel = context.WithTimeout(ctx, t.Total)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// wrapErr wraps err in a shair.ConnectionDroppedError carrying the phase if err was caused by
+// an expired deadline, or in a shair.Error with the given code otherwise.
+// dl names the deadline that was armed when err occurred: handshake, accept or idle.
+func (t Timeouts) wrapErr(ctx context.Context, phase shair.Phase, dl string, code error, msg string, err error) error {
+	var after time.Duration
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		dl, after = "total", t.Total
+
+	case ctx.Err() != nil:
+		// cancelled by the caller, deadlines were forced to unblock the connection
+		return shair.NewError(code, msg, ctx.Err())
+
+	case isTimeout(err):
+		switch dl {
+		case "handshake":
+			after = t.Handshake
+		case "accept":
+			after = t.Accept
+		case "idle":
+			after = t.Idle
+		}
+
+	default:
+		return shair.NewError(code, msg, err)
+	}
+
+	return shair.NewError(shair.ConnectionDroppedError, msg, shair.TimeoutError{Phase: phase, Deadline: dl, After: after})
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// idleConn pushes the deadline of the wrapped connection back before every read and write,
+// so that the connection only expires when no data flows for the idle duration.
+// It stops as soon as ctx is done, since the deadline set by withTotal would otherwise be pushed back.
+type idleConn struct {
+	net.Conn
+	ctx  context.Context
+	idle time.Duration
+}
+
+func newIdleConn(ctx context.Context, c net.Conn, idle time.Duration) net.Conn {
+	return idleConn{Conn: c, ctx: ctx, idle: idle}
+}
+
+func (c idleConn) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if err := c.Conn.SetReadDeadline(deadline(c.idle)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(p)
+}
+
+func (c idleConn) Write(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if err := c.Conn.SetWriteDeadline(deadline(c.idle)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(p)
+}
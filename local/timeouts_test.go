@@ -0,0 +1,158 @@
+package local
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/masar3141/shair"
+)
+
+// transferFile writes a file of content and returns its path along with the header a sender writes for it.
+func transferFile(t *testing.T, l *LocalShairer, content string) (string, []byte) {
+	t.Helper()
+
+	f := filepath.Join(t.TempDir(), "hello.txt")
+	if err := os.WriteFile(f, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	progressCh := make(chan int)
+	go func() {
+		for range progressCh {
+		}
+	}()
+	var b bytes.Buffer
+	if err := l.WriteTransfer(context.Background(), &b, progressCh, f); err != nil {
+		t.Fatal(err)
+	}
+	return f, b.Bytes()[:b.Len()-len(content)]
+}
+
+// wantTimeout fails the test unless err reports the connection dropped when the deadline of phase expired.
+func wantTimeout(t *testing.T, side string, err error, phase shair.Phase) {
+	t.Helper()
+
+	var te shair.TimeoutError
+	if !errors.Is(err, shair.ConnectionDroppedError) || !errors.As(err, &te) || te.Phase != phase {
+		t.Fatalf("the %s got %v, want the connection dropped in the %s phase", side, err, phase)
+	}
+}
+
+func TestTimeoutPhases(t *testing.T) {
+	timeouts := Timeouts{Handshake: 100 * time.Millisecond, Accept: 100 * time.Millisecond, Idle: 100 * time.Millisecond}
+	l := NewLocalShairer(slog.New(slog.DiscardHandler), 0, WithTimeouts(timeouts))
+	f, hdr := transferFile(t, l, "hello")
+	sender := &shair.Device{Name: "sender"}
+
+	// send runs the sender on conn, receive runs the receiver, which answers the requests with accept
+	// unless nil. Both return the error of the transfer.
+	send := func(conn net.Conn) error {
+		progressCh := make(chan int)
+		go func() {
+			for range progressCh {
+			}
+		}()
+		return l.SendFilesOn(context.Background(), conn, progressCh, f)
+	}
+	receive := func(conn net.Conn, accept *bool) error {
+		trCh := make(chan shair.TransferRequest, 1)
+		errCh := make(chan error, 1)
+		go func() { errCh <- l.ServeConn(context.Background(), t.TempDir(), conn, sender, trCh) }()
+
+		select {
+		case err := <-errCh:
+			return err
+		case tr := <-trCh:
+			go func() {
+				for range tr.ProgressCh {
+				}
+			}()
+			if accept != nil {
+				tr.AcceptCh <- *accept
+			}
+			err := <-errCh
+			// the user is told why the request went away
+			if done := <-tr.DoneCh; !errors.Is(done, err) {
+				t.Errorf("got %v done, want %v", done, err)
+			}
+			return err
+		}
+	}
+	accept := true
+
+	tests := []struct {
+		name  string
+		side  string
+		phase shair.Phase
+		run   func(conn net.Conn) error // runs the side tested on its end of the connection
+		peer  func(conn net.Conn)       // plays the other side on its end
+	}{
+		{
+			name: "sender not sending the header", side: "receiver", phase: shair.PhaseHandshake,
+			run:  func(conn net.Conn) error { return receive(conn, &accept) },
+			peer: func(conn net.Conn) {},
+		},
+		{
+			name: "receiver not reading the header", side: "sender", phase: shair.PhaseHandshake,
+			run:  send,
+			peer: func(conn net.Conn) {},
+		},
+		{
+			name: "user not answering", side: "receiver", phase: shair.PhaseAccept,
+			run: func(conn net.Conn) error { return receive(conn, nil) },
+			peer: func(conn net.Conn) {
+				// the sender is told the request expired
+				var rejected shair.RejectedError
+				if err := send(conn); !errors.As(err, &rejected) || rejected.Reason != shair.ReasonTimeout {
+					t.Errorf("the sender got %v, want the request rejected as expired", err)
+				}
+			},
+		},
+		{
+			name: "receiver not answering", side: "sender", phase: shair.PhaseAccept,
+			run:  send,
+			peer: func(conn net.Conn) { _, _ = io.ReadFull(conn, make([]byte, len(hdr))) },
+		},
+		{
+			name: "sender stalling", side: "receiver", phase: shair.PhaseTransfer,
+			run: func(conn net.Conn) error { return receive(conn, &accept) },
+			peer: func(conn net.Conn) {
+				_, _ = conn.Write(hdr)
+				_, _ = io.ReadFull(conn, make([]byte, 1))
+			},
+		},
+		{
+			name: "receiver stalling", side: "sender", phase: shair.PhaseTransfer,
+			run: send,
+			peer: func(conn net.Conn) {
+				_, _ = io.ReadFull(conn, make([]byte, len(hdr)))
+				_, _ = conn.Write([]byte{replyAccepted})
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// writes on a pipe block until they are read, as they would on a connection whose buffers are full
+			conn, peer := net.Pipe()
+			defer peer.Close()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				tt.peer(peer)
+			}()
+
+			wantTimeout(t, tt.side, tt.run(conn), tt.phase)
+			conn.Close()
+			<-done
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package local
+
+import (
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/masar3141/shair"
+)
+
+// keys of the TXT record advertised along the mDNS service
+const (
+	txtID              = "id"
+	txtInstanceID      = "iid"
+	txtProtocolVersion = "pv"
+	txtOS              = "os"
+	txtArch            = "arch"
+	txtType            = "type"
+	txtAppVersion      = "ver"
+	txtCapabilities    = "caps"
+	txtAccepting       = "acc"
+	txtFingerprint     = "fp"
+	txtName            = "name" // only sent in answer to msgIdentify, mDNS carries the name in the service instance
+)
+
+// txtRecord returns the TXT record describing the local device.
+func (l *LocalShairer) txtRecord(accepting bool) map[string]string {
+	acc := "0"
+	if accepting {
+		acc = "1"
+	}
+
+	txt := map[string]string{
+		txtID:              l.deviceID,
+		txtInstanceID:      l.instanceID,
+		txtProtocolVersion: strconv.Itoa(shair.ProtocolVersion),
+		txtOS:              runtime.GOOS,
+		txtArch:            runtime.GOARCH,
+		txtType:            string(l.deviceType),
+		txtAppVersion:      shair.Version,
+		txtCapabilities:    strings.Join(shair.Capabilities, ","),
+		txtAccepting:       acc,
+	}
+	if l.certFingerprint != "" {
+		txt[txtFingerprint] = l.certFingerprint
+	}
+
+	return txt
+}
+
+// identity returns the TXT record sent in answer to msgIdentify, along with the name we are known by.
+func (l *LocalShairer) identity() map[string]string {
+	txt := l.txtRecord(!l.busy.Load())
+
+	l.amu.Lock()
+	txt[txtName] = l.announcedName
+	if txt[txtName] == "" {
+		txt[txtName] = l.name
+	}
+	l.amu.Unlock()
+
+	return txt
+}
+
+// parseTXT fills the metadata of dvc from a TXT record advertised by a peer.
+// Unknown keys are ignored and missing ones leave the fields empty.
+func parseTXT(txt map[string]string, dvc *shair.Device) {
+	dvc.ID = txt[txtID]
+	dvc.ProtocolVersion, _ = strconv.Atoi(txt[txtProtocolVersion])
+	dvc.OS = txt[txtOS]
+	dvc.Arch = txt[txtArch]
+	dvc.Type = shair.DeviceType(txt[txtType])
+	dvc.AppVersion = txt[txtAppVersion]
+	dvc.Accepting = txt[txtAccepting] == "1"
+	dvc.CertFingerprint = txt[txtFingerprint]
+
+	dvc.Capabilities = nil
+	if caps := txt[txtCapabilities]; caps != "" {
+		dvc.Capabilities = strings.Split(caps, ",")
+	}
+}
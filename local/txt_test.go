@@ -0,0 +1,34 @@
+package local
+
+import (
+	"log/slog"
+	"runtime"
+	"testing"
+
+	"github.com/masar3141/shair"
+)
+
+func TestTXTRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		fp   string
+	}{
+		{name: "fingerprint", opts: []Option{WithCertFingerprint("0123abcd")}, fp: "0123abcd"},
+		{name: "no fingerprint"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := append([]Option{WithDeviceID("id"), WithDeviceType(shair.Server)}, tt.opts...)
+			l := NewLocalShairer(slog.New(slog.DiscardHandler), 0, opts...)
+
+			var dvc shair.Device
+			parseTXT(l.txtRecord(true), &dvc)
+			if dvc.ID != "id" || dvc.Type != shair.Server || dvc.OS != runtime.GOOS || !dvc.Accepting ||
+				dvc.ProtocolVersion != shair.ProtocolVersion || dvc.CertFingerprint != tt.fp {
+				t.Fatalf("got %+v, want the device described with the fingerprint %q", dvc, tt.fp)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+// this file provides what the layers share to log consistently: every transfer gets an ID, carried by
+// its context, that the handler returned by NewLogHandler adds to the records logged with that context.
+// The ID isn't sent to the peer: the sender and the receiver of a transfer each log it under their own.
+package shair
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+)
+
+type transferIDCtxKey struct{}
+
+// NewTransferID returns a random identifier for a transfer.
+func NewTransferID() string {
+	b := make([]byte, 6)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// WithTransferID returns a copy of ctx carrying the ID of the transfer it runs.
+func WithTransferID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, transferIDCtxKey{}, id)
+}
+
+// TransferIDFromContext returns the ID of the transfer run by ctx, empty if none.
+func TransferIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(transferIDCtxKey{}).(string)
+	return id
+}
+
+// EnsureTransferID returns ctx and the ID of its transfer, a new one if it has none yet.
+func EnsureTransferID(ctx context.Context) (context.Context, string) {
+	if id := TransferIDFromContext(ctx); id != "" {
+		return ctx, id
+	}
+	id := NewTransferID()
+	return WithTransferID(ctx, id), id
+}
+
+// logHandler adds the transfer ID of the context to the records.
+type logHandler struct {
+	slog.Handler
+}
+
+// NewLogHandler wraps h so that the records logged with the context of a transfer, eg with
+// logger.InfoContext(ctx, ...), carry its ID in a "transfer" attribute.
+func NewLogHandler(h slog.Handler) slog.Handler {
+	return logHandler{h}
+}
+
+func (h logHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := TransferIDFromContext(ctx); id != "" {
+		r.AddAttrs(slog.String("transfer", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return logHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h logHandler) WithGroup(name string) slog.Handler {
+	return logHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,41 @@
+package shair
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func TestLogHandler(t *testing.T) {
+	ctx := WithTransferID(context.Background(), "t1")
+
+	tests := []struct {
+		name string
+		log  func(logger *slog.Logger)
+		want string // transfer attribute, none if empty
+	}{
+		{name: "transfer", log: func(l *slog.Logger) { l.InfoContext(ctx, "sent") }, want: "t1"},
+		{name: "with attributes", log: func(l *slog.Logger) { l.With("svc", "local").WarnContext(ctx, "sent") }, want: "t1"},
+		{name: "ensured", log: func(l *slog.Logger) { ctx, _ := EnsureTransferID(ctx); l.InfoContext(ctx, "sent") }, want: "t1"},
+		{name: "no transfer", log: func(l *slog.Logger) { l.InfoContext(context.Background(), "started") }},
+		{name: "no context", log: func(l *slog.Logger) { l.Info("started") }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tt.log(slog.New(NewLogHandler(slog.NewJSONHandler(&buf, nil))))
+
+			var record map[string]any
+			if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+				t.Fatal(err)
+			}
+			got, found := record["transfer"]
+			if (tt.want == "" && found) || (tt.want != "" && got != tt.want) {
+				t.Fatalf("got transfer %v in %s, want %q", got, buf.String(), tt.want)
+			}
+		})
+	}
+}
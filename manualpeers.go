@@ -0,0 +1,49 @@
+// this file provides the peers added by address, for networks where discovery doesn't work
+package shair
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PeerAdder is implemented by the shairers able to reach a peer from its address alone.
+type PeerAdder interface {
+	// AddPeer asks the peer listening on addr, a "host:port" pair, for its identity
+	// and lists it among the discovered peers.
+	AddPeer(ctx context.Context, addr string) (Device, error)
+}
+
+// LoadManualPeers returns the addresses listed in the peers file of the user config directory,
+// one "host:port" per line, lines starting with # are ignored. A missing file lists no peer.
+func LoadManualPeers() ([]string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(filepath.Join(dir, "shair", "peers"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var addrs []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		addrs = append(addrs, line)
+	}
+
+	return addrs, sc.Err()
+}
@@ -0,0 +1,46 @@
+package shair
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestLoadManualPeers(t *testing.T) {
+	tests := []struct {
+		name string
+		file string // none if the file is missing
+		want []string
+	}{
+		{name: "missing file"},
+		{name: "empty file", file: "\n"},
+		{name: "addresses", file: "192.168.1.20:8085\n[fd00::2]:8085\nlaptop.lan:8085\n", want: []string{"192.168.1.20:8085", "[fd00::2]:8085", "laptop.lan:8085"}},
+		{name: "comments and blank lines", file: "# the office\n\n  192.168.1.20:8085  \n\t\n  # gone\n10.0.0.3:9000", want: []string{"192.168.1.20:8085", "10.0.0.3:9000"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+			t.Setenv("HOME", t.TempDir())
+
+			if tt.file != "" {
+				dir, err := os.UserConfigDir()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.MkdirAll(filepath.Join(dir, "shair"), 0o700); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(dir, "shair", "peers"), []byte(tt.file), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := LoadManualPeers()
+			if err != nil || !slices.Equal(got, tt.want) {
+				t.Fatalf("got %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
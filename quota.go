@@ -0,0 +1,88 @@
+// this file provides receiver side quotas, checked before a transfer request reaches the user
+package shair
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Quota limits what a peer is allowed to send. A zero field disables the corresponding limit.
+type Quota struct {
+	MaxTransferSize uint64 // maximum size of a single transfer, in bytes
+	MaxFiles        int    // maximum number of files in a single transfer
+	MaxDailyPerPeer uint64 // maximum volume received from a single peer per day, in bytes
+}
+
+// QuotaTracker checks transfer requests against a Quota and keeps track of the
+// volume received from each peer during the current day.
+type QuotaTracker struct {
+	quota Quota
+
+	mu    sync.Mutex
+	day   string            // day the usage is accounted for, as YYYY-MM-DD
+	usage map[string]uint64 // bytes received today, per peer
+}
+
+func NewQuotaTracker(q Quota) *QuotaTracker {
+	return &QuotaTracker{
+		quota: q,
+		usage: make(map[string]uint64),
+	}
+}
+
+// Check returns an error describing the exceeded limit if peer isn't allowed to send the files.
+func (t *QuotaTracker) Check(peer string, files []FilePreview) error {
+	if t == nil {
+		return nil
+	}
+
+	total := uint64(0)
+	for _, f := range files {
+		total += f.Size
+	}
+
+	if t.quota.MaxFiles > 0 && len(files) > t.quota.MaxFiles {
+		return fmt.Errorf("%d files requested, at most %d are accepted per transfer", len(files), t.quota.MaxFiles)
+	}
+
+	if t.quota.MaxTransferSize > 0 && total > t.quota.MaxTransferSize {
+		return fmt.Errorf("%d bytes requested, at most %d are accepted per transfer", total, t.quota.MaxTransferSize)
+	}
+
+	if t.quota.MaxDailyPerPeer > 0 {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		used := t.usageLocked(peer)
+		if used+total > t.quota.MaxDailyPerPeer {
+			return fmt.Errorf("%d bytes requested, %d of the %d bytes allowed per day are already used", total, used, t.quota.MaxDailyPerPeer)
+		}
+	}
+
+	return nil
+}
+
+// Record adds n received bytes to the daily volume of peer.
+func (t *QuotaTracker) Record(peer string, n uint64) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.usage[peer] = t.usageLocked(peer) + n
+}
+
+// usageLocked returns the volume received from peer today, resetting the counters when the day changed.
+// t.mu must be held.
+func (t *QuotaTracker) usageLocked(peer string) uint64 {
+	today := time.Now().Format(time.DateOnly)
+	if t.day != today {
+		t.day = today
+		clear(t.usage)
+	}
+
+	return t.usage[peer]
+}
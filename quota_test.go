@@ -0,0 +1,60 @@
+package shair
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestQuotaTracker(t *testing.T) {
+	files := func(sizes ...uint64) []FilePreview {
+		var f []FilePreview
+		for _, s := range sizes {
+			f = append(f, FilePreview{Size: s})
+		}
+		return f
+	}
+
+	tests := []struct {
+		name     string
+		quota    Quota
+		received uint64 // already received from the peer today
+		files    []FilePreview
+		wantErr  string
+	}{
+		{name: "no quota", files: files(1 << 40)},
+		{name: "few enough files", quota: Quota{MaxFiles: 2}, files: files(1, 2)},
+		{name: "too many files", quota: Quota{MaxFiles: 2}, files: files(1, 2, 3), wantErr: "3 files requested"},
+		{name: "small enough", quota: Quota{MaxTransferSize: 10}, files: files(4, 6)},
+		{name: "too big", quota: Quota{MaxTransferSize: 10}, files: files(4, 7), wantErr: "11 bytes requested"},
+		{name: "within the daily volume", quota: Quota{MaxDailyPerPeer: 10}, received: 5, files: files(5)},
+		{name: "over the daily volume", quota: Quota{MaxDailyPerPeer: 10}, received: 5, files: files(6), wantErr: "5 of the 10 bytes"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := NewQuotaTracker(tt.quota)
+			q.Record("peer", tt.received)
+
+			err := q.Check("peer", tt.files)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("got %v, want no error", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("got %v, want an error containing %q", err, tt.wantErr)
+			}
+
+			// the daily volume is accounted per peer
+			if err := q.Check("other", tt.files); tt.wantErr == "" && err != nil {
+				t.Fatalf("got %v for another peer, want no error", err)
+			}
+		})
+	}
+}
+
+func TestQuotaTrackerNil(t *testing.T) {
+	var q *QuotaTracker
+	q.Record("peer", 1)
+	if err := q.Check("peer", []FilePreview{{Size: 1 << 40}}); err != nil {
+		t.Fatalf("got %v from a nil tracker, want no error", err)
+	}
+}
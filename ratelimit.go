@@ -0,0 +1,182 @@
+// this file provides a token bucket limiter used to cap the bandwidth of transfers.
+// A single Limiter can be shared by several transfers to enforce a global cap, and
+// its rate can be changed at any time, even while transfers are running.
+package shair
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// maxChunk bounds the number of bytes accounted at once by limited readers and writers
+// so that a rate change is picked up quickly by running transfers.
+const maxChunk = 16 * 1024
+
+// Limiter is a token bucket that holds at most one second worth of tokens.
+// A nil Limiter or a Limiter with a rate of 0 doesn't limit anything.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   int64   // bytes per second, 0 means unlimited
+	tokens float64 // available tokens, can go negative when a caller borrows tokens
+	last   time.Time
+}
+
+func NewLimiter(bytesPerSec int64) *Limiter {
+	return &Limiter{
+		rate:   max(bytesPerSec, 0),
+		tokens: float64(max(bytesPerSec, 0)),
+		last:   time.Now(),
+	}
+}
+
+// SetLimit changes the rate of the limiter. A rate of 0 disables the limit.
+func (l *Limiter) SetLimit(bytesPerSec int64) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(time.Now())
+	l.rate = max(bytesPerSec, 0)
+	l.tokens = min(l.tokens, float64(l.rate))
+}
+
+// Limit returns the current rate of the limiter in bytes per second, 0 meaning unlimited.
+func (l *Limiter) Limit() int64 {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.rate
+}
+
+// WaitN consumes n tokens and blocks until the bucket is no longer in debt,
+// or the context is cancelled.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	if l.rate == 0 {
+		l.mu.Unlock()
+		return nil
+	}
+
+	now := time.Now()
+	l.refill(now)
+	l.tokens -= float64(n)
+
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if wait == 0 {
+		return nil
+	}
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// refill adds the tokens accumulated since the last call. l.mu must be held.
+func (l *Limiter) refill(now time.Time) {
+	elapsed := now.Sub(l.last).Seconds()
+	l.last = now
+
+	if l.rate == 0 {
+		l.tokens = 0
+		return
+	}
+
+	l.tokens = min(l.tokens+elapsed*float64(l.rate), float64(l.rate))
+}
+
+type limiterCtxKey struct{}
+
+// WithLimiter returns a copy of ctx carrying a limiter for a single transfer.
+// Shairer implementations apply it on top of their global limiter, which makes it
+// possible to cap the bandwidth of one SendFiles call.
+func WithLimiter(ctx context.Context, l *Limiter) context.Context {
+	return context.WithValue(ctx, limiterCtxKey{}, l)
+}
+
+// LimiterFromContext returns the limiter set by WithLimiter, or nil.
+func LimiterFromContext(ctx context.Context) *Limiter {
+	l, _ := ctx.Value(limiterCtxKey{}).(*Limiter)
+	return l
+}
+
+type limitedWriter struct {
+	ctx      context.Context
+	w        io.Writer
+	limiters []*Limiter
+}
+
+// NewLimitedWriter wraps w so that every write waits on all the given limiters.
+func NewLimitedWriter(ctx context.Context, w io.Writer, limiters ...*Limiter) io.Writer {
+	return &limitedWriter{ctx: ctx, w: w, limiters: limiters}
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		chunk := p[written:min(written+maxChunk, len(p))]
+
+		for _, l := range lw.limiters {
+			if err := l.WaitN(lw.ctx, len(chunk)); err != nil {
+				return written, err
+			}
+		}
+
+		n, err := lw.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+type limitedReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*Limiter
+}
+
+// NewLimitedReader wraps r so that every read waits on all the given limiters.
+func NewLimitedReader(ctx context.Context, r io.Reader, limiters ...*Limiter) io.Reader {
+	return &limitedReader{ctx: ctx, r: r, limiters: limiters}
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > maxChunk {
+		p = p[:maxChunk]
+	}
+
+	n, err := lr.r.Read(p)
+	for _, l := range lr.limiters {
+		if werr := l.WaitN(lr.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+
+	return n, err
+}
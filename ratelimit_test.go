@@ -0,0 +1,93 @@
+package shair
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	tests := []struct {
+		name     string
+		limiters []*Limiter
+		size     int
+		min, max time.Duration
+	}{
+		{name: "nil", limiters: []*Limiter{nil}, size: 1 << 20, max: 100 * time.Millisecond},
+		{name: "unlimited", limiters: []*Limiter{NewLimiter(0)}, size: 1 << 20, max: 100 * time.Millisecond},
+		{name: "within the burst", limiters: []*Limiter{NewLimiter(100_000)}, size: 100_000, max: 100 * time.Millisecond},
+		// the first second worth of bytes is free, the rest waits
+		{name: "over the burst", limiters: []*Limiter{NewLimiter(100_000)}, size: 150_000, min: 400 * time.Millisecond, max: time.Second},
+		{name: "slowest limiter wins", limiters: []*Limiter{NewLimiter(1 << 30), NewLimiter(100_000)}, size: 150_000, min: 400 * time.Millisecond, max: time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := NewLimitedWriter(context.Background(), &buf, tt.limiters...)
+
+			start := time.Now()
+			n, err := w.Write(make([]byte, tt.size))
+			elapsed := time.Since(start)
+
+			if err != nil || n != tt.size || buf.Len() != tt.size {
+				t.Fatalf("wrote %d bytes, %d buffered, err %v, want %d", n, buf.Len(), err, tt.size)
+			}
+			if elapsed < tt.min || elapsed > tt.max {
+				t.Fatalf("writing took %v, want between %v and %v", elapsed, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestLimiterSetLimit(t *testing.T) {
+	l := NewLimiter(1000)
+	if err := l.WaitN(context.Background(), 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	// lifting the limit lets the next transfers through right away
+	l.SetLimit(0)
+	if l.Limit() != 0 {
+		t.Fatalf("got limit %d, want 0", l.Limit())
+	}
+
+	start := time.Now()
+	r := NewLimitedReader(context.Background(), bytes.NewReader(make([]byte, 1<<20)), l)
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("reading without limit took %v", elapsed)
+	}
+
+	// a negative rate is taken as no limit
+	l.SetLimit(-5)
+	if l.Limit() != 0 {
+		t.Fatalf("got limit %d for a negative rate, want 0", l.Limit())
+	}
+}
+
+func TestLimiterCancel(t *testing.T) {
+	l := NewLimiter(10)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := l.WaitN(ctx, 1000); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the deadline of the context", err)
+	}
+}
+
+func TestLimiterFromContext(t *testing.T) {
+	if LimiterFromContext(context.Background()) != nil {
+		t.Fatal("got a limiter from an empty context")
+	}
+
+	l := NewLimiter(42)
+	if got := LimiterFromContext(WithLimiter(context.Background(), l)); got != l {
+		t.Fatalf("got %p, want %p", got, l)
+	}
+}
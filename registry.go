@@ -0,0 +1,373 @@
+// this file provides the registry of discovered peers. It is safe for concurrent use and can be shared
+// by several discovery mechanisms and by the ui: peers are keyed on their stable device ID so that the
+// same device found by different means is only listed once.
+package shair
+
+import (
+	"cmp"
+	"context"
+	"maps"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Key returns the identifier the registry uses for the device: its ID, or its name
+// for peers that don't advertise an ID.
+func (d Device) Key() string {
+	if d.ID != "" {
+		return d.ID
+	}
+	return "name:" + d.Name
+}
+
+type peerEntry struct {
+	device  Device            // merged view of the device, returned by the registry
+	sources map[string]Device // device as last reported by each discovery source
+}
+
+// PeerRegistry holds the discovered peers and notifies its subscribers of every change.
+type PeerRegistry struct {
+	wmu   sync.Mutex // serializes changes so that subscribers receive the updates in order
+	mu    sync.RWMutex
+	peers map[string]*peerEntry
+
+	smu  sync.Mutex
+	subs map[int]chan PeerUpdate
+	next int
+}
+
+// updates buffered for each subscriber, one lagging further behind is disconnected
+const subscriberBuffer = 256
+
+func NewPeerRegistry() *PeerRegistry {
+	return &PeerRegistry{
+		peers: make(map[string]*peerEntry),
+		subs:  make(map[int]chan PeerUpdate),
+	}
+}
+
+// Subscribe returns a channel receiving every change of the registry until the returned function is called.
+// The channel is buffered so that the registry never waits for its subscribers: one lagging behind is
+// disconnected, its channel is closed. See Forward for a subscription catching up.
+func (r *PeerRegistry) Subscribe() (<-chan PeerUpdate, func()) {
+	r.smu.Lock()
+	defer r.smu.Unlock()
+
+	id := r.next
+	r.next++
+	ch := make(chan PeerUpdate, subscriberBuffer)
+	r.subs[id] = ch
+
+	return ch, func() {
+		r.smu.Lock()
+		defer r.smu.Unlock()
+		if ch, ok := r.subs[id]; ok {
+			delete(r.subs, id)
+			close(ch)
+		}
+	}
+}
+
+func (r *PeerRegistry) emit(pu PeerUpdate) {
+	r.smu.Lock()
+	defer r.smu.Unlock()
+
+	for id, ch := range r.subs {
+		select {
+		case ch <- pu:
+		default:
+			delete(r.subs, id)
+			close(ch)
+		}
+	}
+}
+
+// Forward sends the peers of the registry to ch, then its changes, until ctx is done. ch must be drained,
+// but a subscriber lagging behind isn't lost for it: it subscribes again and catches up with a snapshot,
+// the peers removed in the meantime are sent as Removed and the others as Discovered or Updated.
+func (r *PeerRegistry) Forward(ctx context.Context, ch chan<- PeerUpdate) {
+	sent := make(map[string]Device) // peers ch knows of, by key
+	send := func(pu PeerUpdate) bool {
+		if pu.Status == Removed {
+			delete(sent, pu.Peer.Key())
+		} else {
+			sent[pu.Peer.Key()] = *pu.Peer
+		}
+
+		select {
+		case ch <- pu:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	for ctx.Err() == nil {
+		updates, unsubscribe := r.Subscribe()
+		if r.replay(sent, send) {
+			forward(ctx, updates, send)
+		}
+		unsubscribe()
+	}
+}
+
+// replay sends the peers of the registry, and the removal of those in sent it doesn't hold anymore.
+// It reports whether it sent them all.
+func (r *PeerRegistry) replay(sent map[string]Device, send func(PeerUpdate) bool) bool {
+	held := make(map[string]bool)
+	for _, d := range r.Snapshot() {
+		held[d.Key()] = true
+
+		status := Discovered
+		if _, found := sent[d.Key()]; found {
+			status = Updated
+		}
+		if !send(PeerUpdate{Peer: &d, Status: status}) {
+			return false
+		}
+	}
+
+	var gone []Device
+	for key, d := range sent {
+		if !held[key] {
+			gone = append(gone, d)
+		}
+	}
+	for _, d := range gone {
+		if !send(PeerUpdate{Peer: &d, Status: Removed}) {
+			return false
+		}
+	}
+	return true
+}
+
+// forward sends the updates until ctx is done or the subscriber is disconnected for lagging behind.
+func forward(ctx context.Context, updates <-chan PeerUpdate, send func(PeerUpdate) bool) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case pu, ok := <-updates:
+			if !ok || !send(pu) {
+				return
+			}
+		}
+	}
+}
+
+// Upsert records the device as seen by source, eg "mdns", and notifies the subscribers:
+// Discovered for a new peer, AddressChanged if its addresses changed, Updated if anything else changed.
+func (r *PeerRegistry) Upsert(source string, d Device) {
+	r.wmu.Lock()
+	defer r.wmu.Unlock()
+
+	key := d.Key()
+	d.LastSeen = time.Now()
+
+	r.mu.Lock()
+	e, found := r.peers[key]
+	if !found {
+		e = &peerEntry{sources: make(map[string]Device)}
+		r.peers[key] = e
+	}
+	e.sources[source] = d
+
+	prev := e.device
+	e.device = e.merge(d)
+	cur := e.device
+	r.mu.Unlock()
+
+	switch {
+	case !found:
+		r.emit(PeerUpdate{Peer: &cur, Status: Discovered})
+	case !sameAddrs(prev, cur):
+		r.emit(PeerUpdate{Peer: &cur, Status: AddressChanged})
+	case !sameMetadata(prev, cur):
+		r.emit(PeerUpdate{Peer: &cur, Status: Updated})
+	}
+}
+
+// merge returns the device to expose: the metadata of the last report, the addresses of all sources
+// and the preferred address kept as long as a source still advertises it.
+func (e *peerEntry) merge(last Device) Device {
+	merged := last
+	merged.Addrs = nil
+	for _, src := range slices.Sorted(maps.Keys(e.sources)) {
+		for _, a := range e.sources[src].Addrs {
+			if !slices.ContainsFunc(merged.Addrs, func(b net.IPAddr) bool { return sameAddr(a, b) }) {
+				merged.Addrs = append(merged.Addrs, a)
+			}
+		}
+	}
+
+	// liveness is measured by the prober, not reported by the sources
+	merged.Reachability, merged.RTT = e.device.Reachability, e.device.RTT
+
+	merged.IP = nil
+	if e.device.IP != nil && slices.ContainsFunc(merged.Addrs, func(a net.IPAddr) bool { return a.IP.Equal(e.device.IP) }) {
+		merged.IP = e.device.IP
+	} else if len(merged.Addrs) != 0 {
+		merged.IP = merged.Addrs[0].IP
+	}
+
+	return merged
+}
+
+// Remove forgets what source knows about the peer. The peer itself is removed, and the subscribers
+// notified, once no source knows about it anymore.
+func (r *PeerRegistry) Remove(source string, key string) {
+	r.wmu.Lock()
+	defer r.wmu.Unlock()
+
+	r.mu.Lock()
+	e, found := r.peers[key]
+	if !found {
+		r.mu.Unlock()
+		return
+	}
+
+	delete(e.sources, source)
+	if len(e.sources) != 0 {
+		prev := e.device
+		e.device = e.merge(e.device)
+		cur := e.device
+		r.mu.Unlock()
+
+		if !sameAddrs(prev, cur) {
+			r.emit(PeerUpdate{Peer: &cur, Status: AddressChanged})
+		}
+		return
+	}
+
+	delete(r.peers, key)
+	removed := e.device
+	r.mu.Unlock()
+
+	r.emit(PeerUpdate{Peer: &removed, Status: Removed})
+}
+
+// SetPreferredIP marks ip as the address to try first when connecting to the peer, eg the one
+// that won the last connection race.
+func (r *PeerRegistry) SetPreferredIP(key string, ip net.IP) {
+	r.wmu.Lock()
+	defer r.wmu.Unlock()
+
+	r.mu.Lock()
+	e, found := r.peers[key]
+	if !found || e.device.IP.Equal(ip) {
+		r.mu.Unlock()
+		return
+	}
+
+	e.device.IP = ip
+	cur := e.device
+	r.mu.Unlock()
+
+	r.emit(PeerUpdate{Peer: &cur, Status: AddressChanged})
+}
+
+// SetReachability records the outcome of a probe of the peer. Subscribers are notified when the reachability
+// changes, or when the round trip time changes by more than a quarter and at least a millisecond.
+func (r *PeerRegistry) SetReachability(key string, reach Reachability, rtt time.Duration) {
+	r.wmu.Lock()
+	defer r.wmu.Unlock()
+
+	r.mu.Lock()
+	e, found := r.peers[key]
+	if !found {
+		r.mu.Unlock()
+		return
+	}
+
+	prev := e.device
+	e.device.Reachability = reach
+	if reach == Reachable {
+		e.device.RTT = rtt
+		e.device.LastSeen = time.Now()
+	}
+	cur := e.device
+	r.mu.Unlock()
+
+	if prev.Reachability != cur.Reachability || (cur.RTT-prev.RTT).Abs() > max(prev.RTT/4, time.Millisecond) {
+		r.emit(PeerUpdate{Peer: &cur, Status: ReachabilityChanged})
+	}
+}
+
+// SetAccepting records whether the peer currently accepts transfer requests, as told by a probe.
+func (r *PeerRegistry) SetAccepting(key string, accepting bool) {
+	r.wmu.Lock()
+	defer r.wmu.Unlock()
+
+	r.mu.Lock()
+	e, found := r.peers[key]
+	if !found || e.device.Accepting == accepting {
+		r.mu.Unlock()
+		return
+	}
+
+	e.device.Accepting = accepting
+	cur := e.device
+	r.mu.Unlock()
+
+	r.emit(PeerUpdate{Peer: &cur, Status: Updated})
+}
+
+// Touch updates the last time the peer was seen.
+func (r *PeerRegistry) Touch(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if e, found := r.peers[key]; found {
+		e.device.LastSeen = time.Now()
+	}
+}
+
+// Get returns a copy of the peer with the given key.
+func (r *PeerRegistry) Get(key string) (Device, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	e, found := r.peers[key]
+	if !found {
+		return Device{}, false
+	}
+	return e.device, true
+}
+
+// Snapshot returns a copy of every known peer, sorted by name.
+func (r *PeerRegistry) Snapshot() []Device {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	peers := make([]Device, 0, len(r.peers))
+	for _, e := range r.peers {
+		peers = append(peers, e.device)
+	}
+
+	slices.SortFunc(peers, func(a, b Device) int { return cmp.Compare(a.Name, b.Name) })
+
+	return peers
+}
+
+func sameAddr(a, b net.IPAddr) bool {
+	return a.IP.Equal(b.IP) && a.Zone == b.Zone
+}
+
+func sameAddrs(a, b Device) bool {
+	return a.IP.Equal(b.IP) && a.SvcPort == b.SvcPort && slices.EqualFunc(a.Addrs, b.Addrs, sameAddr)
+}
+
+func sameMetadata(a, b Device) bool {
+	return a.Name == b.Name &&
+		a.DiscoveredOn == b.DiscoveredOn &&
+		a.ProtocolVersion == b.ProtocolVersion &&
+		a.OS == b.OS &&
+		a.Arch == b.Arch &&
+		a.Type == b.Type &&
+		a.AppVersion == b.AppVersion &&
+		slices.Equal(a.Capabilities, b.Capabilities) &&
+		a.CertFingerprint == b.CertFingerprint &&
+		a.Accepting == b.Accepting
+}
@@ -0,0 +1,255 @@
+package shair
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func addrs(ips ...string) []net.IPAddr {
+	var a []net.IPAddr
+	for _, ip := range ips {
+		a = append(a, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return a
+}
+
+// drain returns the statuses of the updates waiting on ch.
+func drain(ch <-chan PeerUpdate) []PeerStatus {
+	var got []PeerStatus
+	for {
+		select {
+		case pu := <-ch:
+			got = append(got, pu.Status)
+		default:
+			return got
+		}
+	}
+}
+
+func TestPeerRegistryUpdates(t *testing.T) {
+	peer := Device{ID: "id", Name: "laptop", LocalInfo: LocalInfo{SvcPort: 1234, Addrs: addrs("192.168.1.2")}}
+
+	tests := []struct {
+		name   string
+		change func(r *PeerRegistry)
+		want   []PeerStatus
+		peers  int
+	}{
+		{
+			name:   "new peer",
+			change: func(r *PeerRegistry) { r.Upsert("mdns", peer) },
+			want:   []PeerStatus{Discovered},
+			peers:  1,
+		},
+		{
+			name: "same peer again",
+			change: func(r *PeerRegistry) {
+				r.Upsert("mdns", peer)
+				r.Upsert("mdns", peer)
+			},
+			want:  []PeerStatus{Discovered},
+			peers: 1,
+		},
+		{
+			name: "same peer from another source",
+			change: func(r *PeerRegistry) {
+				r.Upsert("mdns", peer)
+				other := peer
+				other.Addrs = addrs("10.0.0.2")
+				r.Upsert("multicast", other)
+			},
+			want:  []PeerStatus{Discovered, AddressChanged},
+			peers: 1,
+		},
+		{
+			name: "renamed peer",
+			change: func(r *PeerRegistry) {
+				r.Upsert("mdns", peer)
+				renamed := peer
+				renamed.Name = "desktop"
+				r.Upsert("mdns", renamed)
+			},
+			want:  []PeerStatus{Discovered, Updated},
+			peers: 1,
+		},
+		{
+			name: "removed by one of two sources",
+			change: func(r *PeerRegistry) {
+				r.Upsert("mdns", peer)
+				r.Upsert("multicast", peer)
+				r.Remove("mdns", peer.Key())
+			},
+			want:  []PeerStatus{Discovered},
+			peers: 1,
+		},
+		{
+			name: "removed by its only source",
+			change: func(r *PeerRegistry) {
+				r.Upsert("mdns", peer)
+				r.Remove("mdns", peer.Key())
+			},
+			want:  []PeerStatus{Discovered, Removed},
+			peers: 0,
+		},
+		{
+			name:   "unknown peer removed",
+			change: func(r *PeerRegistry) { r.Remove("mdns", peer.Key()) },
+			peers:  0,
+		},
+		{
+			name: "reachability and small rtt change",
+			change: func(r *PeerRegistry) {
+				r.Upsert("mdns", peer)
+				r.SetReachability(peer.Key(), Reachable, 10*time.Millisecond)
+				r.SetReachability(peer.Key(), Reachable, 11*time.Millisecond)
+				r.SetReachability(peer.Key(), Stale, 0)
+			},
+			want:  []PeerStatus{Discovered, ReachabilityChanged, ReachabilityChanged},
+			peers: 1,
+		},
+		{
+			name: "accepting state",
+			change: func(r *PeerRegistry) {
+				r.Upsert("mdns", peer)
+				r.SetAccepting(peer.Key(), false)
+				r.SetAccepting(peer.Key(), true)
+				r.SetAccepting(peer.Key(), true)
+			},
+			want:  []PeerStatus{Discovered, Updated},
+			peers: 1,
+		},
+		{
+			name: "preferred address",
+			change: func(r *PeerRegistry) {
+				r.Upsert("mdns", peer)
+				r.SetPreferredIP(peer.Key(), net.ParseIP("192.168.1.2"))
+				r.SetPreferredIP(peer.Key(), net.ParseIP("192.168.1.3"))
+			},
+			want:  []PeerStatus{Discovered, AddressChanged},
+			peers: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewPeerRegistry()
+			updates, unsubscribe := r.Subscribe()
+			defer unsubscribe()
+
+			tt.change(r)
+
+			got := drain(updates)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got updates %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got updates %v, want %v", got, tt.want)
+				}
+			}
+			if n := len(r.Snapshot()); n != tt.peers {
+				t.Fatalf("got %d peers, want %d", n, tt.peers)
+			}
+		})
+	}
+}
+
+func TestPeerRegistryMerge(t *testing.T) {
+	r := NewPeerRegistry()
+
+	a := Device{ID: "id", Name: "laptop", LocalInfo: LocalInfo{Addrs: addrs("192.168.1.2")}}
+	b := Device{ID: "id", Name: "laptop", LocalInfo: LocalInfo{Addrs: addrs("10.0.0.2", "192.168.1.2")}}
+	r.Upsert("mdns", a)
+	r.Upsert("multicast", b)
+	r.SetPreferredIP(a.Key(), net.ParseIP("10.0.0.2"))
+
+	d, _ := r.Get(a.Key())
+	if len(d.Addrs) != 2 {
+		t.Fatalf("got addresses %v, want both sources merged", d.Addrs)
+	}
+	if !d.IP.Equal(net.ParseIP("10.0.0.2")) {
+		t.Fatalf("got preferred address %v, want 10.0.0.2", d.IP)
+	}
+
+	// the preferred address goes away with the only source advertising it
+	r.Remove("multicast", a.Key())
+	d, _ = r.Get(a.Key())
+	if len(d.Addrs) != 1 || !d.IP.Equal(net.ParseIP("192.168.1.2")) {
+		t.Fatalf("got %v preferring %v, want 192.168.1.2 only", d.Addrs, d.IP)
+	}
+}
+
+func TestPeerRegistryLaggingSubscriber(t *testing.T) {
+	r := NewPeerRegistry()
+	updates, unsubscribe := r.Subscribe()
+	defer unsubscribe()
+
+	// the registry must not wait for a subscriber that doesn't read
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range subscriberBuffer + 1 {
+			r.Upsert("mdns", Device{Name: string(rune('a' + i%26)), ID: time.Duration(i).String()})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the registry blocked on a lagging subscriber")
+	}
+
+	n := 0
+	for range updates {
+		n++
+	}
+	if n != subscriberBuffer {
+		t.Fatalf("got %d updates before the disconnection, want %d", n, subscriberBuffer)
+	}
+}
+
+func TestPeerRegistryForwardCatchesUp(t *testing.T) {
+	r := NewPeerRegistry()
+	r.Upsert("mdns", Device{Name: "kept", ID: "kept"})
+	r.Upsert("mdns", Device{Name: "gone", ID: "gone"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan PeerUpdate)
+	go r.Forward(ctx, ch)
+
+	// view is the list of peers as seen through ch
+	view := make(map[string]bool)
+	apply := func(pu PeerUpdate) {
+		if pu.Status == Removed {
+			delete(view, pu.Peer.Key())
+		} else {
+			view[pu.Peer.Key()] = true
+		}
+	}
+	for range 2 {
+		apply(<-ch)
+	}
+
+	// ch isn't read while the registry changes, the subscription is disconnected and the removal of
+	// gone happens after that
+	for i := range subscriberBuffer + 10 {
+		r.Upsert("mdns", Device{Name: "new", ID: time.Duration(i).String()})
+	}
+	r.Remove("mdns", "gone")
+
+	want := len(r.Snapshot())
+	timeout := time.After(5 * time.Second)
+	for len(view) != want || view["gone"] {
+		select {
+		case pu := <-ch:
+			apply(pu)
+		case <-timeout:
+			t.Fatalf("got %d peers, gone listed %v, want the %d peers of the registry", len(view), view["gone"], want)
+		}
+	}
+	if !view["kept"] {
+		t.Fatal("lost a peer while catching up")
+	}
+}
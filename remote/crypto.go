@@ -0,0 +1,392 @@
+// this file provides the end to end encryption of the streams piped by the relay and of the mails
+package remote
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// maximum size of the plaintext carried by one encrypted record
+const maxRecordSize = 16 * 1024
+
+// secureConn encrypts a stream with AES-GCM. Each direction has its own key, records are numbered
+// so that the relay can't drop, replay or reorder them without the peer noticing.
+type secureConn struct {
+	net.Conn
+
+	wmu     sync.Mutex
+	send    cipher.AEAD
+	sendSeq uint64
+
+	rmu     sync.Mutex
+	recv    cipher.AEAD
+	recvSeq uint64
+	pending []byte // decrypted bytes not read yet
+}
+
+func newSecureConn(conn net.Conn, sendKey, recvKey []byte) (*secureConn, error) {
+	send, err := newAEAD(sendKey)
+	if err != nil {
+		return nil, err
+	}
+	recv, err := newAEAD(recvKey)
+	if err != nil {
+		return nil, err
+	}
+	return &secureConn{Conn: conn, send: send, recv: recv}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func nonce(aead cipher.AEAD, seq uint64) []byte {
+	n := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(n[len(n)-8:], seq)
+	return n
+}
+
+func (c *secureConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), maxRecordSize)]
+
+		record := binary.BigEndian.AppendUint32(nil, uint32(len(chunk)+c.send.Overhead()))
+		record = c.send.Seal(record, nonce(c.send, c.sendSeq), chunk, nil)
+		c.sendSeq++
+
+		if _, err := c.Conn.Write(record); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+
+	return written, nil
+}
+
+func (c *secureConn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	if len(c.pending) == 0 {
+		size := make([]byte, 4)
+		if _, err := io.ReadFull(c.Conn, size); err != nil {
+			return 0, err
+		}
+
+		n := binary.BigEndian.Uint32(size)
+		if n > maxRecordSize+uint32(c.recv.Overhead()) {
+			return 0, fmt.Errorf("record of %d bytes is too large", n)
+		}
+
+		record := make([]byte, n)
+		if _, err := io.ReadFull(c.Conn, record); err != nil {
+			return 0, err
+		}
+
+		plain, err := c.recv.Open(record[:0], nonce(c.recv, c.recvSeq), record, nil)
+		if err != nil {
+			return 0, errors.New("record failed authentication")
+		}
+		c.recvSeq++
+		c.pending = plain
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+
+	return n, nil
+}
+
+// concatDH concatenates the secrets of the Diffie-Hellman exchanges between privs[i] and pubs[i].
+func concatDH(privs []*ecdh.PrivateKey, pubs []*ecdh.PublicKey) ([]byte, error) {
+	var secret []byte
+	for i := range privs {
+		s, err := privs[i].ECDH(pubs[i])
+		if err != nil {
+			return nil, err
+		}
+		secret = append(secret, s...)
+	}
+	return secret, nil
+}
+
+// deriveKeys derives the keys of both directions from the handshake secret.
+// The initiator sends with the first one, the responder with the second one.
+func deriveKeys(secret []byte, transcript []byte) (initiator, responder []byte, err error) {
+	keys, err := hkdf.Key(sha256.New, secret, nil, "shair relay v1 "+string(transcript), 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keys[:32], keys[32:], nil
+}
+
+func secure(conn net.Conn, isInitiator bool, initiatorKey, responderKey []byte) (*secureConn, error) {
+	if isInitiator {
+		return newSecureConn(conn, initiatorKey, responderKey)
+	}
+	return newSecureConn(conn, responderKey, initiatorKey)
+}
+
+// handshakeInitiator authenticates the connection to the device owning the static key remote and encrypts it.
+// The responder learns our static key and decides whether it trusts it.
+func handshakeInitiator(conn net.Conn, static *ecdh.PrivateKey, remote *ecdh.PublicKey) (*secureConn, error) {
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	hello := append(eph.PublicKey().Bytes(), static.PublicKey().Bytes()...)
+	if _, err := conn.Write(hello); err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, 32)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	remoteEph, err := ecdh.X25519().NewPublicKey(reply)
+	if err != nil {
+		return nil, err
+	}
+
+	// only the owner of remote can compute the first two secrets
+	secret, err := concatDH([]*ecdh.PrivateKey{eph, static, eph}, []*ecdh.PublicKey{remote, remote, remoteEph})
+	if err != nil {
+		return nil, err
+	}
+
+	ik, rk, err := deriveKeys(secret, append(hello, reply...))
+	if err != nil {
+		return nil, err
+	}
+
+	return secure(conn, true, ik, rk)
+}
+
+// handshakeResponder answers handshakeInitiator with our static key. It returns the static key of the
+// initiator once the connection is encrypted, the caller must check it belongs to a trusted device.
+func handshakeResponder(conn net.Conn, static *ecdh.PrivateKey) (*secureConn, *ecdh.PublicKey, error) {
+	hello := make([]byte, 64)
+	if _, err := io.ReadFull(conn, hello); err != nil {
+		return nil, nil, err
+	}
+
+	remoteEph, err := ecdh.X25519().NewPublicKey(hello[:32])
+	if err != nil {
+		return nil, nil, err
+	}
+	remoteStatic, err := ecdh.X25519().NewPublicKey(hello[32:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	reply := eph.PublicKey().Bytes()
+	if _, err := conn.Write(reply); err != nil {
+		return nil, nil, err
+	}
+
+	secret, err := concatDH([]*ecdh.PrivateKey{static, static, eph}, []*ecdh.PublicKey{remoteEph, remoteStatic, remoteEph})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ik, rk, err := deriveKeys(secret, append(hello, reply...))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sc, err := secure(conn, false, ik, rk)
+	return sc, remoteStatic, err
+}
+
+// handshakeCode encrypts a connection between two peers that joined with the same code. The key is derived
+// from the code with SPAKE2, and both peers prove they know the code before anything else is sent.
+func handshakeCode(conn net.Conn, isInitiator bool, code string) (*secureConn, error) {
+	shared, transcript, err := spake2(conn, isInitiator, code)
+	if err != nil {
+		return nil, err
+	}
+
+	ik, rk, err := deriveKeys(shared, transcript)
+	if err != nil {
+		return nil, err
+	}
+
+	// key confirmation: each side proves it derived the same keys, hence knows the code
+	mac := func(key []byte) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write(transcript)
+		return h.Sum(nil)
+	}
+	mine, theirs := mac(ik), mac(rk)
+	if !isInitiator {
+		mine, theirs = theirs, mine
+	}
+
+	if _, err := conn.Write(mine); err != nil {
+		return nil, err
+	}
+	got := make([]byte, len(theirs))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(got, theirs) {
+		return nil, errors.New("the peer doesn't know the code")
+	}
+
+	return secure(conn, isInitiator, ik, rk)
+}
+
+// newChallenge returns a challenge for the device registering with id and the public key, and the function
+// checking its answer. The challenge is a fresh public key followed by a nonce, see proveKey.
+func newChallenge(key []byte, id string) ([]byte, func(proof []byte) bool, error) {
+	remote, err := ecdh.X25519().NewPublicKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	challenge := make([]byte, 64)
+	copy(challenge, eph.PublicKey().Bytes())
+	if _, err := rand.Read(challenge[32:]); err != nil {
+		return nil, nil, err
+	}
+
+	verify := func(proof []byte) bool {
+		secret, err := eph.ECDH(remote)
+		return err == nil && hmac.Equal(proof, keyProof(secret, challenge, id))
+	}
+	return challenge, verify, nil
+}
+
+// proveKey answers a challenge of newChallenge. Only the owner of static can compute the secret keying the
+// answer, which proves the relay the device registering with id owns the key it registers with.
+func proveKey(static *ecdh.PrivateKey, challenge []byte, id string) ([]byte, error) {
+	if len(challenge) != 64 {
+		return nil, fmt.Errorf("challenge of %d bytes", len(challenge))
+	}
+
+	eph, err := ecdh.X25519().NewPublicKey(challenge[:32])
+	if err != nil {
+		return nil, err
+	}
+	secret, err := static.ECDH(eph)
+	if err != nil {
+		return nil, err
+	}
+
+	return keyProof(secret, challenge, id), nil
+}
+
+func keyProof(secret []byte, challenge []byte, id string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte("shair relay register v1"))
+	h.Write(challenge)
+	h.Write([]byte(id))
+	return h.Sum(nil)
+}
+
+// streamConn lets a secureConn encrypt a stream that isn't a connection, eg a mail.
+type streamConn struct {
+	io.Reader
+	io.Writer
+}
+
+type streamAddr struct{}
+
+func (streamAddr) Network() string { return "stream" }
+func (streamAddr) String() string  { return "stream" }
+
+func (streamConn) Close() error                     { return nil }
+func (streamConn) LocalAddr() net.Addr              { return streamAddr{} }
+func (streamConn) RemoteAddr() net.Addr             { return streamAddr{} }
+func (streamConn) SetDeadline(time.Time) error      { return nil }
+func (streamConn) SetReadDeadline(time.Time) error  { return nil }
+func (streamConn) SetWriteDeadline(time.Time) error { return nil }
+
+// seal encrypts what is written to the returned conn, and writes it to w, for the device owning the
+// static key remote. Unlike a handshake it needs no answer: the device opens it later with unseal.
+func seal(w io.Writer, static *ecdh.PrivateKey, remote *ecdh.PublicKey) (*secureConn, error) {
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	hello := append(eph.PublicKey().Bytes(), static.PublicKey().Bytes()...)
+	if _, err := w.Write(hello); err != nil {
+		return nil, err
+	}
+
+	// only the owner of remote can compute the secrets, the second one proves we sealed it
+	secret, err := concatDH([]*ecdh.PrivateKey{eph, static}, []*ecdh.PublicKey{remote, remote})
+	if err != nil {
+		return nil, err
+	}
+
+	ik, rk, err := deriveKeys(secret, hello)
+	if err != nil {
+		return nil, err
+	}
+
+	return secure(streamConn{Writer: w}, true, ik, rk)
+}
+
+// unseal decrypts what seal wrote, read from r. It returns the static key of the sender, the caller
+// must check it belongs to a trusted device.
+func unseal(r io.Reader, static *ecdh.PrivateKey) (*secureConn, *ecdh.PublicKey, error) {
+	hello := make([]byte, 64)
+	if _, err := io.ReadFull(r, hello); err != nil {
+		return nil, nil, err
+	}
+
+	remoteEph, err := ecdh.X25519().NewPublicKey(hello[:32])
+	if err != nil {
+		return nil, nil, err
+	}
+	remoteStatic, err := ecdh.X25519().NewPublicKey(hello[32:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	secret, err := concatDH([]*ecdh.PrivateKey{static, static}, []*ecdh.PublicKey{remoteEph, remoteStatic})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ik, rk, err := deriveKeys(secret, hello)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sc, err := secure(streamConn{Reader: r}, false, ik, rk)
+	return sc, remoteStatic, err
+}
@@ -0,0 +1,136 @@
+package remote
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// frames exchanged with the relay are a JSON message prefixed by its length on 4 bytes.
+// The length prefix lets the relay read exactly one message before piping the rest of the stream.
+const maxFrameSize = 64 * 1024
+
+// operations a client asks the relay for, in the first frame of each connection
+const (
+	opRegister = "register" // keep the connection to be told about incoming connections for our device ID
+	opWatch    = "watch"    // keep the connection to be told when the given device IDs come and go
+	opDial     = "dial"     // get connected to a registered device ID
+	opAccept   = "accept"   // answer an incoming connection announced on the register connection
+	opJoin     = "join"     // get connected to the other peer joining with the same code
+	opDeposit  = "deposit"  // leave a mail for a device ID in the mailbox, the sealed payload follows the ok
+	opCollect  = "collect"  // get a mail announced on the register connection, the payload follows the ok
+	opKeep     = "keep"     // answer a collected mail that couldn't be handled yet, the mailbox keeps it
+	opProof    = "proof"    // answer the challenge of a register or a deposit, proves we own the key we claim
+)
+
+// operations the relay sends back
+const (
+	opOK        = "ok"        // the connection is established, what follows is the peer's stream
+	opError     = "error"     // the request failed, see Error
+	opIncoming  = "incoming"  // someone dials our device ID, accept it with Token
+	opPresence  = "presence"  // a watched device came online or went offline
+	opAllocated = "allocated" // the nameplate allocated to a join, sent before the ok
+	opMail      = "mail"      // a mail waits for us in the mailbox, collect it with Mail.ID
+	opReceipt   = "receipt"   // the outcome of a mail we deposited, also how the recipient answers a collected mail
+	opChallenge = "challenge" // sent before the ok answering a register or a deposit, see newChallenge
+)
+
+// message is the content of every frame, only the fields relevant to Op are set.
+type message struct {
+	Op    string `json:"op"`
+	Error string `json:"error,omitempty"`
+
+	Peer   *peerInfo `json:"peer,omitempty"`   // register, deposit: the device receipts are sent to, incoming, presence
+	IDs    []string  `json:"ids,omitempty"`    // watch
+	ID     string    `json:"id,omitempty"`     // dial, deposit: the recipient
+	Token  string    `json:"token,omitempty"`  // incoming, accept, and the mail ID on collect and the ok answering a deposit
+	Code   string    `json:"code,omitempty"`   // join, allocated: the nameplate, the public part of a code
+	Online bool      `json:"online,omitempty"` // presence
+	Size   int64     `json:"size,omitempty"`   // deposit, ok answering a collect: size of the payload
+
+	Mail    *mailInfo `json:"mail,omitempty"`    // mail
+	Receipt *Receipt  `json:"receipt,omitempty"` // receipt
+
+	Challenge []byte `json:"challenge,omitempty"` // challenge
+	Proof     []byte `json:"proof,omitempty"`     // proof
+
+	// set on a join without code: the relay allocates a free nameplate
+	Allocate bool `json:"allocate,omitempty"`
+
+	// set on the ok answering a join: the second peer to join leads the handshake
+	Initiator bool `json:"initiator,omitempty"`
+}
+
+// peerInfo describes a device to the relay and to its peers.
+type peerInfo struct {
+	ID           string   `json:"id"`
+	Name         string   `json:"name"`
+	PublicKey    []byte   `json:"publicKey,omitempty"`
+	OS           string   `json:"os,omitempty"`
+	Arch         string   `json:"arch,omitempty"`
+	Type         string   `json:"type,omitempty"`
+	AppVersion   string   `json:"version,omitempty"`
+	Capabilities []string `json:"caps,omitempty"`
+}
+
+func writeFrame(w io.Writer, msg message) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if len(b) > maxFrameSize {
+		return errors.New("frame too large")
+	}
+
+	_, err = w.Write(append(binary.BigEndian.AppendUint32(nil, uint32(len(b))), b...))
+	return err
+}
+
+func readFrame(r io.Reader) (message, error) {
+	size := make([]byte, 4)
+	if _, err := io.ReadFull(r, size); err != nil {
+		return message{}, err
+	}
+
+	n := binary.BigEndian.Uint32(size)
+	if n > maxFrameSize {
+		return message{}, fmt.Errorf("frame of %d bytes is too large", n)
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return message{}, err
+	}
+
+	var msg message
+	if err := json.Unmarshal(b, &msg); err != nil {
+		return message{}, fmt.Errorf("invalid frame: %w", err)
+	}
+
+	return msg, nil
+}
+
+// relayError is an error answered by the relay.
+type relayError string
+
+func (e relayError) Error() string { return "relay: " + string(e) }
+
+// errOffline answers a dial to a device that isn't registered.
+const errOffline relayError = "device is offline"
+
+// readOK reads the relay's answer to a request and turns an error answer into an error.
+func readOK(r io.Reader) (message, error) {
+	msg, err := readFrame(r)
+	if err != nil {
+		return message{}, err
+	}
+	if msg.Op == opError {
+		return message{}, relayError(msg.Error)
+	}
+	if msg.Op != opOK {
+		return message{}, fmt.Errorf("unexpected answer %q from the relay", msg.Op)
+	}
+	return msg, nil
+}
@@ -0,0 +1,144 @@
+// this file provides the client side of the relay's mailbox: files for an offline pair are sealed for it
+// and deposited, the pair collects them when it comes online, and we get a receipt telling what became of them.
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/masar3141/shair"
+)
+
+// Deposit leaves the files for target, one of our pairs, in the relay's mailbox. They are offered to
+// target with a transfer request next time it is announced, and the outcome is reported to the receipt
+// handler, see WithReceiptHandler. It returns the ID of the mail, which the receipt refers to, see
+// SendFiles for a shair.DepositedError carrying it.
+func (r *RemoteShairer) Deposit(ctx context.Context, target *shair.Device, progressCh chan<- int, filepaths ...string) (string, error) {
+	pair, remoteKey, err := r.pairKey(target)
+	if err != nil {
+		return "", err
+	}
+
+	// the size of the mail is needed upfront, seal it in a temporary file first
+	tmp, err := os.CreateTemp("", "shair-mail-*")
+	if err != nil {
+		return "", shair.NewError(shair.UnexpectedError, "cannot create the mail", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	sc, err := seal(tmp, r.key, remoteKey)
+	if err != nil {
+		return "", shair.NewError(shair.UnexpectedError, "cannot seal the mail", err)
+	}
+	if err := r.transfer.WriteTransfer(ctx, sc, progressCh, filepaths...); err != nil {
+		return "", err
+	}
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return "", shair.NewError(shair.UnexpectedError, "cannot read the mail", err)
+	}
+
+	self := r.self()
+	conn, ok, err := r.connect(ctx, message{Op: opDeposit, ID: pair.ID, Peer: &self, Size: size})
+	if err != nil {
+		return "", shair.NewError(shair.ServiceError, fmt.Sprintf("cannot leave the files for %s in the mailbox", target.Name), err)
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	_, err = io.Copy(conn, tmp)
+	if err == nil {
+		_, err = readOK(conn)
+	}
+	if err != nil {
+		return "", shair.NewError(shair.ConnectionDroppedError, fmt.Sprintf("cannot leave the files for %s in the mailbox", target.Name), err)
+	}
+
+	return ok.Token, nil
+}
+
+// Outcome is the outcome of the transfer settled by the receipt, see shair.Application.Settle.
+func (rc Receipt) Outcome() shair.Outcome {
+	switch rc.Status {
+	case Delivered:
+		return shair.Completed
+	case Rejected:
+		return shair.Declined
+	}
+	return shair.Expired
+}
+
+// collect gets a mail from the mailbox and offers it to the user. Rejected and delivered mails are
+// removed from the mailbox, the others are offered again next time we are announced.
+func (r *RemoteShairer) collect(ctx context.Context, mail mailInfo, saveDir string, transferRequestCh chan<- shair.TransferRequest) error {
+	r.mmu.Lock()
+	defer r.mmu.Unlock()
+
+	conn, ok, err := r.connect(ctx, message{Op: opCollect, Token: mail.ID})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	sc, key, err := unseal(io.LimitReader(conn, ok.Size), r.key)
+	if err != nil {
+		return fmt.Errorf("cannot open the mail: %w", err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	pair, found := r.pairByKey(key.Bytes())
+	if !found {
+		_ = answerMail(conn, message{Op: opReceipt, Receipt: &Receipt{Status: Rejected, Reason: "not paired with the sender"}})
+		return errors.New("mail from a device we didn't pair with")
+	}
+
+	sender := r.sender(pair)
+	err = r.transfer.ReadTransfer(ctx, saveDir, sc, &sender, transferRequestCh)
+
+	answer := message{Op: opReceipt, Receipt: &Receipt{Status: Delivered}}
+	var rejection shair.RejectedError
+	switch {
+	case err == nil:
+	case errors.As(err, &rejection) && rejection.Reason != shair.ReasonBusy && rejection.Reason != shair.ReasonTimeout:
+		answer.Receipt = &Receipt{Status: Rejected, Reason: rejection.Error()}
+	default:
+		// busy, unanswered or interrupted, try again later
+		answer = message{Op: opKeep}
+	}
+
+	if werr := answerMail(conn, answer); werr != nil {
+		return werr
+	}
+	if answer.Op == opKeep {
+		return err
+	}
+	return nil
+}
+
+// answerMail tells the relay what became of the mail being collected on conn. The relay stops sending the
+// rest of the mail once it has the answer, what it sent until then is read: closing the connection with
+// unread data would reset it, and the answer could be lost with it.
+func answerMail(conn net.Conn, answer message) error {
+	if err := writeFrame(conn, answer); err != nil {
+		return err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	_, _ = io.Copy(io.Discard, conn)
+	return nil
+}
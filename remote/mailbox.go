@@ -0,0 +1,540 @@
+// this file provides the mailbox of the relay: it holds the payloads sent to offline devices until they
+// come online, and the receipts telling the senders what became of them. Payloads are sealed by the
+// senders for the recipients, the relay can't read them.
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DeliveryStatus is what became of a mail.
+type DeliveryStatus string
+
+const (
+	Delivered DeliveryStatus = "delivered" // the recipient accepted and saved the files
+	Rejected  DeliveryStatus = "rejected"  // the recipient rejected the files, see Receipt.Reason
+	Expired   DeliveryStatus = "expired"   // the recipient didn't collect the mail in time
+)
+
+// Receipt tells the sender of a mail what became of it. It is reported by the relay.
+type Receipt struct {
+	MailID string         `json:"mail"`
+	To     string         `json:"to"` // device ID of the recipient
+	Status DeliveryStatus `json:"status"`
+	Reason string         `json:"reason,omitempty"` // why the mail was rejected
+	Time   time.Time      `json:"time"`
+}
+
+// mailInfo describes a mail to its recipient.
+type mailInfo struct {
+	ID        string    `json:"id"`
+	To        string    `json:"to"`
+	From      string    `json:"from"`
+	Size      int64     `json:"size"`
+	Deposited time.Time `json:"deposited"`
+}
+
+// storedReceipt is a receipt waiting for the sender to come online.
+type storedReceipt struct {
+	For string `json:"for"`
+	Receipt
+}
+
+// Mailbox stores the mails and receipts of a relay in a directory, so that they survive restarts.
+// Each mail is made of its payload, <id>.payload, and its description, <id>.json, written once the
+// payload is complete. Receipts are kept in <id>.receipt.
+type Mailbox struct {
+	dir string
+
+	expiry    time.Duration // how long mails and receipts are kept
+	retry     time.Duration // how long a mail the recipient kept waits before it is offered again
+	maxSize   int64         // of a mail
+	maxTotal  int64         // of the mails waiting for a recipient
+	maxStored int64         // of all the mails
+
+	mu         sync.Mutex
+	mails      map[string]mailInfo // by ID, complete or being deposited
+	collecting map[string]bool     // mails being collected, by ID
+	receipts   map[string]storedReceipt
+}
+
+// MailboxOption configures optional behaviours of a Mailbox.
+type MailboxOption func(*Mailbox)
+
+// WithMailExpiry sets how long mails wait for their recipient, and receipts for their sender,
+// 7 days by default.
+func WithMailExpiry(d time.Duration) MailboxOption {
+	return func(m *Mailbox) {
+		m.expiry = d
+	}
+}
+
+// WithMaxMailSize sets the size of the largest mail accepted, 1 GiB by default.
+func WithMaxMailSize(n int64) MailboxOption {
+	return func(m *Mailbox) {
+		m.maxSize = n
+	}
+}
+
+// WithMaxMailboxSize sets the size of all the mails waiting for a recipient, 4 GiB by default.
+func WithMaxMailboxSize(n int64) MailboxOption {
+	return func(m *Mailbox) {
+		m.maxTotal = n
+	}
+}
+
+// WithMaxStoredSize sets the size of all the mails held, whatever their recipient, 32 GiB by default.
+func WithMaxStoredSize(n int64) MailboxOption {
+	return func(m *Mailbox) {
+		m.maxStored = n
+	}
+}
+
+// WithMailRetry sets how long a mail its recipient couldn't handle yet, eg because it was busy, waits
+// before it is offered again while the recipient stays online, 5 minutes by default.
+func WithMailRetry(d time.Duration) MailboxOption {
+	return func(m *Mailbox) {
+		m.retry = d
+	}
+}
+
+// NewMailbox returns a mailbox storing its content in dir, it loads what was left there.
+func NewMailbox(dir string, opts ...MailboxOption) (*Mailbox, error) {
+	m := &Mailbox{
+		dir: dir,
+
+		expiry:    7 * 24 * time.Hour,
+		retry:     5 * time.Minute,
+		maxSize:   1 << 30,
+		maxTotal:  4 << 30,
+		maxStored: 32 << 30,
+
+		mails:      make(map[string]mailInfo),
+		collecting: make(map[string]bool),
+		receipts:   make(map[string]storedReceipt),
+	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *Mailbox) path(id, ext string) string {
+	return filepath.Join(m.dir, id+ext)
+}
+
+func (m *Mailbox) load() error {
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		id, ext, _ := strings.Cut(e.Name(), ".")
+		switch ext {
+		case "json":
+			var mail mailInfo
+			if err := readJSON(m.path(id, ".json"), &mail); err != nil {
+				return err
+			}
+			m.mails[id] = mail
+		case "receipt":
+			var rc storedReceipt
+			if err := readJSON(m.path(id, ".receipt"), &rc); err != nil {
+				return err
+			}
+			m.receipts[id] = rc
+		}
+	}
+
+	// payloads without description were interrupted while deposited
+	for _, e := range entries {
+		id, ext, _ := strings.Cut(e.Name(), ".")
+		if _, found := m.mails[id]; ext == "payload" && !found {
+			_ = os.Remove(m.path(id, ".payload"))
+		}
+	}
+
+	return nil
+}
+
+func readJSON(p string, v any) error {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func writeJSON(p string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p, b, 0o600)
+}
+
+// reserve makes room for a mail of size bytes, it fails if the mail exceeds the limits.
+func (m *Mailbox) reserve(to, from string, size int64) (mailInfo, error) {
+	if size <= 0 || size > m.maxSize {
+		return mailInfo{}, fmt.Errorf("mails are limited to %d bytes", m.maxSize)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	total, stored := size, size
+	for _, mail := range m.mails {
+		if mail.To == to {
+			total += mail.Size
+		}
+		stored += mail.Size
+	}
+	if total > m.maxTotal {
+		return mailInfo{}, errors.New("the mailbox of the device is full")
+	}
+	if stored > m.maxStored {
+		return mailInfo{}, errors.New("the mailbox of the relay is full")
+	}
+
+	mail := mailInfo{ID: newToken(), To: to, From: from, Size: size, Deposited: time.Now()}
+	m.mails[mail.ID] = mail
+
+	return mail, nil
+}
+
+// deposit stores the payload of a reserved mail, read from r. The mail is dropped if it fails.
+func (m *Mailbox) deposit(mail mailInfo, r io.Reader) (err error) {
+	defer func() {
+		if err != nil {
+			m.remove(mail.ID)
+		}
+	}()
+
+	f, err := os.OpenFile(m.path(mail.ID, ".payload"), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(f, r, mail.Size)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(m.path(mail.ID, ".json"), mail)
+}
+
+// pending returns the complete mails waiting for the recipient.
+func (m *Mailbox) pending(to string) []mailInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var mails []mailInfo
+	for _, mail := range m.mails {
+		if mail.To == to && !m.collecting[mail.ID] && m.complete(mail.ID) {
+			mails = append(mails, mail)
+		}
+	}
+	return mails
+}
+
+func (m *Mailbox) complete(id string) bool {
+	_, err := os.Stat(m.path(id, ".json"))
+	return err == nil
+}
+
+// collect opens the payload of a mail, which can't be collected again until release or remove.
+func (m *Mailbox) collect(id string) (mailInfo, *os.File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mail, found := m.mails[id]
+	if !found || !m.complete(id) {
+		return mailInfo{}, nil, errors.New("unknown mail")
+	}
+	if m.collecting[id] {
+		return mailInfo{}, nil, errors.New("the mail is already being collected")
+	}
+
+	f, err := os.Open(m.path(id, ".payload"))
+	if err != nil {
+		return mailInfo{}, nil, err
+	}
+	m.collecting[id] = true
+
+	return mail, f, nil
+}
+
+// release makes a collected mail available again.
+func (m *Mailbox) release(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.collecting, id)
+}
+
+// waiting tells whether the mail is complete and waits to be collected.
+func (m *Mailbox) waiting(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, found := m.mails[id]
+	return found && !m.collecting[id] && m.complete(id)
+}
+
+func (m *Mailbox) remove(id string) {
+	m.mu.Lock()
+	delete(m.mails, id)
+	delete(m.collecting, id)
+	m.mu.Unlock()
+
+	_ = os.Remove(m.path(id, ".json"))
+	_ = os.Remove(m.path(id, ".payload"))
+}
+
+// addReceipt keeps rc until the sender of the mail collects it.
+func (m *Mailbox) addReceipt(sender string, rc Receipt) {
+	stored := storedReceipt{For: sender, Receipt: rc}
+
+	m.mu.Lock()
+	m.receipts[rc.MailID] = stored
+	m.mu.Unlock()
+
+	_ = writeJSON(m.path(rc.MailID, ".receipt"), stored)
+}
+
+// takeReceipts removes and returns the receipts waiting for the sender, see addReceipt to put them back.
+func (m *Mailbox) takeReceipts(sender string) []Receipt {
+	m.mu.Lock()
+	var rcs []Receipt
+	for id, rc := range m.receipts {
+		if rc.For == sender {
+			rcs = append(rcs, rc.Receipt)
+			delete(m.receipts, id)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, rc := range rcs {
+		_ = os.Remove(m.path(rc.MailID, ".receipt"))
+	}
+	return rcs
+}
+
+// expire drops the mails and receipts older than the expiry, it returns the mails dropped.
+func (m *Mailbox) expire(now time.Time) []mailInfo {
+	var expired []mailInfo
+	var receipts []string
+
+	m.mu.Lock()
+	for id, mail := range m.mails {
+		if now.Sub(mail.Deposited) > m.expiry && !m.collecting[id] {
+			expired = append(expired, mail)
+		}
+	}
+	for id, rc := range m.receipts {
+		if now.Sub(rc.Time) > m.expiry {
+			receipts = append(receipts, id)
+			delete(m.receipts, id)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, mail := range expired {
+		m.remove(mail.ID)
+	}
+	for _, id := range receipts {
+		_ = os.Remove(m.path(id, ".receipt"))
+	}
+
+	return expired
+}
+
+// deposit stores the mail that follows the request, for a device that may be offline. The depositor must
+// prove who it is, as on register, since the receipts are sent to it.
+func (r *Relay) deposit(conn net.Conn, msg message) {
+	if r.mailbox == nil {
+		_ = writeFrame(conn, message{Op: opError, Error: "this relay has no mailbox"})
+		return
+	}
+	if msg.ID == "" || msg.Peer == nil || msg.Peer.ID == "" {
+		_ = writeFrame(conn, message{Op: opError, Error: "missing device ID"})
+		return
+	}
+
+	if err := r.authenticate(conn, *msg.Peer); err != nil {
+		r.logger.Warn("deposit refused", "from", msg.Peer.ID, "remote", conn.RemoteAddr(), "err", err)
+		_ = writeFrame(conn, message{Op: opError, Error: err.Error()})
+		return
+	}
+
+	mail, err := r.mailbox.reserve(msg.ID, msg.Peer.ID, msg.Size)
+	if err != nil {
+		_ = writeFrame(conn, message{Op: opError, Error: err.Error()})
+		return
+	}
+	if err := writeFrame(conn, message{Op: opOK, Token: mail.ID}); err != nil {
+		r.mailbox.remove(mail.ID)
+		return
+	}
+
+	if err := r.mailbox.deposit(mail, conn); err != nil {
+		r.logger.Debug("deposit failed", "to", mail.To, "err", err)
+		_ = writeFrame(conn, message{Op: opError, Error: "cannot store the mail"})
+		return
+	}
+
+	r.logger.Info("mail deposited", "id", mail.ID, "to", mail.To, "size", mail.Size)
+	_ = writeFrame(conn, message{Op: opOK, Token: mail.ID})
+
+	// tell the recipient right away if it is online
+	r.offer(mail)
+}
+
+// offer tells the recipient of the mail that it waits in the mailbox, if the recipient is online.
+func (r *Relay) offer(mail mailInfo) {
+	r.mu.Lock()
+	reg, found := r.registered[mail.To]
+	r.mu.Unlock()
+	if found {
+		reg.send(message{Op: opMail, Mail: &mail})
+	}
+}
+
+// collect sends a mail to its recipient and waits for the recipient to tell what became of it.
+func (r *Relay) collect(conn net.Conn, msg message) {
+	if r.mailbox == nil {
+		_ = writeFrame(conn, message{Op: opError, Error: "this relay has no mailbox"})
+		return
+	}
+
+	mail, f, err := r.mailbox.collect(msg.Token)
+	if err != nil {
+		_ = writeFrame(conn, message{Op: opError, Error: err.Error()})
+		return
+	}
+	defer f.Close()
+
+	// the mail stays in the mailbox unless the recipient answers it, and is offered again later
+	// if the recipient is still online by then
+	answered := false
+	defer func() {
+		if !answered {
+			r.mailbox.release(mail.ID)
+			time.AfterFunc(r.mailbox.retry, func() {
+				if r.mailbox.waiting(mail.ID) {
+					r.offer(mail)
+				}
+			})
+		}
+	}()
+
+	// the recipient answers once its user did, which takes as long as it takes, and may do so before it
+	// read the whole mail, eg when the files are rejected: the answer is read along the copy, and stops it
+	answerCh := make(chan message, 1)
+	go func() {
+		answer, err := readFrame(conn)
+		if err != nil {
+			answer = message{}
+		}
+		answerCh <- answer
+		_ = conn.SetWriteDeadline(time.Now())
+	}()
+
+	if err := writeFrame(conn, message{Op: opOK, Size: mail.Size}); err != nil {
+		return
+	}
+	_, _ = io.Copy(conn, f)
+
+	answer := <-answerCh
+	if answer.Op != opReceipt || answer.Receipt == nil {
+		return
+	}
+
+	answered = true
+	r.mailbox.remove(mail.ID)
+
+	rc := Receipt{MailID: mail.ID, To: mail.To, Status: answer.Receipt.Status, Reason: answer.Receipt.Reason, Time: time.Now()}
+	r.logger.Info("mail collected", "id", mail.ID, "to", mail.To, "status", rc.Status)
+	r.receipt(mail.From, rc)
+}
+
+// receipt sends rc to the sender of the mail, or keeps it until the sender comes online.
+func (r *Relay) receipt(sender string, rc Receipt) {
+	r.mailbox.addReceipt(sender, rc)
+
+	r.mu.Lock()
+	reg, found := r.registered[sender]
+	r.mu.Unlock()
+	if found {
+		reg.flush(r.mailbox)
+	}
+}
+
+// expireMail drops the expired mails every minute, or more often for a shorter expiry, until ctx is cancelled.
+func (r *Relay) expireMail(ctx context.Context) {
+	every := time.Minute
+	if r.mailbox.expiry > 0 {
+		every = min(every, r.mailbox.expiry)
+	}
+	t := time.NewTicker(every)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			for _, mail := range r.mailbox.expire(now) {
+				r.logger.Info("mail expired", "id", mail.ID, "to", mail.To)
+				r.receipt(mail.From, Receipt{MailID: mail.ID, To: mail.To, Status: Expired, Time: now})
+			}
+		}
+	}
+}
+
+// send writes msg on the register connection, it reports whether it did.
+func (reg *registration) send(msg message) bool {
+	reg.wmu.Lock()
+	defer reg.wmu.Unlock()
+
+	_ = reg.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return writeFrame(reg.conn, msg) == nil
+}
+
+// flush sends the device the mails and receipts waiting for it in the mailbox.
+func (reg *registration) flush(m *Mailbox) {
+	for _, mail := range m.pending(reg.peer.ID) {
+		if !reg.send(message{Op: opMail, Mail: &mail}) {
+			return
+		}
+	}
+
+	for _, rc := range m.takeReceipts(reg.peer.ID) {
+		if !reg.send(message{Op: opReceipt, Receipt: &rc}) {
+			// the device will get it next time it registers
+			m.addReceipt(reg.peer.ID, rc)
+		}
+	}
+}
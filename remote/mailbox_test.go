@@ -0,0 +1,291 @@
+package remote
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/masar3141/shair"
+)
+
+func TestMailboxReserve(t *testing.T) {
+	m, err := NewMailbox(t.TempDir(), WithMaxMailSize(10), WithMaxMailboxSize(15), WithMaxStoredSize(25))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, to := range []string{"a", "b"} {
+		if _, err := m.reserve(to, "c", 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the cases run in order, the last one takes the room left
+	tests := []struct {
+		name string
+		to   string
+		size int64
+		ok   bool
+	}{
+		{name: "empty mail", to: "c", size: 0},
+		{name: "mail too large", to: "c", size: 11},
+		{name: "mailbox of the device full", to: "a", size: 6},
+		{name: "mailbox of the relay full", to: "c", size: 6},
+		{name: "room left", to: "c", size: 5, ok: true},
+		{name: "nothing left", to: "c", size: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := m.reserve(tt.to, "d", tt.size)
+			if (err == nil) != tt.ok {
+				t.Fatalf("got %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+// startMailRelay serves a relay with a mailbox until the test ends, it returns its address.
+func startMailRelay(t *testing.T, opts ...MailboxOption) string {
+	t.Helper()
+
+	m, err := NewMailbox(t.TempDir(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return startRelay(t, WithMailbox(m))
+}
+
+func TestRemoteShairerDeposit(t *testing.T) {
+	addr := startMailRelay(t)
+	receipts := make(chan Receipt, 1)
+	a, b := newPairedShairers(t, addr, WithMailFallback(), WithReceiptHandler(func(rc Receipt) { receipts <- rc }))
+
+	// receipts are received while announced
+	announce(t, b, "b", t.TempDir())
+
+	progressCh := make(chan int)
+	go drain(progressCh)
+	f := writeFile(t, "hello.txt", "hello from the mailbox")
+	err := b.SendFiles(context.Background(), &shair.Device{ID: "a", Name: "a"}, progressCh, f)
+	var deposited shair.DepositedError
+	if !errors.As(err, &deposited) || deposited.MailID == "" {
+		t.Fatalf("got %v, want the files deposited", err)
+	}
+
+	dir := t.TempDir()
+	outcomes := announce(t, a, "a", dir)
+	if err := <-outcomes; err != nil {
+		t.Fatalf("collecting failed: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "hello.txt"))
+	if err != nil || string(got) != "hello from the mailbox" {
+		t.Fatalf("collected %q, %v", got, err)
+	}
+
+	select {
+	case rc := <-receipts:
+		if rc.MailID != deposited.MailID || rc.To != "a" || rc.Status != Delivered || rc.Outcome() != shair.Completed {
+			t.Fatalf("got receipt %+v, want mail %s delivered to a", rc, deposited.MailID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no receipt")
+	}
+}
+
+// depositFor has b leave the file f for its pair a in the mailbox, it returns the ID of the mail.
+func depositFor(t *testing.T, b *RemoteShairer, f string) string {
+	t.Helper()
+
+	progressCh := make(chan int)
+	go drain(progressCh)
+	err := b.SendFiles(context.Background(), &shair.Device{ID: "a", Name: "a"}, progressCh, f)
+	var deposited shair.DepositedError
+	if !errors.As(err, &deposited) || deposited.MailID == "" {
+		t.Fatalf("got %v, want the files deposited", err)
+	}
+	return deposited.MailID
+}
+
+// waitReceipt waits for the receipt of the mail id.
+func waitReceipt(t *testing.T, receipts <-chan Receipt, id string, status DeliveryStatus, outcome shair.Outcome) {
+	t.Helper()
+
+	select {
+	case rc := <-receipts:
+		if rc.MailID != id || rc.To != "a" || rc.Status != status || rc.Outcome() != outcome {
+			t.Fatalf("got receipt %+v, want mail %s %s", rc, id, status)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("no receipt for mail %s", id)
+	}
+}
+
+func TestRemoteShairerDepositRejected(t *testing.T) {
+	addr := startMailRelay(t)
+	receipts := make(chan Receipt, 1)
+	a, b := newPairedShairers(t, addr, WithMailFallback(), WithReceiptHandler(func(rc Receipt) { receipts <- rc }))
+	announce(t, b, "b", t.TempDir())
+
+	// larger than the socket buffers, the recipient rejects it before reading it all
+	f := filepath.Join(t.TempDir(), "large.bin")
+	if err := os.WriteFile(f, make([]byte, 32<<20), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	id := depositFor(t, b, f)
+
+	dir := t.TempDir()
+	announceAnswering(t, a, "a", dir, false)
+	waitReceipt(t, receipts, id, Rejected, shair.Declined)
+
+	if _, err := os.Stat(filepath.Join(dir, "large.bin")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("got %v, want the rejected file left out", err)
+	}
+}
+
+func TestRemoteShairerDepositExpired(t *testing.T) {
+	addr := startMailRelay(t, WithMailExpiry(100*time.Millisecond))
+	receipts := make(chan Receipt, 1)
+	_, b := newPairedShairers(t, addr, WithMailFallback(), WithReceiptHandler(func(rc Receipt) { receipts <- rc }))
+	announce(t, b, "b", t.TempDir())
+
+	// a never comes online
+	id := depositFor(t, b, writeFile(t, "hello.txt", "too late"))
+	waitReceipt(t, receipts, id, Expired, shair.Expired)
+}
+
+// deposit leaves payload for the device to on the relay at addr, as the device id with the public key of
+// pub, proving it with the key priv. It returns the mail ID, or the error answered by the relay.
+func deposit(t *testing.T, addr string, to string, id string, pub *ecdh.PublicKey, priv *ecdh.PrivateKey, payload string) (string, error) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	peer := peerInfo{ID: id, PublicKey: pub.Bytes()}
+	if err := writeFrame(conn, message{Op: opDeposit, ID: to, Peer: &peer, Size: int64(len(payload))}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := readFrame(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Op != opChallenge {
+		return "", relayError(msg.Error)
+	}
+
+	proof, err := proveKey(priv, msg.Challenge, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFrame(conn, message{Op: opProof, Proof: proof}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readOK(conn); err != nil {
+		return "", err
+	}
+
+	if _, err := io.WriteString(conn, payload); err != nil {
+		t.Fatal(err)
+	}
+	ok, err := readOK(conn)
+	return ok.Token, err
+}
+
+func newKey(t *testing.T) *ecdh.PrivateKey {
+	t.Helper()
+
+	k, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestRelayDeposit(t *testing.T) {
+	addr := startMailRelay(t)
+	owner, impostor := newKey(t), newKey(t)
+
+	if _, err := register(t, addr, "b", owner.PublicKey(), owner); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		id   string
+		pub  *ecdh.PublicKey
+		priv *ecdh.PrivateKey
+		ok   bool
+	}{
+		{name: "owner of the key", id: "b", pub: owner.PublicKey(), priv: owner, ok: true},
+		{name: "key not owned", id: "b", pub: owner.PublicKey(), priv: impostor},
+		{name: "ID bound to another key", id: "b", pub: impostor.PublicKey(), priv: impostor},
+		{name: "unknown device owning its key", id: "c", pub: impostor.PublicKey(), priv: impostor, ok: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := deposit(t, addr, "a", tt.id, tt.pub, tt.priv, "sealed")
+			if (err == nil) != tt.ok {
+				t.Fatalf("got %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestRelayOffersKeptMailAgain(t *testing.T) {
+	addr := startMailRelay(t, WithMailRetry(50*time.Millisecond))
+	a, b := newKey(t), newKey(t)
+
+	reg, err := register(t, addr, "a", a.PublicKey(), a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := deposit(t, addr, "a", "b", b.PublicKey(), b, "sealed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// offered is the mail announced on the register connection
+	offered := func() {
+		t.Helper()
+
+		_ = reg.SetReadDeadline(time.Now().Add(5 * time.Second))
+		msg, err := readFrame(reg)
+		if err != nil || msg.Op != opMail || msg.Mail == nil || msg.Mail.ID != id {
+			t.Fatalf("got %+v, %v, want mail %s offered", msg, err, id)
+		}
+	}
+	offered()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := writeFrame(conn, message{Op: opCollect, Token: id}); err != nil {
+		t.Fatal(err)
+	}
+	ok, err := readOK(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, ok.Size)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFrame(conn, message{Op: opKeep}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the recipient stays online, the mail is offered again
+	offered()
+}
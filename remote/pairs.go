@@ -0,0 +1,137 @@
+package remote
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Pair is a device we paired with: we accept its files and can send it ours through the relay.
+type Pair struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	PublicKey []byte `json:"publicKey"` // X25519 key authenticating the device
+}
+
+func configPath(name string) (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "shair", name), nil
+}
+
+// LoadKey returns the key authenticating this device to its pairs, stored in the user config directory.
+// It is generated on first use.
+func LoadKey() (*ecdh.PrivateKey, error) {
+	p, err := configPath("relay-key")
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := os.ReadFile(p)
+	if err == nil {
+		return ecdh.X25519().NewPrivateKey(b)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(p, key.Bytes(), 0o600); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// Fingerprint returns the fingerprint of a public key, shown to tell devices apart and advertised by the
+// local shairer, see local.WithCertFingerprint.
+func Fingerprint(publicKey []byte) string {
+	sum := sha256.Sum256(publicKey)
+	return hex.EncodeToString(sum[:16])
+}
+
+// LoadPairs returns the pairs saved with SavePairs, none if they were never saved.
+func LoadPairs() ([]Pair, error) {
+	p, err := configPath("pairs.json")
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var pairs []Pair
+	return pairs, json.Unmarshal(b, &pairs)
+}
+
+// SavePairs saves the pairs in the user config directory.
+func SavePairs(pairs []Pair) error {
+	p, err := configPath("pairs.json")
+	if err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(pairs, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+		return err
+	}
+
+	return os.WriteFile(p, b, 0o600)
+}
+
+// letters of the pairing codes, without the ones easily mistaken for another
+const codeAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+
+// NewCode returns a random pairing code, eg "K7MQ-2PXA". Only the part before the dash, the nameplate,
+// is sent to the relay.
+func NewCode() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+
+	var sb strings.Builder
+	for i, c := range b {
+		if i == 4 {
+			sb.WriteByte('-')
+		}
+		sb.WriteByte(codeAlphabet[int(c)%len(codeAlphabet)])
+	}
+
+	return sb.String()
+}
+
+// ValidPairCode tells whether code looks like a code of NewCode, in upper or lower case.
+func ValidPairCode(code string) bool {
+	np, secret, found := strings.Cut(strings.ToUpper(code), "-")
+	if !found || len(np) != 4 || len(secret) != 4 {
+		return false
+	}
+	for _, c := range np + secret {
+		if !strings.ContainsRune(codeAlphabet, c) {
+			return false
+		}
+	}
+	return true
+}
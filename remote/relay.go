@@ -0,0 +1,514 @@
+// this file provides the relay server: it introduces peers that can't reach each other directly and pipes
+// their streams. Streams are encrypted end to end by the peers, the relay never sees the files.
+package remote
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultRelayPort is the port the relay listens on when none is given.
+const DefaultRelayPort = 8087
+
+// Relay is the rendezvous and relay server peers connect to.
+type Relay struct {
+	logger *slog.Logger
+
+	joinTimeout   time.Duration // how long a peer waits for the other one to join with the same code
+	acceptTimeout time.Duration // how long a dialer waits for the dialed device to accept
+
+	mailbox *Mailbox // holds the mails of offline devices, nil if the relay doesn't
+
+	mu         sync.Mutex
+	registered map[string]*registration // by device ID
+	keys       map[string][]byte        // key each device ID first registered with, no other key can take it over
+	watchers   map[*watcher]struct{}    // connections watching device IDs
+	pending    map[string]chan net.Conn // dials waiting to be accepted, by token
+	joining    map[string]*rendezvous   // peers waiting for another one to join, by code
+}
+
+type registration struct {
+	peer peerInfo
+	conn net.Conn
+	wmu  sync.Mutex // serializes the frames written on conn
+}
+
+type watcher struct {
+	ids  []string
+	conn net.Conn
+	wmu  sync.Mutex
+}
+
+// rendezvous is where the first peer joining with a code waits for the second one.
+type rendezvous struct {
+	attempts chan joinAttempt
+	closed   chan struct{} // closed once the first peer stopped waiting
+}
+
+type joinAttempt struct {
+	conn net.Conn
+	done chan struct{} // closed once the relay is done with the pair
+}
+
+// RelayOption configures optional behaviours of a Relay.
+type RelayOption func(*Relay)
+
+// WithJoinTimeout sets how long a peer joining with a code waits for the other one, 10 minutes by default.
+func WithJoinTimeout(d time.Duration) RelayOption {
+	return func(r *Relay) {
+		r.joinTimeout = d
+	}
+}
+
+// WithAcceptTimeout sets how long a dialer waits for the dialed device to accept, 30 seconds by default.
+func WithAcceptTimeout(d time.Duration) RelayOption {
+	return func(r *Relay) {
+		r.acceptTimeout = d
+	}
+}
+
+// WithMailbox makes the relay hold in m the files sent to offline devices, see Mailbox.
+func WithMailbox(m *Mailbox) RelayOption {
+	return func(r *Relay) {
+		r.mailbox = m
+	}
+}
+
+func NewRelay(logger *slog.Logger, opts ...RelayOption) *Relay {
+	r := &Relay{
+		logger: logger,
+
+		joinTimeout:   10 * time.Minute,
+		acceptTimeout: 30 * time.Second,
+
+		registered: make(map[string]*registration),
+		keys:       make(map[string][]byte),
+		watchers:   make(map[*watcher]struct{}),
+		pending:    make(map[string]chan net.Conn),
+		joining:    make(map[string]*rendezvous),
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return r
+}
+
+// ListenAndServe listens on addr and serves the peers until ctx is cancelled.
+func (r *Relay) ListenAndServe(ctx context.Context, addr string) error {
+	lnc := net.ListenConfig{}
+	ln, err := lnc.Listen(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return r.Serve(ctx, ln)
+}
+
+// Serve serves the peers connecting to ln until ctx is cancelled, ln is closed on return.
+func (r *Relay) Serve(ctx context.Context, ln net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		_ = ln.Close()
+	}()
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+
+	if r.mailbox != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.expireMail(ctx)
+		}()
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.handle(ctx, conn)
+		}()
+	}
+}
+
+func (r *Relay) handle(ctx context.Context, conn net.Conn) {
+	// the connection is closed here unless it was handed over to a dial or join
+	handedOver := false
+	defer func() {
+		if !handedOver {
+			conn.Close()
+		}
+	}()
+
+	// close the connection when the relay stops, which unblocks the reads below
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	msg, err := readFrame(conn)
+	if err != nil {
+		r.logger.Debug("invalid request", "remote", conn.RemoteAddr(), "err", err)
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	switch msg.Op {
+	case opRegister:
+		r.register(conn, msg)
+	case opWatch:
+		r.watch(conn, msg)
+	case opDial:
+		r.dial(conn, msg)
+	case opAccept:
+		handedOver = r.accept(conn, msg)
+	case opJoin:
+		r.join(ctx, conn, msg)
+	case opDeposit:
+		r.deposit(conn, msg)
+	case opCollect:
+		r.collect(conn, msg)
+	default:
+		_ = writeFrame(conn, message{Op: opError, Error: "unknown operation " + msg.Op})
+	}
+}
+
+// register keeps the connection of a device until it closes, to tell it about incoming connections.
+// The device must prove it owns the key it registers with, and a device ID can only be registered
+// with the key it was first registered with.
+func (r *Relay) register(conn net.Conn, msg message) {
+	if msg.Peer == nil || msg.Peer.ID == "" {
+		_ = writeFrame(conn, message{Op: opError, Error: "missing device ID"})
+		return
+	}
+
+	if err := r.authenticate(conn, *msg.Peer); err != nil {
+		r.logger.Warn("registration refused", "id", msg.Peer.ID, "remote", conn.RemoteAddr(), "err", err)
+		_ = writeFrame(conn, message{Op: opError, Error: err.Error()})
+		return
+	}
+
+	reg := &registration{peer: *msg.Peer, conn: conn}
+
+	r.mu.Lock()
+	if old, found := r.registered[reg.peer.ID]; found {
+		// the device reconnected, the previous connection is stale
+		old.conn.Close()
+	}
+	r.registered[reg.peer.ID] = reg
+	r.mu.Unlock()
+
+	r.logger.Info("device registered", "id", reg.peer.ID, "name", reg.peer.Name)
+	reg.send(message{Op: opOK})
+	r.notify(reg.peer, true)
+
+	if r.mailbox != nil {
+		reg.flush(r.mailbox)
+	}
+
+	// nothing is expected from the device, reading only tells when it leaves
+	_, _ = io.Copy(io.Discard, conn)
+
+	r.mu.Lock()
+	current := r.registered[reg.peer.ID] == reg
+	if current {
+		delete(r.registered, reg.peer.ID)
+	}
+	r.mu.Unlock()
+
+	if current {
+		r.logger.Info("device left", "id", reg.peer.ID)
+		r.notify(reg.peer, false)
+	}
+}
+
+// authenticate challenges the device claiming to be peer to prove it owns peer.PublicKey, which must be
+// the key its ID was first seen with. The ID is bound to the key from then on.
+func (r *Relay) authenticate(conn net.Conn, peer peerInfo) error {
+	if err := r.verifyKey(conn, peer); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if key, found := r.keys[peer.ID]; found && !bytes.Equal(key, peer.PublicKey) {
+		return errors.New("device ID registered with another key")
+	}
+	r.keys[peer.ID] = peer.PublicKey
+	return nil
+}
+
+// verifyKey challenges the device claiming to be peer to prove it owns peer.PublicKey.
+func (r *Relay) verifyKey(conn net.Conn, peer peerInfo) error {
+	challenge, verify, err := newChallenge(peer.PublicKey, peer.ID)
+	if err != nil {
+		return errors.New("invalid public key")
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer func() { _ = conn.SetDeadline(time.Time{}) }()
+
+	if err := writeFrame(conn, message{Op: opChallenge, Challenge: challenge}); err != nil {
+		return err
+	}
+	msg, err := readFrame(conn)
+	if err != nil {
+		return err
+	}
+	if msg.Op != opProof || !verify(msg.Proof) {
+		return errors.New("key ownership not proven")
+	}
+
+	return nil
+}
+
+// watch tells the connection when the watched devices come and go, until it closes.
+func (r *Relay) watch(conn net.Conn, msg message) {
+	w := &watcher{ids: msg.IDs, conn: conn}
+
+	r.mu.Lock()
+	r.watchers[w] = struct{}{}
+	var online []peerInfo
+	for _, id := range w.ids {
+		if reg, found := r.registered[id]; found {
+			online = append(online, reg.peer)
+		}
+	}
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		delete(r.watchers, w)
+		r.mu.Unlock()
+	}()
+
+	w.wmu.Lock()
+	err := writeFrame(conn, message{Op: opOK})
+	for _, p := range online {
+		if err == nil {
+			err = writeFrame(conn, message{Op: opPresence, Peer: &p, Online: true})
+		}
+	}
+	w.wmu.Unlock()
+	if err != nil {
+		return
+	}
+
+	_, _ = io.Copy(io.Discard, conn)
+}
+
+func (r *Relay) notify(peer peerInfo, online bool) {
+	r.mu.Lock()
+	var ws []*watcher
+	for w := range r.watchers {
+		for _, id := range w.ids {
+			if id == peer.ID {
+				ws = append(ws, w)
+				break
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	for _, w := range ws {
+		w.wmu.Lock()
+		_ = w.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if err := writeFrame(w.conn, message{Op: opPresence, Peer: &peer, Online: online}); err != nil {
+			w.conn.Close()
+		}
+		w.wmu.Unlock()
+	}
+}
+
+// dial connects conn to the registered device it asks for, once the device accepted.
+func (r *Relay) dial(conn net.Conn, msg message) {
+	token := newToken()
+	accepted := make(chan net.Conn, 1)
+
+	r.mu.Lock()
+	reg, found := r.registered[msg.ID]
+	if found {
+		r.pending[token] = accepted
+	}
+	r.mu.Unlock()
+
+	if !found {
+		_ = writeFrame(conn, message{Op: opError, Error: string(errOffline)})
+		return
+	}
+
+	defer func() {
+		r.mu.Lock()
+		delete(r.pending, token)
+		r.mu.Unlock()
+	}()
+
+	reg.wmu.Lock()
+	_ = reg.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	err := writeFrame(reg.conn, message{Op: opIncoming, Token: token})
+	reg.wmu.Unlock()
+	if err != nil {
+		_ = writeFrame(conn, message{Op: opError, Error: string(errOffline)})
+		return
+	}
+
+	t := time.NewTimer(r.acceptTimeout)
+	defer t.Stop()
+
+	var peer net.Conn
+	select {
+	case peer = <-accepted:
+	case <-t.C:
+		_ = writeFrame(conn, message{Op: opError, Error: "device didn't accept the connection"})
+		return
+	}
+	defer peer.Close()
+
+	if writeFrame(conn, message{Op: opOK}) != nil || writeFrame(peer, message{Op: opOK}) != nil {
+		return
+	}
+
+	pipe(conn, peer)
+}
+
+// accept hands conn over to the dial waiting for it, it reports whether it did.
+func (r *Relay) accept(conn net.Conn, msg message) bool {
+	r.mu.Lock()
+	accepted, found := r.pending[msg.Token]
+	delete(r.pending, msg.Token)
+	r.mu.Unlock()
+
+	if !found {
+		_ = writeFrame(conn, message{Op: opError, Error: "unknown or expired token"})
+		return false
+	}
+
+	accepted <- conn
+	return true
+}
+
+// join connects the two peers joining with the same nameplate, the public part of their code.
+func (r *Relay) join(ctx context.Context, conn net.Conn, msg message) {
+	if msg.Code == "" && !msg.Allocate {
+		_ = writeFrame(conn, message{Op: opError, Error: "missing code"})
+		return
+	}
+
+	r.mu.Lock()
+	if msg.Allocate {
+		// the smallest free number keeps the codes short
+		for i := 1; ; i++ {
+			if _, taken := r.joining[strconv.Itoa(i)]; !taken {
+				msg.Code = strconv.Itoa(i)
+				break
+			}
+		}
+	}
+	rv, found := r.joining[msg.Code]
+	if !found {
+		rv = &rendezvous{attempts: make(chan joinAttempt), closed: make(chan struct{})}
+		r.joining[msg.Code] = rv
+	}
+	r.mu.Unlock()
+
+	// the second peer hands its connection to the first one, which pipes them
+	if found {
+		done := make(chan struct{})
+		select {
+		case rv.attempts <- joinAttempt{conn, done}:
+			<-done
+		case <-rv.closed:
+			_ = writeFrame(conn, message{Op: opError, Error: "nobody is waiting with this code"})
+		case <-ctx.Done():
+		}
+		return
+	}
+
+	// the code is used once: the first peer leaves the rendezvous as soon as it is done waiting,
+	// and the peers that found it meanwhile stop waiting for it
+	leave := sync.OnceFunc(func() {
+		r.mu.Lock()
+		if r.joining[msg.Code] == rv {
+			delete(r.joining, msg.Code)
+		}
+		r.mu.Unlock()
+		close(rv.closed)
+	})
+	defer leave()
+
+	if msg.Allocate {
+		if err := writeFrame(conn, message{Op: opAllocated, Code: msg.Code}); err != nil {
+			return
+		}
+	}
+
+	t := time.NewTimer(r.joinTimeout)
+	defer t.Stop()
+
+	var other joinAttempt
+	select {
+	case other = <-rv.attempts:
+	case <-t.C:
+		_ = writeFrame(conn, message{Op: opError, Error: "nobody joined with this code"})
+		return
+	case <-ctx.Done():
+		return
+	}
+	defer close(other.done)
+	leave()
+
+	if writeFrame(conn, message{Op: opOK}) != nil || writeFrame(other.conn, message{Op: opOK, Initiator: true}) != nil {
+		return
+	}
+
+	pipe(conn, other.conn)
+}
+
+// pipe copies the streams of a and b to each other until both directions are done.
+func pipe(a, b net.Conn) {
+	wg := sync.WaitGroup{}
+	cp := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, _ = io.Copy(dst, src)
+
+		// let the other side know this direction is over, and stop everything on failure
+		if tc, ok := dst.(*net.TCPConn); ok {
+			_ = tc.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+
+	wg.Add(2)
+	go cp(a, b)
+	go cp(b, a)
+	wg.Wait()
+}
+
+func newToken() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
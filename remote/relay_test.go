@@ -0,0 +1,447 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/masar3141/shair"
+)
+
+var discard = slog.New(slog.DiscardHandler)
+
+// startRelay serves a relay on a free localhost port until the test ends, it returns its address.
+func startRelay(t *testing.T, opts ...RelayOption) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = NewRelay(discard, opts...).Serve(ctx, ln)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return ln.Addr().String()
+}
+
+// newPairedShairers returns two shairers on the relay at addr, paired with each other.
+func newPairedShairers(t *testing.T, addr string, opts ...Option) (a, b *RemoteShairer) {
+	t.Helper()
+
+	a = NewRemoteShairer(discard, addr, append([]Option{WithDeviceID("a")}, opts...)...)
+	b = NewRemoteShairer(discard, addr, append([]Option{WithDeviceID("b")}, opts...)...)
+	WithPairs(Pair{ID: "b", Name: "b", PublicKey: b.PublicKey()})(a)
+	WithPairs(Pair{ID: "a", Name: "a", PublicKey: a.PublicKey()})(b)
+
+	return a, b
+}
+
+// announce announces s until the test ends, accepting every transfer request. The outcomes of the
+// transfers are sent on the returned channel.
+func announce(t *testing.T, s shair.Shairer, name string, saveDir string) <-chan error {
+	t.Helper()
+	return announceAnswering(t, s, name, saveDir, true)
+}
+
+// announceAnswering announces s as announce does, answering every transfer request with accept.
+func announceAnswering(t *testing.T, s shair.Shairer, name string, saveDir string, accept bool) <-chan error {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	trCh := make(chan shair.TransferRequest)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = s.Announce(ctx, name, saveDir, trCh)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	outcomes := make(chan error, 16)
+	go func() {
+		for {
+			select {
+			case tr := <-trCh:
+				tr.AcceptCh <- accept
+				go drain(tr.ProgressCh)
+				outcomes <- <-tr.DoneCh
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return outcomes
+}
+
+// discover discovers peers with s until the test ends.
+func discover(t *testing.T, s shair.Shairer) <-chan shair.PeerUpdate {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	puCh := make(chan shair.PeerUpdate)
+	go func() { _ = s.Discover(ctx, puCh) }()
+	return puCh
+}
+
+// waitFor waits for the peer with id to be online, or offline, on puCh.
+func waitFor(t *testing.T, puCh <-chan shair.PeerUpdate, id string, online bool) {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case pu := <-puCh:
+			if pu.Peer.ID == id && (pu.Status == shair.Removed) != online {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("%s never became online=%v", id, online)
+		}
+	}
+}
+
+func drain[T any](ch <-chan T) {
+	for range ch {
+	}
+}
+
+func writeFile(t *testing.T, name string, content string) string {
+	t.Helper()
+
+	p := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(p, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestRemoteShairerSendFiles(t *testing.T) {
+	addr := startRelay(t)
+	a, b := newPairedShairers(t, addr)
+
+	dir := t.TempDir()
+	outcomes := announce(t, a, "a", dir)
+	waitFor(t, discover(t, b), "a", true)
+
+	progressCh := make(chan int)
+	go drain(progressCh)
+	f := writeFile(t, "hello.txt", "hello through the relay")
+	if err := b.SendFiles(context.Background(), &shair.Device{ID: "a", Name: "a"}, progressCh, f); err != nil {
+		t.Fatalf("sending failed: %v", err)
+	}
+
+	if err := <-outcomes; err != nil {
+		t.Fatalf("receiving failed: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "hello.txt"))
+	if err != nil || string(got) != "hello through the relay" {
+		t.Fatalf("received %q, %v", got, err)
+	}
+}
+
+func TestRemoteShairerSendToOffline(t *testing.T) {
+	addr := startRelay(t)
+	_, b := newPairedShairers(t, addr)
+
+	f := writeFile(t, "hello.txt", "hello")
+	err := b.SendFiles(context.Background(), &shair.Device{ID: "a", Name: "a"}, make(chan int), f)
+	if !errors.Is(err, errOffline) {
+		t.Fatalf("got %v, want the target offline", err)
+	}
+
+	err = b.SendFiles(context.Background(), &shair.Device{ID: "c", Name: "c"}, make(chan int), f)
+	if err == nil {
+		t.Fatal("sent files to a device we didn't pair with")
+	}
+}
+
+func TestRemoteShairerRejectsUnpairedSender(t *testing.T) {
+	addr := startRelay(t)
+	a, _ := newPairedShairers(t, addr)
+
+	// c knows a's key, but a didn't pair with c
+	c := NewRemoteShairer(discard, addr, WithDeviceID("c"), WithPairs(Pair{ID: "a", Name: "a", PublicKey: a.PublicKey()}))
+
+	announce(t, a, "a", t.TempDir())
+	waitFor(t, discover(t, c), "a", true)
+
+	f := writeFile(t, "hello.txt", "hello")
+	progressCh := make(chan int)
+	go drain(progressCh)
+	if err := c.SendFiles(context.Background(), &shair.Device{ID: "a", Name: "a"}, progressCh, f); err == nil {
+		t.Fatal("a device we didn't pair with sent us files")
+	}
+}
+
+// pair pairs a and b with a new code, it returns the peer each of them learnt.
+func pair(t *testing.T, a, b *RemoteShairer) (shair.Device, shair.Device, error, error) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	code := NewCode()
+	type result struct {
+		peer shair.Device
+		err  error
+	}
+	done := make(chan result)
+	go func() {
+		peer, err := b.Pair(ctx, code)
+		done <- result{peer, err}
+	}()
+	peerA, errA := a.Pair(ctx, code)
+	r := <-done
+
+	return peerA, r.peer, errA, r.err
+}
+
+func TestRemoteShairerPair(t *testing.T) {
+	addr := startRelay(t)
+	a := NewRemoteShairer(discard, addr, WithDeviceID("a"))
+	b := NewRemoteShairer(discard, addr, WithDeviceID("b"))
+
+	peerA, peerB, errA, errB := pair(t, a, b)
+	if errA != nil || errB != nil || peerA.ID != "b" || peerB.ID != "a" {
+		t.Fatalf("a paired with %+v, %v, b with %+v, %v", peerA, errA, peerB, errB)
+	}
+
+	// pairing again with the same key is fine
+	if _, _, errA, errB := pair(t, a, b); errA != nil || errB != nil {
+		t.Fatalf("paired again: %v, %v", errA, errB)
+	}
+
+	// another device claiming to be b is refused, b stays paired under its key
+	impostor := NewRemoteShairer(discard, addr, WithDeviceID("b"))
+	if _, _, err, _ := pair(t, a, impostor); err == nil {
+		t.Fatal("paired with another device under the ID of b")
+	}
+	a.pmu.Lock()
+	got := a.pairs["b"]
+	a.pmu.Unlock()
+	if !bytes.Equal(got.PublicKey, b.PublicKey()) {
+		t.Fatal("the key of b was replaced")
+	}
+}
+
+func TestRelayWatch(t *testing.T) {
+	addr := startRelay(t)
+	a, b := newPairedShairers(t, addr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = a.Announce(ctx, "a", t.TempDir(), make(chan shair.TransferRequest))
+	}()
+	puCh := discover(t, b)
+	waitFor(t, puCh, "a", true)
+
+	cancel()
+	<-done
+	waitFor(t, puCh, "a", false)
+}
+
+// register registers the device id with the public key of pub on the relay at addr, proving it with the
+// key priv. It returns the register connection, which is closed when the test ends, and the error
+// answered by the relay.
+func register(t *testing.T, addr string, id string, pub *ecdh.PublicKey, priv *ecdh.PrivateKey) (net.Conn, error) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	if err := writeFrame(conn, message{Op: opRegister, Peer: &peerInfo{ID: id, PublicKey: pub.Bytes()}}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := readFrame(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Op != opChallenge {
+		return conn, relayError(msg.Error)
+	}
+
+	proof, err := proveKey(priv, msg.Challenge, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFrame(conn, message{Op: opProof, Proof: proof}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = readOK(conn)
+	return conn, err
+}
+
+func TestRelayRegister(t *testing.T) {
+	addr := startRelay(t)
+
+	owner, impostor := newKey(t), newKey(t)
+
+	if _, err := register(t, addr, "a", owner.PublicKey(), owner); err != nil {
+		t.Fatalf("the owner of the key couldn't register: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		pub  *ecdh.PublicKey
+		priv *ecdh.PrivateKey
+	}{
+		{name: "key not owned", pub: owner.PublicKey(), priv: impostor},
+		{name: "another key", pub: impostor.PublicKey(), priv: impostor},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := register(t, addr, "a", tt.pub, tt.priv); err == nil {
+				t.Fatal("an impostor registered")
+			}
+		})
+	}
+
+	// the owner is still registered, and can register again
+	b := NewRemoteShairer(discard, addr, WithDeviceID("b"), WithPairs(Pair{ID: "a", Name: "a", PublicKey: owner.PublicKey().Bytes()}))
+	waitFor(t, discover(t, b), "a", true)
+
+	if _, err := register(t, addr, "a", owner.PublicKey(), owner); err != nil {
+		t.Fatalf("the owner of the key couldn't register again: %v", err)
+	}
+}
+
+// join joins the relay at addr with code, it returns the connection once the other peer joined.
+func join(addr string, code string) (net.Conn, message, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, message{}, err
+	}
+	if err := writeFrame(conn, message{Op: opJoin, Code: code}); err != nil {
+		conn.Close()
+		return nil, message{}, err
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	ok, err := readOK(conn)
+	if err != nil {
+		conn.Close()
+		return nil, message{}, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	return conn, ok, nil
+}
+
+func TestRelayJoin(t *testing.T) {
+	addr := startRelay(t)
+
+	type result struct {
+		conn net.Conn
+		ok   message
+		err  error
+	}
+	first := make(chan result)
+	go func() {
+		conn, ok, err := join(addr, "42")
+		first <- result{conn, ok, err}
+	}()
+
+	// let the first peer wait before the second one joins
+	time.Sleep(100 * time.Millisecond)
+	second, ok, err := join(addr, "42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	r := <-first
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	defer r.conn.Close()
+
+	if !ok.Initiator || r.ok.Initiator {
+		t.Fatalf("got initiator %v for the second peer and %v for the first, want the second one only", ok.Initiator, r.ok.Initiator)
+	}
+
+	if _, err := second.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(r.conn, got); err != nil || string(got) != "ping" {
+		t.Fatalf("got %q, %v through the relay", got, err)
+	}
+}
+
+func TestRelayJoinTimeout(t *testing.T) {
+	addr := startRelay(t, WithJoinTimeout(100*time.Millisecond))
+
+	if _, _, err := join(addr, "7"); err == nil {
+		t.Fatal("joined without a peer")
+	}
+
+	// the code is free again once the first peer gave up
+	done := make(chan error)
+	go func() {
+		_, _, err := join(addr, "7")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		var re relayError
+		if !errors.As(err, &re) {
+			t.Fatalf("got %v, want the relay to time out", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the second join hanged")
+	}
+}
+
+func TestRelayAllocate(t *testing.T) {
+	addr := startRelay(t)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := writeFrame(conn, message{Op: opJoin, Allocate: true}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := readFrame(conn)
+	if err != nil || msg.Op != opAllocated || msg.Code != "1" {
+		t.Fatalf("got %+v, %v, want the nameplate 1", msg, err)
+	}
+
+	// the allocated nameplate is taken until the second peer joins
+	c, _, err := join(addr, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
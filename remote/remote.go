@@ -0,0 +1,595 @@
+// this file provides an implementation of shairer for transfers between devices that can't reach
+// each other directly. Devices meet on a relay server, which pipes their end to end encrypted streams,
+// and speak the same transfer protocol as on a local network.
+package remote
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/masar3141/shair"
+	"github.com/masar3141/shair/local"
+)
+
+// name of the relay discovery in the peer registry
+const relaySource = "relay"
+
+// how long connecting to the relay and authenticating the peer may take
+const handshakeTimeout = 30 * time.Second
+
+// Transferer runs the transfer protocol over connections established by the RemoteShairer, and over
+// the mails it deposits and collects, see local.LocalShairer.
+type Transferer interface {
+	SendFilesOn(ctx context.Context, conn net.Conn, progressCh chan<- int, filepaths ...string) error
+	ServeConn(ctx context.Context, saveDir string, conn net.Conn, sender *shair.Device, transferRequestCh chan<- shair.TransferRequest) error
+	WriteTransfer(ctx context.Context, w io.Writer, progressCh chan<- int, filepaths ...string) error
+	ReadTransfer(ctx context.Context, saveDir string, r io.Reader, sender *shair.Device, transferRequestCh chan<- shair.TransferRequest) error
+}
+
+// RemoteShairer implements shair.Shairer
+type RemoteShairer struct {
+	logger *slog.Logger
+
+	relayAddr string // host:port of the relay
+
+	key        *ecdh.PrivateKey // authenticates us to our pairs
+	deviceID   string
+	deviceType shair.DeviceType
+
+	transfer Transferer
+	registry *shair.PeerRegistry
+
+	pmu          sync.Mutex
+	pairs        map[string]Pair // by device ID
+	onPair       func(Pair)      // called with every new pair, eg to save it
+	pairsChanged chan struct{}   // tells Discover to watch the new pairs
+
+	mailFallback bool          // whether files for offline pairs are left in the mailbox
+	onReceipt    func(Receipt) // called with the receipts of the mails we deposited
+	mmu          sync.Mutex    // collect mails one at a time
+
+	nmu  sync.Mutex
+	name string // name we are announced with
+}
+
+// Option configures optional behaviours of a RemoteShairer.
+type Option func(*RemoteShairer)
+
+// WithKey sets the key authenticating us to our pairs. Without it, a new key is generated
+// for each RemoteShairer, see LoadKey for a persistent one.
+func WithKey(key *ecdh.PrivateKey) Option {
+	return func(rs *RemoteShairer) {
+		rs.key = key
+	}
+}
+
+// WithDeviceID sets the identifier our pairs know us by, see shair.LoadDeviceID.
+func WithDeviceID(id string) Option {
+	return func(rs *RemoteShairer) {
+		rs.deviceID = id
+	}
+}
+
+// WithPairs sets the devices we already paired with, see LoadPairs.
+func WithPairs(pairs ...Pair) Option {
+	return func(rs *RemoteShairer) {
+		for _, p := range pairs {
+			rs.pairs[p.ID] = p
+		}
+	}
+}
+
+// WithPairHandler calls fn with every new pair made with RemoteShairer.Pair, eg to save it.
+func WithPairHandler(fn func(Pair)) Option {
+	return func(rs *RemoteShairer) {
+		rs.onPair = fn
+	}
+}
+
+// WithMailFallback makes SendFiles leave the files in the relay's mailbox when the target is offline,
+// see Deposit.
+func WithMailFallback() Option {
+	return func(rs *RemoteShairer) {
+		rs.mailFallback = true
+	}
+}
+
+// WithReceiptHandler calls fn with the receipts of the mails we deposited, they are received while announced.
+func WithReceiptHandler(fn func(Receipt)) Option {
+	return func(rs *RemoteShairer) {
+		rs.onReceipt = fn
+	}
+}
+
+// WithTransferer runs the transfers with t, typically the local.LocalShairer of the application so that
+// its bandwidth caps, timeouts and receiving policies apply to remote transfers as well.
+func WithTransferer(t Transferer) Option {
+	return func(rs *RemoteShairer) {
+		rs.transfer = t
+	}
+}
+
+// WithRegistry makes the RemoteShairer record the peers it discovers in r instead of its own registry.
+func WithRegistry(r *shair.PeerRegistry) Option {
+	return func(rs *RemoteShairer) {
+		rs.registry = r
+	}
+}
+
+func NewRemoteShairer(logger *slog.Logger, relayAddr string, opts ...Option) *RemoteShairer {
+	r := &RemoteShairer{
+		logger:    logger,
+		relayAddr: relayAddr,
+
+		deviceID:   shair.NewDeviceID(),
+		deviceType: shair.DetectDeviceType(),
+
+		registry: shair.NewPeerRegistry(),
+
+		pairs:        make(map[string]Pair),
+		pairsChanged: make(chan struct{}, 1),
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	if r.key == nil {
+		r.key, _ = ecdh.X25519().GenerateKey(rand.Reader)
+	}
+	if r.transfer == nil {
+		r.transfer = local.NewLocalShairer(logger, 0)
+	}
+
+	return r
+}
+
+// Registry returns the registry holding the peers discovered by the RemoteShairer.
+func (r *RemoteShairer) Registry() *shair.PeerRegistry {
+	return r.registry
+}
+
+// PublicKey returns the key our pairs authenticate us with.
+func (r *RemoteShairer) PublicKey() []byte {
+	return r.key.PublicKey().Bytes()
+}
+
+// Pairs returns the devices we paired with.
+func (r *RemoteShairer) Pairs() []Pair {
+	r.pmu.Lock()
+	defer r.pmu.Unlock()
+
+	pairs := make([]Pair, 0, len(r.pairs))
+	for _, p := range r.pairs {
+		pairs = append(pairs, p)
+	}
+	return pairs
+}
+
+func (r *RemoteShairer) pair(id string) (Pair, bool) {
+	r.pmu.Lock()
+	defer r.pmu.Unlock()
+
+	p, found := r.pairs[id]
+	return p, found
+}
+
+// pairByKey returns the pair authenticated by the public key.
+func (r *RemoteShairer) pairByKey(key []byte) (Pair, bool) {
+	r.pmu.Lock()
+	defer r.pmu.Unlock()
+
+	for _, p := range r.pairs {
+		if bytes.Equal(p.PublicKey, key) {
+			return p, true
+		}
+	}
+	return Pair{}, false
+}
+
+func (r *RemoteShairer) localName() string {
+	r.nmu.Lock()
+	defer r.nmu.Unlock()
+
+	if r.name != "" {
+		return r.name
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+func (r *RemoteShairer) self() peerInfo {
+	return peerInfo{
+		ID:           r.deviceID,
+		Name:         r.localName(),
+		PublicKey:    r.PublicKey(),
+		OS:           runtime.GOOS,
+		Arch:         runtime.GOARCH,
+		Type:         string(r.deviceType),
+		AppVersion:   shair.Version,
+		Capabilities: shair.Capabilities,
+	}
+}
+
+func (p peerInfo) device() shair.Device {
+	return shair.Device{
+		Name:            p.Name,
+		DiscoveredOn:    shair.Remote,
+		ID:              p.ID,
+		ProtocolVersion: shair.ProtocolVersion,
+		OS:              p.OS,
+		Arch:            p.Arch,
+		Type:            shair.DeviceType(p.Type),
+		AppVersion:      p.AppVersion,
+		Capabilities:    p.Capabilities,
+		CertFingerprint: Fingerprint(p.PublicKey),
+		Accepting:       true,
+	}
+}
+
+// connect opens a connection to the relay and sends it the request.
+func (r *RemoteShairer) connect(ctx context.Context, req message) (net.Conn, message, error) {
+	dialer := net.Dialer{Timeout: handshakeTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", r.relayAddr)
+	if err != nil {
+		return nil, message{}, err
+	}
+
+	// give up waiting for the relay when ctx is done
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := writeFrame(conn, req); err != nil {
+		conn.Close()
+		return nil, message{}, err
+	}
+
+	// the relay only registers us, or takes our mail, once we proved we own our key
+	if req.Op == opRegister || req.Op == opDeposit {
+		if err := r.proveKey(conn); err != nil {
+			conn.Close()
+			return nil, message{}, err
+		}
+	}
+
+	// dials wait for the dialed device to accept, which is bounded by the relay
+	if req.Op == opDial || req.Op == opJoin {
+		_ = conn.SetDeadline(time.Time{})
+	}
+
+	ok, err := readOK(conn)
+	if err != nil {
+		conn.Close()
+		return nil, message{}, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	return conn, ok, nil
+}
+
+// proveKey answers the challenge the relay sends before registering us.
+func (r *RemoteShairer) proveKey(conn net.Conn) error {
+	msg, err := readFrame(conn)
+	if err != nil {
+		return err
+	}
+	if msg.Op == opError {
+		return relayError(msg.Error)
+	}
+	if msg.Op != opChallenge {
+		return fmt.Errorf("unexpected answer %q from the relay", msg.Op)
+	}
+
+	proof, err := proveKey(r.key, msg.Challenge, r.deviceID)
+	if err != nil {
+		return err
+	}
+	return writeFrame(conn, message{Op: opProof, Proof: proof})
+}
+
+// Discover watches our pairs on the relay, they are listed while they are announced.
+// It runs until ctx is cancelled or the connection to the relay is lost.
+func (r *RemoteShairer) Discover(ctx context.Context, peerCh chan<- shair.PeerUpdate) error {
+	fctx, cancel := context.WithCancel(ctx)
+	forwarded := make(chan struct{})
+	go func() {
+		defer close(forwarded)
+		r.registry.Forward(fctx, peerCh)
+	}()
+	defer func() {
+		cancel()
+		<-forwarded
+	}()
+
+	for {
+		changed, err := r.watch(ctx)
+		if err != nil {
+			return shair.NewError(shair.ServiceError, "lost the connection to the relay", err)
+		}
+		if !changed {
+			return nil
+		}
+	}
+}
+
+// watch records the presence of our pairs in the registry until ctx is done, in which case it
+// returns false, or until the pairs change, in which case it returns true.
+func (r *RemoteShairer) watch(ctx context.Context) (bool, error) {
+	var ids []string
+	for _, p := range r.Pairs() {
+		ids = append(ids, p.ID)
+	}
+
+	conn, _, err := r.connect(ctx, message{Op: opWatch, IDs: ids})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	// the peers we watched are listed again by the next watch, if still online
+	defer func() {
+		for _, id := range ids {
+			r.registry.Remove(relaySource, id)
+		}
+	}()
+
+	changed := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			changed <- false
+		case <-r.pairsChanged:
+			changed <- true
+		}
+		conn.Close()
+	}()
+
+	for {
+		msg, err := readFrame(conn)
+		if err != nil {
+			select {
+			case c := <-changed:
+				return c, nil
+			default:
+				return false, err
+			}
+		}
+
+		if msg.Op != opPresence || msg.Peer == nil {
+			continue
+		}
+
+		// only trust what the relay says about devices we paired with, with the key we paired with
+		pair, found := r.pair(msg.Peer.ID)
+		if !found || !bytes.Equal(pair.PublicKey, msg.Peer.PublicKey) {
+			continue
+		}
+
+		if msg.Online {
+			r.registry.Upsert(relaySource, msg.Peer.device())
+		} else {
+			r.registry.Remove(relaySource, msg.Peer.ID)
+		}
+	}
+}
+
+// Announce registers us on the relay and receives the files our pairs send us.
+// It runs until ctx is cancelled or the connection to the relay is lost.
+func (r *RemoteShairer) Announce(ctx context.Context, localDeviceName string, saveDir string, transferRequestCh chan<- shair.TransferRequest) error {
+	r.nmu.Lock()
+	r.name = localDeviceName
+	r.nmu.Unlock()
+
+	self := r.self()
+	conn, _, err := r.connect(ctx, message{Op: opRegister, Peer: &self})
+	if err != nil {
+		return shair.NewError(shair.ServiceError, "cannot register on the relay", err)
+	}
+	defer conn.Close()
+	shair.ReportRunning(ctx, 0, []string{r.relayAddr})
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+
+	for {
+		msg, err := readFrame(conn)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return shair.NewError(shair.ServiceError, "lost the connection to the relay", err)
+		}
+
+		switch msg.Op {
+		case opMail:
+			if msg.Mail == nil {
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ctx := shair.WithTransferID(ctx, shair.NewTransferID())
+				if err := r.collect(ctx, *msg.Mail, saveDir, transferRequestCh); err != nil {
+					r.logger.ErrorContext(ctx, "cannot collect mail", "id", msg.Mail.ID, "err", err)
+				}
+			}()
+			continue
+
+		case opReceipt:
+			if msg.Receipt == nil {
+				continue
+			}
+			r.logger.Info("mail receipt", "id", msg.Receipt.MailID, "to", msg.Receipt.To, "status", msg.Receipt.Status)
+			if r.onReceipt != nil {
+				r.onReceipt(*msg.Receipt)
+			}
+			continue
+
+		case opIncoming:
+		default:
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := shair.WithTransferID(ctx, shair.NewTransferID())
+			if err := r.accept(ctx, msg.Token, saveDir, transferRequestCh); err != nil {
+				r.logger.ErrorContext(ctx, "relayed transfer request failed", "err", err)
+			}
+		}()
+	}
+}
+
+// accept answers an incoming connection and serves it if it comes from one of our pairs.
+func (r *RemoteShairer) accept(ctx context.Context, token string, saveDir string, transferRequestCh chan<- shair.TransferRequest) error {
+	conn, _, err := r.connect(ctx, message{Op: opAccept, Token: token})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	sc, key, err := handshakeResponder(conn, r.key)
+	if err != nil {
+		return fmt.Errorf("handshake failed: %w", err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	pair, found := r.pairByKey(key.Bytes())
+	if !found {
+		return errors.New("connection from a device we didn't pair with")
+	}
+
+	sender := r.sender(pair)
+	r.logger.DebugContext(ctx, "relayed connection authenticated", "sender", sender.ID)
+	return r.transfer.ServeConn(ctx, saveDir, sc, &sender, transferRequestCh)
+}
+
+// sender describes the pair a transfer comes from, authenticated with its key.
+func (r *RemoteShairer) sender(pair Pair) shair.Device {
+	sender, found := r.registry.Get(pair.ID)
+	if !found {
+		sender = shair.Device{Name: pair.Name, ID: pair.ID, DiscoveredOn: shair.Remote}
+	}
+	sender.Verified = true
+	return sender
+}
+
+// pairKey returns the pair target is and the key authenticating it.
+func (r *RemoteShairer) pairKey(target *shair.Device) (Pair, *ecdh.PublicKey, error) {
+	pair, found := r.pair(target.ID)
+	if !found {
+		return Pair{}, nil, shair.NewError(shair.UnexpectedError, fmt.Sprintf("%s isn't paired with this device", target.Name), nil)
+	}
+
+	key, err := ecdh.X25519().NewPublicKey(pair.PublicKey)
+	if err != nil {
+		return Pair{}, nil, shair.NewError(shair.UnexpectedError, fmt.Sprintf("invalid key for %s", target.Name), err)
+	}
+
+	return pair, key, nil
+}
+
+// SendFiles sends the files to target, one of our pairs, through the relay. With WithMailFallback,
+// they are left in the relay's mailbox when target is offline, and a shair.DepositedError is returned.
+func (r *RemoteShairer) SendFiles(ctx context.Context, target *shair.Device, progressCh chan<- int, filepaths ...string) error {
+	pair, remoteKey, err := r.pairKey(target)
+	if err != nil {
+		return err
+	}
+
+	conn, _, err := r.connect(ctx, message{Op: opDial, ID: pair.ID})
+	if errors.Is(err, errOffline) && r.mailFallback {
+		id, err := r.Deposit(ctx, target, progressCh, filepaths...)
+		if err != nil {
+			return err
+		}
+		r.logger.InfoContext(ctx, "target offline, files left in the mailbox", "target", target.ID, "mail", id)
+		return shair.DepositedError{MailID: id}
+	}
+	if err != nil {
+		return shair.NewError(shair.UnexpectedError, fmt.Sprintf("cannot reach %s through the relay", target.Name), err)
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	sc, err := handshakeInitiator(conn, r.key, remoteKey)
+	if err != nil {
+		return shair.NewError(shair.UnexpectedError, fmt.Sprintf("cannot authenticate %s", target.Name), err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	r.logger.DebugContext(ctx, "relayed connection authenticated", "target", target.ID)
+
+	return r.transfer.SendFilesOn(ctx, sc, progressCh, filepaths...)
+}
+
+// Pair meets the device joining the relay with the same code, see NewCode, and pairs with it:
+// both devices learn each other's identity and key, and can then exchange files through the relay.
+// Pairing fails if the device claims the ID of a pair known under another key.
+func (r *RemoteShairer) Pair(ctx context.Context, code string) (shair.Device, error) {
+	// the code may have been typed in lower case on one of the devices
+	code = strings.ToUpper(code)
+
+	conn, ok, err := r.connect(ctx, message{Op: opJoin, Code: nameplate(code)})
+	if err != nil {
+		return shair.Device{}, shair.NewError(shair.UnexpectedError, "cannot join the relay", err)
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	sc, err := handshakeCode(conn, ok.Initiator, code)
+	if err != nil {
+		return shair.Device{}, shair.NewError(shair.UnexpectedError, "cannot authenticate the peer", err)
+	}
+
+	self := r.self()
+	if err := writeFrame(sc, message{Op: opOK, Peer: &self}); err != nil {
+		return shair.Device{}, shair.NewError(shair.ConnectionDroppedError, "cannot send our identity", err)
+	}
+	msg, err := readFrame(sc)
+	if err != nil || msg.Peer == nil || msg.Peer.ID == "" {
+		return shair.Device{}, shair.NewError(shair.ConnectionDroppedError, "cannot read the peer's identity", err)
+	}
+
+	pair := Pair{ID: msg.Peer.ID, Name: msg.Peer.Name, PublicKey: msg.Peer.PublicKey}
+
+	// a device paired again keeps its key, another key under its ID is someone else claiming to be it
+	r.pmu.Lock()
+	if known, found := r.pairs[pair.ID]; found && !bytes.Equal(known.PublicKey, pair.PublicKey) {
+		r.pmu.Unlock()
+		return shair.Device{}, shair.NewError(shair.UnexpectedError, fmt.Sprintf("already paired with %s under another key", known.Name), nil)
+	}
+	r.pairs[pair.ID] = pair
+	r.pmu.Unlock()
+
+	if r.onPair != nil {
+		r.onPair(pair)
+	}
+
+	select {
+	case r.pairsChanged <- struct{}{}:
+	default:
+	}
+
+	return msg.Peer.device(), nil
+}
@@ -0,0 +1,115 @@
+// this file provides SPAKE2, a password authenticated key exchange: two peers sharing a short code derive
+// a strong key, while an attacker in the middle, the relay included, gets a single guess of the code per attempt.
+// It runs in the prime order subgroup of edwards25519, the group of the magic wormhole, with the constant time
+// arithmetic of filippo.io/edwards25519.
+package remote
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"filippo.io/edwards25519"
+)
+
+// elements of unknown discrete logarithm blinding the messages of each side
+var (
+	pakeM = arbitraryElement("shair spake2 M")
+	pakeN = arbitraryElement("shair spake2 N")
+)
+
+// size of an encoded group element
+const pakeElementSize = 32
+
+// arbitraryElement maps s to an element of the prime order subgroup whose discrete logarithm nobody knows:
+// hashes of s are decoded as points until one is valid, which is then multiplied by the cofactor.
+func arbitraryElement(s string) *edwards25519.Point {
+	for i := byte(0); ; i++ {
+		h := sha256.Sum256(append([]byte(s), i))
+		p, err := new(edwards25519.Point).SetBytes(h[:])
+		if err != nil {
+			continue
+		}
+		p.MultByCofactor(p)
+		if p.Equal(edwards25519.NewIdentityPoint()) == 1 {
+			continue
+		}
+		return p
+	}
+}
+
+// randomScalar returns a uniformly random scalar.
+func randomScalar() (*edwards25519.Scalar, error) {
+	b := make([]byte, 64)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return new(edwards25519.Scalar).SetUniformBytes(b)
+}
+
+// passwordScalar maps the code to a scalar.
+func passwordScalar(code string) *edwards25519.Scalar {
+	h := sha512.Sum512([]byte("shair spake2 password " + code))
+	w, _ := new(edwards25519.Scalar).SetUniformBytes(h[:])
+	return w
+}
+
+// spake2 runs the exchange over rw and returns the shared secret along with the transcript of the exchange.
+// The initiator blinds its message with M, the responder with N. Peers that don't share the code end up
+// with different secrets, which the caller must detect with a key confirmation.
+func spake2(rw io.ReadWriter, isInitiator bool, code string) ([]byte, []byte, error) {
+	w := passwordScalar(code)
+
+	mine, theirs := pakeM, pakeN
+	if !isInitiator {
+		mine, theirs = pakeN, pakeM
+	}
+
+	x, err := randomScalar()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// X = x*B + w*mine
+	X := new(edwards25519.Point).ScalarBaseMult(x)
+	X.Add(X, new(edwards25519.Point).ScalarMult(w, mine))
+
+	msg := X.Bytes()
+	if _, err := rw.Write(msg); err != nil {
+		return nil, nil, err
+	}
+
+	reply := make([]byte, pakeElementSize)
+	if _, err := io.ReadFull(rw, reply); err != nil {
+		return nil, nil, err
+	}
+	Y, err := new(edwards25519.Point).SetBytes(reply)
+	if err != nil {
+		return nil, nil, errors.New("invalid key exchange message")
+	}
+
+	// K = x*8*(Y - w*theirs), the cofactor cancels the components of small order an attacker may add
+	K := new(edwards25519.Point).Subtract(Y, new(edwards25519.Point).ScalarMult(w, theirs))
+	K.MultByCofactor(K)
+	K.ScalarMult(x, K)
+	if K.Equal(edwards25519.NewIdentityPoint()) == 1 {
+		return nil, nil, errors.New("invalid key exchange message")
+	}
+
+	// the transcript orders the messages the same way on both sides
+	transcript := append(msg, reply...)
+	if !isInitiator {
+		transcript = append(reply, msg...)
+	}
+
+	h := sha256.New()
+	for _, b := range [][]byte{transcript, K.Bytes(), w.Bytes()} {
+		_ = binary.Write(h, binary.BigEndian, uint32(len(b)))
+		h.Write(b)
+	}
+
+	return h.Sum(nil), transcript, nil
+}
@@ -0,0 +1,253 @@
+package remote
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"filippo.io/edwards25519"
+)
+
+// loopback returns both ends of a tcp connection on localhost, net.Pipe would deadlock as both
+// sides of an exchange write first.
+func loopback(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+
+	a, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := <-accepted
+	if b == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+
+	return a, b
+}
+
+type spake2Result struct {
+	secret []byte
+	err    error
+}
+
+// exchange runs spake2 between an initiator knowing codeA and a responder knowing codeB.
+func exchange(t *testing.T, codeA, codeB string) (spake2Result, spake2Result) {
+	t.Helper()
+
+	a, b := loopback(t)
+	done := make(chan spake2Result)
+	go func() {
+		secret, _, err := spake2(b, false, codeB)
+		done <- spake2Result{secret, err}
+	}()
+
+	secret, _, err := spake2(a, true, codeA)
+	return spake2Result{secret, err}, <-done
+}
+
+func TestSpake2(t *testing.T) {
+	tests := []struct {
+		name         string
+		codeA, codeB string
+		same         bool
+	}{
+		{name: "same code", codeA: "7-guitar-orbit", codeB: "7-guitar-orbit", same: true},
+		{name: "wrong code", codeA: "7-guitar-orbit", codeB: "7-guitar-orchid"},
+		{name: "empty code", codeA: "", codeB: "7-guitar-orbit"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := exchange(t, tt.codeA, tt.codeB)
+			if a.err != nil || b.err != nil {
+				t.Fatalf("exchange failed: %v, %v", a.err, b.err)
+			}
+			if bytes.Equal(a.secret, b.secret) != tt.same {
+				t.Fatalf("got equal secrets %v, want %v", bytes.Equal(a.secret, b.secret), tt.same)
+			}
+		})
+	}
+
+	// the secrets are fresh on every exchange
+	a1, _ := exchange(t, "1-a-b", "1-a-b")
+	a2, _ := exchange(t, "1-a-b", "1-a-b")
+	if bytes.Equal(a1.secret, a2.secret) {
+		t.Fatal("two exchanges with the same code derived the same secret")
+	}
+}
+
+func TestSpake2RejectsInvalidElements(t *testing.T) {
+	// bytes that don't decode to a point
+	var notAPoint []byte
+	for i := byte(0); notAPoint == nil; i++ {
+		b := bytes.Repeat([]byte{i}, 32)
+		if _, err := new(edwards25519.Point).SetBytes(b); err != nil {
+			notAPoint = b
+		}
+	}
+
+	// a reply unblinding to the identity, or to a point of small order, would make the secret known
+	unblinded := new(edwards25519.Point).ScalarMult(passwordScalar("7-guitar-orbit"), pakeN)
+	smallOrder, err := new(edwards25519.Point).SetBytes(append([]byte{0xec}, append(bytes.Repeat([]byte{0xff}, 30), 0x7f)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		reply []byte
+	}{
+		{name: "not a point", reply: notAPoint},
+		{name: "identity once unblinded", reply: unblinded.Bytes()},
+		{name: "small order once unblinded", reply: new(edwards25519.Point).Add(unblinded, smallOrder).Bytes()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := loopback(t)
+			go func() {
+				_, _ = io.ReadFull(b, make([]byte, pakeElementSize))
+				_, _ = b.Write(tt.reply)
+			}()
+
+			if _, _, err := spake2(a, true, "7-guitar-orbit"); err == nil {
+				t.Fatal("accepted an invalid element")
+			}
+		})
+	}
+}
+
+// handshakeThrough runs handshakeCode between an initiator knowing codeA and a responder knowing codeB,
+// through a relay tampering with the first message of the initiator.
+func handshakeThrough(t *testing.T, codeA, codeB string, tamper func([]byte)) (errA, errB error) {
+	t.Helper()
+
+	a, relayA := loopback(t)
+	relayB, b := loopback(t)
+
+	go func() {
+		// a peer giving up makes the other one give up too
+		defer relayA.Close()
+		defer relayB.Close()
+
+		msg := make([]byte, pakeElementSize)
+		if _, err := io.ReadFull(relayA, msg); err != nil {
+			return
+		}
+		tamper(msg)
+		if _, err := relayB.Write(msg); err != nil {
+			return
+		}
+		go func() { _, _ = io.Copy(relayB, relayA) }()
+		_, _ = io.Copy(relayA, relayB)
+	}()
+
+	done := make(chan error)
+	go func() {
+		_, err := handshakeCode(b, false, codeB)
+		b.Close()
+		done <- err
+	}()
+
+	_, errA = handshakeCode(a, true, codeA)
+	a.Close()
+	return errA, <-done
+}
+
+func TestHandshakeCode(t *testing.T) {
+	untouched := func([]byte) {}
+	flipBit := func(msg []byte) { msg[3] ^= 0x10 }
+
+	// the relay swaps the initiator's message for one of its own, made with a guessed code
+	substitute := func(msg []byte) {
+		guess := passwordScalar("7-guitar-orchid")
+		x, _ := randomScalar()
+		X := new(edwards25519.Point).ScalarBaseMult(x)
+		X.Add(X, new(edwards25519.Point).ScalarMult(guess, pakeM))
+		copy(msg, X.Bytes())
+	}
+
+	tests := []struct {
+		name         string
+		codeA, codeB string
+		tamper       func([]byte)
+		ok           bool
+	}{
+		{name: "same code", codeA: "7-guitar-orbit", codeB: "7-guitar-orbit", tamper: untouched, ok: true},
+		{name: "wrong code", codeA: "7-guitar-orbit", codeB: "7-guitar-orchid", tamper: untouched},
+		{name: "tampered message", codeA: "7-guitar-orbit", codeB: "7-guitar-orbit", tamper: flipBit},
+		{name: "substituted message", codeA: "7-guitar-orbit", codeB: "7-guitar-orbit", tamper: substitute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errA, errB := handshakeThrough(t, tt.codeA, tt.codeB, tt.tamper)
+			if tt.ok && (errA != nil || errB != nil) {
+				t.Fatalf("handshake failed: %v, %v", errA, errB)
+			}
+			if !tt.ok && (errA == nil || errB == nil) {
+				t.Fatalf("got errors %v and %v, want both peers to fail", errA, errB)
+			}
+		})
+	}
+}
+
+// TestHandshakeCodeMITM runs a relay completing an exchange with each peer on its own, it must know
+// the code to fool them.
+func TestHandshakeCodeMITM(t *testing.T) {
+	tests := []struct {
+		name   string
+		guess  string
+		fooled bool
+	}{
+		{name: "wrong guess", guess: "7-guitar-orchid"},
+		{name: "code leaked", guess: "7-guitar-orbit", fooled: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, relayA := loopback(t)
+			relayB, b := loopback(t)
+
+			errs := make(chan error, 3)
+			run := func(conn net.Conn, isInitiator bool, code string) {
+				_, err := handshakeCode(conn, isInitiator, code)
+				conn.Close()
+				errs <- err
+			}
+			go run(relayA, false, tt.guess)
+			go run(relayB, true, tt.guess)
+			go run(b, false, "7-guitar-orbit")
+
+			_, errA := handshakeCode(a, true, "7-guitar-orbit")
+			a.Close()
+			var errB error
+			for range 3 {
+				if err := <-errs; err != nil && errB == nil {
+					errB = err
+				}
+			}
+
+			if fooled := errA == nil && errB == nil; fooled != tt.fooled {
+				t.Fatalf("got peers fooled %v (%v, %v), want %v", fooled, errA, errB, tt.fooled)
+			}
+		})
+	}
+}
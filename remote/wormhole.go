@@ -0,0 +1,307 @@
+// this file provides code phrase transfers, magic-wormhole style: the sender gets a short code such as
+// "7-guitar-orbit" to read to the receiver. The number, the nameplate, lets both devices meet on the relay,
+// the whole code authenticates them with SPAKE2 and never leaves the devices.
+package remote
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/masar3141/shair"
+	"github.com/masar3141/shair/local"
+)
+
+// words of the code phrases, 256 of them so that each word carries a byte of the secret
+var codeWords = [...]string{
+	"acid", "acorn", "actor", "adobe", "agent", "alarm", "album", "alert", "alien", "alpha", "amber",
+	"angle", "ankle", "apple", "april", "apron", "arena", "armor", "arrow", "atlas", "atom", "audio",
+	"autumn", "avocado", "award", "bacon", "badge", "bagel", "baker", "bamboo", "banana", "banjo",
+	"barrel", "basil", "basket", "beach", "beacon", "beaver", "berry", "bicycle", "bishop", "blanket",
+	"blossom", "bonus", "boxer", "brain", "bravo", "bread", "breeze", "brick", "bridge", "bronze",
+	"bubble", "bucket", "buffalo", "button", "cabin", "cactus", "camera", "canal", "candle", "canoe",
+	"canvas", "carbon", "cargo", "carpet", "castle", "cedar", "cello", "cement", "chalk", "charm",
+	"cherry", "chess", "chorus", "cider", "cinema", "circus", "citrus", "clover", "cobra", "cocoa",
+	"comet", "copper", "coral", "cotton", "cougar", "crater", "crayon", "cricket", "crystal",
+	"cupcake", "cycle", "dance", "daisy", "delta", "denim", "desert", "diamond", "diesel", "dinner",
+	"disco", "doctor", "dolphin", "domino", "donkey", "dragon", "drum", "eagle", "echo", "eclipse",
+	"elbow", "electric", "elephant", "elk", "ember", "emerald", "engine", "enigma", "epoch",
+	"equator", "falcon", "fossil", "fiber", "fiddle", "flag", "flame", "flute", "forest", "fox",
+	"fridge", "galaxy", "garden", "garlic", "gazelle", "gecko", "ginger", "giraffe", "glacier",
+	"globe", "gold", "gorilla", "gravel", "guitar", "hammer", "harbor", "harp", "hazel", "helmet",
+	"hero", "honey", "horizon", "hotel", "husky", "igloo", "indigo", "iris", "island", "ivory",
+	"jacket", "jaguar", "jasmine", "jazz", "jelly", "jewel", "jigsaw", "jockey", "juice", "jungle",
+	"kayak", "kernel", "ketchup", "kettle", "kiwi", "koala", "ladder", "lagoon", "lamp", "laser",
+	"lemon", "lens", "leopard", "lilac", "lime", "linen", "lizard", "lobster", "locket", "lotus",
+	"lunar", "magnet", "mango", "maple", "marble", "meadow", "melon", "mercury", "meteor", "mint",
+	"mirror", "mocha", "monkey", "mosaic", "motor", "muffin", "museum", "nectar", "needle", "nickel",
+	"ninja", "noodle", "nova", "nugget", "oasis", "ocean", "olive", "omega", "onion", "opera",
+	"orange", "orbit", "orchid", "otter", "oven", "owl", "oyster", "paddle", "panda", "paper",
+	"parrot", "pasta", "peach", "pebble", "pelican", "pepper", "piano", "pickle", "pilot", "pirate",
+	"pixel", "planet", "plum", "polar", "pony", "potato", "prism", "pumpkin", "puzzle", "quartz",
+	"quiver", "rabbit", "radar", "radio", "raven", "ribbon", "river",
+}
+
+// nameplate returns the public part of a code, the one the relay sees.
+func nameplate(code string) string {
+	np, _, _ := strings.Cut(code, "-")
+	return np
+}
+
+// Wormhole implements shair.Shairer for a single transfer between two devices sharing a code phrase.
+// The sender calls Allocate to get a code and SendFiles, the receiver sets the code with WithCode and
+// calls Announce. Discover lists the device on the other end of the code, so that the Wormhole can
+// be used like any other Shairer.
+type Wormhole struct {
+	logger *slog.Logger
+
+	relayAddr string
+	words     int // number of words of the allocated codes
+
+	transfer Transferer
+
+	mu   sync.Mutex
+	code string
+	conn net.Conn // connection waiting on the relay for the other device, opened by Allocate
+	init bool     // whether we lead the handshake on conn
+}
+
+// WormholeOption configures optional behaviours of a Wormhole.
+type WormholeOption func(*Wormhole)
+
+// WithCode sets the code given by the other device.
+func WithCode(code string) WormholeOption {
+	return func(w *Wormhole) {
+		w.code = code
+	}
+}
+
+// WithCodeWords sets the number of words of the codes allocated by the Wormhole, 2 by default.
+// Each word makes guessing the code 256 times harder.
+func WithCodeWords(n int) WormholeOption {
+	return func(w *Wormhole) {
+		w.words = n
+	}
+}
+
+// WithWormholeTransferer runs the transfer with t, see WithTransferer.
+func WithWormholeTransferer(t Transferer) WormholeOption {
+	return func(w *Wormhole) {
+		w.transfer = t
+	}
+}
+
+func NewWormhole(logger *slog.Logger, relayAddr string, opts ...WormholeOption) *Wormhole {
+	w := &Wormhole{
+		logger:    logger,
+		relayAddr: relayAddr,
+		words:     2,
+	}
+
+	for _, opt := range opts {
+		opt(w)
+	}
+
+	if w.transfer == nil {
+		w.transfer = local.NewLocalShairer(logger, 0)
+	}
+
+	return w
+}
+
+// Code returns the code of the Wormhole, empty until allocated or set.
+func (w *Wormhole) Code() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.code
+}
+
+// Peer returns the device on the other end of the code.
+func (w *Wormhole) Peer() *shair.Device {
+	code := w.Code()
+	return &shair.Device{
+		Name:         "wormhole " + code,
+		DiscoveredOn: shair.Remote,
+		ID:           "wormhole:" + code,
+		Accepting:    true,
+	}
+}
+
+// Allocate reserves a nameplate on the relay and returns the code to give to the other device.
+// The Wormhole then waits on the relay for it, until SendFiles or Announce is called.
+func (w *Wormhole) Allocate(ctx context.Context) (string, error) {
+	conn, err := w.dial(ctx, message{Op: opJoin, Allocate: true})
+	if err != nil {
+		return "", shair.NewError(shair.ServiceError, "cannot reach the relay", err)
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	msg, err := readFrame(conn)
+	if err == nil && msg.Op != opAllocated {
+		err = fmt.Errorf("unexpected answer %q from the relay", msg.Op)
+	}
+	if err != nil {
+		conn.Close()
+		return "", shair.NewError(shair.ServiceError, "the relay didn't allocate a code", err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	secret := make([]byte, w.words)
+	_, _ = rand.Read(secret)
+
+	parts := []string{msg.Code}
+	for _, b := range secret {
+		parts = append(parts, codeWords[b])
+	}
+
+	w.mu.Lock()
+	w.code = strings.Join(parts, "-")
+	w.conn = conn
+	w.mu.Unlock()
+
+	return w.Code(), nil
+}
+
+func (w *Wormhole) dial(ctx context.Context, req message) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: handshakeTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", w.relayAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := writeFrame(conn, req); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+// meet waits for the other device on the relay and authenticates it with the code. It returns the
+// encrypted connection and the name the other device gave.
+func (w *Wormhole) meet(ctx context.Context, name string) (net.Conn, string, error) {
+	w.mu.Lock()
+	code, conn := w.code, w.conn
+	w.conn = nil
+	w.mu.Unlock()
+
+	if code == "" {
+		return nil, "", shair.NewError(shair.UnexpectedError, "no code, allocate one or set the code of the other device", nil)
+	}
+
+	var err error
+	if conn == nil {
+		conn, err = w.dial(ctx, message{Op: opJoin, Code: nameplate(code)})
+		if err != nil {
+			return nil, "", shair.NewError(shair.ServiceError, "cannot reach the relay", err)
+		}
+	}
+	shair.ReportRunning(ctx, 0, []string{w.relayAddr})
+
+	// give up waiting when ctx is done
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	ok, err := readOK(conn)
+	if err != nil {
+		conn.Close()
+		return nil, "", shair.NewError(shair.ConnectionDroppedError, "nobody joined with the code", err)
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	sc, err := handshakeCode(conn, ok.Initiator, code)
+	if err != nil {
+		conn.Close()
+		return nil, "", shair.NewError(shair.UnexpectedError, "the other device doesn't have the same code", err)
+	}
+
+	// tell each other who we are, for the transfer request
+	self := peerInfo{Name: name, OS: runtime.GOOS, Arch: runtime.GOARCH, AppVersion: shair.Version}
+	err = writeFrame(sc, message{Op: opOK, Peer: &self})
+	var msg message
+	if err == nil {
+		msg, err = readFrame(sc)
+	}
+	if err != nil || msg.Peer == nil {
+		conn.Close()
+		return nil, "", shair.NewError(shair.ConnectionDroppedError, "cannot read the identity of the other device", err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	return sc, msg.Peer.Name, nil
+}
+
+// Discover lists the device on the other end of the code, it runs until ctx is cancelled.
+func (w *Wormhole) Discover(ctx context.Context, peerCh chan<- shair.PeerUpdate) error {
+	if w.Code() != "" {
+		select {
+		case peerCh <- shair.PeerUpdate{Peer: w.Peer(), Status: shair.Discovered}:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+
+	<-ctx.Done()
+	return nil
+}
+
+// Announce waits for the device with the same code and receives its files. A code is used for a
+// single transfer, Announce returns once it is over.
+func (w *Wormhole) Announce(ctx context.Context, localDeviceName string, saveDir string, transferRequestCh chan<- shair.TransferRequest) error {
+	conn, name, err := w.meet(ctx, localDeviceName)
+	if err != nil {
+		return err
+	}
+
+	sender := w.Peer()
+	sender.Name = name
+	w.logger.DebugContext(ctx, "met the device with the code", "name", name)
+
+	return w.transfer.ServeConn(ctx, saveDir, conn, sender, transferRequestCh)
+}
+
+// SendFiles waits for the device with the same code and sends it the files.
+func (w *Wormhole) SendFiles(ctx context.Context, target *shair.Device, progressCh chan<- int, filepaths ...string) error {
+	hostname, _ := os.Hostname()
+
+	conn, _, err := w.meet(ctx, hostname)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return w.transfer.SendFilesOn(ctx, conn, progressCh, filepaths...)
+}
+
+// codeByte returns the byte a word of a code stands for, it is used to validate codes typed by the user.
+func codeByte(word string) (byte, bool) {
+	for i, w := range codeWords {
+		if w == word {
+			return byte(i), true
+		}
+	}
+	return 0, false
+}
+
+// ValidCode tells whether code looks like a code allocated by a Wormhole: a nameplate followed by words.
+func ValidCode(code string) bool {
+	parts := strings.Split(code, "-")
+	if len(parts) < 2 || parts[0] == "" {
+		return false
+	}
+	for _, p := range parts[1:] {
+		if _, ok := codeByte(p); !ok {
+			return false
+		}
+	}
+	return true
+}
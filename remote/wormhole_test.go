@@ -0,0 +1,82 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/masar3141/shair"
+)
+
+func TestWormhole(t *testing.T) {
+	addr := startRelay(t)
+
+	tests := []struct {
+		name string
+		code func(allocated string) string // code the receiver types
+		ok   bool
+	}{
+		{name: "same code", code: func(c string) string { return c }, ok: true},
+		{
+			name: "wrong code",
+			code: func(c string) string {
+				// the same nameplate meets the sender, the wrong word fails the handshake
+				word := codeWords[0]
+				if strings.HasSuffix(c, "-"+word) {
+					word = codeWords[1]
+				}
+				return c[:strings.LastIndex(c, "-")+1] + word
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			sender := NewWormhole(discard, addr)
+			code, err := sender.Allocate(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ValidCode(code) {
+				t.Fatalf("allocated the invalid code %q", code)
+			}
+
+			// the receiver accepts the request
+			dir := t.TempDir()
+			receiver := NewWormhole(discard, addr, WithCode(tt.code(code)))
+			trCh := make(chan shair.TransferRequest)
+			received := make(chan error, 1)
+			go func() { received <- receiver.Announce(ctx, "receiver", dir, trCh) }()
+			go func() {
+				select {
+				case tr := <-trCh:
+					tr.AcceptCh <- true
+					drain(tr.ProgressCh)
+				case <-ctx.Done():
+				}
+			}()
+
+			progressCh := make(chan int)
+			go drain(progressCh)
+			sent := sender.SendFiles(ctx, sender.Peer(), progressCh, writeFile(t, "hello.txt", "hello through the wormhole"))
+			if err := <-received; (err == nil) != tt.ok || (sent == nil) != tt.ok {
+				t.Fatalf("sent with %v, received with %v, want ok %v", sent, err, tt.ok)
+			}
+
+			got, err := os.ReadFile(filepath.Join(dir, "hello.txt"))
+			switch {
+			case tt.ok && (err != nil || string(got) != "hello through the wormhole"):
+				t.Fatalf("received %q, %v", got, err)
+			case !tt.ok && !errors.Is(err, os.ErrNotExist):
+				t.Fatalf("got %v, want nothing received with the wrong code", err)
+			}
+		})
+	}
+}
@@ -2,7 +2,10 @@ package shair
 
 import (
 	"context"
+	"fmt"
 	"net"
+	"strings"
+	"time"
 )
 
 type SvcType int
@@ -26,33 +29,76 @@ func (s SvcType) String() string {
 	return str
 }
 
+// MarshalText encodes the service by its name, eg in the history of the transfers.
+func (s SvcType) MarshalText() ([]byte, error) {
+	return []byte(strings.ToLower(s.String())), nil
+}
+
+func (s *SvcType) UnmarshalText(b []byte) error {
+	for _, svc := range []SvcType{Bluetooth, Local, Remote} {
+		if strings.EqualFold(string(b), svc.String()) {
+			*s = svc
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown service %q", b)
+}
+
 // The Shairer interface defines the methods for peer discovery, local device advertisement,
 // and file transfer management.
 type Shairer interface {
 	// Discover listens for service announcements from other nodes.
 	// It sends updates through the channel when a matching service is discovered or removed.
-	// The function runs until the context is canceled or an error occurs.
-	Discover(context.Context, chan<- PeerUpdate)
+	// The function runs until the context is canceled or an error occurs, in which case the error is returned.
+	Discover(context.Context, chan<- PeerUpdate) error
 
 	// Announce makes the local device discoverable on the network with given name by advertising its service.
 	// It listens for incoming transfer requests and saves the received files to the specified `saveDir`.
-	// This function runs until the provided context is canceled or an error occurs.
-	Announce(ctx context.Context, localDeviceName string, saveDir string, transferRequestCh chan<- TransferRequest)
+	// This function runs until the provided context is canceled or an error occurs, in which case the error is returned.
+	Announce(ctx context.Context, localDeviceName string, saveDir string, transferRequestCh chan<- TransferRequest) error
 
 	// SendFiles sends one or more files to the specified receiver.
 	SendFiles(ctx context.Context, target *Device, progressCh chan<- int, filepaths ...string) error
 }
 
+// Pairer is implemented by the shairers reaching the devices they paired with, see remote.RemoteShairer.
+type Pairer interface {
+	// Pair meets the device pairing with the same code and pairs with it, it returns the new pair.
+	Pair(ctx context.Context, code string) (Device, error)
+}
+
 // struct containing info related to a device  discovered on a local network
 type LocalInfo struct {
-	IP      net.IP
-	SvcPort int // port on which the tcp server is listening
+	IP      net.IP       // first address the device was found with
+	Addrs   []net.IPAddr // addresses advertised by the device, link-local IPv6 ones carry their zone
+	SvcPort int          // port on which the tcp server is listening
 }
 
 type Device struct {
 	Name         string
 	DiscoveredOn SvcType // holds the service type on which the device was discovered
 
+	// metadata advertised by the peer, fields are left empty when the peer doesn't advertise them
+	ID              string     // stable identifier of the device
+	ProtocolVersion int        // version of the transfer protocol spoken by the peer
+	OS              string     // GOOS of the peer
+	Arch            string     // GOARCH of the peer
+	Type            DeviceType // desktop, laptop or server
+	AppVersion      string     // version of shair run by the peer
+	Capabilities    []string   // optional protocol features supported by the peer, see the Cap constants
+	CertFingerprint string     // fingerprint of the peer's certificate, if it has one
+	Accepting       bool       // whether the peer currently accepts transfer requests
+
+	// whether the peer proved its identity, eg a pair with its key. The names of the other peers, such as
+	// the senders of the local network named after a reverse DNS lookup, can be taken by anyone
+	Verified bool
+
+	LastSeen time.Time // last time the peer was heard of, set by the PeerRegistry
+
+	// liveness of the peer as measured by the prober of the Shairer that found it
+	Reachability Reachability
+	RTT          time.Duration // round trip time of the last successful probe
+
 	LocalInfo
 }
 
@@ -61,10 +107,39 @@ type PeerStatus = uint8
 const (
 	Discovered PeerStatus = iota
 	Removed
+	Self                // the local device as seen by its peers, sent when the name it is announced with is known or changes
+	Updated             // the metadata of a known peer changed
+	AddressChanged      // the addresses of a known peer changed
+	ReachabilityChanged // the peer became reachable, stale or unreachable, or its round trip time changed noticeably
+)
+
+// Reachability tells whether a peer answered the last probes.
+type Reachability uint8
+
+const (
+	ReachabilityUnknown Reachability = iota // the peer wasn't probed yet, or can't be
+	Reachable                               // the peer answered the last probe
+	Stale                                   // the peer missed the last probe
+	Unreachable                             // the peer missed several probes in a row
 )
 
+func (r Reachability) String() string {
+	var str string
+	switch r {
+	case ReachabilityUnknown:
+		str = "unknown"
+	case Reachable:
+		str = "reachable"
+	case Stale:
+		str = "stale"
+	case Unreachable:
+		str = "unreachable"
+	}
+	return str
+}
+
 type PeerUpdate struct {
-	Peer   *Device // keep the pointer here so we can index maps with the pointer. see local.LocalShairer.foundDevices
+	Peer   *Device // copy of the peer at the time of the update, identify it with Device.Key
 	Status PeerStatus
 }
 
@@ -73,9 +148,51 @@ type FilePreview struct {
 	Size uint64
 }
 
+// RejectReason tells the sender why a transfer request was rejected.
+type RejectReason uint8
+
+const (
+	ReasonDeclined          RejectReason = iota // the user declined the request
+	ReasonInsufficientSpace                     // the save directory can't hold the files
+	ReasonQuotaExceeded                         // the request exceeds one of the receiver's quotas
+	ReasonBusy                                  // the receiver is already handling another transfer
+	ReasonUntrusted                             // the sender isn't trusted by the receiver
+	ReasonFileTypeBlocked                       // one of the files has a type the receiver doesn't accept
+	ReasonTimeout                               // the user didn't answer the request in time
+)
+
+func (r RejectReason) String() string {
+	var str string
+	switch r {
+	case ReasonDeclined:
+		str = "declined"
+	case ReasonInsufficientSpace:
+		str = "insufficient space"
+	case ReasonQuotaExceeded:
+		str = "quota exceeded"
+	case ReasonBusy:
+		str = "busy"
+	case ReasonUntrusted:
+		str = "untrusted peer"
+	case ReasonFileTypeBlocked:
+		str = "file type blocked"
+	case ReasonTimeout:
+		str = "timeout"
+	default:
+		str = "unknown reason"
+	}
+	return str
+}
+
 type TransferRequest struct {
+	ID           string // identifies the transfer in the logs, see WithTransferID
 	Sender       *Device
 	FilePreviews []FilePreview
-	AcceptCh     chan<- bool
+	FreeSpace    uint64      // bytes available in the save directory, 0 if it couldn't be determined
+	AcceptCh     chan<- bool // buffered, so answering a request that already expired never blocks
 	ProgressCh   chan int
+
+	// DoneCh receives the outcome of an accepted transfer, nil on success, before ProgressCh is closed.
+	// It also receives a shair.ConnectionDroppedError if the request expired before being answered.
+	DoneCh <-chan error
 }